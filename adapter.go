@@ -6,3 +6,11 @@ package bluetooth
 func (a *Adapter) SetConnectHandler(c func(device Device, connected bool)) {
 	a.connectHandler = c
 }
+
+// SetLinkUpdateHandler sets a handler function to be called whenever the data
+// length, PHY or ATT MTU of a connection changes, for example after a call to
+// Device.RequestDataLength, Device.SetPHY or Device.ExchangeMTU. The handler is
+// only called by the backends that support these updates.
+func (a *Adapter) SetLinkUpdateHandler(c func(device Device, update LinkUpdate)) {
+	a.linkUpdateHandler = c
+}
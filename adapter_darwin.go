@@ -17,14 +17,20 @@ type Adapter struct {
 	pm cbgo.PeripheralManager
 
 	peripheralFoundHandler func(*Adapter, ScanResult)
-	scanChan               chan error
 	poweredChan            chan error
 
+	// scanChan stops the running scan, it is nil while not scanning. It is
+	// never closed, because StopScan may still be called from a discovery
+	// callback once the scan has stopped.
+	scanMu   sync.Mutex
+	scanChan chan error
+
 	// connectMap is a mapping of peripheralId -> chan cbgo.Peripheral,
 	// used to allow multiple callers to call Connect concurrently.
 	connectMap sync.Map
 
-	connectHandler func(device Device, connected bool)
+	connectHandler    func(device Device, connected bool)
+	linkUpdateHandler func(device Device, update LinkUpdate)
 }
 
 // DefaultAdapter is the default adapter on the system.
@@ -194,3 +200,12 @@ type peripheralManagerDelegate struct {
 
 	a *Adapter
 }
+
+// SetPreferredMTU sets the ATT MTU that is offered when the MTU of a connection
+// is exchanged.
+//
+// CoreBluetooth doesn't offer a way to set this, so this call always returns
+// ErrNotSupported.
+func (a *Adapter) SetPreferredMTU(mtu uint16) error {
+	return ErrNotSupported
+}
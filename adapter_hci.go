@@ -3,29 +3,41 @@
 package bluetooth
 
 import (
-	"machine"
 	"runtime"
-
+	"sync"
 	"time"
 )
 
-// hciAdapter represents the implementation for the UART connection to the HCI controller.
+// hciAdapter represents the implementation for the connection to the HCI controller.
 type hciAdapter struct {
-	uart *machine.UART
-	hci  *hci
-	att  *att
+	hci *hci
+	att *att
 
 	isDefault bool
 	scanning  bool
 
-	connectHandler func(device Device, connected bool)
+	connectHandler    func(device Device, connected bool)
+	linkUpdateHandler func(device Device, update LinkUpdate)
+	pairingHandler    PairingHandler
 
+	connecting           sync.Mutex // one connection attempt at a time
+	connectionsMu        sync.Mutex // protects connectedDevices
 	connectedDevices     []Device
 	notificationsStarted bool
 	charWriteHandlers    []charWriteHandler
+
+	defaultAdvertisement  *Advertisement
+	advertisements        []*Advertisement
+	lastAdvertisingHandle uint8
+	advertisementPolling  bool
+	privacyGeneration     int // incremented to stop the address rotation
+	scanReports           scanReportMerger
+	extendedScanData      AdvertisementData
+	capture               *hciCapture
 }
 
 func (a *hciAdapter) enable() error {
+	a.hci.capture = a.capture
 	a.hci.start()
 
 	if err := a.hci.reset(); err != nil {
@@ -38,10 +50,23 @@ func (a *hciAdapter) enable() error {
 		return err
 	}
 
-	return a.hci.setLeEventMask(0x00000000000003FF)
+	if err := a.hci.setLeEventMask(0x0000000000001FFF); err != nil {
+		return err
+	}
+
+	if err := a.hci.readLeBufferSize(); err != nil {
+		return err
+	}
+
+	// The address is part of the pairing calculations.
+	return a.hci.readBdAddr()
 }
 
 func (a *hciAdapter) Address() (MACAddress, error) {
+	// Another goroutine may be polling for events while advertising.
+	a.att.busy.Lock()
+	defer a.att.busy.Unlock()
+
 	if err := a.hci.readBdAddr(); err != nil {
 		return MACAddress{}, err
 	}
@@ -49,14 +74,16 @@ func (a *hciAdapter) Address() (MACAddress, error) {
 	return MACAddress{MAC: makeAddress(a.hci.address)}, nil
 }
 
-func newBLEStack(uart *machine.UART) (*hci, *att) {
-	h := newHCI(uart)
+func newBLEStack(transport HCITransport) (*hci, *att) {
+	h := newHCI(transport)
 	a := newATT(h)
 	h.att = a
 
 	l := newL2CAP(h)
 	h.l2cap = l
 
+	h.smp = newSMP(h)
+
 	return h, a
 }
 
@@ -84,7 +111,7 @@ func makeNINAAddress(mac MAC) [6]uint8 {
 	}
 }
 
-func (a *hciAdapter) startNotifications() {
+func (a *Adapter) startNotifications() {
 	if a.notificationsStarted {
 		return
 	}
@@ -98,7 +125,7 @@ func (a *hciAdapter) startNotifications() {
 	// go routine to poll for HCI events for ATT notifications
 	go func() {
 		for {
-			if err := a.att.poll(); err != nil {
+			if err := a.poll(); err != nil {
 				// TODO: handle error
 				if debug {
 					println("error polling for notifications:", err.Error())
@@ -146,11 +173,327 @@ func (a *hciAdapter) startNotifications() {
 	}()
 }
 
+// poll processes the pending HCI events, and then the resulting changes to
+// the connection table.
+func (a *Adapter) poll() error {
+	err := a.att.poll()
+	a.handleConnectionEvents()
+
+	return err
+}
+
+// handleConnectionEvents handles new and closed connections. It runs outside
+// the event handler, so that the connect handler can use the connection.
+func (a *Adapter) handleConnectionEvents() {
+	a.att.busy.Lock()
+	if len(a.hci.connectionEvents) == 0 && len(a.hci.linkUpdates) == 0 && len(a.hci.smp.events) == 0 {
+		a.att.busy.Unlock()
+		return
+	}
+	events := append([]hciConnectionEvent(nil), a.hci.connectionEvents...)
+	a.hci.connectionEvents = a.hci.connectionEvents[:0]
+	linkUpdates := append([]hciLinkUpdate(nil), a.hci.linkUpdates...)
+	a.hci.linkUpdates = a.hci.linkUpdates[:0]
+	pairingEvents := append([]smpEvent(nil), a.hci.smp.events...)
+	a.hci.smp.events = a.hci.smp.events[:0]
+
+	// Update the connected devices before releasing the lock, so that a new
+	// connection can be found as soon as the connection attempt completes.
+	devices := make([]Device, len(events))
+	for i, event := range events {
+		if event.connected {
+			devices[i] = Device{
+				Address: Address{
+					MACAddress{
+						MAC:      makeAddress(event.peerBdaddr),
+						isRandom: event.peerBdaddrType&0x01 != 0,
+					},
+				},
+				deviceInternal: &deviceInternal{
+					adapter:                   a,
+					handle:                    event.handle,
+					notificationRegistrations: make([]notificationRegistration, 0),
+				},
+			}
+			a.addConnection(devices[i])
+		} else {
+			devices[i] = a.findConnection(event.handle)
+			if devices[i].deviceInternal != nil {
+				a.removeConnection(devices[i])
+			}
+		}
+	}
+	a.att.busy.Unlock()
+
+	for i, event := range events {
+		if event.role == hciRolePeripheral {
+			a.restartAdvertisements(event.connected)
+		}
+		if devices[i].deviceInternal != nil {
+			a.connectHandler(devices[i], event.connected)
+		}
+	}
+
+	for _, event := range pairingEvents {
+		a.handlePairingEvent(event)
+	}
+
+	if a.linkUpdateHandler == nil {
+		return
+	}
+	for _, update := range linkUpdates {
+		device := a.findConnection(update.handle)
+		if device.deviceInternal != nil {
+			a.linkUpdateHandler(device, update.LinkUpdate)
+		}
+	}
+}
+
+// SetPreferredMTU sets the ATT MTU, between MinMTU and MaxMTU bytes, that is
+// offered when a client exchanges the MTU. The connection then uses the
+// smaller of the MTUs of both sides, which is reported to the link update
+// handler. The default is 248 bytes.
+func (a *Adapter) SetPreferredMTU(mtu uint16) error {
+	if mtu < MinMTU || mtu > MaxMTU {
+		return errInvalidMTU
+	}
+
+	a.att.busy.Lock()
+	defer a.att.busy.Unlock()
+
+	a.att.maxMTU = mtu
+	return nil
+}
+
+// SetIOCapability sets the means this device has to interact with the user
+// during pairing. The default is IOCapabilityNoInputNoOutput, which only
+// allows pairing without protection against man-in-the-middle attacks.
+func (a *Adapter) SetIOCapability(ioCapability IOCapability) {
+	a.att.busy.Lock()
+	defer a.att.busy.Unlock()
+
+	a.hci.smp.ioCapability = ioCapability
+}
+
+// SetPairingHandler sets the functions that show or ask the user for a
+// passkey during pairing, and that report the result of pairing.
+func (a *Adapter) SetPairingHandler(handler PairingHandler) {
+	a.att.busy.Lock()
+	defer a.att.busy.Unlock()
+
+	a.pairingHandler = handler
+}
+
+// SetBondStore sets the store that keeps the keys of paired devices. The
+// default is a MemoryBondStore, use a FileBondStore to reconnect encrypted
+// after the program restarts.
+func (a *Adapter) SetBondStore(store BondStore) {
+	a.att.busy.Lock()
+	defer a.att.busy.Unlock()
+
+	a.hci.smp.store = store
+}
+
+// Bonds returns the bonds with the devices this adapter has paired with.
+func (a *Adapter) Bonds() ([]Bond, error) {
+	a.att.busy.Lock()
+	defer a.att.busy.Unlock()
+
+	return a.hci.smp.store.Bonds()
+}
+
+// DeleteBond forgets the keys of the device with the given identity address,
+// so that it must pair again.
+func (a *Adapter) DeleteBond(address MACAddress) error {
+	a.att.busy.Lock()
+	defer a.att.busy.Unlock()
+
+	return a.hci.smp.store.DeleteBond(address)
+}
+
+// EnablePrivacy makes the adapter advertise with a resolvable private address
+// instead of its public address. The address is generated from the IRK and
+// changes every interval, or every 15 minutes if the interval is zero, so
+// that only devices that have bonded with the adapter can recognize it. The
+// IRK and the public address are distributed to devices during pairing.
+//
+// Scanning and connecting as central still use the address in the options.
+func (a *Adapter) EnablePrivacy(irk [16]byte, interval time.Duration) error {
+	if interval == 0 {
+		interval = 15 * time.Minute
+	}
+
+	a.att.busy.Lock()
+	a.hci.privacy = true
+	a.hci.irk = irk
+	err := a.rotatePrivateAddress()
+	if err != nil {
+		a.hci.privacy = false
+	}
+	a.privacyGeneration++
+	generation := a.privacyGeneration
+	a.att.busy.Unlock()
+	if err != nil {
+		return err
+	}
+
+	go func() {
+		for {
+			time.Sleep(interval)
+
+			a.att.busy.Lock()
+			if a.privacyGeneration != generation {
+				// Privacy was enabled again with another interval.
+				a.att.busy.Unlock()
+				return
+			}
+			err := a.rotatePrivateAddress()
+			a.att.busy.Unlock()
+
+			if err != nil && debug {
+				println("could not change private address:", err.Error())
+			}
+		}
+	}()
+
+	return nil
+}
+
+// rotatePrivateAddress generates a new resolvable private address, and
+// restarts the started advertisements with it.
+func (a *Adapter) rotatePrivateAddress() error {
+	address, err := NewResolvableAddress(a.hci.irk)
+	if err != nil {
+		return err
+	}
+
+	// The random address can't change while legacy advertising is enabled.
+	legacy := false
+	for _, adv := range a.advertisements {
+		legacy = legacy || (adv.started && !adv.startedExtended)
+	}
+	if legacy {
+		if err := a.hci.leSetAdvertiseEnable(false); err != nil {
+			return err
+		}
+	}
+
+	a.hci.randomAddress = makeNINAAddress(address.MAC)
+	if err := a.hci.leSetRandomAddress(a.hci.randomAddress); err != nil {
+		return err
+	}
+
+	// Advertisements that the controller stopped when a central connected
+	// stay stopped until it disconnects.
+	peripheral := false
+	for _, conn := range a.hci.connections {
+		peripheral = peripheral || conn.role == hciRolePeripheral
+	}
+	for _, adv := range a.advertisements {
+		if !adv.started {
+			continue
+		}
+		if peripheral && !adv.nonConnectable && !adv.whileConnected {
+			if adv.startedExtended {
+				if err := a.hci.leSetAdvertisingSetRandomAddress(adv.handle, a.hci.randomAddress); err != nil {
+					return err
+				}
+			}
+			continue
+		}
+		if err := adv.start(); err != nil {
+			return err
+		}
+	}
+
+	return nil
+}
+
+// identityAddress returns the identity address of a device that uses a
+// resolvable private address, if it is bonded and has sent its IRK.
+func (a *Adapter) identityAddress(address MACAddress) (Address, bool) {
+	if address.Type() != AddressResolvablePrivate {
+		return Address{}, false
+	}
+
+	a.att.busy.Lock()
+	defer a.att.busy.Unlock()
+
+	bond, ok := resolveBond(a.hci.smp.store, address)
+	if !ok || bond.Address == address {
+		return Address{}, false
+	}
+
+	return Address{bond.Address}, true
+}
+
+// handlePairingEvent passes a pairing event to the pairing handler. Questions
+// for the user are asked in a separate goroutine, so that events are still
+// processed while waiting for the answer.
+func (a *Adapter) handlePairingEvent(event smpEvent) {
+	device := a.findConnection(event.handle)
+	if device.deviceInternal == nil {
+		return
+	}
+
+	a.att.busy.Lock()
+	handler := a.pairingHandler
+	a.att.busy.Unlock()
+
+	switch event.kind {
+	case smpEventDisplayPasskey:
+		if handler.DisplayPasskey != nil {
+			handler.DisplayPasskey(device, event.passkey)
+		}
+
+	case smpEventRequestPasskey:
+		go func() {
+			passkey, ok := uint32(0), false
+			if handler.RequestPasskey != nil {
+				passkey, ok = handler.RequestPasskey(device)
+			}
+
+			a.att.busy.Lock()
+			err := a.hci.smp.passkeyEntered(event.handle, passkey, ok)
+			a.att.busy.Unlock()
+			if err != nil && debug {
+				println("could not continue pairing:", err.Error())
+			}
+		}()
+
+	case smpEventConfirmPasskey:
+		go func() {
+			ok := false
+			if handler.ConfirmPasskey != nil {
+				ok = handler.ConfirmPasskey(device, event.passkey)
+			}
+
+			a.att.busy.Lock()
+			err := a.hci.smp.passkeyConfirmed(event.handle, ok)
+			a.att.busy.Unlock()
+			if err != nil && debug {
+				println("could not continue pairing:", err.Error())
+			}
+		}()
+
+	case smpEventComplete:
+		if handler.PairingComplete != nil {
+			handler.PairingComplete(device, event.err)
+		}
+	}
+}
+
 func (a *hciAdapter) addConnection(d Device) {
+	a.connectionsMu.Lock()
+	defer a.connectionsMu.Unlock()
+
 	a.connectedDevices = append(a.connectedDevices, d)
 }
 
 func (a *hciAdapter) removeConnection(d Device) {
+	a.connectionsMu.Lock()
+	defer a.connectionsMu.Unlock()
+
 	for i := range a.connectedDevices {
 		if d.handle == a.connectedDevices[i].handle {
 			a.connectedDevices[i] = a.connectedDevices[len(a.connectedDevices)-1]
@@ -163,6 +506,9 @@ func (a *hciAdapter) removeConnection(d Device) {
 }
 
 func (a *hciAdapter) findConnection(handle uint16) Device {
+	a.connectionsMu.Lock()
+	defer a.connectionsMu.Unlock()
+
 	for _, d := range a.connectedDevices {
 		if d.handle == handle {
 			if debug {
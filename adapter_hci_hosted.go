@@ -0,0 +1,69 @@
+//go:build hci && !baremetal
+
+package bluetooth
+
+const maxConnections = 1
+
+// Adapter represents the connection to an HCI controller on a hosted system,
+// for example over a serial device, a pty, a socketpair or a Linux HCI user
+// channel.
+type Adapter struct {
+	hciAdapter
+
+	transport HCITransport
+}
+
+// DefaultAdapter is the default adapter on the current system.
+//
+// Make sure to call Enable() before using it to initialize the adapter. It
+// opens the user channel of hci0 unless a different transport has
+// been set with SetTransport().
+var DefaultAdapter = &Adapter{
+	hciAdapter: hciAdapter{
+		isDefault: true,
+		connectHandler: func(device Device, connected bool) {
+			return
+		},
+		connectedDevices: make([]Device, 0, maxConnections),
+	},
+}
+
+// NewAdapter returns a new adapter that talks to an HCI controller over the
+// given transport. The transport may be nil, in which case the default
+// transport is opened by Enable() (see DefaultAdapter).
+func NewAdapter(transport HCITransport) *Adapter {
+	return &Adapter{
+		hciAdapter: hciAdapter{
+			connectHandler: func(device Device, connected bool) {
+				return
+			},
+			connectedDevices: make([]Device, 0, maxConnections),
+		},
+		transport: transport,
+	}
+}
+
+// SetTransport sets the transport to use for the HCI connection. Use
+// NewHCITransport to wrap any io.ReadWriter, such as an *os.File or a
+// net.Conn. It must be called before calling Enable().
+func (a *Adapter) SetTransport(transport HCITransport) error {
+	a.transport = transport
+
+	return nil
+}
+
+// Enable configures the BLE stack. It must be called before any
+// Bluetooth-related calls (unless otherwise indicated).
+func (a *Adapter) Enable() error {
+	if a.transport == nil {
+		transport, err := OpenHCIUserChannel(0)
+		if err != nil {
+			return err
+		}
+		a.transport = transport
+	}
+
+	a.hci, a.att = newBLEStack(a.transport)
+
+	return a.enable()
+}
@@ -12,6 +12,8 @@ const maxConnections = 1
 type Adapter struct {
 	hciAdapter
 
+	uart *machine.UART
+
 	// used for software flow control
 	cts, rts machine.Pin
 }
@@ -20,11 +22,13 @@ type Adapter struct {
 //
 // Make sure to call Enable() before using it to initialize the adapter.
 var DefaultAdapter = &Adapter{
-	isDefault: true,
-	connectHandler: func(device Device, connected bool) {
-		return
+	hciAdapter: hciAdapter{
+		isDefault: true,
+		connectHandler: func(device Device, connected bool) {
+			return
+		},
+		connectedDevices: make([]Device, 0, maxConnections),
 	},
-	connectedDevices: make([]Device, 0, maxConnections),
 }
 
 // SetUART sets the UART to use for the HCI connection.
@@ -49,16 +53,12 @@ func (a *Adapter) SetSoftwareFlowControl(cts, rts machine.Pin) error {
 // Enable configures the BLE stack. It must be called before any
 // Bluetooth-related calls (unless otherwise indicated).
 func (a *Adapter) Enable() error {
-	a.hci, a.att = newBLEStack(a.uart)
-
+	cts, rts := machine.NoPin, machine.NoPin
 	if a.cts != 0 && a.rts != 0 {
-		a.hci.softRTS = a.rts
-		a.hci.softRTS.Configure(machine.PinConfig{Mode: machine.PinOutput})
-		a.hci.softRTS.High()
-
-		a.hci.softCTS = a.cts
-		a.cts.Configure(machine.PinConfig{Mode: machine.PinInput})
+		cts, rts = a.cts, a.rts
 	}
 
-	a.enable()
+	a.hci, a.att = newBLEStack(newUARTTransport(a.uart, cts, rts))
+
+	return a.enable()
 }
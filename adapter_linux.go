@@ -1,4 +1,4 @@
-//go:build !baremetal
+//go:build !baremetal && !hci
 
 // Some documentation for the BlueZ D-Bus interface:
 // https://git.kernel.org/pub/scm/bluetooth/bluez.git/tree/doc
@@ -8,6 +8,7 @@ package bluetooth
 import (
 	"errors"
 	"fmt"
+	"sync"
 
 	"github.com/godbus/dbus/v5"
 )
@@ -23,7 +24,12 @@ type Adapter struct {
 	address              string
 	defaultAdvertisement *Advertisement
 
-	connectHandler func(device Device, connected bool)
+	connectHandler    func(device Device, connected bool)
+	linkUpdateHandler func(device Device, update LinkUpdate)
+	agent             agent
+
+	clientsMu sync.Mutex
+	clients   []bluezClient // clients of the GATT server, by Connection - 1
 }
 
 // DefaultAdapter is the default adapter on the system. On Linux, it is the
@@ -55,6 +61,9 @@ func (a *Adapter) Enable() (err error) {
 	}
 	addr.Store(&a.address)
 
+	// The agent may have been configured before the adapter was enabled.
+	a.updateAgent()
+
 	return nil
 }
 
@@ -68,3 +77,12 @@ func (a *Adapter) Address() (MACAddress, error) {
 	}
 	return MACAddress{MAC: mac}, nil
 }
+
+// SetPreferredMTU sets the ATT MTU that is offered when the MTU of a connection
+// is exchanged.
+//
+// BlueZ offers the MTU from its own configuration (ExchangeMTU in main.conf),
+// so this call always returns ErrNotSupported.
+func (a *Adapter) SetPreferredMTU(mtu uint16) error {
+	return ErrNotSupported
+}
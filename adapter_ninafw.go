@@ -54,16 +54,13 @@ func (a *Adapter) Enable() error {
 
 	uart.Configure(cfg)
 
-	a.hci, a.att = newBLEStack(uart)
+	cts, rts := machine.NoPin, machine.NoPin
 	if machine.NINA_SOFT_FLOWCONTROL {
-		a.hci.softRTS = machine.NINA_RTS
-		a.hci.softRTS.Configure(machine.PinConfig{Mode: machine.PinOutput})
-		a.hci.softRTS.High()
-
-		a.hci.softCTS = machine.NINA_CTS
-		machine.NINA_CTS.Configure(machine.PinConfig{Mode: machine.PinInput})
+		cts, rts = machine.NINA_CTS, machine.NINA_RTS
 	}
 
+	a.hci, a.att = newBLEStack(newUARTTransport(uart, cts, rts))
+
 	return a.enable()
 }
 
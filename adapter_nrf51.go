@@ -13,6 +13,10 @@ import "C"
 
 import "unsafe"
 
+// The room for event data in the event buffer. The S110 SoftDevice only
+// supports the default MTU.
+const eventBufExtra = 23
+
 //export assertHandler
 func assertHandler(pc uint32, line_number uint16, p_file_name *byte) {
 	println("SoftDevice assert")
@@ -48,8 +52,11 @@ func handleEvent() {
 				Address:          Address{makeMACAddress(connectEvent.peer_addr)},
 				connectionHandle: gapEvent.conn_handle,
 			}
+			setConnectionPeer(gapEvent.conn_handle, device.Address.MACAddress, true)
 			DefaultAdapter.connectHandler(device, true)
 		case C.BLE_GAP_EVT_DISCONNECTED:
+			// An indication can't be confirmed anymore.
+			indicationPending.Set(0)
 			if defaultAdvertisement.isAdvertising.Get() != 0 {
 				// The advertisement was running but was automatically stopped
 				// by the connection event.
@@ -60,6 +67,7 @@ func handleEvent() {
 				defaultAdvertisement.start()
 			}
 			currentConnection.handle.Reg = C.BLE_CONN_HANDLE_INVALID
+			setConnectionPeer(gapEvent.conn_handle, MACAddress{}, false)
 			device := Device{
 				connectionHandle: gapEvent.conn_handle,
 			}
@@ -78,17 +86,29 @@ func handleEvent() {
 				println("unknown GAP event:", id)
 			}
 		}
+	case id == C.BLE_EVT_USER_MEM_REQUEST:
+		// A client started a long write.
+		replyUserMemRequest(eventBuf.evt.unionfield_common_evt().conn_handle)
 	case id >= C.BLE_GATTS_EVT_BASE && id <= C.BLE_GATTS_EVT_LAST:
 		gattsEvent := eventBuf.evt.unionfield_gatts_evt()
 		switch id {
 		case C.BLE_GATTS_EVT_WRITE:
 			writeEvent := gattsEvent.params.unionfield_write()
+			if writeEvent.op == C.BLE_GATTS_OP_EXEC_WRITE_REQ_NOW {
+				// A long write, queued in the memory given below.
+				DefaultAdapter.handleQueuedWrites(Connection(gattsEvent.conn_handle))
+				break
+			}
 			len := writeEvent.len - writeEvent.offset
 			data := (*[255]byte)(unsafe.Pointer(&writeEvent.data[0]))[:len:len]
 			handler := DefaultAdapter.getCharWriteHandler(writeEvent.handle)
 			if handler != nil {
 				handler.callback(Connection(gattsEvent.conn_handle), int(writeEvent.offset), data)
 			}
+		case C.BLE_GATTS_EVT_RW_AUTHORIZE_REQUEST:
+			// A client reads an attribute whose value comes from a read
+			// handler, or accesses an attribute that needs authorization.
+			DefaultAdapter.handleAuthorizeRequest(gattsEvent.conn_handle, gattsEvent.params.unionfield_authorize_request())
 		case C.BLE_GATTS_EVT_SYS_ATTR_MISSING:
 			// This event is generated when reading the Generic Attribute
 			// service. It appears to be necessary for bonded devices.
@@ -99,6 +119,9 @@ func handleEvent() {
 			// Maybe we should look at the error, but as there's not really a
 			// way to handle it, ignore it.
 			C.sd_ble_gatts_sys_attr_set(gattsEvent.conn_handle, nil, 0, 0)
+		case C.BLE_GATTS_EVT_HVC:
+			// The central confirmed an indication.
+			indicationPending.Set(0)
 		default:
 			if debug {
 				println("unknown GATTS event:", id, id-C.BLE_GATTS_EVT_BASE)
@@ -127,3 +150,17 @@ func makeMACAddress(addr C.ble_gap_addr_t) MACAddress {
 		isRandom: addr.addr_type != 0,
 	}
 }
+
+// SetPreferredMTU sets the ATT MTU that is offered when the MTU of a connection
+// is exchanged.
+//
+// The S110 SoftDevice only supports the default MTU, so this call always
+// returns ErrNotSupported.
+func (a *Adapter) SetPreferredMTU(mtu uint16) error {
+	return ErrNotSupported
+}
+
+// attMTU returns the ATT MTU of the SoftDevice, which is always the default.
+func (a *Adapter) attMTU() uint16 {
+	return MinMTU
+}
@@ -29,6 +29,9 @@ func handleEvent() {
 				Address:          Address{makeMACAddress(connectEvent.peer_addr)},
 				connectionHandle: gapEvent.conn_handle,
 			}
+			securityConnected(gapEvent.conn_handle, device.Address.MACAddress, connectEvent.role == C.BLE_GAP_ROLE_CENTRAL)
+			setConnectionMTU(gapEvent.conn_handle, 0)
+			setConnectionPeer(gapEvent.conn_handle, device.Address.MACAddress, true)
 			switch connectEvent.role {
 			case C.BLE_GAP_ROLE_PERIPH:
 				if debug {
@@ -48,6 +51,10 @@ func handleEvent() {
 			if debug {
 				println("evt: disconnected")
 			}
+			// An indication can't be confirmed anymore, and an MTU exchange
+			// won't get a response.
+			indicationPending.Set(0)
+			exchangingMTU.Set(0)
 			// Clean up state for this connection.
 			for i, cb := range gattcNotificationCallbacks {
 				if uint16(cb.connectionHandle) == currentConnection.handle.Reg {
@@ -55,6 +62,8 @@ func handleEvent() {
 				}
 			}
 			currentConnection.handle.Reg = C.BLE_CONN_HANDLE_INVALID
+			securityDisconnected(gapEvent.conn_handle)
+			setConnectionPeer(gapEvent.conn_handle, MACAddress{}, false)
 			// Auto-restart advertisement if needed.
 			if defaultAdvertisement.isAdvertising.Get() != 0 {
 				// The advertisement was running but was automatically stopped
@@ -63,7 +72,7 @@ func handleEvent() {
 				// because it would need to be reconfigured as a non-connectable
 				// advertisement. That's left as a future addition, if
 				// necessary.
-				C.sd_ble_gap_adv_start(defaultAdvertisement.handle, C.BLE_CONN_CFG_TAG_DEFAULT)
+				C.sd_ble_gap_adv_start(defaultAdvertisement.handle, connectionConfig)
 			}
 			device := Device{
 				connectionHandle: gapEvent.conn_handle,
@@ -86,11 +95,29 @@ func handleEvent() {
 			// Prepare the globalScanResult, which will be passed to the
 			// callback.
 			scanReportBuffer.len = byte(advReport.data.len)
+			address := makeMACAddress(advReport.peer_addr)
+			scanResponse := advReport._type.bitfield_scan_response() != 0
+			switch {
+			case scanResponse:
+				globalScanResult.PDUType = AdvertisingPDUScanRsp
+			case advReport._type.bitfield_directed() != 0:
+				globalScanResult.PDUType = AdvertisingPDUAdvDirectInd
+			case advReport._type.bitfield_connectable() != 0:
+				globalScanResult.PDUType = AdvertisingPDUAdvInd
+			case advReport._type.bitfield_scannable() != 0:
+				globalScanResult.PDUType = AdvertisingPDUAdvScanInd
+			default:
+				globalScanResult.PDUType = AdvertisingPDUAdvNonconnInd
+			}
 			globalScanResult.RSSI = int16(advReport.rssi)
-			globalScanResult.Address = Address{
-				makeMACAddress(advReport.peer_addr),
+			globalScanResult.Address = Address{address}
+			globalScanResult.IdentityAddress = Address{}
+			if advReport.peer_addr.bitfield_addr_id_peer() != 0 {
+				// The SoftDevice resolved the address with the device
+				// identity list.
+				globalScanResult.IdentityAddress = Address{address}
 			}
-			globalScanResult.AdvertisementPayload = &scanReportBuffer
+			globalScanResult.AdvertisementPayload = scanReports.add(address, scanResponse, scanReportBuffer.Bytes())
 			// Signal to the main thread that there was a scan report.
 			// Scanning will be resumed (from the main thread) once the scan
 			// report has been processed.
@@ -104,17 +131,35 @@ func handleEvent() {
 			// > BLE_GAP_EVT_CONN_PARAM_UPDATE_REQUEST, the peripheral request
 			// > will be rejected
 			C.sd_ble_gap_conn_param_update(gapEvent.conn_handle, nil)
+		case C.BLE_GAP_EVT_SEC_PARAMS_REQUEST:
+			handleSecParamsRequest(gapEvent.conn_handle)
+		case C.BLE_GAP_EVT_SEC_INFO_REQUEST:
+			handleSecInfoRequest(gapEvent.conn_handle, gapEvent.params.unionfield_sec_info_request())
+		case C.BLE_GAP_EVT_AUTH_STATUS:
+			handleAuthStatus(gapEvent.conn_handle, gapEvent.params.unionfield_auth_status())
+		case C.BLE_GAP_EVT_SEC_REQUEST:
+			handleSecRequest(gapEvent.conn_handle)
 		case C.BLE_GAP_EVT_DATA_LENGTH_UPDATE_REQUEST:
 			// We need to respond with sd_ble_gap_data_length_update. Setting
 			// both parameters to nil will make sure we send the default values.
 			C.sd_ble_gap_data_length_update(gapEvent.conn_handle, nil, nil)
 		case C.BLE_GAP_EVT_DATA_LENGTH_UPDATE:
-			// ignore confirmation of data length successfully updated
+			params := gapEvent.params.unionfield_data_length_update().effective_params
+			handleLinkUpdate(gapEvent.conn_handle, LinkUpdate{
+				TxOctets: uint16(params.max_tx_octets),
+				RxOctets: uint16(params.max_rx_octets),
+			})
 		case C.BLE_GAP_EVT_PHY_UPDATE_REQUEST:
 			phyUpdateRequest := gapEvent.params.unionfield_phy_update_request()
 			C.sd_ble_gap_phy_update(gapEvent.conn_handle, &phyUpdateRequest.peer_preferred_phys)
 		case C.BLE_GAP_EVT_PHY_UPDATE:
-			// ignore confirmation of phy successfully updated
+			phyUpdate := gapEvent.params.unionfield_phy_update()
+			if phyUpdate.status == C.BLE_HCI_STATUS_CODE_SUCCESS {
+				handleLinkUpdate(gapEvent.conn_handle, LinkUpdate{
+					TxPHY: makePHY(phyUpdate.tx_phy),
+					RxPHY: makePHY(phyUpdate.rx_phy),
+				})
+			}
 		case C.BLE_GAP_EVT_TIMEOUT:
 			timeoutEvt := gapEvent.params.unionfield_timeout()
 			switch timeoutEvt.src {
@@ -124,6 +169,11 @@ func handleEvent() {
 					println("gap timeout: conn")
 				}
 				connectionAttempt.state.Set(3) // connection timed out
+			case C.BLE_GAP_TIMEOUT_SRC_SCAN:
+				if debug {
+					println("gap timeout: scan")
+				}
+				scanTimedOut.Set(1)
 			default:
 				// For example a scan timeout.
 				if debug {
@@ -135,17 +185,29 @@ func handleEvent() {
 				println("unknown GAP event:", id)
 			}
 		}
+	case id == C.BLE_EVT_USER_MEM_REQUEST:
+		// A client started a long write.
+		replyUserMemRequest(eventBuf.evt.unionfield_common_evt().conn_handle)
 	case id >= C.BLE_GATTS_EVT_BASE && id <= C.BLE_GATTS_EVT_LAST:
 		gattsEvent := eventBuf.evt.unionfield_gatts_evt()
 		switch id {
 		case C.BLE_GATTS_EVT_WRITE:
 			writeEvent := gattsEvent.params.unionfield_write()
+			if writeEvent.op == C.BLE_GATTS_OP_EXEC_WRITE_REQ_NOW {
+				// A long write, queued in the memory given below.
+				DefaultAdapter.handleQueuedWrites(Connection(gattsEvent.conn_handle))
+				break
+			}
 			len := writeEvent.len - writeEvent.offset
 			data := (*[255]byte)(unsafe.Pointer(&writeEvent.data[0]))[:len:len]
 			handler := DefaultAdapter.getCharWriteHandler(writeEvent.handle)
 			if handler != nil {
 				handler.callback(Connection(gattsEvent.conn_handle), int(writeEvent.offset), data)
 			}
+		case C.BLE_GATTS_EVT_RW_AUTHORIZE_REQUEST:
+			// A client reads an attribute whose value comes from a read
+			// handler, or accesses an attribute that needs authorization.
+			DefaultAdapter.handleAuthorizeRequest(gattsEvent.conn_handle, gattsEvent.params.unionfield_authorize_request())
 		case C.BLE_GATTS_EVT_SYS_ATTR_MISSING:
 			// This event is generated when reading the Generic Attribute
 			// service. It appears to be necessary for bonded devices.
@@ -157,11 +219,18 @@ func handleEvent() {
 			// way to handle it, ignore it.
 			C.sd_ble_gatts_sys_attr_set(gattsEvent.conn_handle, nil, 0, 0)
 		case C.BLE_GATTS_EVT_EXCHANGE_MTU_REQUEST:
-			// This event is generated by some devices. While we could support
-			// larger MTUs, this default MTU is supported everywhere.
-			C.sd_ble_gatts_exchange_mtu_reply(gattsEvent.conn_handle, C.BLE_GATT_ATT_MTU_DEFAULT)
+			// Reply with the MTU the SoftDevice was configured with, both
+			// sides then use the smaller one.
+			mtu := DefaultAdapter.attMTU()
+			C.sd_ble_gatts_exchange_mtu_reply(gattsEvent.conn_handle, C.uint16_t(mtu))
+			mtu = negotiateMTU(uint16(gattsEvent.params.unionfield_exchange_mtu_request().client_rx_mtu), mtu)
+			setConnectionMTU(gattsEvent.conn_handle, mtu)
+			handleLinkUpdate(gattsEvent.conn_handle, LinkUpdate{MTU: mtu})
 		case C.BLE_GATTS_EVT_HVN_TX_COMPLETE:
 			// ignore confirmation of a notification successfully sent
+		case C.BLE_GATTS_EVT_HVC:
+			// The central confirmed an indication.
+			indicationPending.Set(0)
 		default:
 			if debug {
 				println("unknown GATTS event:", id, id-C.BLE_GATTS_EVT_BASE)
@@ -229,16 +298,35 @@ func handleEvent() {
 			if debug {
 				println("evt: read response, data length", readEvent.len)
 			}
-			readingCharacteristic.handle_value.Set(readEvent.handle)
 			readingCharacteristic.offset = readEvent.offset
 			readingCharacteristic.length = readEvent.len
+			readingCharacteristic.status = gattcEvent.gatt_status
+			if gattcEvent.gatt_status != C.BLE_GATT_STATUS_SUCCESS {
+				// The response has no data, signal it with the handle of
+				// the error.
+				readingCharacteristic.length = 0
+				readingCharacteristic.handle_value.Set(gattcEvent.error_handle)
+				break
+			}
 
 			// copy read event data into Go slice
 			copy(readingCharacteristic.value, (*[255]byte)(unsafe.Pointer(&readEvent.data[0]))[:readEvent.len:readEvent.len])
+			readingCharacteristic.handle_value.Set(readEvent.handle)
+		case C.BLE_GATTC_EVT_WRITE_RSP:
+			if debug {
+				println("evt: write response")
+			}
+			writingCharacteristic.status = gattcEvent.gatt_status
+			writingCharacteristic.done.Set(1)
+		case C.BLE_GATTC_EVT_EXCHANGE_MTU_RSP:
+			mtu := negotiateMTU(DefaultAdapter.attMTU(), uint16(gattcEvent.params.unionfield_exchange_mtu_rsp().server_rx_mtu))
+			setConnectionMTU(gattcEvent.conn_handle, mtu)
+			exchangingMTU.Set(0)
+			handleLinkUpdate(gattcEvent.conn_handle, LinkUpdate{MTU: mtu})
 		case C.BLE_GATTC_EVT_HVX:
 			hvxEvent := gattcEvent.params.unionfield_hvx()
 			switch hvxEvent._type {
-			case C.BLE_GATT_HVX_NOTIFICATION:
+			case C.BLE_GATT_HVX_NOTIFICATION, C.BLE_GATT_HVX_INDICATION:
 				if debug {
 					println("evt: notification", hvxEvent.handle)
 				}
@@ -254,6 +342,11 @@ func handleEvent() {
 						break
 					}
 				}
+				if hvxEvent._type == C.BLE_GATT_HVX_INDICATION {
+					// The peripheral waits for the confirmation before it
+					// sends the next indication.
+					C.sd_ble_gattc_hv_confirm(gattcEvent.conn_handle, hvxEvent.handle)
+				}
 			}
 		default:
 			if debug {
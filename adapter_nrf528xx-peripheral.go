@@ -29,6 +29,9 @@ func handleEvent() {
 			}
 			currentConnection.handle.Reg = uint16(gapEvent.conn_handle)
 			connectEvent := gapEvent.params.unionfield_connected()
+			securityConnected(gapEvent.conn_handle, makeMACAddress(connectEvent.peer_addr), false)
+			setConnectionMTU(gapEvent.conn_handle, 0)
+			setConnectionPeer(gapEvent.conn_handle, makeMACAddress(connectEvent.peer_addr), true)
 			device := Device{
 				Address:          Address{makeMACAddress(connectEvent.peer_addr)},
 				connectionHandle: gapEvent.conn_handle,
@@ -38,7 +41,11 @@ func handleEvent() {
 			if debug {
 				println("evt: disconnected")
 			}
+			// An indication can't be confirmed anymore.
+			indicationPending.Set(0)
 			currentConnection.handle.Reg = C.BLE_CONN_HANDLE_INVALID
+			securityDisconnected(gapEvent.conn_handle)
+			setConnectionPeer(gapEvent.conn_handle, MACAddress{}, false)
 			// Auto-restart advertisement if needed.
 			if defaultAdvertisement.isAdvertising.Get() != 0 {
 				// The advertisement was running but was automatically stopped
@@ -47,39 +54,67 @@ func handleEvent() {
 				// because it would need to be reconfigured as a non-connectable
 				// advertisement. That's left as a future addition, if
 				// necessary.
-				C.sd_ble_gap_adv_start(defaultAdvertisement.handle, C.BLE_CONN_CFG_TAG_DEFAULT)
+				C.sd_ble_gap_adv_start(defaultAdvertisement.handle, connectionConfig)
 			}
 			device := Device{
 				connectionHandle: gapEvent.conn_handle,
 			}
 			DefaultAdapter.connectHandler(device, false)
+		case C.BLE_GAP_EVT_SEC_PARAMS_REQUEST:
+			handleSecParamsRequest(gapEvent.conn_handle)
+		case C.BLE_GAP_EVT_SEC_INFO_REQUEST:
+			handleSecInfoRequest(gapEvent.conn_handle, gapEvent.params.unionfield_sec_info_request())
+		case C.BLE_GAP_EVT_AUTH_STATUS:
+			handleAuthStatus(gapEvent.conn_handle, gapEvent.params.unionfield_auth_status())
 		case C.BLE_GAP_EVT_DATA_LENGTH_UPDATE_REQUEST:
 			// We need to respond with sd_ble_gap_data_length_update. Setting
 			// both parameters to nil will make sure we send the default values.
 			C.sd_ble_gap_data_length_update(gapEvent.conn_handle, nil, nil)
 		case C.BLE_GAP_EVT_DATA_LENGTH_UPDATE:
-			// ignore confirmation of data length successfully updated
+			params := gapEvent.params.unionfield_data_length_update().effective_params
+			handleLinkUpdate(gapEvent.conn_handle, LinkUpdate{
+				TxOctets: uint16(params.max_tx_octets),
+				RxOctets: uint16(params.max_rx_octets),
+			})
 		case C.BLE_GAP_EVT_PHY_UPDATE_REQUEST:
 			phyUpdateRequest := gapEvent.params.unionfield_phy_update_request()
 			C.sd_ble_gap_phy_update(gapEvent.conn_handle, &phyUpdateRequest.peer_preferred_phys)
 		case C.BLE_GAP_EVT_PHY_UPDATE:
-			// ignore confirmation of phy successfully updated
+			phyUpdate := gapEvent.params.unionfield_phy_update()
+			if phyUpdate.status == C.BLE_HCI_STATUS_CODE_SUCCESS {
+				handleLinkUpdate(gapEvent.conn_handle, LinkUpdate{
+					TxPHY: makePHY(phyUpdate.tx_phy),
+					RxPHY: makePHY(phyUpdate.rx_phy),
+				})
+			}
 		default:
 			if debug {
 				println("unknown GAP event:", id)
 			}
 		}
+	case id == C.BLE_EVT_USER_MEM_REQUEST:
+		// A client started a long write.
+		replyUserMemRequest(eventBuf.evt.unionfield_common_evt().conn_handle)
 	case id >= C.BLE_GATTS_EVT_BASE && id <= C.BLE_GATTS_EVT_LAST:
 		gattsEvent := eventBuf.evt.unionfield_gatts_evt()
 		switch id {
 		case C.BLE_GATTS_EVT_WRITE:
 			writeEvent := gattsEvent.params.unionfield_write()
+			if writeEvent.op == C.BLE_GATTS_OP_EXEC_WRITE_REQ_NOW {
+				// A long write, queued in the memory given below.
+				DefaultAdapter.handleQueuedWrites(Connection(gattsEvent.conn_handle))
+				break
+			}
 			len := writeEvent.len - writeEvent.offset
 			data := (*[255]byte)(unsafe.Pointer(&writeEvent.data[0]))[:len:len]
 			handler := DefaultAdapter.getCharWriteHandler(writeEvent.handle)
 			if handler != nil {
 				handler.callback(Connection(gattsEvent.conn_handle), int(writeEvent.offset), data)
 			}
+		case C.BLE_GATTS_EVT_RW_AUTHORIZE_REQUEST:
+			// A client reads an attribute whose value comes from a read
+			// handler, or accesses an attribute that needs authorization.
+			DefaultAdapter.handleAuthorizeRequest(gattsEvent.conn_handle, gattsEvent.params.unionfield_authorize_request())
 		case C.BLE_GATTS_EVT_SYS_ATTR_MISSING:
 			// This event is generated when reading the Generic Attribute
 			// service. It appears to be necessary for bonded devices.
@@ -91,11 +126,18 @@ func handleEvent() {
 			// way to handle it, ignore it.
 			C.sd_ble_gatts_sys_attr_set(gattsEvent.conn_handle, nil, 0, 0)
 		case C.BLE_GATTS_EVT_EXCHANGE_MTU_REQUEST:
-			// This event is generated by some devices. While we could support
-			// larger MTUs, this default MTU is supported everywhere.
-			C.sd_ble_gatts_exchange_mtu_reply(gattsEvent.conn_handle, C.BLE_GATT_ATT_MTU_DEFAULT)
+			// Reply with the MTU the SoftDevice was configured with, both
+			// sides then use the smaller one.
+			mtu := DefaultAdapter.attMTU()
+			C.sd_ble_gatts_exchange_mtu_reply(gattsEvent.conn_handle, C.uint16_t(mtu))
+			mtu = negotiateMTU(uint16(gattsEvent.params.unionfield_exchange_mtu_request().client_rx_mtu), mtu)
+			setConnectionMTU(gattsEvent.conn_handle, mtu)
+			handleLinkUpdate(gattsEvent.conn_handle, LinkUpdate{MTU: mtu})
 		case C.BLE_GATTS_EVT_HVN_TX_COMPLETE:
 			// ignore confirmation of a notification successfully sent
+		case C.BLE_GATTS_EVT_HVC:
+			// The central confirmed an indication.
+			indicationPending.Set(0)
 		default:
 			if debug {
 				println("unknown GATTS event:", id, id-C.BLE_GATTS_EVT_BASE)
@@ -11,14 +11,24 @@ package bluetooth
 #include "ble_gap.h"
 
 void assertHandler(void);
+
+static inline uint32_t sd_ble_cfg_set_att_mtu(uint8_t conn_cfg_tag, uint16_t att_mtu, uint32_t app_ram_base) {
+	ble_cfg_t cfg = {0};
+	cfg.conn_cfg.conn_cfg_tag = conn_cfg_tag;
+	cfg.conn_cfg.params.gatt_conn_cfg.att_mtu = att_mtu;
+	return sd_ble_cfg_set(BLE_CONN_CFG_GATT, &cfg, app_ram_base);
+}
 */
 import "C"
 
 import (
+	"errors"
 	"machine"
 	"unsafe"
 )
 
+var errEnabled = errors.New("bluetooth: the SoftDevice is already enabled")
+
 //export assertHandler
 func assertHandler() {
 	println("SoftDevice assert")
@@ -31,9 +41,19 @@ var clockConfigXtal C.nrf_clock_lf_cfg_t = C.nrf_clock_lf_cfg_t{
 	accuracy:     C.NRF_CLOCK_LF_ACCURACY_250_PPM,
 }
 
+// The room for event data in the event buffer. The largest events are primary
+// service discovery responses, which hold up to (MTU-1)/4 services of 8 bytes
+// each.
+const eventBufExtra = (MaxMTU - 1) / 4 * 8
+
 //go:extern __app_ram_base
 var appRAMBase [0]uint32
 
+// The connection configuration that is used to advertise and connect. It is
+// only changed from the default configuration of the SoftDevice when a larger
+// MTU is configured, see SetPreferredMTU.
+var connectionConfig C.uint8_t = C.BLE_CONN_CFG_TAG_DEFAULT
+
 func (a *Adapter) enable() error {
 	// Enable the SoftDevice.
 	var clockConfig *C.nrf_clock_lf_cfg_t
@@ -45,10 +65,57 @@ func (a *Adapter) enable() error {
 		return Error(errCode)
 	}
 
-	// Enable the BLE stack.
 	appRAMBase := C.uint32_t(uintptr(unsafe.Pointer(&appRAMBase)))
+	if a.preferredMTU > C.BLE_GATT_ATT_MTU_DEFAULT {
+		// The default configuration can't be changed, so the larger MTU is
+		// part of a new configuration.
+		errCode = C.sd_ble_cfg_set_att_mtu(1, C.uint16_t(a.preferredMTU), appRAMBase)
+		if errCode != 0 {
+			return Error(errCode)
+		}
+		connectionConfig = 1
+	}
+
+	// Enable the BLE stack.
 	errCode = C.sd_ble_enable(&appRAMBase)
-	return makeError(errCode)
+	if errCode != 0 {
+		return Error(errCode)
+	}
+
+	// Resolve the private addresses of bonded devices.
+	return loadBondIdentities(a.bondStore)
+}
+
+// SetPreferredMTU sets the ATT MTU, between MinMTU and MaxMTU bytes, that is
+// offered when the MTU of a connection is exchanged. The connection then uses
+// the smaller of the MTUs of both sides, which is reported to the link update
+// handler. The default is the minimum MTU.
+//
+// The MTU is part of the SoftDevice configuration, so it must be set before
+// Enable. A larger MTU needs more RAM for the SoftDevice, which Enable reports
+// with an error if the linker script doesn't reserve enough of it.
+func (a *Adapter) SetPreferredMTU(mtu uint16) error {
+	if mtu < MinMTU || mtu > MaxMTU {
+		return errInvalidMTU
+	}
+
+	var enabled C.uint8_t
+	C.sd_softdevice_is_enabled(&enabled)
+	if enabled != 0 {
+		return errEnabled
+	}
+
+	a.preferredMTU = mtu
+	return nil
+}
+
+// attMTU returns the ATT MTU the SoftDevice was configured with, which it
+// offers in MTU exchanges.
+func (a *Adapter) attMTU() uint16 {
+	if a.preferredMTU > C.BLE_GATT_ATT_MTU_DEFAULT {
+		return a.preferredMTU
+	}
+	return C.BLE_GATT_ATT_MTU_DEFAULT
 }
 
 func (a *Adapter) Address() (MACAddress, error) {
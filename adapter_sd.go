@@ -30,10 +30,51 @@ var (
 // There can only be one connection at a time in the default configuration.
 var currentConnection = volatileHandle{handle: volatile.Register16{C.BLE_CONN_HANDLE_INVALID}}
 
-// Globally allocated buffer for incoming SoftDevice events.
+// The ATT MTU of each connection, indexed by connection handle, as the
+// SoftDevice numbers its connections from zero. Zero means the default MTU.
+var connectionMTUs [8]volatile.Register16
+
+// connectionMTU returns the ATT MTU of the given connection.
+func connectionMTU(connHandle C.uint16_t) uint16 {
+	if int(connHandle) < len(connectionMTUs) {
+		if mtu := connectionMTUs[connHandle].Get(); mtu != 0 {
+			return mtu
+		}
+	}
+	return MinMTU
+}
+
+// setConnectionMTU stores the ATT MTU of the given connection after an MTU
+// exchange, or resets it to the default with a zero MTU.
+func setConnectionMTU(connHandle C.uint16_t, mtu uint16) {
+	if int(connHandle) < len(connectionMTUs) {
+		connectionMTUs[connHandle].Set(mtu)
+	}
+}
+
+// connectionPeer is the peer of a connection.
+type connectionPeer struct {
+	address   MACAddress
+	connected bool
+}
+
+// The peer of each connection, indexed by connection handle like
+// connectionMTUs.
+var connectionPeers [8]connectionPeer
+
+// setConnectionPeer stores the peer of a new connection, or forgets it when
+// the connection is closed.
+func setConnectionPeer(connHandle C.uint16_t, address MACAddress, connected bool) {
+	if int(connHandle) < len(connectionPeers) {
+		connectionPeers[connHandle] = connectionPeer{address, connected}
+	}
+}
+
+// Globally allocated buffer for incoming SoftDevice events. Its size depends on
+// the largest MTU the SoftDevice supports.
 var eventBuf struct {
 	C.ble_evt_t
-	buf [23]byte
+	buf [eventBufExtra]byte
 }
 
 func init() {
@@ -41,14 +82,28 @@ func init() {
 	secModeOpen.set_bitfield_lv(1)
 }
 
+// securityMode returns the SoftDevice security mode that needs the given
+// security level. The levels are those of LE security mode 1, starting at 1
+// for no security.
+func securityMode(level securityLevel) (mode C.ble_gap_conn_sec_mode_t) {
+	mode.set_bitfield_sm(1)
+	mode.set_bitfield_lv(C.uint8_t(level) + 1)
+	return
+}
+
 // Adapter is a dummy adapter: it represents the connection to the (only)
 // SoftDevice on the chip.
 type Adapter struct {
 	isDefault         bool
 	scanning          bool
 	charWriteHandlers []charWriteHandler
+	readHandlers      []readHandler
+	authorizeHandlers []authorizeHandler
 
-	connectHandler func(device Device, connected bool)
+	connectHandler    func(device Device, connected bool)
+	linkUpdateHandler func(device Device, update LinkUpdate)
+	bondStore         BondStore
+	preferredMTU      uint16
 }
 
 // DefaultAdapter is the default adapter on the current system. On Nordic chips,
@@ -58,7 +113,9 @@ type Adapter struct {
 var DefaultAdapter = &Adapter{isDefault: true,
 	connectHandler: func(device Device, connected bool) {
 		return
-	}}
+	},
+	bondStore: NewMemoryBondStore(),
+}
 
 var eventBufLen C.uint16_t
 
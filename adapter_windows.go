@@ -12,7 +12,8 @@ import (
 type Adapter struct {
 	watcher *advertisement.BluetoothLEAdvertisementWatcher
 
-	connectHandler func(device Device, connected bool)
+	connectHandler    func(device Device, connected bool)
+	linkUpdateHandler func(device Device, update LinkUpdate)
 }
 
 // DefaultAdapter is the default adapter on the system.
@@ -56,3 +57,11 @@ func awaitAsyncOperation(asyncOperation *foundation.IAsyncOperation, genericPara
 	}
 	return nil
 }
+
+// SetPreferredMTU sets the ATT MTU that is offered when the MTU of a connection
+// is exchanged.
+//
+// This call has not yet been implemented on Windows and returns ErrNotSupported.
+func (a *Adapter) SetPreferredMTU(mtu uint16) error {
+	return ErrNotSupported
+}
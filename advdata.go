@@ -0,0 +1,719 @@
+package bluetooth
+
+import (
+	"encoding/binary"
+	"errors"
+	"strings"
+)
+
+var errInvalidADStructure = errors.New("bluetooth: invalid AD structure")
+
+// ADType is the type of an AD structure in advertisement or scan response
+// data. See the Generic Access Profile section of the Assigned Numbers
+// document for the full list:
+// https://www.bluetooth.com/specifications/assigned-numbers/
+type ADType uint8
+
+const (
+	ADTypeFlags                             ADType = 0x01
+	ADTypeIncomplete16BitServiceUUIDs       ADType = 0x02
+	ADTypeComplete16BitServiceUUIDs         ADType = 0x03
+	ADTypeIncomplete32BitServiceUUIDs       ADType = 0x04
+	ADTypeComplete32BitServiceUUIDs         ADType = 0x05
+	ADTypeIncomplete128BitServiceUUIDs      ADType = 0x06
+	ADTypeComplete128BitServiceUUIDs        ADType = 0x07
+	ADTypeShortenedLocalName                ADType = 0x08
+	ADTypeCompleteLocalName                 ADType = 0x09
+	ADTypeTxPowerLevel                      ADType = 0x0a
+	ADTypeClassOfDevice                     ADType = 0x0d
+	ADTypeSimplePairingHashC192             ADType = 0x0e
+	ADTypeSimplePairingRandomizerR192       ADType = 0x0f
+	ADTypeSecurityManagerTKValue            ADType = 0x10
+	ADTypeSecurityManagerOOBFlags           ADType = 0x11
+	ADTypePeripheralConnectionIntervalRange ADType = 0x12 // formerly Slave Connection Interval Range
+	ADType16BitSolicitationUUIDs            ADType = 0x14
+	ADType128BitSolicitationUUIDs           ADType = 0x15
+	ADTypeServiceData16BitUUID              ADType = 0x16
+	ADTypePublicTargetAddress               ADType = 0x17
+	ADTypeRandomTargetAddress               ADType = 0x18
+	ADTypeAppearance                        ADType = 0x19
+	ADTypeAdvertisingInterval               ADType = 0x1a
+	ADTypeLEBluetoothDeviceAddress          ADType = 0x1b
+	ADTypeLERole                            ADType = 0x1c
+	ADTypeSimplePairingHashC256             ADType = 0x1d
+	ADTypeSimplePairingRandomizerR256       ADType = 0x1e
+	ADType32BitSolicitationUUIDs            ADType = 0x1f
+	ADTypeServiceData32BitUUID              ADType = 0x20
+	ADTypeServiceData128BitUUID             ADType = 0x21
+	ADTypeLESecureConnectionsConfirmation   ADType = 0x22
+	ADTypeLESecureConnectionsRandom         ADType = 0x23
+	ADTypeURI                               ADType = 0x24
+	ADTypeLESupportedFeatures               ADType = 0x27
+	ADTypeChannelMapUpdateIndication        ADType = 0x28
+	ADTypeBroadcastName                     ADType = 0x30
+	ADTypeManufacturerData                  ADType = 0xff
+)
+
+// Flags used in the Flags AD structure.
+const (
+	ADFlagLimitedDiscoverable = 0x01
+	ADFlagGeneralDiscoverable = 0x02
+	ADFlagBREDRNotSupported   = 0x04
+)
+
+// LE Role values, as used in the LE Role AD structure.
+const (
+	LERolePeripheralOnly       = 0x00
+	LERoleCentralOnly          = 0x01
+	LERolePeripheralAndCentral = 0x02 // peripheral preferred
+	LERoleCentralAndPeripheral = 0x03 // central preferred
+)
+
+// connectionIntervalNoSpecific is used in the Peripheral Connection Interval
+// Range AD structure when there is no specific minimum or maximum.
+const connectionIntervalNoSpecific = 0xffff
+
+// uriSchemes maps the scheme code used in URI AD structures to the scheme
+// prefix. Code 0x01 means the URI has no scheme prefix.
+var uriSchemes = [...]string{
+	0x02: "aaa:",
+	0x03: "aaas:",
+	0x04: "about:",
+	0x05: "acap:",
+	0x06: "acct:",
+	0x07: "cap:",
+	0x08: "cid:",
+	0x09: "coap:",
+	0x0a: "coaps:",
+	0x0b: "crid:",
+	0x0c: "data:",
+	0x0d: "dav:",
+	0x0e: "dict:",
+	0x0f: "dns:",
+	0x10: "file:",
+	0x11: "ftp:",
+	0x12: "geo:",
+	0x13: "go:",
+	0x14: "gopher:",
+	0x15: "h323:",
+	0x16: "http:",
+	0x17: "https:",
+}
+
+// AdvertisementData is raw advertisement or scan response data: a sequence of
+// AD structures, each consisting of a length byte, a type byte and data. It
+// implements AdvertisementPayload.
+type AdvertisementData []byte
+
+// Bytes returns the data as a plain byte slice.
+func (d AdvertisementData) Bytes() []byte {
+	return d
+}
+
+// ADIterator iterates over the AD structures in AdvertisementData. Use it like
+// this:
+//
+//	it := data.Iterator()
+//	for it.Next() {
+//		println(it.Type(), it.Data())
+//	}
+//	if it.Err() != nil {
+//		// malformed data
+//	}
+type ADIterator struct {
+	data  []byte
+	typ   ADType
+	value []byte
+	err   error
+}
+
+// Iterator returns an iterator over all AD structures in the data.
+func (d AdvertisementData) Iterator() ADIterator {
+	return ADIterator{data: d}
+}
+
+// Next advances to the next AD structure. It returns false when there are no
+// more structures, or when the data is malformed.
+func (it *ADIterator) Next() bool {
+	if len(it.data) == 0 || it.err != nil {
+		return false
+	}
+
+	length := int(it.data[0])
+	if length == 0 {
+		// A zero length marks the end of the significant part of the data,
+		// everything after it is padding.
+		it.data = nil
+		return false
+	}
+	if length+1 > len(it.data) {
+		it.data = nil
+		it.err = errInvalidADStructure
+		return false
+	}
+
+	it.typ = ADType(it.data[1])
+	it.value = it.data[2 : length+1]
+	it.data = it.data[length+1:]
+
+	return true
+}
+
+// Type returns the type of the current AD structure.
+func (it *ADIterator) Type() ADType {
+	return it.typ
+}
+
+// Data returns the data of the current AD structure, excluding the length and
+// type. It points into the underlying advertisement data.
+func (it *ADIterator) Data() []byte {
+	return it.value
+}
+
+// Err returns an error if iteration stopped because the data is malformed.
+func (it *ADIterator) Err() error {
+	return it.err
+}
+
+// Field returns the data of the first AD structure of the given type, or nil
+// if there is none.
+func (d AdvertisementData) Field(typ ADType) []byte {
+	it := d.Iterator()
+	for it.Next() {
+		if it.Type() == typ {
+			return it.Data()
+		}
+	}
+
+	return nil
+}
+
+// Flags returns the value of the Flags AD structure, if present.
+func (d AdvertisementData) Flags() (uint8, bool) {
+	b := d.Field(ADTypeFlags)
+	if len(b) < 1 {
+		return 0, false
+	}
+
+	return b[0], true
+}
+
+// LocalName returns the complete or shortened local name, or an empty string
+// if neither is present.
+func (d AdvertisementData) LocalName() string {
+	if b := d.Field(ADTypeCompleteLocalName); len(b) != 0 {
+		return string(b)
+	}
+
+	return string(d.Field(ADTypeShortenedLocalName))
+}
+
+// TxPowerLevel returns the advertised transmit power in dBm, if present.
+func (d AdvertisementData) TxPowerLevel() (int8, bool) {
+	b := d.Field(ADTypeTxPowerLevel)
+	if len(b) != 1 {
+		return 0, false
+	}
+
+	return int8(b[0]), true
+}
+
+// Appearance returns the external appearance of the device, if present.
+func (d AdvertisementData) Appearance() (uint16, bool) {
+	b := d.Field(ADTypeAppearance)
+	if len(b) != 2 {
+		return 0, false
+	}
+
+	return binary.LittleEndian.Uint16(b), true
+}
+
+// ServiceUUIDs returns all Service Class UUIDs in the data: 16-bit, 32-bit and
+// 128-bit, from both complete and incomplete lists.
+func (d AdvertisementData) ServiceUUIDs() []UUID {
+	return d.uuids(ADTypeIncomplete16BitServiceUUIDs, ADTypeComplete16BitServiceUUIDs,
+		ADTypeIncomplete32BitServiceUUIDs, ADTypeComplete32BitServiceUUIDs,
+		ADTypeIncomplete128BitServiceUUIDs, ADTypeComplete128BitServiceUUIDs)
+}
+
+// SolicitationUUIDs returns all Service Solicitation UUIDs in the data.
+func (d AdvertisementData) SolicitationUUIDs() []UUID {
+	return d.uuids(ADType16BitSolicitationUUIDs, ADType16BitSolicitationUUIDs,
+		ADType32BitSolicitationUUIDs, ADType32BitSolicitationUUIDs,
+		ADType128BitSolicitationUUIDs, ADType128BitSolicitationUUIDs)
+}
+
+// HasServiceUUID returns true whether the given UUID is present in the data as
+// a Service Class UUID. Unlike ServiceUUIDs, it does not allocate.
+func (d AdvertisementData) HasServiceUUID(uuid UUID) bool {
+	found := false
+	d.eachUUID(func(u UUID) bool {
+		found = u == uuid
+		return !found
+	}, ADTypeIncomplete16BitServiceUUIDs, ADTypeComplete16BitServiceUUIDs,
+		ADTypeIncomplete32BitServiceUUIDs, ADTypeComplete32BitServiceUUIDs,
+		ADTypeIncomplete128BitServiceUUIDs, ADTypeComplete128BitServiceUUIDs)
+
+	return found
+}
+
+// uuids returns the UUIDs in the AD structures with the given types, which
+// must be pairs of 16-bit, 32-bit and 128-bit UUID list types.
+func (d AdvertisementData) uuids(types ...ADType) []UUID {
+	var uuids []UUID
+	d.eachUUID(func(uuid UUID) bool {
+		uuids = append(uuids, uuid)
+		return true
+	}, types...)
+
+	return uuids
+}
+
+// eachUUID calls fn for every UUID in the AD structures with the given types
+// (see uuids), until fn returns false.
+func (d AdvertisementData) eachUUID(fn func(UUID) bool, types ...ADType) {
+	it := d.Iterator()
+	for it.Next() {
+		size := 0
+		for i, typ := range types {
+			if it.Type() == typ {
+				size = [...]int{2, 4, 16}[i/2]
+				break
+			}
+		}
+		if size == 0 {
+			continue
+		}
+
+		b := it.Data()
+		for ; len(b) >= size; b = b[size:] {
+			if !fn(uuidFromBytes(b[:size])) {
+				return
+			}
+		}
+	}
+}
+
+// uuidFromBytes converts a 16-bit, 32-bit or 128-bit UUID in little endian
+// byte order to a UUID.
+func uuidFromBytes(b []byte) UUID {
+	switch len(b) {
+	case 2:
+		return New16BitUUID(binary.LittleEndian.Uint16(b))
+	case 4:
+		return New32BitUUID(binary.LittleEndian.Uint32(b))
+	default:
+		var uuid [16]byte
+		for i := range uuid {
+			uuid[i] = b[15-i]
+		}
+		return NewUUID(uuid)
+	}
+}
+
+// PeripheralConnectionIntervalRange returns the preferred connection interval
+// range of the peripheral, if present. A zero value means there is no specific
+// minimum or maximum.
+func (d AdvertisementData) PeripheralConnectionIntervalRange() (min, max Duration, ok bool) {
+	b := d.Field(ADTypePeripheralConnectionIntervalRange)
+	if len(b) != 4 {
+		return 0, 0, false
+	}
+
+	// The intervals are in units of 1.25ms, Duration is in units of 0.625ms.
+	if v := binary.LittleEndian.Uint16(b[0:]); v != connectionIntervalNoSpecific {
+		min = Duration(v) * 2
+	}
+	if v := binary.LittleEndian.Uint16(b[2:]); v != connectionIntervalNoSpecific {
+		max = Duration(v) * 2
+	}
+
+	return min, max, true
+}
+
+// URI returns the URI AD structure, if present. Well known URI schemes are
+// expanded; if the scheme is not known the URI is returned without scheme.
+func (d AdvertisementData) URI() (string, bool) {
+	b := d.Field(ADTypeURI)
+	if len(b) < 1 {
+		return "", false
+	}
+
+	var scheme string
+	if int(b[0]) < len(uriSchemes) {
+		scheme = uriSchemes[b[0]]
+	}
+
+	return scheme + string(b[1:]), true
+}
+
+// LERole returns the supported LE roles, if present. See the LERole*
+// constants.
+func (d AdvertisementData) LERole() (uint8, bool) {
+	b := d.Field(ADTypeLERole)
+	if len(b) != 1 {
+		return 0, false
+	}
+
+	return b[0], true
+}
+
+// AdvertisingInterval returns the advertised advertising interval, if
+// present.
+func (d AdvertisementData) AdvertisingInterval() (Duration, bool) {
+	b := d.Field(ADTypeAdvertisingInterval)
+	if len(b) != 2 {
+		return 0, false
+	}
+
+	return Duration(binary.LittleEndian.Uint16(b)), true
+}
+
+// PublicTargetAddresses returns the addresses in the Public Target Address AD
+// structure.
+func (d AdvertisementData) PublicTargetAddresses() []MAC {
+	return d.addresses(ADTypePublicTargetAddress)
+}
+
+// RandomTargetAddresses returns the addresses in the Random Target Address AD
+// structure.
+func (d AdvertisementData) RandomTargetAddresses() []MAC {
+	return d.addresses(ADTypeRandomTargetAddress)
+}
+
+func (d AdvertisementData) addresses(typ ADType) []MAC {
+	var addresses []MAC
+	it := d.Iterator()
+	for it.Next() {
+		if it.Type() != typ {
+			continue
+		}
+		for b := it.Data(); len(b) >= 6; b = b[6:] {
+			var mac MAC
+			copy(mac[:], b)
+			addresses = append(addresses, mac)
+		}
+	}
+
+	return addresses
+}
+
+// ManufacturerData returns all manufacturer data in the advertisement data.
+// The data slices point into the underlying advertisement data.
+func (d AdvertisementData) ManufacturerData() []ManufacturerDataElement {
+	var manufacturerData []ManufacturerDataElement
+	it := d.Iterator()
+	for it.Next() {
+		b := it.Data()
+		if it.Type() != ADTypeManufacturerData || len(b) < 2 {
+			continue
+		}
+		manufacturerData = append(manufacturerData, ManufacturerDataElement{
+			CompanyID: binary.LittleEndian.Uint16(b),
+			Data:      b[2:],
+		})
+	}
+
+	return manufacturerData
+}
+
+// ServiceData returns all service data in the advertisement data, for 16-bit,
+// 32-bit and 128-bit UUIDs. The data slices point into the underlying
+// advertisement data.
+func (d AdvertisementData) ServiceData() []ServiceDataElement {
+	var serviceData []ServiceDataElement
+	it := d.Iterator()
+	for it.Next() {
+		size := 0
+		switch it.Type() {
+		case ADTypeServiceData16BitUUID:
+			size = 2
+		case ADTypeServiceData32BitUUID:
+			size = 4
+		case ADTypeServiceData128BitUUID:
+			size = 16
+		}
+		b := it.Data()
+		if size == 0 || len(b) < size {
+			continue
+		}
+		serviceData = append(serviceData, ServiceDataElement{
+			UUID: uuidFromBytes(b[:size]),
+			Data: b[size:],
+		})
+	}
+
+	return serviceData
+}
+
+// ADBuilder builds advertisement or scan response data. It appends to a
+// buffer without growing it beyond its capacity, so it doesn't allocate.
+//
+// Every Add method returns false if the AD structure doesn't fit in the
+// remaining space, in which case nothing is added.
+type ADBuilder struct {
+	buf []byte
+}
+
+// NewADBuilder returns a builder that writes to buf, starting at the
+// beginning. The capacity of buf limits the size of the data, for example 31
+// bytes for legacy advertising.
+func NewADBuilder(buf []byte) ADBuilder {
+	return ADBuilder{buf: buf[:0]}
+}
+
+// Bytes returns the data that has been built so far.
+func (b *ADBuilder) Bytes() AdvertisementData {
+	return b.buf
+}
+
+// Len returns the number of bytes that have been built so far.
+func (b *ADBuilder) Len() int {
+	return len(b.buf)
+}
+
+// Free returns the number of bytes that are still available.
+func (b *ADBuilder) Free() int {
+	return cap(b.buf) - len(b.buf)
+}
+
+// Reset removes all AD structures.
+func (b *ADBuilder) Reset() {
+	b.buf = b.buf[:0]
+}
+
+// Add adds an AD structure of the given type. The data may be split over
+// multiple slices, which are concatenated.
+func (b *ADBuilder) Add(typ ADType, data ...[]byte) bool {
+	length := 1
+	for _, d := range data {
+		length += len(d)
+	}
+	if length > 0xff || length+1 > b.Free() {
+		return false
+	}
+
+	b.buf = append(b.buf, byte(length), byte(typ))
+	for _, d := range data {
+		b.buf = append(b.buf, d...)
+	}
+
+	return true
+}
+
+// AddFlags adds the Flags AD structure. See the ADFlag* constants.
+func (b *ADBuilder) AddFlags(flags uint8) bool {
+	return b.Add(ADTypeFlags, []byte{flags})
+}
+
+// AddLocalName adds the Complete Local Name AD structure.
+func (b *ADBuilder) AddLocalName(name string) bool {
+	if len(name)+1 > 0xff || len(name)+2 > b.Free() {
+		return false
+	}
+
+	b.buf = append(b.buf, byte(len(name)+1), byte(ADTypeCompleteLocalName))
+	b.buf = append(b.buf, name...)
+
+	return true
+}
+
+// AddShortenedLocalName adds the Shortened Local Name AD structure, with as
+// much of the name as fits. It returns false if not even one byte of the name
+// fits.
+func (b *ADBuilder) AddShortenedLocalName(name string) bool {
+	n := b.Free() - 2
+	if n > 0xff-1 {
+		// The length byte also counts the type.
+		n = 0xff - 1
+	}
+	if n < 1 || len(name) == 0 {
+		return false
+	}
+	if len(name) > n {
+		name = name[:n]
+	}
+
+	b.buf = append(b.buf, byte(len(name)+1), byte(ADTypeShortenedLocalName))
+	b.buf = append(b.buf, name...)
+
+	return true
+}
+
+// AddTxPowerLevel adds the TX Power Level AD structure, in dBm.
+func (b *ADBuilder) AddTxPowerLevel(dBm int8) bool {
+	return b.Add(ADTypeTxPowerLevel, []byte{byte(dBm)})
+}
+
+// AddAppearance adds the Appearance AD structure.
+func (b *ADBuilder) AddAppearance(appearance uint16) bool {
+	return b.Add(ADTypeAppearance, []byte{byte(appearance), byte(appearance >> 8)})
+}
+
+// AddServiceUUIDs adds complete lists of Service Class UUIDs. UUIDs of the same
+// width are packed into one AD structure: there is at most one list of 16-bit,
+// one of 32-bit and one of 128-bit UUIDs.
+func (b *ADBuilder) AddServiceUUIDs(uuids []UUID) bool {
+	return b.addUUIDs(uuids, ADTypeComplete16BitServiceUUIDs,
+		ADTypeComplete32BitServiceUUIDs, ADTypeComplete128BitServiceUUIDs)
+}
+
+// AddSolicitationUUIDs adds Service Solicitation UUIDs, packed in the same way
+// as AddServiceUUIDs.
+func (b *ADBuilder) AddSolicitationUUIDs(uuids []UUID) bool {
+	return b.addUUIDs(uuids, ADType16BitSolicitationUUIDs,
+		ADType32BitSolicitationUUIDs, ADType128BitSolicitationUUIDs)
+}
+
+func (b *ADBuilder) addUUIDs(uuids []UUID, types ...ADType) bool {
+	start := len(b.buf)
+	for i, size := range [...]int{2, 4, 16} {
+		lengthPos := -1
+		for _, uuid := range uuids {
+			if uuidSize(uuid) != size {
+				continue
+			}
+
+			if lengthPos < 0 {
+				// start a new AD structure
+				if b.Free() < 2+size {
+					b.buf = b.buf[:start]
+					return false
+				}
+				lengthPos = len(b.buf)
+				b.buf = append(b.buf, 1, byte(types[i]))
+			}
+			if b.Free() < size || int(b.buf[lengthPos])+size > 0xff {
+				b.buf = b.buf[:start]
+				return false
+			}
+
+			raw := uuidBytes(uuid, size)
+			b.buf = append(b.buf, raw...)
+			b.buf[lengthPos] += byte(size)
+		}
+	}
+
+	return true
+}
+
+// uuidBytes returns the UUID in little endian byte order, shortened to the
+// given size (2, 4 or 16 bytes).
+func uuidBytes(uuid UUID, size int) []byte {
+	raw := uuid.Bytes()
+	if size < 16 {
+		// The 16-bit and 32-bit part of the UUID are in bytes 12-15.
+		return raw[12 : 12+size]
+	}
+
+	return raw[:]
+}
+
+// uuidSize returns the number of bytes needed to encode the UUID: 2, 4 or 16.
+func uuidSize(uuid UUID) int {
+	switch {
+	case uuid.Is16Bit():
+		return 2
+	case uuid.Is32Bit():
+		return 4
+	default:
+		return 16
+	}
+}
+
+// AddPeripheralConnectionIntervalRange adds the preferred connection interval
+// range of the peripheral. A zero value means there is no specific minimum or
+// maximum.
+func (b *ADBuilder) AddPeripheralConnectionIntervalRange(min, max Duration) bool {
+	var data [4]byte
+	binary.LittleEndian.PutUint16(data[0:], connectionInterval(min))
+	binary.LittleEndian.PutUint16(data[2:], connectionInterval(max))
+
+	return b.Add(ADTypePeripheralConnectionIntervalRange, data[:])
+}
+
+// connectionInterval converts a Duration to a connection interval in units of
+// 1.25ms, or "no specific value" for zero.
+func connectionInterval(d Duration) uint16 {
+	if d == 0 {
+		return connectionIntervalNoSpecific
+	}
+
+	return uint16(d / 2)
+}
+
+// AddURI adds the URI AD structure. Well known URI schemes are encoded in a
+// single byte.
+func (b *ADBuilder) AddURI(uri string) bool {
+	code := byte(0x01) // no scheme
+	for i, scheme := range uriSchemes {
+		if scheme != "" && strings.HasPrefix(uri, scheme) {
+			code = byte(i)
+			uri = uri[len(scheme):]
+			break
+		}
+	}
+
+	if len(uri)+2 > 0xff || len(uri)+3 > b.Free() {
+		return false
+	}
+
+	b.buf = append(b.buf, byte(len(uri)+2), byte(ADTypeURI), code)
+	b.buf = append(b.buf, uri...)
+
+	return true
+}
+
+// AddLERole adds the LE Role AD structure. See the LERole* constants.
+func (b *ADBuilder) AddLERole(role uint8) bool {
+	return b.Add(ADTypeLERole, []byte{role})
+}
+
+// AddAdvertisingInterval adds the Advertising Interval AD structure.
+func (b *ADBuilder) AddAdvertisingInterval(interval Duration) bool {
+	return b.Add(ADTypeAdvertisingInterval, []byte{byte(interval), byte(interval >> 8)})
+}
+
+// AddPublicTargetAddresses adds the Public Target Address AD structure.
+func (b *ADBuilder) AddPublicTargetAddresses(addresses ...MAC) bool {
+	return b.addAddresses(ADTypePublicTargetAddress, addresses)
+}
+
+// AddRandomTargetAddresses adds the Random Target Address AD structure.
+func (b *ADBuilder) AddRandomTargetAddresses(addresses ...MAC) bool {
+	return b.addAddresses(ADTypeRandomTargetAddress, addresses)
+}
+
+func (b *ADBuilder) addAddresses(typ ADType, addresses []MAC) bool {
+	length := 1 + 6*len(addresses)
+	if length > 0xff || length+1 > b.Free() {
+		return false
+	}
+
+	b.buf = append(b.buf, byte(length), byte(typ))
+	for _, mac := range addresses {
+		b.buf = append(b.buf, mac[:]...)
+	}
+
+	return true
+}
+
+// AddManufacturerData adds a Manufacturer Specific Data AD structure.
+func (b *ADBuilder) AddManufacturerData(companyID uint16, data []byte) bool {
+	return b.Add(ADTypeManufacturerData, []byte{byte(companyID), byte(companyID >> 8)}, data)
+}
+
+// AddServiceData adds a Service Data AD structure, using the shortest form of
+// the UUID.
+func (b *ADBuilder) AddServiceData(uuid UUID, data []byte) bool {
+	size := uuidSize(uuid)
+	typ := ADTypeServiceData128BitUUID
+	switch size {
+	case 2:
+		typ = ADTypeServiceData16BitUUID
+	case 4:
+		typ = ADTypeServiceData32BitUUID
+	}
+
+	return b.Add(typ, uuidBytes(uuid, size), data)
+}
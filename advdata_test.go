@@ -0,0 +1,171 @@
+package bluetooth
+
+import (
+	"reflect"
+	"strings"
+	"testing"
+	"time"
+)
+
+func TestAdvertisementDataParse(t *testing.T) {
+	data := AdvertisementData("\x02\x01\x06" + // flags
+		"\x02\x0a\xf4" + // TX power level: -12
+		"\x03\x19\x41\x03" + // appearance: 0x0341
+		"\x05\x02\x0d\x18\x0f\x18" + // incomplete 16-bit UUIDs
+		"\x05\x05\x78\x56\x34\x12" + // complete 32-bit UUIDs
+		"\x03\x14\x0a\x18" + // 16-bit solicitation UUIDs
+		"\x05\x12\x06\x00\xff\xff" + // peripheral connection interval range
+		"\x0d\x24\x17example.com" + // URI
+		"\x02\x1c\x02" + // LE role
+		"\x03\x1a\x40\x00" + // advertising interval
+		"\x07\x17\x11\x22\x33\x44\x55\x66" + // public target address
+		"\x04\x08abc" + // shortened local name
+		"\x00\x00\x00") // padding
+
+	if flags, ok := data.Flags(); !ok || flags != 0x06 {
+		t.Errorf("unexpected flags: %d %v", flags, ok)
+	}
+	if power, ok := data.TxPowerLevel(); !ok || power != -12 {
+		t.Errorf("unexpected TX power level: %d %v", power, ok)
+	}
+	if appearance, ok := data.Appearance(); !ok || appearance != 0x0341 {
+		t.Errorf("unexpected appearance: %#x %v", appearance, ok)
+	}
+	expectedUUIDs := []UUID{ServiceUUIDHeartRate, ServiceUUIDBattery, New32BitUUID(0x12345678)}
+	if uuids := data.ServiceUUIDs(); !reflect.DeepEqual(uuids, expectedUUIDs) {
+		t.Errorf("unexpected service UUIDs: %v", uuids)
+	}
+	if !data.HasServiceUUID(New32BitUUID(0x12345678)) || data.HasServiceUUID(ServiceUUIDCyclingPower) {
+		t.Errorf("HasServiceUUID failed")
+	}
+	if uuids := data.SolicitationUUIDs(); !reflect.DeepEqual(uuids, []UUID{New16BitUUID(0x180a)}) {
+		t.Errorf("unexpected solicitation UUIDs: %v", uuids)
+	}
+	if min, max, ok := data.PeripheralConnectionIntervalRange(); !ok || min != NewDuration(7500*time.Microsecond) || max != 0 {
+		t.Errorf("unexpected connection interval range: %d %d %v", min, max, ok)
+	}
+	if uri, ok := data.URI(); !ok || uri != "https:example.com" {
+		t.Errorf("unexpected URI: %q %v", uri, ok)
+	}
+	if role, ok := data.LERole(); !ok || role != LERolePeripheralAndCentral {
+		t.Errorf("unexpected LE role: %d %v", role, ok)
+	}
+	if interval, ok := data.AdvertisingInterval(); !ok || interval != NewDuration(40*time.Millisecond) {
+		t.Errorf("unexpected advertising interval: %d %v", interval, ok)
+	}
+	if addrs := data.PublicTargetAddresses(); !reflect.DeepEqual(addrs, []MAC{{0x11, 0x22, 0x33, 0x44, 0x55, 0x66}}) {
+		t.Errorf("unexpected public target addresses: %v", addrs)
+	}
+	if name := data.LocalName(); name != "abc" {
+		t.Errorf("unexpected local name: %q", name)
+	}
+
+	it := data.Iterator()
+	n := 0
+	for it.Next() {
+		n++
+	}
+	if n != 12 || it.Err() != nil {
+		t.Errorf("unexpected number of AD structures: %d (err: %v)", n, it.Err())
+	}
+
+	it = AdvertisementData("\x02\x01\x06\x05\x09ab").Iterator()
+	for it.Next() {
+	}
+	if it.Err() == nil {
+		t.Errorf("expected error for truncated AD structure")
+	}
+}
+
+func TestADBuilder(t *testing.T) {
+	uuid128, _ := ParseUUID("a0b40001-926d-4d61-98df-8c5c62ee53b3")
+
+	var buf [31]byte
+	b := NewADBuilder(buf[:])
+	ok := b.AddFlags(ADFlagGeneralDiscoverable|ADFlagBREDRNotSupported) &&
+		b.AddServiceUUIDs([]UUID{ServiceUUIDHeartRate, uuid128, ServiceUUIDBattery})
+	if !ok {
+		t.Fatal("could not build advertisement data")
+	}
+
+	// The 16-bit UUIDs are packed in a single field, before the 128-bit UUID.
+	raw128 := uuid128.Bytes()
+	expected := "\x02\x01\x06" +
+		"\x05\x03\x0d\x18\x0f\x18" +
+		"\x11\x07" + string(raw128[:])
+	if string(b.Bytes()) != expected {
+		t.Errorf("unexpected data:\nexpected: %x\nactual:   %x", expected, b.Bytes())
+	}
+
+	// Fields that don't fit are not added.
+	if b.AddLocalName("too long") {
+		t.Errorf("local name should not fit")
+	}
+	if !b.AddShortenedLocalName("too long") {
+		t.Errorf("shortened local name should fit")
+	}
+	if name := b.Bytes().LocalName(); name != "to" {
+		t.Errorf("unexpected shortened local name: %q", name)
+	}
+	if b.Free() != 0 {
+		t.Errorf("expected buffer to be full, %d bytes left", b.Free())
+	}
+
+	b.Reset()
+	b.AddURI("https://tinygo.org")
+	b.AddPeripheralConnectionIntervalRange(NewDuration(10*time.Millisecond), 0)
+	if uri, _ := b.Bytes().URI(); uri != "https://tinygo.org" {
+		t.Errorf("unexpected URI: %q", uri)
+	}
+	if string(b.Bytes().Field(ADTypeURI)) != "\x17//tinygo.org" {
+		t.Errorf("unexpected URI encoding: %x", b.Bytes().Field(ADTypeURI))
+	}
+	if min, max, _ := b.Bytes().PeripheralConnectionIntervalRange(); min != NewDuration(10*time.Millisecond) || max != 0 {
+		t.Errorf("unexpected connection interval range: %d %d", min, max)
+	}
+}
+
+func TestADBuilderLongFields(t *testing.T) {
+	// Extended advertising data has room for fields longer than the length
+	// byte of an AD structure allows.
+	b := NewADBuilder(make([]byte, 0, maxExtendedAdvertisingDataLength))
+	long := strings.Repeat("n", 300)
+
+	if b.AddLocalName(long) {
+		t.Error("a local name of 300 bytes should not fit in an AD structure")
+	}
+	if b.AddURI("https:" + long) {
+		t.Error("a URI of 300 bytes should not fit in an AD structure")
+	}
+	if b.AddURI("https:" + long[:254]) {
+		t.Error("a URI of 254 bytes should not fit with its scheme")
+	}
+	if len(b.Bytes()) != 0 {
+		t.Fatalf("expected no data, got %x", b.Bytes())
+	}
+
+	if !b.AddLocalName(long[:254]) {
+		t.Error("a local name of 254 bytes should fit")
+	}
+	if !b.AddShortenedLocalName(long) {
+		t.Error("a shortened local name should fit")
+	}
+	if !b.AddURI("https:" + long[:253]) {
+		t.Error("a URI of 253 bytes should fit")
+	}
+
+	// Each field is parsed back in full.
+	data := b.Bytes()
+	if name := string(data.Field(ADTypeCompleteLocalName)); name != long[:254] {
+		t.Errorf("unexpected local name of %d bytes", len(name))
+	}
+	if name := string(data.Field(ADTypeShortenedLocalName)); name != long[:254] {
+		t.Errorf("unexpected shortened local name of %d bytes", len(name))
+	}
+	if uri, _ := data.URI(); uri != "https:"+long[:253] {
+		t.Errorf("unexpected URI of %d bytes", len(uri))
+	}
+	if len(data) != 3*(2+254) {
+		t.Errorf("expected %d bytes, got %d", 3*(2+254), len(data))
+	}
+}
@@ -3,6 +3,8 @@
 package bluetooth
 
 import (
+	"bytes"
+	"context"
 	"encoding/binary"
 	"encoding/hex"
 	"errors"
@@ -39,6 +41,7 @@ const (
 	attOpHandleNotify        = 0x1b
 	attOpHandleInd           = 0x1d
 	attOpHandleCNF           = 0x1e
+	attOpMultiHandleNotify   = 0x23
 	attOpSignedWriteCmd      = 0xd2
 
 	attErrorInvalidHandle          = 0x01
@@ -76,6 +79,20 @@ var (
 
 const defaultTimeoutSeconds = 10
 
+const (
+	// maxPreparedWrites is the number of Prepare Write Requests a client can
+	// queue before it must execute them.
+	maxPreparedWrites = 64
+
+	// attCommandFlag is set in the opcode of commands, which have no
+	// response, not even an error.
+	attCommandFlag = 0x40
+
+	// attSignatureLength is the length of the signature at the end of a
+	// Signed Write Command.
+	attSignatureLength = 12
+)
+
 type rawService struct {
 	startHandle uint16
 	endHandle   uint16
@@ -209,6 +226,7 @@ type rawAttribute struct {
 	uuid        UUID
 	permissions CharacteristicPermissions
 	value       []byte
+	descriptor  *DescriptorConfig // descriptors other than the CCCD
 }
 
 func (a *rawAttribute) Write(buf []byte) (int, error) {
@@ -259,18 +277,50 @@ type connectData struct {
 	lastErrorHandle uint16
 	lastErrorCode   uint8
 	mtu             uint16
-	maxMTU          uint16
+	clientMTU       uint16 // the MTU sent in our own MTU request
 	services        []rawService
 	characteristics []rawCharacteristic
 	descriptors     []rawDescriptor
 	value           []byte
+	indicating      bool // waiting for the confirmation of an indication
+	prepared        []preparedWrite
+
+	// cccds are the Client Characteristic Configurations that the client
+	// wrote, by the handle of the characteristic value.
+	cccds map[uint16]uint16
+}
+
+// preparedWrite is a write that a client has queued with a Prepare Write
+// Request, until it executes or cancels the queue.
+type preparedWrite struct {
+	handle uint16
+	offset uint16
+	value  []byte
+}
+
+// attMTU returns the ATT MTU of the connection, which is the default until an
+// MTU exchange.
+func (cd *connectData) attMTU() int {
+	if cd.mtu < defaultMTU {
+		return defaultMTU
+	}
+	return int(cd.mtu)
+}
+
+// notificationValue returns as much of the value as fits in a notification or
+// indication on the connection.
+func (cd *connectData) notificationValue(value []byte) []byte {
+	if len(value) > cd.attMTU()-3 {
+		return value[:cd.attMTU()-3]
+	}
+	return value
 }
 
 type att struct {
 	hci           *hci
 	busy          sync.Mutex
-	mtu           uint16
-	maxMTU        uint16
+	indicate      sync.Mutex // held while an indication is outstanding
+	maxMTU        uint16     // the MTU offered to clients in an MTU exchange
 	notifications chan rawNotification
 
 	connections          []uint16
@@ -279,6 +329,12 @@ type att struct {
 	localServices        []rawService
 	localCharacteristics []rawCharacteristic
 	attributes           []rawAttribute
+
+	// clients has the address and MTU of each connection, for
+	// Adapter.ConnectionInfo. It has its own lock, as the read and write
+	// handlers that use it are called while the stack is busy.
+	clientsMu sync.Mutex
+	clients   map[uint16]ConnectionInfo
 }
 
 func newATT(hci *hci) *att {
@@ -288,6 +344,7 @@ func newATT(hci *hci) *att {
 		notifications:        make(chan rawNotification, 32),
 		connections:          []uint16{},
 		connectionsData:      make(map[uint16]*connectData),
+		clients:              make(map[uint16]ConnectionInfo),
 		lastHandle:           0x0001,
 		attributes:           []rawAttribute{},
 		localServices:        []rawService{},
@@ -376,6 +433,26 @@ func (a *att) readReq(connectionHandle, valueHandle uint16) error {
 	return a.waitUntilResponse(connectionHandle)
 }
 
+func (a *att) readBlobReq(connectionHandle, valueHandle, offset uint16) error {
+	if debug {
+		println("att.readBlobReq:", connectionHandle, valueHandle, offset)
+	}
+
+	a.busy.Lock()
+	defer a.busy.Unlock()
+
+	var b [5]byte
+	b[0] = attOpReadBlobReq
+	binary.LittleEndian.PutUint16(b[1:], valueHandle)
+	binary.LittleEndian.PutUint16(b[3:], offset)
+
+	if err := a.sendReq(connectionHandle, b[:]); err != nil {
+		return err
+	}
+
+	return a.waitUntilResponse(connectionHandle)
+}
+
 func (a *att) writeCmd(connectionHandle, valueHandle uint16, data []byte) error {
 	if debug {
 		println("att.writeCmd:", connectionHandle, valueHandle, hex.EncodeToString(data))
@@ -414,34 +491,70 @@ func (a *att) writeReq(connectionHandle, valueHandle uint16, data []byte) error
 	return a.waitUntilResponse(connectionHandle)
 }
 
-func (a *att) mtuReq(connectionHandle uint16) error {
+func (a *att) prepWriteReq(connectionHandle, valueHandle, offset uint16, data []byte) error {
 	if debug {
-		println("att.mtuReq:", connectionHandle)
+		println("att.prepWriteReq:", connectionHandle, valueHandle, offset, hex.EncodeToString(data))
 	}
 
-	cd, err := a.findConnectionData(connectionHandle)
-	if err != nil {
+	a.busy.Lock()
+	defer a.busy.Unlock()
+
+	var b [5]byte
+	b[0] = attOpPrepWriteReq
+	binary.LittleEndian.PutUint16(b[1:], valueHandle)
+	binary.LittleEndian.PutUint16(b[3:], offset)
+
+	if err := a.sendReq(connectionHandle, append(b[:], data...)); err != nil {
+		return err
+	}
+
+	return a.waitUntilResponse(connectionHandle)
+}
+
+func (a *att) execWriteReq(connectionHandle uint16, flags uint8) error {
+	if debug {
+		println("att.execWriteReq:", connectionHandle, flags)
+	}
+
+	a.busy.Lock()
+	defer a.busy.Unlock()
+
+	if err := a.sendReq(connectionHandle, []byte{attOpExecWriteReq, flags}); err != nil {
 		return err
 	}
 
+	return a.waitUntilResponse(connectionHandle)
+}
+
+// mtuReq exchanges the MTU with the server, and returns the MTU that is used
+// from then on.
+func (a *att) mtuReq(connectionHandle, mtu uint16) (uint16, error) {
+	if debug {
+		println("att.mtuReq:", connectionHandle, mtu)
+	}
+
 	a.busy.Lock()
 	defer a.busy.Unlock()
 
+	cd, err := a.findConnectionData(connectionHandle)
+	if err != nil {
+		return 0, err
+	}
+	cd.clientMTU = mtu
+
 	var b [3]byte
 	b[0] = attOpMTUReq
-	binary.LittleEndian.PutUint16(b[1:], cd.mtu)
+	binary.LittleEndian.PutUint16(b[1:], mtu)
 
 	if err := a.sendReq(connectionHandle, b[:]); err != nil {
-		return err
+		return 0, err
 	}
 
-	return a.waitUntilResponse(connectionHandle)
-}
-
-func (a *att) setMaxMTU(mtu uint16) error {
-	a.maxMTU = mtu
+	if err := a.waitUntilResponse(connectionHandle); err != nil {
+		return 0, err
+	}
 
-	return nil
+	return uint16(cd.attMTU()), nil
 }
 
 func (a *att) sendReq(handle uint16, data []byte) error {
@@ -472,12 +585,17 @@ func (a *att) sendNotification(handle uint16, data []byte) error {
 	b[0] = attOpHandleNotify
 	binary.LittleEndian.PutUint16(b[1:], handle)
 
-	for connection := range a.connections {
+	for _, connection := range a.connections {
+		cd, err := a.findConnectionData(connection)
+		if err != nil || cd.cccds[handle]&cccdNotify == 0 {
+			continue
+		}
+
 		if debug {
 			println("att.sendNotifications: sending to", connection)
 		}
 
-		if err := a.hci.sendAclPkt(uint16(connection), attCID, append(b[:], data...)); err != nil {
+		if err := a.hci.sendAclPkt(connection, attCID, append(b[:], cd.notificationValue(data)...)); err != nil {
 			return err
 		}
 	}
@@ -485,6 +603,73 @@ func (a *att) sendNotification(handle uint16, data []byte) error {
 	return nil
 }
 
+// sendIndication sends an indication to the connections whose client has
+// enabled indications, and waits until each of them has confirmed it or the
+// context is done. A connection can only have one outstanding indication, so
+// indications are sent one at a time.
+func (a *att) sendIndication(ctx context.Context, handle uint16, data []byte) error {
+	if debug {
+		println("att.sendIndication:", handle, "data:", hex.EncodeToString(data))
+	}
+
+	a.indicate.Lock()
+	defer a.indicate.Unlock()
+
+	var b [3]byte
+	b[0] = attOpHandleInd
+	binary.LittleEndian.PutUint16(b[1:], handle)
+
+	a.busy.Lock()
+	var connections []uint16
+	for _, connection := range a.connections {
+		cd, err := a.findConnectionData(connection)
+		if err != nil || cd.cccds[handle]&cccdIndicate == 0 {
+			continue
+		}
+		if err := a.hci.sendAclPkt(connection, attCID, append(b[:], cd.notificationValue(data)...)); err != nil {
+			a.busy.Unlock()
+			return err
+		}
+		cd.indicating = true
+		connections = append(connections, connection)
+	}
+	a.busy.Unlock()
+
+	for {
+		a.busy.Lock()
+		waiting := false
+		for _, connection := range connections {
+			// Connections that were closed in the meantime are skipped.
+			if cd, err := a.findConnectionData(connection); err == nil && cd.indicating {
+				waiting = true
+			}
+		}
+		if !waiting {
+			a.busy.Unlock()
+			return nil
+		}
+		err := a.hci.poll()
+		a.busy.Unlock()
+		if err != nil {
+			return err
+		}
+
+		select {
+		case <-ctx.Done():
+			// A late confirmation is ignored.
+			a.busy.Lock()
+			for _, connection := range connections {
+				if cd, err := a.findConnectionData(connection); err == nil {
+					cd.indicating = false
+				}
+			}
+			a.busy.Unlock()
+			return ctx.Err()
+		case <-time.After(5 * time.Millisecond):
+		}
+	}
+}
+
 func (a *att) sendError(handle uint16, opcode uint8, hdl uint16, code uint8) error {
 	if err := a.clearResponse(handle); err != nil {
 		return err
@@ -517,6 +702,16 @@ func (a *att) handleData(handle uint16, buf []byte) error {
 		return err
 	}
 
+	if len(buf) == 0 {
+		return nil
+	}
+	if len(buf) < attMinLength(buf[0]) {
+		if buf[0]&attCommandFlag != 0 {
+			return nil
+		}
+		return a.sendError(handle, buf[0], 0, attErrorInvalidPDU)
+	}
+
 	switch buf[0] {
 	case attOpError:
 		cd.errored = true
@@ -534,28 +729,36 @@ func (a *att) handleData(handle uint16, buf []byte) error {
 		if debug {
 			println("att.handleData: attOpMTUReq", hex.EncodeToString(buf))
 		}
-		mtu := binary.LittleEndian.Uint16(buf[1:])
-		if mtu > a.maxMTU {
-			mtu = a.maxMTU
-		}
-
-		// save mtu for connection
-		cd.mtu = mtu
+		cd.mtu = negotiateMTU(binary.LittleEndian.Uint16(buf[1:]), a.maxMTU)
+		a.setClientMTU(handle, cd.mtu)
 
+		// The response carries the MTU of this side, both sides then use the
+		// smaller one.
 		var b [3]byte
 		b[0] = attOpMTUResponse
-		binary.LittleEndian.PutUint16(b[1:], mtu)
+		binary.LittleEndian.PutUint16(b[1:], a.maxMTU)
 
 		if err := a.hci.sendAclPkt(handle, attCID, b[:]); err != nil {
 			return err
 		}
 
+		a.hci.linkUpdates = append(a.hci.linkUpdates, hciLinkUpdate{
+			handle:     handle,
+			LinkUpdate: LinkUpdate{MTU: cd.mtu},
+		})
+
 	case attOpMTUResponse:
 		if debug {
 			println("att.handleData: attOpMTUResponse")
 		}
 		cd.responded = true
-		cd.mtu = binary.LittleEndian.Uint16(buf[1:])
+		cd.mtu = negotiateMTU(cd.clientMTU, binary.LittleEndian.Uint16(buf[1:]))
+		a.setClientMTU(handle, cd.mtu)
+
+		a.hci.linkUpdates = append(a.hci.linkUpdates, hciLinkUpdate{
+			handle:     handle,
+			LinkUpdate: LinkUpdate{MTU: cd.mtu},
+		})
 
 	case attOpFindInfoReq:
 		if debug {
@@ -591,6 +794,12 @@ func (a *att) handleData(handle uint16, buf []byte) error {
 			println("att.handleData: attOpFindByTypeReq")
 		}
 
+		startHandle := binary.LittleEndian.Uint16(buf[1:])
+		endHandle := binary.LittleEndian.Uint16(buf[3:])
+		typ := shortUUID(binary.LittleEndian.Uint16(buf[5:]))
+
+		return a.handleFindByTypeReq(handle, startHandle, endHandle, typ, buf[7:])
+
 	case attOpReadByTypeReq:
 		if debug {
 			println("att.handleData: attOpReadByTypeReq")
@@ -668,6 +877,17 @@ func (a *att) handleData(handle uint16, buf []byte) error {
 			println("att.handleData: attOpReadBlobReq")
 		}
 
+		attrHandle := binary.LittleEndian.Uint16(buf[1:])
+		offset := binary.LittleEndian.Uint16(buf[3:])
+		return a.handleReadBlobReq(handle, attrHandle, offset)
+
+	case attOpReadBlobResponse:
+		if debug {
+			println("att.handleData: attOpReadBlobResponse")
+		}
+		cd.responded = true
+		cd.value = append(cd.value, buf[1:]...)
+
 	case attOpReadResponse:
 		if debug {
 			println("att.handleData: attOpReadResponse")
@@ -688,6 +908,9 @@ func (a *att) handleData(handle uint16, buf []byte) error {
 			println("att.handleData: attOpWriteCmd")
 		}
 
+		attrHandle := binary.LittleEndian.Uint16(buf[1:])
+		a.handleWriteCmd(handle, attrHandle, buf[3:])
+
 	case attOpWriteResponse:
 		if debug {
 			println("att.handleData: attOpWriteResponse")
@@ -699,11 +922,29 @@ func (a *att) handleData(handle uint16, buf []byte) error {
 			println("att.handleData: attOpPrepWriteReq")
 		}
 
+		attrHandle := binary.LittleEndian.Uint16(buf[1:])
+		offset := binary.LittleEndian.Uint16(buf[3:])
+		return a.handlePrepWriteReq(handle, cd, attrHandle, offset, buf[5:])
+
+	case attOpPrepWriteResponse:
+		if debug {
+			println("att.handleData: attOpPrepWriteResponse")
+		}
+		cd.responded = true
+
 	case attOpExecWriteReq:
 		if debug {
 			println("att.handleData: attOpExecWriteReq")
 		}
 
+		return a.handleExecWriteReq(handle, cd, buf[1])
+
+	case attOpExecWriteResponse:
+		if debug {
+			println("att.handleData: attOpExecWriteResponse")
+		}
+		cd.responded = true
+
 	case attOpHandleNotify:
 		if debug {
 			println("att.handleData: attOpHandleNotify")
@@ -727,25 +968,53 @@ func (a *att) handleData(handle uint16, buf []byte) error {
 			println("att.handleData: attOpHandleInd")
 		}
 
+		// Indications are delivered like notifications, and confirmed right
+		// away.
+		not := rawNotification{
+			connectionHandle: handle,
+			handle:           binary.LittleEndian.Uint16(buf[1:]),
+			data:             append([]byte{}, buf[3:]...),
+		}
+
+		select {
+		case a.notifications <- not:
+		default:
+			// out of space, drop indication :(
+		}
+
+		return a.hci.sendAclPkt(handle, attCID, []byte{attOpHandleCNF})
+
 	case attOpHandleCNF:
 		if debug {
 			println("att.handleData: attOpHandleCNF")
 		}
 
+		cd.indicating = false
+
 	case attOpReadMultiReq:
 		if debug {
 			println("att.handleData: attOpReadMultiReq")
 		}
 
+		return a.handleReadMultiReq(handle, buf[1:])
+
 	case attOpSignedWriteCmd:
 		if debug {
 			println("att.handleData: attOpSignedWriteCmd")
 		}
 
+		a.handleSignedWriteCmd(handle, buf)
+
 	default:
 		if debug {
 			println("att.handleData: unknown")
 		}
+
+		// Unknown requests are rejected, other PDUs are ignored: an error
+		// response may only answer a request.
+		if attIsRequest(buf[0]) {
+			return a.sendError(handle, buf[0], 0, attErrorRequestNotSupported)
+		}
 	}
 
 	return nil
@@ -753,6 +1022,7 @@ func (a *att) handleData(handle uint16, buf []byte) error {
 
 func (a *att) handleReadByGroupReq(handle, start, end uint16, uuid shortUUID) error {
 	var response [64]byte
+	size := a.responseSize(handle, len(response))
 	response[0] = attOpReadByGroupResponse
 	response[1] = 0x0 // length per service
 	pos := 2
@@ -780,7 +1050,7 @@ func (a *att) handleReadByGroupReq(handle, start, end uint16, uuid shortUUID) er
 				s.Read(response[pos : pos+length])
 				pos += length
 
-				if uint16(pos+length) > a.mtu {
+				if pos+length > size {
 					break
 				}
 			}
@@ -813,6 +1083,7 @@ func (a *att) handleReadByGroupReq(handle, start, end uint16, uuid shortUUID) er
 
 func (a *att) handleReadByTypeReq(handle, start, end uint16, uuid shortUUID) error {
 	var response [64]byte
+	size := a.responseSize(handle, len(response))
 	response[0] = attOpReadByTypeResponse
 	pos := 0
 
@@ -846,7 +1117,7 @@ func (a *att) handleReadByTypeReq(handle, start, end uint16, uuid shortUUID) err
 				c.Read(response[pos : pos+length])
 				pos += length
 
-				if uint16(pos+length) > a.mtu {
+				if pos+length > size {
 					break
 				}
 			}
@@ -878,6 +1149,7 @@ func (a *att) handleReadByTypeReq(handle, start, end uint16, uuid shortUUID) err
 
 func (a *att) handleFindInfoReq(handle, start, end uint16) error {
 	var response [64]byte
+	size := a.responseSize(handle, len(response))
 	response[0] = attOpFindInfoResponse
 	pos := 0
 
@@ -895,7 +1167,7 @@ func (a *att) handleFindInfoReq(handle, start, end uint16) error {
 				println("handleFindInfoReq: replying with attribute", attr.handle, attr.uuid.String(), attr.typ)
 			}
 
-			if attr.typ == attributeTypeCharacteristicValue || attr.typ == attributeTypeDescriptor {
+			if (attr.typ == attributeTypeCharacteristicValue || attr.typ == attributeTypeDescriptor) && attr.uuid.Is16Bit() {
 				infoType = 1
 			} else {
 				infoType = 2
@@ -912,7 +1184,7 @@ func (a *att) handleFindInfoReq(handle, start, end uint16) error {
 			attr.Read(response[pos : pos+length])
 			pos += length
 
-			if uint16(pos+length) >= a.mtu {
+			if pos+length > size {
 				break
 			}
 		}
@@ -931,66 +1203,297 @@ func (a *att) handleFindInfoReq(handle, start, end uint16) error {
 	return nil
 }
 
+func (a *att) handleFindByTypeReq(handle, start, end uint16, typ shortUUID, value []byte) error {
+	if start == 0 || start > end {
+		return a.sendError(handle, attOpFindByTypeReq, start, attErrorInvalidHandle)
+	}
+
+	var response [64]byte
+	size := a.responseSize(handle, len(response))
+	response[0] = attOpFindByTypeResponse
+	pos := 1
+
+	// Each match is the handle of the attribute and the end of its group. Only
+	// services are groups.
+	addMatch := func(found, groupEnd uint16) bool {
+		if pos+4 > size {
+			return false
+		}
+		binary.LittleEndian.PutUint16(response[pos:], found)
+		binary.LittleEndian.PutUint16(response[pos+2:], groupEnd)
+		pos += 4
+		return true
+	}
+
+	switch typ {
+	case shortUUID(gattServiceUUID):
+		uuid, ok := attUUID(value)
+		if !ok {
+			break
+		}
+		for _, s := range a.localServices {
+			if s.startHandle >= start && s.startHandle <= end && s.uuid == uuid {
+				if debug {
+					println("handleFindByTypeReq: replying with service", s.startHandle, s.endHandle, s.uuid.String())
+				}
+
+				if !addMatch(s.startHandle, s.endHandle) {
+					break
+				}
+			}
+		}
+
+	default:
+		for _, attr := range a.attributes {
+			if attr.handle < start || attr.handle > end || attr.uuid != typ.UUID() {
+				continue
+			}
+
+			attrValue, code := a.readAttribute(handle, attr.handle, 0)
+			if code == 0 && bytes.Equal(attrValue, value) {
+				if !addMatch(attr.handle, attr.handle) {
+					break
+				}
+			}
+		}
+	}
+
+	if pos == 1 {
+		return a.sendError(handle, attOpFindByTypeReq, start, attErrorAttrNotFound)
+	}
+
+	return a.hci.sendAclPkt(handle, attCID, response[:pos])
+}
+
 func (a *att) handleReadReq(handle, attrHandle uint16) error {
+	value, code := a.readAttribute(handle, attrHandle, 0)
+	if code != 0 {
+		return a.sendError(handle, attOpReadReq, attrHandle, code)
+	}
+
+	return a.sendReadResponse(handle, attOpReadResponse, value)
+}
+
+func (a *att) handleReadBlobReq(handle, attrHandle, offset uint16) error {
+	value, code := a.readAttribute(handle, attrHandle, offset)
+	if code != 0 {
+		return a.sendError(handle, attOpReadBlobReq, attrHandle, code)
+	}
+
+	return a.sendReadResponse(handle, attOpReadBlobResponse, value)
+}
+
+// handleReadMultiReq responds with the values of two or more attributes one
+// after another. Only the last one may be truncated, as the client can't tell
+// where the values end.
+func (a *att) handleReadMultiReq(handle uint16, handles []byte) error {
+	if len(handles)%2 != 0 {
+		return a.sendError(handle, attOpReadMultiReq, 0, attErrorInvalidPDU)
+	}
+
+	var values []byte
+	for i := 0; i < len(handles); i += 2 {
+		attrHandle := binary.LittleEndian.Uint16(handles[i:])
+		value, code := a.readAttribute(handle, attrHandle, 0)
+		if code != 0 {
+			return a.sendError(handle, attOpReadMultiReq, attrHandle, code)
+		}
+		values = append(values, value...)
+	}
+
+	return a.sendReadResponse(handle, attOpReadMultiResponse, values)
+}
+
+// readAttribute returns the value of a local attribute from the offset on, for
+// a client on the connection, or the ATT error code to respond with.
+func (a *att) readAttribute(handle, attrHandle, offset uint16) ([]byte, uint8) {
 	attr := a.findAttribute(attrHandle)
 	if attr == nil {
 		if debug {
-			println("att.handleReadReq: attribute not found", attrHandle)
+			println("att.readAttribute: attribute not found", attrHandle)
 		}
-		return a.sendError(handle, attOpReadReq, attrHandle, attErrorAttrNotFound)
+		return nil, attErrorAttrNotFound
 	}
 
-	var response [64]byte
-	response[0] = attOpReadResponse
-	pos := 1
-
+	var value []byte
 	switch attr.typ {
 	case attributeTypeCharacteristicValue:
 		if debug {
-			println("att.handleReadReq: reading characteristic value", attrHandle)
+			println("att.readAttribute: reading characteristic value", attrHandle)
 		}
 
 		c := a.findCharacteristic(attr.parent)
-		if c != nil && c.chr != nil {
-			value, err := c.chr.readValue()
+		if c == nil || c.chr == nil {
+			return nil, attErrorReadNotPermitted
+		}
+		chrValue, err := c.chr.readValue()
+		if err != nil {
+			return nil, attErrorReadNotPermitted
+		}
+		if code := a.securityError(handle, c.chr.security.read()); code != 0 {
+			return nil, code
+		}
+		if !c.chr.security.authorized(Connection(handle), false, c.chr.authorize) {
+			return nil, attErrorAuthorization
+		}
+		if c.chr.readEvent != nil {
+			value, err := c.chr.readEvent(Connection(handle), int(offset))
 			if err != nil {
-				return a.sendError(handle, attOpReadReq, attrHandle, attErrorReadNotPermitted)
+				return nil, attErrorCode(err)
 			}
-
-			copy(response[pos:], value)
-			pos += len(value)
-
-			if err := a.hci.sendAclPkt(handle, attCID, response[:pos]); err != nil {
-				return err
-			}
-
-			return nil
+			return value, 0
 		}
+		value = chrValue
 
 	case attributeTypeDescriptor:
 		if debug {
-			println("att.handleReadReq: reading descriptor", attrHandle)
+			println("att.readAttribute: reading descriptor", attrHandle)
+		}
+
+		if attr.descriptor != nil {
+			return a.readDescriptor(handle, attr, offset)
 		}
 
 		c := a.findCharacteristic(attr.parent)
-		if c != nil && c.chr != nil {
-			cccd, err := c.chr.readCCCD()
-			if err != nil {
-				return a.sendError(handle, attOpReadReq, attrHandle, attErrorReadNotPermitted)
-			}
+		if c == nil || c.chr == nil {
+			return nil, attErrorReadNotPermitted
+		}
+		cccd, err := c.chr.readCCCD(handle)
+		if err != nil {
+			return nil, attErrorReadNotPermitted
+		}
+		value = make([]byte, 2)
+		binary.LittleEndian.PutUint16(value, cccd)
 
-			binary.LittleEndian.PutUint16(response[pos:], cccd)
-			pos += 2
+	default:
+		return nil, attErrorReadNotPermitted
+	}
 
-			if err := a.hci.sendAclPkt(handle, attCID, response[:pos]); err != nil {
-				return err
-			}
+	if int(offset) > len(value) {
+		return nil, attErrorInvalidOffset
+	}
 
-			return nil
+	return value[offset:], 0
+}
+
+// readDescriptor returns the value of a descriptor that the program added from
+// the offset on, or the ATT error code to respond with.
+func (a *att) readDescriptor(handle uint16, attr *rawAttribute, offset uint16) ([]byte, uint8) {
+	d := attr.descriptor
+	if !d.Flags.Read() {
+		return nil, attErrorReadNotPermitted
+	}
+	if code := a.securityError(handle, d.Security.read()); code != 0 {
+		return nil, code
+	}
+	if !d.Security.authorized(Connection(handle), false, d.AuthorizeEvent) {
+		return nil, attErrorAuthorization
+	}
+
+	if d.ReadEvent != nil {
+		value, err := d.ReadEvent(Connection(handle), int(offset))
+		if err != nil {
+			return nil, attErrorCode(err)
 		}
+		return value, 0
+	}
+
+	if int(offset) > len(attr.value) {
+		return nil, attErrorInvalidOffset
+	}
+
+	return attr.value[offset:], 0
+}
+
+// writeDescriptor writes the value of a descriptor that the program added at
+// the offset, or returns the ATT error code to respond with.
+func (a *att) writeDescriptor(handle uint16, attr *rawAttribute, offset int, data []byte) uint8 {
+	d := attr.descriptor
+	if !d.Flags.Write() {
+		return attErrorWriteNotPermitted
+	}
+	if code := a.securityError(handle, d.Security.write()); code != 0 {
+		return code
+	}
+	if !d.Security.authorized(Connection(handle), true, d.AuthorizeEvent) {
+		return attErrorAuthorization
+	}
+	if offset > len(attr.value) {
+		return attErrorInvalidOffset
+	}
+	if offset+len(data) > maxAttributeLength {
+		return attErrorInvalidAttrValueLength
+	}
+
+	attr.value = append(attr.value[:offset], data...)
+	if d.WriteEvent != nil {
+		d.WriteEvent(Connection(handle), offset, data)
+	}
+
+	return 0
+}
+
+// securityError returns the ATT error code for a client on the connection that
+// accesses an attribute that needs the given security, or 0 if the link is
+// secure enough. The error asks the client to pair or encrypt the link.
+func (a *att) securityError(handle uint16, required securityLevel) uint8 {
+	switch {
+	case a.hci.smp.securityLevel(handle) >= required:
+		return 0
+	case required == securityEncrypted:
+		return attErrorInsuffEnc
+	default:
+		return attErrorAuthentication
+	}
+}
+
+// writeError returns the ATT error code for a client on the connection that
+// writes length bytes at the offset of the value of the characteristic, or 0
+// if it may.
+func (a *att) writeError(handle uint16, chr *Characteristic, offset, length int) uint8 {
+	if code := a.securityError(handle, chr.security.write()); code != 0 {
+		return code
+	}
+	if !chr.security.authorized(Connection(handle), true, chr.authorize) {
+		return attErrorAuthorization
 	}
+	if offset+length > chr.maxLength {
+		return attErrorInvalidAttrValueLength
+	}
+
+	return 0
+}
 
-	return a.sendError(handle, attOpReadReq, attrHandle, attErrorReadNotPermitted)
+// responseSize returns how much of a response buffer of the given size can be
+// sent on the connection.
+func (a *att) responseSize(handle uint16, size int) int {
+	cd, err := a.findConnectionData(handle)
+	if err != nil {
+		return defaultMTU
+	}
+	if cd.attMTU() < size {
+		return cd.attMTU()
+	}
+	return size
+}
+
+// sendReadResponse sends as much of the value as fits in the MTU of the
+// connection. The client reads the rest with Read Blob Requests.
+func (a *att) sendReadResponse(handle uint16, opcode uint8, value []byte) error {
+	cd, err := a.findConnectionData(handle)
+	if err != nil {
+		return err
+	}
+
+	if len(value) > cd.attMTU()-1 {
+		value = value[:cd.attMTU()-1]
+	}
+
+	response := make([]byte, 1, 1+len(value))
+	response[0] = opcode
+	response = append(response, value...)
+
+	return a.hci.sendAclPkt(handle, attCID, response)
 }
 
 func (a *att) handleWriteReq(handle, attrHandle uint16, data []byte) error {
@@ -1010,7 +1513,13 @@ func (a *att) handleWriteReq(handle, attrHandle uint16, data []byte) error {
 
 		c := a.findCharacteristic(attr.parent)
 		if c != nil && c.chr != nil {
-			if _, err := c.chr.Write(data); err != nil {
+			if !c.chr.permissions.Write() {
+				return a.sendError(handle, attOpWriteReq, attrHandle, attErrorWriteNotPermitted)
+			}
+			if code := a.writeError(handle, c.chr, 0, len(data)); code != 0 {
+				return a.sendError(handle, attOpWriteReq, attrHandle, code)
+			}
+			if err := c.chr.writeValue(Connection(handle), 0, data); err != nil {
 				return a.sendError(handle, attOpWriteReq, attrHandle, attErrorWriteNotPermitted)
 			}
 
@@ -1026,9 +1535,21 @@ func (a *att) handleWriteReq(handle, attrHandle uint16, data []byte) error {
 			println("att.handleWriteReq: writing descriptor", attrHandle, hex.EncodeToString(data))
 		}
 
+		if attr.descriptor != nil {
+			if code := a.writeDescriptor(handle, attr, 0, data); code != 0 {
+				return a.sendError(handle, attOpWriteReq, attrHandle, code)
+			}
+
+			return a.hci.sendAclPkt(handle, attCID, []byte{attOpWriteResponse})
+		}
+
+		if len(data) != 2 {
+			return a.sendError(handle, attOpWriteReq, attrHandle, attErrorInvalidAttrValueLength)
+		}
+
 		c := a.findCharacteristic(attr.parent)
 		if c != nil && c.chr != nil {
-			if err := c.chr.writeCCCD(binary.LittleEndian.Uint16(data)); err != nil {
+			if err := c.chr.writeCCCD(handle, binary.LittleEndian.Uint16(data)); err != nil {
 				return a.sendError(handle, attOpWriteReq, attrHandle, attErrorWriteNotPermitted)
 			}
 
@@ -1044,6 +1565,134 @@ func (a *att) handleWriteReq(handle, attrHandle uint16, data []byte) error {
 	return a.sendError(handle, attOpWriteReq, attrHandle, attErrorWriteNotPermitted)
 }
 
+// writableCharacteristic returns the characteristic whose value has the
+// handle, if the value can be written with the given permission.
+func (a *att) writableCharacteristic(attrHandle uint16, permission CharacteristicPermissions) *Characteristic {
+	attr := a.findAttribute(attrHandle)
+	if attr == nil || attr.typ != attributeTypeCharacteristicValue {
+		return nil
+	}
+
+	c := a.findCharacteristic(attr.parent)
+	if c == nil || c.chr == nil || c.chr.permissions&permission == 0 {
+		return nil
+	}
+
+	return c.chr
+}
+
+// handleWriteCmd writes a value without responding, so that failed writes are
+// silently dropped.
+func (a *att) handleWriteCmd(handle, attrHandle uint16, data []byte) {
+	chr := a.writableCharacteristic(attrHandle, CharacteristicWriteWithoutResponsePermission)
+	if chr == nil || a.writeError(handle, chr, 0, len(data)) != 0 {
+		if debug {
+			println("att.handleWriteCmd: not writable", attrHandle)
+		}
+		return
+	}
+
+	chr.writeValue(Connection(handle), 0, data)
+}
+
+// handleSignedWriteCmd writes a value like a Write Command, if the signature
+// at the end of the PDU is valid for a bonded client.
+func (a *att) handleSignedWriteCmd(handle uint16, buf []byte) {
+	attrHandle := binary.LittleEndian.Uint16(buf[1:])
+	n := len(buf) - attSignatureLength
+	chr := a.writableCharacteristic(attrHandle, CharacteristicSignedWritePermission)
+	if chr == nil || a.writeError(handle, chr, 0, n-3) != 0 {
+		if debug {
+			println("att.handleSignedWriteCmd: not writable", attrHandle)
+		}
+		return
+	}
+
+	if !a.hci.smp.verifySignature(handle, buf[:n], buf[n:]) {
+		if debug {
+			println("att.handleSignedWriteCmd: invalid signature", attrHandle)
+		}
+		return
+	}
+
+	chr.writeValue(Connection(handle), 0, buf[3:n])
+}
+
+func (a *att) handlePrepWriteReq(handle uint16, cd *connectData, attrHandle, offset uint16, data []byte) error {
+	attr := a.findAttribute(attrHandle)
+	if attr == nil {
+		return a.sendError(handle, attOpPrepWriteReq, attrHandle, attErrorInvalidHandle)
+	}
+
+	// Only characteristic values can be long.
+	c := a.findCharacteristic(attr.parent)
+	if attr.typ != attributeTypeCharacteristicValue || c == nil || c.chr == nil || !c.chr.permissions.Write() {
+		return a.sendError(handle, attOpPrepWriteReq, attrHandle, attErrorWriteNotPermitted)
+	}
+	if code := a.securityError(handle, c.chr.security.write()); code != 0 {
+		return a.sendError(handle, attOpPrepWriteReq, attrHandle, code)
+	}
+	if !c.chr.security.authorized(Connection(handle), true, c.chr.authorize) {
+		return a.sendError(handle, attOpPrepWriteReq, attrHandle, attErrorAuthorization)
+	}
+
+	if len(cd.prepared) >= maxPreparedWrites {
+		return a.sendError(handle, attOpPrepWriteReq, attrHandle, attErrorPreQueueFull)
+	}
+
+	// Offset and length are checked when the writes are executed.
+	cd.prepared = append(cd.prepared, preparedWrite{
+		handle: attrHandle,
+		offset: offset,
+		value:  append([]byte{}, data...),
+	})
+
+	// The response echoes the request, so that the client can verify it.
+	response := make([]byte, 5, 5+len(data))
+	response[0] = attOpPrepWriteResponse
+	binary.LittleEndian.PutUint16(response[1:], attrHandle)
+	binary.LittleEndian.PutUint16(response[3:], offset)
+	response = append(response, cd.prepared[len(cd.prepared)-1].value...)
+
+	return a.hci.sendAclPkt(handle, attCID, response)
+}
+
+func (a *att) handleExecWriteReq(handle uint16, cd *connectData, flags uint8) error {
+	prepared := cd.prepared
+	cd.prepared = nil
+
+	// Flags 0 cancels all prepared writes.
+	if flags != 0 {
+		// Check all writes before any of them is executed, so that either all
+		// or none of the values change.
+		lengths := map[uint16]int{}
+		for _, write := range prepared {
+			c := a.findCharacteristic(a.findAttribute(write.handle).parent)
+			length, ok := lengths[write.handle]
+			if !ok {
+				length = len(c.chr.value)
+			}
+			if int(write.offset) > length {
+				return a.sendError(handle, attOpExecWriteReq, write.handle, attErrorInvalidOffset)
+			}
+			length = int(write.offset) + len(write.value)
+			if length > c.chr.maxLength {
+				return a.sendError(handle, attOpExecWriteReq, write.handle, attErrorInvalidAttrValueLength)
+			}
+			lengths[write.handle] = length
+		}
+
+		for _, write := range prepared {
+			c := a.findCharacteristic(a.findAttribute(write.handle).parent)
+			if err := c.chr.writeValue(Connection(handle), int(write.offset), write.value); err != nil {
+				return a.sendError(handle, attOpExecWriteReq, write.handle, attErrorWriteNotPermitted)
+			}
+		}
+	}
+
+	return a.hci.sendAclPkt(handle, attCID, []byte{attOpExecWriteResponse})
+}
+
 func (a *att) clearResponse(handle uint16) error {
 	cd, err := a.findConnectionData(handle)
 	if err != nil {
@@ -1084,8 +1733,6 @@ func (a *att) waitUntilResponse(handle uint16) error {
 			time.Sleep(5 * time.Millisecond)
 		}
 	}
-
-	return ErrATTTimeout
 }
 
 func (a *att) poll() error {
@@ -1099,17 +1746,28 @@ func (a *att) poll() error {
 	return nil
 }
 
-func (a *att) addConnection(handle uint16) error {
+func (a *att) addConnection(conn hciConnection) error {
 	if debug {
-		println("att.addConnection:", handle)
+		println("att.addConnection:", conn.handle)
 	}
-	a.connections = append(a.connections, handle)
-	a.connectionsData[handle] = &connectData{
+	a.connections = append(a.connections, conn.handle)
+	a.connectionsData[conn.handle] = &connectData{
 		services:        []rawService{},
 		characteristics: []rawCharacteristic{},
 		value:           []byte{},
 	}
 
+	a.clientsMu.Lock()
+	a.clients[conn.handle] = ConnectionInfo{
+		Address: Address{MACAddress{
+			MAC:      makeAddress(conn.peerBdaddr),
+			isRandom: conn.peerBdaddrType&0x01 != 0,
+		}},
+		MTU:      defaultMTU,
+		LinkType: LinkTypeLE,
+	}
+	a.clientsMu.Unlock()
+
 	return nil
 }
 
@@ -1122,6 +1780,9 @@ func (a *att) removeConnection(handle uint16) error {
 		if a.connections[i] == handle {
 			a.connections = append(a.connections[:i], a.connections[i+1:]...)
 			delete(a.connectionsData, handle)
+			a.clientsMu.Lock()
+			delete(a.clients, handle)
+			a.clientsMu.Unlock()
 			break
 		}
 	}
@@ -1129,6 +1790,30 @@ func (a *att) removeConnection(handle uint16) error {
 	return nil
 }
 
+// setClientMTU records the MTU of a connection after an MTU exchange.
+func (a *att) setClientMTU(handle, mtu uint16) {
+	a.clientsMu.Lock()
+	defer a.clientsMu.Unlock()
+
+	if info, ok := a.clients[handle]; ok {
+		info.MTU = mtu
+		a.clients[handle] = info
+	}
+}
+
+// clientInfo returns the address and MTU of a connection. It doesn't need the
+// stack to be idle, so it can be called from read and write handlers.
+func (a *att) clientInfo(handle uint16) (ConnectionInfo, error) {
+	a.clientsMu.Lock()
+	defer a.clientsMu.Unlock()
+
+	info, ok := a.clients[handle]
+	if !ok {
+		return ConnectionInfo{}, errUnknownConnection
+	}
+	return info, nil
+}
+
 func (a *att) addLocalAttribute(typ attributeType, parent uint16, uuid UUID, permissions CharacteristicPermissions, value []byte) uint16 {
 	handle := a.lastHandle
 	a.attributes = append(a.attributes,
@@ -1145,6 +1830,15 @@ func (a *att) addLocalAttribute(typ attributeType, parent uint16, uuid UUID, per
 	return handle
 }
 
+// addLocalDescriptor adds a descriptor that the program configured to the
+// characteristic with the declaration at the parent handle.
+func (a *att) addLocalDescriptor(parent uint16, config DescriptorConfig) uint16 {
+	handle := a.addLocalAttribute(attributeTypeDescriptor, parent, config.UUID, 0, config.Value)
+	a.attributes[len(a.attributes)-1].descriptor = &config
+
+	return handle
+}
+
 func (a *att) addLocalService(start, end uint16, uuid UUID) {
 	a.localServices = append(a.localServices, rawService{
 		startHandle: start,
@@ -1201,3 +1895,54 @@ func (a *att) lastError(handle uint16) (uint8, uint16, uint8) {
 
 	return cd.lastErrorOpcode, cd.lastErrorHandle, cd.lastErrorCode
 }
+
+// attIsRequest returns whether the opcode is that of a request, which is
+// answered with a response or an error. Responses, notifications and
+// indications have odd opcodes, unknown opcodes are requests unless they are
+// commands.
+func attIsRequest(opcode uint8) bool {
+	switch {
+	case opcode&attCommandFlag != 0:
+		return false
+	case opcode <= attOpMultiHandleNotify && opcode&1 != 0:
+		return false
+	case opcode == attOpHandleCNF:
+		return false
+	}
+
+	return true
+}
+
+// attMinLength returns the shortest valid PDU with the opcode of a request or
+// command, or 1 for other PDUs.
+func attMinLength(opcode uint8) int {
+	switch opcode {
+	case attOpExecWriteReq:
+		return 2
+	case attOpMTUReq, attOpReadReq, attOpWriteReq, attOpWriteCmd:
+		return 3
+	case attOpFindInfoReq, attOpReadBlobReq, attOpReadMultiReq, attOpPrepWriteReq:
+		return 5
+	case attOpFindByTypeReq, attOpReadByTypeReq, attOpReadByGroupReq:
+		return 7
+	case attOpSignedWriteCmd:
+		return 3 + attSignatureLength
+	}
+
+	return 1
+}
+
+// attUUID parses a UUID in the 2 or 16 byte format of ATT PDUs.
+func attUUID(buf []byte) (UUID, bool) {
+	switch len(buf) {
+	case 2:
+		return New16BitUUID(binary.LittleEndian.Uint16(buf)), true
+	case 16:
+		var uuid [16]byte
+		copy(uuid[:], buf)
+		slices.Reverse(uuid[:])
+		return NewUUID(uuid), true
+	}
+
+	return UUID{}, false
+}
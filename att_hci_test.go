@@ -0,0 +1,626 @@
+//go:build hci && !baremetal
+
+package bluetooth
+
+import (
+	"bytes"
+	"encoding/binary"
+	"reflect"
+	"testing"
+)
+
+// attServer is a local GATT server with a single connection, that is tested
+// by passing ATT PDUs to the server and looking at the PDUs it sends back.
+type attServer struct {
+	adapter  *Adapter
+	recorder *packetRecorder
+	peer     MACAddress
+	writes   [][]byte
+
+	// reads counts the reads of the humidity, which fail with readError
+	// if it is set.
+	reads     int
+	readError error
+}
+
+// vendorDescriptorUUID is the UUID of a descriptor without a 16-bit UUID.
+var vendorDescriptorUUID = NewUUID([16]byte{0x00, 0x11, 0x22, 0x33, 0x44, 0x55, 0x66, 0x77,
+	0x88, 0x99, 0xaa, 0xbb, 0xcc, 0xdd, 0xee, 0xff})
+
+// newATTServer adds four services to a server:
+//
+//	0x0001 service 0x180d
+//	0x0002   characteristic 0x2a37
+//	0x0003     value "hr": read, notify
+//	0x0004     CCCD
+//	0x0005   characteristic 0x2a38
+//	0x0006     value "loc": read, write without response, signed write
+//	0x0007 service with a 128-bit UUID
+//	0x0008   characteristic 0x2a39
+//	0x0009     value "abc": read
+//	0x000a service 0x181c
+//	0x000b   characteristic 0x2a8a
+//	0x000c     value "secret": encrypted read, authenticated write of up to
+//	           8 bytes
+//	0x000d     user description "name": read
+//	0x000e     valid range 0-10: read, write
+//	0x000f     descriptor with a 128-bit UUID that is read from a callback
+//	0x0010 service 0x181a
+//	0x0011   characteristic 0x2a6f
+//	0x0012     humidity that is read from a callback: read
+func newATTServer(t *testing.T) *attServer {
+	t.Helper()
+
+	s := &attServer{
+		adapter:  &Adapter{},
+		recorder: &packetRecorder{},
+	}
+	s.adapter.hci, s.adapter.att = newBLEStack(s.recorder)
+	s.adapter.hci.aclMaxLen = 251
+	s.adapter.hci.aclBuf = make([]byte, 1+hciACLLenPos+251)
+
+	conn := hciConnection{handle: 1, peerBdaddr: [6]byte{0x01, 0x02, 0x03, 0x04, 0x05, 0x06}}
+	s.adapter.hci.connections = append(s.adapter.hci.connections, conn)
+	s.adapter.att.addConnection(conn)
+	s.adapter.hci.smp.addConnection(conn)
+	s.peer = MACAddress{MAC: makeAddress(conn.peerBdaddr)}
+
+	err := s.adapter.AddService(&Service{
+		UUID: ServiceUUIDHeartRate,
+		Characteristics: []CharacteristicConfig{
+			{
+				UUID:  CharacteristicUUIDHeartRateMeasurement,
+				Value: []byte("hr"),
+				Flags: CharacteristicReadPermission | CharacteristicNotifyPermission,
+			},
+			{
+				UUID:  CharacteristicUUIDBodySensorLocation,
+				Value: []byte("loc"),
+				Flags: CharacteristicReadPermission | CharacteristicWriteWithoutResponsePermission |
+					CharacteristicSignedWritePermission,
+				WriteEvent: func(client Connection, offset int, value []byte) {
+					if client != 1 || offset != 0 {
+						t.Errorf("unexpected write from %d at offset %d", client, offset)
+					}
+					s.writes = append(s.writes, append([]byte{}, value...))
+				},
+			},
+		},
+	})
+	if err != nil {
+		t.Fatal("could not add service:", err)
+	}
+	err = s.adapter.AddService(&Service{
+		UUID: NewUUID([16]byte{0x12, 0x34, 0x56, 0x78, 0x9a, 0xbc, 0xde, 0xf0,
+			0x12, 0x34, 0x56, 0x78, 0x9a, 0xbc, 0xde, 0xf0}),
+		Characteristics: []CharacteristicConfig{
+			{
+				UUID:  CharacteristicUUIDHeartRateControlPoint,
+				Value: []byte("abc"),
+				Flags: CharacteristicReadPermission,
+			},
+		},
+	})
+	if err != nil {
+		t.Fatal("could not add service:", err)
+	}
+	err = s.adapter.AddService(&Service{
+		UUID: ServiceUUIDUserData,
+		Characteristics: []CharacteristicConfig{
+			{
+				UUID:      CharacteristicUUIDFirstName,
+				Value:     []byte("secret"),
+				Flags:     CharacteristicReadPermission | CharacteristicWritePermission,
+				Security:  CharacteristicEncryptedRead | CharacteristicAuthenticatedWrite,
+				MaxLength: 8,
+				Descriptors: []DescriptorConfig{
+					{
+						UUID:  New16BitUUID(0x2901),
+						Value: []byte("name"),
+						Flags: DescriptorReadPermission,
+					},
+					{
+						UUID:  New16BitUUID(0x2906),
+						Value: []byte{0, 10},
+						Flags: DescriptorReadPermission | DescriptorWritePermission,
+						WriteEvent: func(client Connection, offset int, value []byte) {
+							s.writes = append(s.writes, append([]byte{}, value...))
+						},
+					},
+					{
+						UUID:  vendorDescriptorUUID,
+						Flags: DescriptorReadPermission,
+						ReadEvent: func(client Connection, offset int) ([]byte, error) {
+							value := []byte("dynamic")
+							if offset > len(value) {
+								return nil, errReadFailed
+							}
+							return value[offset:], nil
+						},
+					},
+				},
+			},
+		},
+	})
+	if err != nil {
+		t.Fatal("could not add service:", err)
+	}
+	err = s.adapter.AddService(&Service{
+		UUID: ServiceUUIDEnvironmentalSensing,
+		Characteristics: []CharacteristicConfig{
+			{
+				UUID:  CharacteristicUUIDHumidity,
+				Value: []byte{100},
+				Flags: CharacteristicReadPermission,
+				ReadEvent: func(client Connection, offset int) ([]byte, error) {
+					if client != 1 {
+						t.Errorf("unexpected read from %d", client)
+					}
+					if s.readError != nil {
+						return nil, s.readError
+					}
+					s.reads++
+					value := []byte{byte(90 - s.reads), '%'}
+					if offset > len(value) {
+						return nil, ATTErrorInvalidOffset
+					}
+					return value[offset:], nil
+				},
+			},
+		},
+	})
+	if err != nil {
+		t.Fatal("could not add service:", err)
+	}
+
+	return s
+}
+
+// request passes a PDU to the server, and returns its response or nil if it
+// didn't respond.
+func (s *attServer) request(t *testing.T, pdu ...byte) []byte {
+	t.Helper()
+
+	s.recorder.packets = nil
+	if err := s.adapter.att.handleData(1, pdu); err != nil {
+		t.Fatalf("could not handle %x: %v", pdu, err)
+	}
+
+	switch len(s.recorder.packets) {
+	case 0:
+		return nil
+	case 1:
+		// Skip the packet type, the ACL header and the L2CAP header.
+		return s.recorder.packets[0][9:]
+	default:
+		t.Fatalf("expected a single response to %x, got %x", pdu, s.recorder.packets)
+		return nil
+	}
+}
+
+// expect checks the response to each request, where a nil response means
+// that the server must not respond.
+func (s *attServer) expect(t *testing.T, tests []attExchange) {
+	t.Helper()
+
+	for _, tc := range tests {
+		if response := s.request(t, tc.request...); !bytes.Equal(response, tc.response) {
+			t.Errorf("%s: expected response %x to %x, got %x", tc.name, tc.response, tc.request, response)
+		}
+	}
+}
+
+type attExchange struct {
+	name     string
+	request  []byte
+	response []byte
+}
+
+func TestATTFindByTypeValue(t *testing.T) {
+	s := newATTServer(t)
+	s.expect(t, []attExchange{
+		{"16-bit service",
+			[]byte{attOpFindByTypeReq, 0x01, 0x00, 0xff, 0xff, 0x00, 0x28, 0x0d, 0x18},
+			[]byte{attOpFindByTypeResponse, 0x01, 0x00, 0x06, 0x00}},
+		{"128-bit service",
+			[]byte{attOpFindByTypeReq, 0x01, 0x00, 0xff, 0xff, 0x00, 0x28,
+				0xf0, 0xde, 0xbc, 0x9a, 0x78, 0x56, 0x34, 0x12, 0xf0, 0xde, 0xbc, 0x9a, 0x78, 0x56, 0x34, 0x12},
+			[]byte{attOpFindByTypeResponse, 0x07, 0x00, 0x09, 0x00}},
+		{"service out of range",
+			[]byte{attOpFindByTypeReq, 0x02, 0x00, 0xff, 0xff, 0x00, 0x28, 0x0d, 0x18},
+			[]byte{attOpError, attOpFindByTypeReq, 0x02, 0x00, attErrorAttrNotFound}},
+		{"unknown service",
+			[]byte{attOpFindByTypeReq, 0x01, 0x00, 0xff, 0xff, 0x00, 0x28, 0x0f, 0x18},
+			[]byte{attOpError, attOpFindByTypeReq, 0x01, 0x00, attErrorAttrNotFound}},
+		{"characteristic value",
+			[]byte{attOpFindByTypeReq, 0x01, 0x00, 0xff, 0xff, 0x37, 0x2a, 'h', 'r'},
+			[]byte{attOpFindByTypeResponse, 0x03, 0x00, 0x03, 0x00}},
+		{"different value",
+			[]byte{attOpFindByTypeReq, 0x01, 0x00, 0xff, 0xff, 0x37, 0x2a, 'h'},
+			[]byte{attOpError, attOpFindByTypeReq, 0x01, 0x00, attErrorAttrNotFound}},
+		{"start handle 0",
+			[]byte{attOpFindByTypeReq, 0x00, 0x00, 0xff, 0xff, 0x00, 0x28, 0x0d, 0x18},
+			[]byte{attOpError, attOpFindByTypeReq, 0x00, 0x00, attErrorInvalidHandle}},
+		{"start after end",
+			[]byte{attOpFindByTypeReq, 0x05, 0x00, 0x04, 0x00, 0x00, 0x28, 0x0d, 0x18},
+			[]byte{attOpError, attOpFindByTypeReq, 0x05, 0x00, attErrorInvalidHandle}},
+	})
+}
+
+func TestATTReadMultiple(t *testing.T) {
+	s := newATTServer(t)
+	s.expect(t, []attExchange{
+		{"values",
+			[]byte{attOpReadMultiReq, 0x03, 0x00, 0x06, 0x00, 0x09, 0x00},
+			[]byte{attOpReadMultiResponse, 'h', 'r', 'l', 'o', 'c', 'a', 'b', 'c'}},
+		{"declaration",
+			[]byte{attOpReadMultiReq, 0x03, 0x00, 0x02, 0x00},
+			[]byte{attOpError, attOpReadMultiReq, 0x02, 0x00, attErrorReadNotPermitted}},
+		{"unknown handle",
+			[]byte{attOpReadMultiReq, 0x03, 0x00, 0x20, 0x00},
+			[]byte{attOpError, attOpReadMultiReq, 0x20, 0x00, attErrorAttrNotFound}},
+		{"single handle",
+			[]byte{attOpReadMultiReq, 0x03, 0x00},
+			[]byte{attOpError, attOpReadMultiReq, 0x00, 0x00, attErrorInvalidPDU}},
+		{"odd length",
+			[]byte{attOpReadMultiReq, 0x03, 0x00, 0x06, 0x00, 0x09},
+			[]byte{attOpError, attOpReadMultiReq, 0x00, 0x00, attErrorInvalidPDU}},
+	})
+}
+
+func TestATTWriteCommand(t *testing.T) {
+	s := newATTServer(t)
+	s.expect(t, []attExchange{
+		{"write", []byte{attOpWriteCmd, 0x06, 0x00, 'n', 'e', 'w'}, nil},
+		{"read", []byte{attOpReadReq, 0x06, 0x00}, []byte{attOpReadResponse, 'n', 'e', 'w'}},
+
+		// Failed writes are dropped without a response.
+		{"not permitted", []byte{attOpWriteCmd, 0x03, 0x00, 'x'}, nil},
+		{"declaration", []byte{attOpWriteCmd, 0x05, 0x00, 'x'}, nil},
+		{"unknown handle", []byte{attOpWriteCmd, 0x20, 0x00, 'x'}, nil},
+		{"unchanged", []byte{attOpReadReq, 0x03, 0x00}, []byte{attOpReadResponse, 'h', 'r'}},
+	})
+
+	if len(s.writes) != 1 || string(s.writes[0]) != "new" {
+		t.Errorf("expected a single write event, got %q", s.writes)
+	}
+}
+
+func TestATTSignedWrite(t *testing.T) {
+	s := newATTServer(t)
+	csrk := [16]byte{0x11, 0x22, 0x33, 0x44, 15: 0xff}
+
+	signed := func(counter uint32, value string) []byte {
+		pdu := append([]byte{attOpSignedWriteCmd, 0x06, 0x00}, value...)
+		signature := smpSign(csrk, pdu, counter)
+		return append(pdu, signature[:]...)
+	}
+
+	// Without a bond, the signature can't be checked.
+	s.request(t, signed(1, "unbonded")...)
+	if len(s.writes) != 0 {
+		t.Fatalf("unexpected write without bond: %q", s.writes)
+	}
+
+	if err := s.adapter.hci.smp.store.SaveBond(Bond{Address: s.peer, CSRK: csrk}); err != nil {
+		t.Fatal("could not save bond:", err)
+	}
+	invalid := signed(3, "invalid")
+	invalid[len(invalid)-1] ^= 0x01
+	s.expect(t, []attExchange{
+		{"first", signed(2, "first"), nil},
+		{"replayed", signed(2, "replayed"), nil},
+		{"invalid signature", invalid, nil},
+		{"lower counter", signed(1, "lower"), nil},
+		{"second", signed(10, "second"), nil},
+		{"read", []byte{attOpReadReq, 0x06, 0x00}, []byte{attOpReadResponse, 's', 'e', 'c', 'o', 'n', 'd'}},
+	})
+	if len(s.writes) != 2 || string(s.writes[0]) != "first" || string(s.writes[1]) != "second" {
+		t.Errorf("expected two signed writes, got %q", s.writes)
+	}
+
+	// Characteristics need the permission for signed writes.
+	pdu := append([]byte{attOpSignedWriteCmd, 0x09, 0x00}, 'x')
+	signature := smpSign(csrk, pdu, 20)
+	s.request(t, append(pdu, signature[:]...)...)
+	if response := s.request(t, attOpReadReq, 0x09, 0x00); string(response[1:]) != "abc" {
+		t.Errorf("expected the value to be unchanged, got %q", response[1:])
+	}
+}
+
+func TestATTInvalidPDUs(t *testing.T) {
+	s := newATTServer(t)
+	s.expect(t, []attExchange{
+		{"unknown request",
+			[]byte{0x30, 0x01, 0x02},
+			[]byte{attOpError, 0x30, 0x00, 0x00, attErrorRequestNotSupported}},
+		{"unknown command", []byte{0x70, 0x01, 0x02}, nil},
+		{"unexpected find by type value response",
+			[]byte{attOpFindByTypeResponse, 0x01, 0x00, 0x03, 0x00}, nil},
+		{"unexpected read multiple response", []byte{attOpReadMultiResponse, 'x'}, nil},
+		{"multiple handle value notification",
+			[]byte{attOpMultiHandleNotify, 0x03, 0x00, 0x01, 0x00, 'x'}, nil},
+		{"short read request",
+			[]byte{attOpReadReq, 0x03},
+			[]byte{attOpError, attOpReadReq, 0x00, 0x00, attErrorInvalidPDU}},
+		{"short find by type value request",
+			[]byte{attOpFindByTypeReq, 0x01, 0x00, 0xff, 0xff, 0x00},
+			[]byte{attOpError, attOpFindByTypeReq, 0x00, 0x00, attErrorInvalidPDU}},
+		{"short write command", []byte{attOpWriteCmd, 0x06}, nil},
+		{"short signed write command", []byte{attOpSignedWriteCmd, 0x06, 0x00, 0x01}, nil},
+		{"short CCCD write",
+			[]byte{attOpWriteReq, 0x04, 0x00, 0x01},
+			[]byte{attOpError, attOpWriteReq, 0x04, 0x00, attErrorInvalidAttrValueLength}},
+		{"empty PDU", []byte{}, nil},
+	})
+}
+
+func TestATTSecurity(t *testing.T) {
+	s := newATTServer(t)
+	link := s.adapter.hci.smp.findConnection(1)
+	s.expect(t, []attExchange{
+		{"unencrypted read",
+			[]byte{attOpReadReq, 0x0c, 0x00},
+			[]byte{attOpError, attOpReadReq, 0x0c, 0x00, attErrorInsuffEnc}},
+		{"unencrypted read multiple",
+			[]byte{attOpReadMultiReq, 0x03, 0x00, 0x0c, 0x00},
+			[]byte{attOpError, attOpReadMultiReq, 0x0c, 0x00, attErrorInsuffEnc}},
+		{"unencrypted find by type value",
+			[]byte{attOpFindByTypeReq, 0x01, 0x00, 0xff, 0xff, 0x8a, 0x2a, 's', 'e', 'c', 'r', 'e', 't'},
+			[]byte{attOpError, attOpFindByTypeReq, 0x01, 0x00, attErrorAttrNotFound}},
+		{"unencrypted write",
+			[]byte{attOpWriteReq, 0x0c, 0x00, 'x'},
+			[]byte{attOpError, attOpWriteReq, 0x0c, 0x00, attErrorAuthentication}},
+		{"unencrypted prepared write",
+			[]byte{attOpPrepWriteReq, 0x0c, 0x00, 0x00, 0x00, 'x'},
+			[]byte{attOpError, attOpPrepWriteReq, 0x0c, 0x00, attErrorAuthentication}},
+
+		// Without the permission, writes fail regardless of the security.
+		{"write request without permission",
+			[]byte{attOpWriteReq, 0x06, 0x00, 'x'},
+			[]byte{attOpError, attOpWriteReq, 0x06, 0x00, attErrorWriteNotPermitted}},
+	})
+
+	link.security = securityEncrypted
+	s.expect(t, []attExchange{
+		{"encrypted read",
+			[]byte{attOpReadReq, 0x0c, 0x00},
+			[]byte{attOpReadResponse, 's', 'e', 'c', 'r', 'e', 't'}},
+		{"encrypted write",
+			[]byte{attOpWriteReq, 0x0c, 0x00, 'x'},
+			[]byte{attOpError, attOpWriteReq, 0x0c, 0x00, attErrorAuthentication}},
+	})
+
+	link.security = securityAuthenticated
+	s.expect(t, []attExchange{
+		{"authenticated write",
+			[]byte{attOpWriteReq, 0x0c, 0x00, '1', '2', '3', '4', '5', '6', '7', '8'},
+			[]byte{attOpWriteResponse}},
+		{"too long",
+			[]byte{attOpWriteReq, 0x0c, 0x00, '1', '2', '3', '4', '5', '6', '7', '8', '9'},
+			[]byte{attOpError, attOpWriteReq, 0x0c, 0x00, attErrorInvalidAttrValueLength}},
+		{"prepare write",
+			[]byte{attOpPrepWriteReq, 0x0c, 0x00, 0x04, 0x00, '5', '6', '7', '8', '9'},
+			[]byte{attOpPrepWriteResponse, 0x0c, 0x00, 0x04, 0x00, '5', '6', '7', '8', '9'}},
+		{"too long when executed",
+			[]byte{attOpExecWriteReq, 0x01},
+			[]byte{attOpError, attOpExecWriteReq, 0x0c, 0x00, attErrorInvalidAttrValueLength}},
+		{"read",
+			[]byte{attOpReadReq, 0x0c, 0x00},
+			[]byte{attOpReadResponse, '1', '2', '3', '4', '5', '6', '7', '8'}},
+	})
+}
+
+func TestATTAuthorization(t *testing.T) {
+	s := newATTServer(t)
+	authorized := false
+	var accesses []bool
+	err := s.adapter.AddService(&Service{
+		UUID: ServiceUUIDAutomationIO,
+		Characteristics: []CharacteristicConfig{
+			{
+				UUID:     CharacteristicUUIDDigital,
+				Value:    []byte("on"),
+				Flags:    CharacteristicReadPermission | CharacteristicWritePermission,
+				Security: CharacteristicAuthorizedRead | CharacteristicAuthorizedWrite,
+				AuthorizeEvent: func(client Connection, write bool) bool {
+					if client != 1 {
+						t.Errorf("unexpected authorization of %d", client)
+					}
+					accesses = append(accesses, write)
+					return authorized
+				},
+				Descriptors: []DescriptorConfig{
+					{
+						UUID:     New16BitUUID(0x2901),
+						Value:    []byte("switch"),
+						Flags:    DescriptorReadPermission | DescriptorWritePermission,
+						Security: CharacteristicAuthorizedWrite,
+					},
+				},
+			},
+		},
+	})
+	if err != nil {
+		t.Fatal("could not add service:", err)
+	}
+
+	// The service starts at 0x0013, the value is at 0x0015 and the user
+	// description at 0x0016.
+	s.expect(t, []attExchange{
+		{"unauthorized read",
+			[]byte{attOpReadReq, 0x15, 0x00},
+			[]byte{attOpError, attOpReadReq, 0x15, 0x00, attErrorAuthorization}},
+		{"unauthorized write",
+			[]byte{attOpWriteReq, 0x15, 0x00, 'x'},
+			[]byte{attOpError, attOpWriteReq, 0x15, 0x00, attErrorAuthorization}},
+		{"unauthorized prepared write",
+			[]byte{attOpPrepWriteReq, 0x15, 0x00, 0x00, 0x00, 'x'},
+			[]byte{attOpError, attOpPrepWriteReq, 0x15, 0x00, attErrorAuthorization}},
+
+		// Without an authorize handler, writes of the descriptor always fail.
+		{"descriptor read",
+			[]byte{attOpReadReq, 0x16, 0x00},
+			[]byte{attOpReadResponse, 's', 'w', 'i', 't', 'c', 'h'}},
+		{"unauthorized descriptor write",
+			[]byte{attOpWriteReq, 0x16, 0x00, 'x'},
+			[]byte{attOpError, attOpWriteReq, 0x16, 0x00, attErrorAuthorization}},
+	})
+	if expected := []bool{false, true, true}; !reflect.DeepEqual(accesses, expected) {
+		t.Errorf("expected authorizations %v, got %v", expected, accesses)
+	}
+
+	authorized = true
+	s.expect(t, []attExchange{
+		{"authorized write",
+			[]byte{attOpWriteReq, 0x15, 0x00, 'o', 'f', 'f'},
+			[]byte{attOpWriteResponse}},
+		{"authorized read",
+			[]byte{attOpReadReq, 0x15, 0x00},
+			[]byte{attOpReadResponse, 'o', 'f', 'f'}},
+	})
+}
+
+func TestATTDescriptors(t *testing.T) {
+	s := newATTServer(t)
+	vendorUUID := vendorDescriptorUUID.Bytes()
+	s.expect(t, []attExchange{
+		{"find information",
+			[]byte{attOpFindInfoReq, 0x0d, 0x00, 0xff, 0xff},
+			[]byte{attOpFindInfoResponse, 0x01, 0x0d, 0x00, 0x01, 0x29, 0x0e, 0x00, 0x06, 0x29}},
+		{"find information with 128-bit UUID",
+			[]byte{attOpFindInfoReq, 0x0f, 0x00, 0x0f, 0x00},
+			append([]byte{attOpFindInfoResponse, 0x02, 0x0f, 0x00}, vendorUUID[:]...)},
+
+		{"read",
+			[]byte{attOpReadReq, 0x0d, 0x00},
+			[]byte{attOpReadResponse, 'n', 'a', 'm', 'e'}},
+		{"read blob",
+			[]byte{attOpReadBlobReq, 0x0d, 0x00, 0x02, 0x00},
+			[]byte{attOpReadBlobResponse, 'm', 'e'}},
+		{"invalid offset",
+			[]byte{attOpReadBlobReq, 0x0d, 0x00, 0x05, 0x00},
+			[]byte{attOpError, attOpReadBlobReq, 0x0d, 0x00, attErrorInvalidOffset}},
+		{"write without permission",
+			[]byte{attOpWriteReq, 0x0d, 0x00, 'x'},
+			[]byte{attOpError, attOpWriteReq, 0x0d, 0x00, attErrorWriteNotPermitted}},
+
+		{"write",
+			[]byte{attOpWriteReq, 0x0e, 0x00, 0x01, 0x05},
+			[]byte{attOpWriteResponse}},
+		{"read written value",
+			[]byte{attOpReadReq, 0x0e, 0x00},
+			[]byte{attOpReadResponse, 0x01, 0x05}},
+
+		{"read from callback",
+			[]byte{attOpReadReq, 0x0f, 0x00},
+			[]byte{attOpReadResponse, 'd', 'y', 'n', 'a', 'm', 'i', 'c'}},
+		{"read blob from callback",
+			[]byte{attOpReadBlobReq, 0x0f, 0x00, 0x03, 0x00},
+			[]byte{attOpReadBlobResponse, 'a', 'm', 'i', 'c'}},
+		{"callback error",
+			[]byte{attOpReadBlobReq, 0x0f, 0x00, 0x08, 0x00},
+			[]byte{attOpError, attOpReadBlobReq, 0x0f, 0x00, attErrorReadNotPermitted}},
+
+		// The CCCD is still handled by the server.
+		{"write CCCD",
+			[]byte{attOpWriteReq, 0x04, 0x00, 0x01, 0x00},
+			[]byte{attOpWriteResponse}},
+		{"read CCCD",
+			[]byte{attOpReadReq, 0x04, 0x00},
+			[]byte{attOpReadResponse, 0x01, 0x00}},
+	})
+
+	if len(s.writes) != 1 || !bytes.Equal(s.writes[0], []byte{0x01, 0x05}) {
+		t.Errorf("expected a single write event, got %x", s.writes)
+	}
+}
+
+func TestATTReadEvent(t *testing.T) {
+	s := newATTServer(t)
+	s.expect(t, []attExchange{
+		{"read",
+			[]byte{attOpReadReq, 0x12, 0x00},
+			[]byte{attOpReadResponse, 89, '%'}},
+		{"read again",
+			[]byte{attOpReadReq, 0x12, 0x00},
+			[]byte{attOpReadResponse, 88, '%'}},
+		{"read blob",
+			[]byte{attOpReadBlobReq, 0x12, 0x00, 0x01, 0x00},
+			[]byte{attOpReadBlobResponse, '%'}},
+		{"invalid offset",
+			[]byte{attOpReadBlobReq, 0x12, 0x00, 0x03, 0x00},
+			[]byte{attOpError, attOpReadBlobReq, 0x12, 0x00, attErrorInvalidOffset}},
+		{"read multiple",
+			[]byte{attOpReadMultiReq, 0x12, 0x00, 0x09, 0x00},
+			[]byte{attOpReadMultiResponse, 85, '%', 'a', 'b', 'c'}},
+	})
+
+	for _, tc := range []struct {
+		err  error
+		code uint8
+	}{
+		{ATTErrorInsufficientAuthorization, attErrorAuthorization},
+		{ATTErrorApplication + 1, 0x81},
+		{errReadFailed, attErrorReadNotPermitted},
+	} {
+		s.readError = tc.err
+		s.expect(t, []attExchange{
+			{tc.err.Error(),
+				[]byte{attOpReadReq, 0x12, 0x00},
+				[]byte{attOpError, attOpReadReq, 0x12, 0x00, tc.code}},
+		})
+	}
+}
+
+func TestATTClients(t *testing.T) {
+	s := newATTServer(t)
+	conn := hciConnection{handle: 2, peerBdaddrType: 0x01, peerBdaddr: [6]byte{0x11, 0x12, 0x13, 0x14, 0x15, 0xc6}}
+	s.adapter.hci.connections = append(s.adapter.hci.connections, conn)
+	s.adapter.att.addConnection(conn)
+	s.adapter.hci.smp.addConnection(conn)
+
+	expected := ConnectionInfo{
+		Address:  Address{MACAddress{MAC: makeAddress(conn.peerBdaddr), isRandom: true}},
+		MTU:      defaultMTU,
+		LinkType: LinkTypeLE,
+	}
+	if info, err := s.adapter.ConnectionInfo(2); err != nil || info != expected {
+		t.Errorf("expected %+v, got %+v (%v)", expected, info, err)
+	}
+	if err := s.adapter.att.handleData(2, []byte{attOpMTUReq, 100, 0}); err != nil {
+		t.Fatal("could not exchange MTU:", err)
+	}
+	expected.MTU = 100
+	if info, err := s.adapter.ConnectionInfo(2); err != nil || info != expected {
+		t.Errorf("expected %+v after the MTU exchange, got %+v (%v)", expected, info, err)
+	}
+	if info, err := s.adapter.ConnectionInfo(1); err != nil || info.Address.MACAddress != s.peer || info.MTU != defaultMTU {
+		t.Errorf("unexpected info for the first connection: %+v (%v)", info, err)
+	}
+
+	// Only the second client enables notifications.
+	if err := s.adapter.att.handleData(2, []byte{attOpWriteReq, 0x04, 0x00, 0x01, 0x00}); err != nil {
+		t.Fatal("could not write CCCD:", err)
+	}
+	s.expect(t, []attExchange{
+		{"CCCD of the first client",
+			[]byte{attOpReadReq, 0x04, 0x00},
+			[]byte{attOpReadResponse, 0x00, 0x00}},
+	})
+
+	s.recorder.packets = nil
+	if _, err := s.adapter.att.findCharacteristic(0x0002).chr.Write([]byte("72")); err != nil {
+		t.Fatal("could not write characteristic:", err)
+	}
+	if len(s.recorder.packets) != 1 || binary.LittleEndian.Uint16(s.recorder.packets[0][1:])&0x0fff != 2 ||
+		!bytes.Equal(s.recorder.packets[0][9:], []byte{attOpHandleNotify, 0x03, 0x00, '7', '2'}) {
+		t.Errorf("expected a single notification to the second client, got %x", s.recorder.packets)
+	}
+
+	// The state of a client is gone with its connection.
+	s.adapter.att.removeConnection(2)
+	if _, err := s.adapter.ConnectionInfo(2); err != errUnknownConnection {
+		t.Errorf("expected %v after the disconnection, got %v", errUnknownConnection, err)
+	}
+}
@@ -0,0 +1,168 @@
+package bluetooth
+
+import "errors"
+
+var (
+	errBondNotFound  = errors.New("bluetooth: no bond with this device")
+	errBondStoreFull = errors.New("bluetooth: bond store is full")
+)
+
+// memoryBondStoreSize is the number of bonds a store from NewMemoryBondStore
+// has room for. It is the number of device identities the SoftDevice can
+// resolve.
+const memoryBondStoreSize = 8
+
+// Bond contains the keys that were exchanged with a device during pairing, so
+// that later connections to the device can be encrypted without pairing again.
+// Keys are in the order in which they are sent over the air: the least
+// significant octet comes first.
+type Bond struct {
+	// Address is the identity address of the device: the address it sent
+	// during pairing, or else the address it was connected with.
+	Address MACAddress
+
+	// LTK is the Long Term Key that encrypts connections. EDIV and Rand
+	// identify the key, they are zero for keys created with LE Secure
+	// Connections.
+	LTK  [16]byte
+	EDIV uint16
+	Rand uint64
+
+	// IRK is the Identity Resolving Key of the device, which resolves its
+	// private addresses. It is zero if the device didn't send it.
+	IRK [16]byte
+
+	// CSRK is the Connection Signature Resolving Key of the device, which
+	// checks signed writes. It is zero if the device didn't send it.
+	CSRK [16]byte
+
+	// Authenticated is set if pairing was protected against man-in-the-middle
+	// attacks, SecureConnections if it used LE Secure Connections.
+	Authenticated     bool
+	SecureConnections bool
+}
+
+// BondStore keeps the bonds of an adapter. The adapter looks up a bond when a
+// connection is encrypted, and saves it once pairing has finished.
+//
+// On the Nordic SoftDevice, the adapter uses the store from the event handler,
+// which runs in an interrupt. Bond and SaveBond must not allocate memory or
+// block there.
+type BondStore interface {
+	// Bond returns the bond with the device with the given identity address,
+	// and whether there is one.
+	Bond(address MACAddress) (Bond, bool)
+
+	// Bonds returns all bonds in the store.
+	Bonds() ([]Bond, error)
+
+	// SaveBond adds the bond to the store, replacing an earlier bond with the
+	// same device.
+	SaveBond(bond Bond) error
+
+	// DeleteBond removes the bond with the device with the given identity
+	// address.
+	DeleteBond(address MACAddress) error
+}
+
+// MemoryBondStore is a BondStore that keeps bonds in memory, so that they are
+// lost when the program exits. It is the default BondStore of an adapter.
+//
+// The zero value grows as bonds are saved. A store returned by
+// NewMemoryBondStore has a fixed size instead.
+type MemoryBondStore struct {
+	bonds []Bond
+	fixed bool
+}
+
+// NewMemoryBondStore returns an empty bond store with room for 8 bonds. It
+// never allocates memory when saving a bond, so it can be used from an
+// interrupt. SaveBond returns an error once it is full.
+func NewMemoryBondStore() *MemoryBondStore {
+	return &MemoryBondStore{
+		bonds: make([]Bond, 0, memoryBondStoreSize),
+		fixed: true,
+	}
+}
+
+// Bond returns the bond with the device with the given identity address.
+func (s *MemoryBondStore) Bond(address MACAddress) (Bond, bool) {
+	if i := s.find(address); i >= 0 {
+		return s.bonds[i], true
+	}
+
+	return Bond{}, false
+}
+
+// Bonds returns a copy of all bonds in the store.
+func (s *MemoryBondStore) Bonds() ([]Bond, error) {
+	return append([]Bond(nil), s.bonds...), nil
+}
+
+// SaveBond adds the bond to the store, replacing an earlier bond with the
+// same device. It returns an error if a fixed size store is full.
+func (s *MemoryBondStore) SaveBond(bond Bond) error {
+	if i := s.find(bond.Address); i >= 0 {
+		s.bonds[i] = bond
+		return nil
+	}
+	if s.fixed && len(s.bonds) == cap(s.bonds) {
+		return errBondStoreFull
+	}
+
+	s.bonds = append(s.bonds, bond)
+	return nil
+}
+
+// DeleteBond removes the bond with the device with the given identity
+// address.
+func (s *MemoryBondStore) DeleteBond(address MACAddress) error {
+	i := s.find(address)
+	if i < 0 {
+		return errBondNotFound
+	}
+
+	s.bonds = append(s.bonds[:i], s.bonds[i+1:]...)
+	return nil
+}
+
+func (s *MemoryBondStore) find(address MACAddress) int {
+	for i := range s.bonds {
+		if s.bonds[i].Address == address {
+			return i
+		}
+	}
+
+	return -1
+}
+
+// resolveBond returns the bond with the device with the given address. A
+// resolvable private address is resolved with the IRKs of the bonds if no
+// bond has this address.
+func resolveBond(store BondStore, address MACAddress) (Bond, bool) {
+	if store == nil {
+		return Bond{}, false
+	}
+	if bond, ok := store.Bond(address); ok {
+		return bond, true
+	}
+	if address.Type() != AddressResolvablePrivate {
+		return Bond{}, false
+	}
+
+	bonds, err := store.Bonds()
+	if err != nil {
+		return Bond{}, false
+	}
+	for _, bond := range bonds {
+		// A zero IRK means the device didn't send one.
+		if bond.IRK == ([16]byte{}) {
+			continue
+		}
+		if _, ok := address.Resolve([][16]byte{bond.IRK}); ok {
+			return bond, true
+		}
+	}
+
+	return Bond{}, false
+}
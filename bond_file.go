@@ -0,0 +1,159 @@
+//go:build !baremetal
+
+package bluetooth
+
+import (
+	"encoding/hex"
+	"encoding/json"
+	"errors"
+	"os"
+)
+
+// FileBondStore is a BondStore that keeps bonds in a JSON file, so that
+// devices can reconnect encrypted after the program restarts. The file holds
+// secret keys, it is only readable by the current user.
+type FileBondStore struct {
+	path   string
+	memory MemoryBondStore
+}
+
+// fileBond is the JSON representation of a Bond.
+type fileBond struct {
+	Address           string `json:"address"`
+	Random            bool   `json:"random,omitempty"`
+	LTK               string `json:"ltk"`
+	EDIV              uint16 `json:"ediv,omitempty"`
+	Rand              uint64 `json:"rand,omitempty"`
+	IRK               string `json:"irk,omitempty"`
+	CSRK              string `json:"csrk,omitempty"`
+	Authenticated     bool   `json:"authenticated,omitempty"`
+	SecureConnections bool   `json:"secureConnections,omitempty"`
+}
+
+// NewFileBondStore returns a bond store that keeps bonds in the file at the
+// given path. The bonds in the file are loaded right away. The file doesn't
+// need to exist yet, it is created when the first bond is saved.
+func NewFileBondStore(path string) (*FileBondStore, error) {
+	s := &FileBondStore{path: path}
+
+	data, err := os.ReadFile(path)
+	if errors.Is(err, os.ErrNotExist) {
+		return s, nil
+	}
+	if err != nil {
+		return nil, err
+	}
+
+	var bonds []fileBond
+	if err := json.Unmarshal(data, &bonds); err != nil {
+		return nil, err
+	}
+	for _, b := range bonds {
+		mac, err := ParseMAC(b.Address)
+		if err != nil {
+			return nil, err
+		}
+		bond := Bond{
+			Address:           MACAddress{MAC: mac, isRandom: b.Random},
+			EDIV:              b.EDIV,
+			Rand:              b.Rand,
+			Authenticated:     b.Authenticated,
+			SecureConnections: b.SecureConnections,
+		}
+		for _, key := range []struct {
+			dst *[16]byte
+			src string
+		}{{&bond.LTK, b.LTK}, {&bond.IRK, b.IRK}, {&bond.CSRK, b.CSRK}} {
+			if err := decodeKey(key.dst, key.src); err != nil {
+				return nil, err
+			}
+		}
+		s.memory.SaveBond(bond)
+	}
+
+	return s, nil
+}
+
+// decodeKey decodes a key in hex, an empty string is a zero key.
+func decodeKey(key *[16]byte, s string) error {
+	if s == "" {
+		return nil
+	}
+
+	b, err := hex.DecodeString(s)
+	if err != nil {
+		return err
+	}
+	if len(b) != len(key) {
+		return errors.New("bluetooth: invalid key length in bond file")
+	}
+	copy(key[:], b)
+
+	return nil
+}
+
+// encodeKey encodes a key in hex, a zero key is an empty string.
+func encodeKey(key [16]byte) string {
+	if key == [16]byte{} {
+		return ""
+	}
+
+	return hex.EncodeToString(key[:])
+}
+
+// Bond returns the bond with the device with the given identity address.
+func (s *FileBondStore) Bond(address MACAddress) (Bond, bool) {
+	return s.memory.Bond(address)
+}
+
+// Bonds returns all bonds in the store.
+func (s *FileBondStore) Bonds() ([]Bond, error) {
+	return s.memory.Bonds()
+}
+
+// SaveBond adds the bond to the store and writes the file.
+func (s *FileBondStore) SaveBond(bond Bond) error {
+	s.memory.SaveBond(bond)
+	return s.write()
+}
+
+// DeleteBond removes the bond with the device from the store and writes the
+// file.
+func (s *FileBondStore) DeleteBond(address MACAddress) error {
+	if err := s.memory.DeleteBond(address); err != nil {
+		return err
+	}
+
+	return s.write()
+}
+
+// write replaces the file with the bonds in memory. The new file is written
+// next to it first, so that a crash doesn't leave a partial file behind.
+func (s *FileBondStore) write() error {
+	bonds := make([]fileBond, len(s.memory.bonds))
+	for i, bond := range s.memory.bonds {
+		bonds[i] = fileBond{
+			Address:           bond.Address.MAC.String(),
+			Random:            bond.Address.isRandom,
+			LTK:               hex.EncodeToString(bond.LTK[:]),
+			EDIV:              bond.EDIV,
+			Rand:              bond.Rand,
+			IRK:               encodeKey(bond.IRK),
+			CSRK:              encodeKey(bond.CSRK),
+			Authenticated:     bond.Authenticated,
+			SecureConnections: bond.SecureConnections,
+		}
+	}
+
+	data, err := json.MarshalIndent(bonds, "", "\t")
+	if err != nil {
+		return err
+	}
+
+	tmp := s.path + ".tmp"
+	if err := os.WriteFile(tmp, append(data, '\n'), 0o600); err != nil {
+		return err
+	}
+
+	return os.Rename(tmp, s.path)
+}
@@ -0,0 +1,113 @@
+//go:build !baremetal
+
+package bluetooth
+
+import (
+	"os"
+	"path/filepath"
+	"reflect"
+	"testing"
+)
+
+func TestFileBondStore(t *testing.T) {
+	path := filepath.Join(t.TempDir(), "bonds.json")
+	store, err := NewFileBondStore(path)
+	if err != nil {
+		t.Fatal("could not open missing bond file:", err)
+	}
+
+	bonds := []Bond{
+		{
+			Address:           MACAddress{MAC: MAC{0x66, 0x55, 0x44, 0x33, 0x22, 0x11}},
+			LTK:               [16]byte{1, 2, 3, 4, 5, 6, 7, 8, 9, 10, 11, 12, 13, 14, 15, 16},
+			EDIV:              0x1234,
+			Rand:              0x0123456789abcdef,
+			Authenticated:     true,
+			SecureConnections: false,
+		},
+		{
+			Address:           MACAddress{MAC: MAC{0x01, 0x00, 0x00, 0x00, 0x00, 0xc0}, isRandom: true},
+			LTK:               [16]byte{0xff, 15: 0x01},
+			IRK:               [16]byte{0xaa, 15: 0xbb},
+			CSRK:              [16]byte{0xcc, 15: 0xdd},
+			SecureConnections: true,
+		},
+	}
+	for _, bond := range bonds {
+		if err := store.SaveBond(bond); err != nil {
+			t.Fatal("could not save bond:", err)
+		}
+	}
+
+	info, err := os.Stat(path)
+	if err != nil {
+		t.Fatal("bond file not written:", err)
+	}
+	if info.Mode().Perm()&0o077 != 0 {
+		t.Errorf("bond file is readable by others: %v", info.Mode())
+	}
+
+	// Another store reads the same bonds from the file.
+	store, err = NewFileBondStore(path)
+	if err != nil {
+		t.Fatal("could not read bond file:", err)
+	}
+	loaded, err := store.Bonds()
+	if err != nil {
+		t.Fatal("could not list bonds:", err)
+	}
+	if !reflect.DeepEqual(loaded, bonds) {
+		t.Errorf("unexpected bonds:\nexpected: %+v\nactual:   %+v", bonds, loaded)
+	}
+	if _, ok := store.Bond(MACAddress{MAC: bonds[1].Address.MAC}); ok {
+		t.Error("found a bond for a public address with the same value as a random address")
+	}
+
+	// Saving a bond with the same device replaces it, deleting it removes it
+	// from the file.
+	bonds[0].LTK[0] = 0xee
+	if err := store.SaveBond(bonds[0]); err != nil {
+		t.Fatal("could not save bond:", err)
+	}
+	if err := store.DeleteBond(bonds[1].Address); err != nil {
+		t.Fatal("could not delete bond:", err)
+	}
+	if err := store.DeleteBond(bonds[1].Address); err != errBondNotFound {
+		t.Errorf("expected error for deleting a missing bond, got %v", err)
+	}
+	store, err = NewFileBondStore(path)
+	if err != nil {
+		t.Fatal("could not read bond file:", err)
+	}
+	loaded, _ = store.Bonds()
+	if !reflect.DeepEqual(loaded, bonds[:1]) {
+		t.Errorf("unexpected bonds:\nexpected: %+v\nactual:   %+v", bonds[:1], loaded)
+	}
+}
+
+func TestMemoryBondStoreFull(t *testing.T) {
+	store := NewMemoryBondStore()
+	for i := 0; i < memoryBondStoreSize; i++ {
+		if err := store.SaveBond(Bond{Address: MACAddress{MAC: MAC{byte(i)}}}); err != nil {
+			t.Fatal("could not save bond:", err)
+		}
+	}
+	if err := store.SaveBond(Bond{Address: MACAddress{MAC: MAC{0xff}}}); err != errBondStoreFull {
+		t.Errorf("expected error for a full store, got %v", err)
+	}
+
+	// A bond with a known device still replaces the earlier one, and deleting
+	// a bond makes room for another.
+	if err := store.SaveBond(Bond{Address: MACAddress{MAC: MAC{0}}, EDIV: 1}); err != nil {
+		t.Error("could not replace bond:", err)
+	}
+	if err := store.DeleteBond(MACAddress{MAC: MAC{1}}); err != nil {
+		t.Fatal("could not delete bond:", err)
+	}
+	if err := store.SaveBond(Bond{Address: MACAddress{MAC: MAC{0xff}}}); err != nil {
+		t.Error("could not save bond after deleting one:", err)
+	}
+	if bonds, _ := store.Bonds(); len(bonds) != memoryBondStoreSize {
+		t.Errorf("expected %d bonds, got %d", memoryBondStoreSize, len(bonds))
+	}
+}
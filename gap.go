@@ -9,6 +9,14 @@ var (
 	errScanning                  = errors.New("bluetooth: a scan is already in progress")
 	errNotScanning               = errors.New("bluetooth: there is no scan in progress")
 	errAdvertisementPacketTooBig = errors.New("bluetooth: advertisement packet overflows")
+	errExtendedScanResponse      = errors.New("bluetooth: extended advertisements have no scan response")
+	errInvalidDataLength         = errors.New("bluetooth: data length must be between 27 and 251 bytes")
+	errInvalidMTU                = errors.New("bluetooth: MTU must be between 23 and 517 bytes")
+	errUnknownConnection         = errors.New("bluetooth: unknown connection")
+
+	// ErrNotSupported is returned by operations that are not available on the
+	// current platform.
+	ErrNotSupported = errors.New("bluetooth: not supported on this platform")
 )
 
 // MACAddress contains a Bluetooth address which is a MAC address.
@@ -59,7 +67,66 @@ type AdvertisementOptions struct {
 
 	// ServiceData stores Advertising Data.
 	ServiceData []ServiceDataElement
-}
+
+	// ScanResponse contains the fields that are sent in the scan response,
+	// which a central requests when it does an active scan. Like the
+	// advertisement packet, the scan response can hold up to 31 bytes.
+	ScanResponse AdvertisementFields
+
+	// AutoScanResponse moves fields that don't fit in the advertisement packet
+	// to the scan response, instead of failing with an error. The local name
+	// is placed last so that it is the first field to be moved, and it is
+	// shortened if it doesn't fit in either packet.
+	AutoScanResponse bool
+
+	// NonConnectable advertises without accepting connections, for example
+	// for a beacon.
+	NonConnectable bool
+
+	// AdvertiseWhileConnected continues a connectable advertisement after a
+	// central has connected, so that more centrals can connect. By default
+	// the advertisement is resumed once the connection is closed. This is
+	// only supported by the HCI backend.
+	AdvertiseWhileConnected bool
+
+	// Extended uses extended advertising (Bluetooth 5), which allows up to
+	// 1650 bytes of advertisement data and other PHYs than 1M. Extended
+	// advertisements have no scan response, and are only received by scanners
+	// that support extended advertising. Extended advertisements with more
+	// data than fits in a single packet (about 250 bytes) must be
+	// non-connectable.
+	Extended bool
+
+	// PrimaryPHY is the PHY used on the primary advertising channels, PHY1M or
+	// PHYCoded. SecondaryPHY is the PHY of the packets that carry the data.
+	// They are only used for extended advertisements, and default to PHY1M.
+	PrimaryPHY   PHY
+	SecondaryPHY PHY
+
+	// TxPower is the requested transmit power in dBm for extended
+	// advertisements. The controller picks the closest power it supports.
+	// Zero means no preference.
+	TxPower int8
+}
+
+// maxExtendedAdvertisingDataLength is the maximum amount of data in an
+// extended advertisement.
+const maxExtendedAdvertisingDataLength = 1650
+
+// PHY is a physical layer of Bluetooth Low Energy. The zero value means no
+// PHY was specified.
+type PHY uint8
+
+const (
+	// PHY1M is the 1 Mbit/s PHY supported by every device.
+	PHY1M PHY = iota + 1
+
+	// PHY2M is the 2 Mbit/s PHY, for higher throughput.
+	PHY2M
+
+	// PHYCoded is the coded PHY, for longer range at a lower data rate.
+	PHYCoded
+)
 
 // Manufacturer data that's part of an advertisement packet.
 type ManufacturerDataElement struct {
@@ -97,9 +164,156 @@ func NewDuration(interval time.Duration) Duration {
 	return Duration(uint64(interval / (625 * time.Microsecond)))
 }
 
+// OwnAddressType is the type of address a device uses for itself, for example
+// in the scan requests of an active scan.
+type OwnAddressType uint8
+
+const (
+	// OwnAddressPublic uses the public device address.
+	OwnAddressPublic OwnAddressType = iota
+
+	// OwnAddressRandom uses the random device address.
+	OwnAddressRandom
+
+	// OwnAddressResolvableOrPublic uses a resolvable private address generated
+	// by the controller, or the public address if it has none.
+	OwnAddressResolvableOrPublic
+
+	// OwnAddressResolvableOrRandom uses a resolvable private address generated
+	// by the controller, or the random address if it has none.
+	OwnAddressResolvableOrRandom
+)
+
+// ScanFilterPolicy selects which advertisement packets are reported while
+// scanning.
+type ScanFilterPolicy uint8
+
+const (
+	// ScanFilterAcceptAll reports all advertisement packets, except directed
+	// advertisements that are not addressed to this device.
+	ScanFilterAcceptAll ScanFilterPolicy = iota
+
+	// ScanFilterAcceptList only reports advertisement packets from devices in
+	// the controller's filter accept list.
+	ScanFilterAcceptList
+
+	// ScanFilterAcceptAllResolvable is like ScanFilterAcceptAll, but also
+	// reports directed advertisements to a resolvable private address.
+	ScanFilterAcceptAllResolvable
+
+	// ScanFilterAcceptListResolvable is like ScanFilterAcceptList, but also
+	// reports directed advertisements to a resolvable private address.
+	ScanFilterAcceptListResolvable
+)
+
+// ScanOptions configures a scan started with ScanWithOptions. Not every
+// backend supports every option, unsupported options are ignored. The zero
+// value is a passive scan that reports every advertisement. Scan uses the zero
+// value on Linux, HCI and the SoftDevice, but filters duplicates on macOS and
+// scans actively on Windows.
+type ScanOptions struct {
+	// Active requests a scan response from every scannable advertiser, which
+	// usually contains more data such as the local name. Passive scanning only
+	// listens, which uses less power and is not visible to advertisers.
+	Active bool
+
+	// Interval is the time between the start of two scan windows, and Window
+	// is how long the radio listens during each of them. Lower the window
+	// compared to the interval for a lower duty cycle. Create them with
+	// NewDuration. If either is zero, a default is used.
+	Interval Duration
+	Window   Duration
+
+	// FilterDuplicates reports every advertiser only once, instead of
+	// reporting every received advertisement packet.
+	FilterDuplicates bool
+
+	// OwnAddressType is the address type used in scan requests.
+	OwnAddressType OwnAddressType
+
+	// FilterPolicy selects which advertisement packets are reported.
+	FilterPolicy ScanFilterPolicy
+
+	// Timeout stops the scan after the given time, as if StopScan was called.
+	// If zero, the scan continues until StopScan is called.
+	Timeout time.Duration
+
+	// Extended also receives extended advertisements (Bluetooth 5), on the
+	// 1M PHY and, with CodedPHY, also on the Coded PHY.
+	Extended bool
+	CodedPHY bool
+
+	// done stops the scan when it is closed, from the goroutine that is
+	// scanning. It is set by ScanContext.
+	done <-chan struct{}
+}
+
 // Connection is a numeric identifier that indicates a connection handle.
 type Connection uint16
 
+// ConnectionInfo describes the client on a connection, as returned by
+// Adapter.ConnectionInfo for the connection that is passed to the read and
+// write handlers of a GATT server.
+type ConnectionInfo struct {
+	// Address of the client.
+	Address Address
+
+	// ATT MTU of the connection, which limits notifications and read
+	// responses. It is zero if the MTU is not known.
+	MTU uint16
+
+	// LinkType is the transport of the connection.
+	LinkType LinkType
+}
+
+// LinkType is the transport of a connection.
+type LinkType uint8
+
+const (
+	// LinkTypeUnknown is used when the backend doesn't report the transport.
+	LinkTypeUnknown LinkType = iota
+
+	// LinkTypeLE is a Bluetooth Low Energy connection.
+	LinkTypeLE
+
+	// LinkTypeBREDR is a Bluetooth Classic (BR/EDR) connection, which BlueZ
+	// also serves GATT over.
+	LinkTypeBREDR
+)
+
+// AdvertisingPDUType is the type of an advertising packet received while
+// scanning.
+type AdvertisingPDUType uint8
+
+const (
+	// AdvertisingPDUUnknown is used when the backend doesn't report the type.
+	AdvertisingPDUUnknown AdvertisingPDUType = iota
+
+	// AdvertisingPDUAdvInd is a connectable and scannable undirected
+	// advertisement (ADV_IND).
+	AdvertisingPDUAdvInd
+
+	// AdvertisingPDUAdvDirectInd is a connectable directed advertisement
+	// (ADV_DIRECT_IND). It has no data.
+	AdvertisingPDUAdvDirectInd
+
+	// AdvertisingPDUAdvScanInd is a scannable undirected advertisement
+	// (ADV_SCAN_IND).
+	AdvertisingPDUAdvScanInd
+
+	// AdvertisingPDUAdvNonconnInd is a non-connectable undirected
+	// advertisement (ADV_NONCONN_IND).
+	AdvertisingPDUAdvNonconnInd
+
+	// AdvertisingPDUScanRsp is a scan response (SCAN_RSP). Its payload
+	// includes the preceding advertisement of the same device, if received.
+	AdvertisingPDUScanRsp
+
+	// AdvertisingPDUExtended is an extended advertisement, possibly combined
+	// from multiple packets.
+	AdvertisingPDUExtended
+)
+
 // ScanResult contains information from when an advertisement packet was
 // received. It is passed as a parameter to the callback of the Scan method.
 type ScanResult struct {
@@ -109,6 +323,24 @@ type ScanResult struct {
 	// RSSI the last time a packet from this device has been received.
 	RSSI int16
 
+	// PDUType is the type of the received packet. It is
+	// AdvertisingPDUUnknown on backends that don't report it.
+	PDUType AdvertisingPDUType
+
+	// The PHYs, advertising set ID and transmit power (in dBm, 127 if not
+	// available) of an extended advertisement. They are only set if PDUType
+	// is AdvertisingPDUExtended.
+	PrimaryPHY   PHY
+	SecondaryPHY PHY
+	SID          uint8
+	TxPower      int8
+
+	// IdentityAddress is the identity address of a bonded device that
+	// advertises with a resolvable private address, resolved with the IRK it
+	// sent during pairing. It is the zero Address if the address wasn't
+	// resolved, or on backends that don't resolve addresses.
+	IdentityAddress Address
+
 	// The data obtained from the advertisement data, which may contain many
 	// different properties.
 	// Warning: this data may only stay valid until the next event arrives. If
@@ -164,6 +396,11 @@ type AdvertisementFields struct {
 	ServiceData []ServiceDataElement
 }
 
+// isEmpty returns whether none of the fields are set.
+func (f *AdvertisementFields) isEmpty() bool {
+	return f.LocalName == "" && len(f.ServiceUUIDs) == 0 && len(f.ManufacturerData) == 0 && len(f.ServiceData) == 0
+}
+
 // advertisementFields wraps AdvertisementFields to implement the
 // AdvertisementPayload interface. The methods to implement the interface (such
 // as LocalName) cannot be implemented on AdvertisementFields because they would
@@ -218,133 +455,27 @@ func (buf *rawAdvertisementPayload) Bytes() []byte {
 	return buf.data[:buf.len]
 }
 
-// findField returns the data of a specific field in the advertisement packet.
-//
-// See this list of field types:
-// https://www.bluetooth.com/specifications/assigned-numbers/generic-access-profile/
-func (buf *rawAdvertisementPayload) findField(fieldType byte) []byte {
-	data := buf.Bytes()
-	for len(data) >= 2 {
-		fieldLength := data[0]
-		if int(fieldLength)+1 > len(data) {
-			// Invalid field length.
-			return nil
-		}
-		if fieldType == data[1] {
-			return data[2 : fieldLength+1]
-		}
-		data = data[fieldLength+1:]
-	}
-	return nil
-}
-
 // LocalName returns the local name (complete or shortened) in the advertisement
 // payload.
 func (buf *rawAdvertisementPayload) LocalName() string {
-	b := buf.findField(9) // Complete Local Name
-	if len(b) != 0 {
-		return string(b)
-	}
-	b = buf.findField(8) // Shortened Local Name
-	if len(b) != 0 {
-		return string(b)
-	}
-	return ""
+	return AdvertisementData(buf.Bytes()).LocalName()
 }
 
 // HasServiceUUID returns true whether the given UUID is present in the
-// advertisement payload as a Service Class UUID. It checks both 16-bit UUIDs
-// and 128-bit UUIDs.
+// advertisement payload as a Service Class UUID. It checks 16-bit, 32-bit and
+// 128-bit UUIDs.
 func (buf *rawAdvertisementPayload) HasServiceUUID(uuid UUID) bool {
-	if uuid.Is16Bit() {
-		b := buf.findField(0x03) // Complete List of 16-bit Service Class UUIDs
-		if len(b) == 0 {
-			b = buf.findField(0x02) // Incomplete List of 16-bit Service Class UUIDs
-		}
-		uuid := uuid.Get16Bit()
-		for i := 0; i < len(b)/2; i++ {
-			foundUUID := uint16(b[i*2]) | (uint16(b[i*2+1]) << 8)
-			if uuid == foundUUID {
-				return true
-			}
-		}
-		return false
-	} else {
-		b := buf.findField(0x07) // Complete List of 128-bit Service Class UUIDs
-		if len(b) == 0 {
-			b = buf.findField(0x06) // Incomplete List of 128-bit Service Class UUIDs
-		}
-		uuidBuf1 := uuid.Bytes()
-		for i := 0; i < len(b)/16; i++ {
-			uuidBuf2 := b[i*16 : i*16+16]
-			match := true
-			for i, c := range uuidBuf1 {
-				if c != uuidBuf2[i] {
-					match = false
-					break
-				}
-			}
-			if match {
-				return true
-			}
-		}
-		return false
-	}
+	return AdvertisementData(buf.Bytes()).HasServiceUUID(uuid)
 }
 
 // ManufacturerData returns the manufacturer data in the advertisement payload.
 func (buf *rawAdvertisementPayload) ManufacturerData() []ManufacturerDataElement {
-	var manufacturerData []ManufacturerDataElement
-	for index := 0; index < int(buf.len)+4; index += int(buf.data[index]) + 1 {
-		fieldLength := int(buf.data[index+0])
-		if fieldLength < 3 {
-			continue
-		}
-		fieldType := buf.data[index+1]
-		if fieldType != 0xff {
-			continue
-		}
-		key := uint16(buf.data[index+2]) | uint16(buf.data[index+3])<<8
-		manufacturerData = append(manufacturerData, ManufacturerDataElement{
-			CompanyID: key,
-			Data:      buf.data[index+4 : index+fieldLength+1],
-		})
-	}
-	return manufacturerData
+	return AdvertisementData(buf.Bytes()).ManufacturerData()
 }
 
 // ServiceData returns the service data in the advertisment payload
 func (buf *rawAdvertisementPayload) ServiceData() []ServiceDataElement {
-	var serviceData []ServiceDataElement
-	for index := 0; index < int(buf.len)+4; index += int(buf.data[index]) + 1 {
-		fieldLength := int(buf.data[index+0])
-		if fieldLength < 3 { // field has only length and type and no data
-			continue
-		}
-		fieldType := buf.data[index+1]
-		switch fieldType {
-		case 0x16: // 16-bit uuid
-			serviceData = append(serviceData, ServiceDataElement{
-				UUID: New16BitUUID(uint16(buf.data[index+2]) + (uint16(buf.data[index+3]) << 8)),
-				Data: buf.data[index+4 : index+fieldLength+1],
-			})
-		case 0x20: // 32-bit uuid
-			serviceData = append(serviceData, ServiceDataElement{
-				UUID: New32BitUUID(uint32(buf.data[index+2]) + (uint32(buf.data[index+3]) << 8) + (uint32(buf.data[index+4]) << 16) + (uint32(buf.data[index+5]) << 24)),
-				Data: buf.data[index+6 : index+fieldLength+1],
-			})
-		case 0x21: // 128-bit uuid
-			var uuidArray [16]byte
-			copy(uuidArray[:], buf.data[index+2:index+18])
-			serviceData = append(serviceData, ServiceDataElement{
-				UUID: NewUUID(uuidArray),
-				Data: buf.data[index+18 : index+fieldLength+1],
-			})
-		default:
-			continue
-		}
-	}
-	return serviceData
+	return AdvertisementData(buf.Bytes()).ServiceData()
 }
 
 // reset restores this buffer to the original state.
@@ -358,164 +489,191 @@ func (buf *rawAdvertisementPayload) reset() {
 // before the call) from the advertisement options. It returns true if it fits,
 // false otherwise.
 func (buf *rawAdvertisementPayload) addFromOptions(options AdvertisementOptions) (ok bool) {
-	buf.addFlags(0x06)
-	if options.LocalName != "" {
-		if !buf.addCompleteLocalName(options.LocalName) {
-			return false
-		}
+	b := NewADBuilder(buf.data[buf.len:buf.len])
+	defer func() {
+		buf.len += uint8(b.Len())
+	}()
+
+	b.AddFlags(ADFlagGeneralDiscoverable | ADFlagBREDRNotSupported)
+	return addAdvertisementFields(&b, AdvertisementFields{
+		LocalName:        options.LocalName,
+		ServiceUUIDs:     options.ServiceUUIDs,
+		ManufacturerData: options.ManufacturerData,
+		ServiceData:      options.ServiceData,
+	})
+}
+
+// makeAdvertisementPayloads constructs both the advertisement packet and the
+// scan response from the advertisement options. The scan response is empty if
+// there is nothing to put in it. It returns true if all fields fit, false
+// otherwise.
+func makeAdvertisementPayloads(options AdvertisementOptions, adv, scanResponse *rawAdvertisementPayload) bool {
+	a := NewADBuilder(adv.data[:])
+	r := NewADBuilder(scanResponse.data[:])
+	defer func() {
+		adv.len = uint8(a.Len())
+		scanResponse.len = uint8(r.Len())
+	}()
+
+	return buildAdvertisementData(options, &a, &r)
+}
+
+// buildAdvertisementData adds the advertisement and scan response data from
+// the advertisement options to a and r. It returns true if all fields fit,
+// false otherwise.
+func buildAdvertisementData(options AdvertisementOptions, a, r *ADBuilder) bool {
+	if !addAdvertisementFields(r, options.ScanResponse) {
+		return false
 	}
-	// TODO: if there are multiple 16-bit UUIDs, they should be listed in
-	// one field.
-	// This is not possible for 128-bit service UUIDs (at least not in
-	// legacy advertising) because of the 31-byte advertisement packet
-	// limit.
-	for _, uuid := range options.ServiceUUIDs {
-		if !buf.addServiceUUID(uuid) {
-			return false
-		}
+
+	a.AddFlags(ADFlagGeneralDiscoverable | ADFlagBREDRNotSupported)
+	if !options.AutoScanResponse {
+		return addAdvertisementFields(a, AdvertisementFields{
+			LocalName:        options.LocalName,
+			ServiceUUIDs:     options.ServiceUUIDs,
+			ManufacturerData: options.ManufacturerData,
+			ServiceData:      options.ServiceData,
+		})
 	}
 
+	// Every field goes in the advertisement packet if it fits, and in the scan
+	// response otherwise.
+	if !a.AddServiceUUIDs(options.ServiceUUIDs) && !r.AddServiceUUIDs(options.ServiceUUIDs) {
+		return false
+	}
 	for _, element := range options.ManufacturerData {
-		if !buf.addManufacturerData(element.CompanyID, element.Data) {
+		if !a.AddManufacturerData(element.CompanyID, element.Data) && !r.AddManufacturerData(element.CompanyID, element.Data) {
 			return false
 		}
 	}
-
 	for _, element := range options.ServiceData {
-		if !buf.addServiceData(element.UUID, element.Data) {
+		if !a.AddServiceData(element.UUID, element.Data) && !r.AddServiceData(element.UUID, element.Data) {
 			return false
 		}
 	}
-
-	return true
-}
-
-// addManufacturerData adds manufacturer data ([]byte) entries to the advertisement payload.
-func (buf *rawAdvertisementPayload) addManufacturerData(key uint16, value []byte) (ok bool) {
-	// Check whether the field can fit this manufacturer data.
-	fieldLength := len(value) + 4
-	if int(buf.len)+fieldLength > len(buf.data) {
-		return false
+	if options.LocalName != "" {
+		if !a.AddLocalName(options.LocalName) && !r.AddLocalName(options.LocalName) && !r.AddShortenedLocalName(options.LocalName) {
+			return false
+		}
 	}
 
-	// Add the data.
-	buf.data[buf.len+0] = uint8(fieldLength - 1)
-	buf.data[buf.len+1] = 0xff
-	buf.data[buf.len+2] = uint8(key)
-	buf.data[buf.len+3] = uint8(key >> 8)
-	copy(buf.data[buf.len+4:], value)
-	buf.len += uint8(fieldLength)
-
 	return true
 }
 
-// addServiceData adds service data ([]byte) entries to the advertisement payload.
-func (buf *rawAdvertisementPayload) addServiceData(uuid UUID, data []byte) (ok bool) {
-	switch {
-	case uuid.Is16Bit():
-		// check if it fits
-		fieldLength := 1 + 1 + 2 + len(data) // 1 byte length, 1 byte ad type, 2 bytes uuid, actual service data
-		if int(buf.len)+fieldLength > len(buf.data) {
+// addAdvertisementFields adds the local name, service UUIDs, manufacturer data
+// and service data to b, in that order. It returns false if they don't all fit.
+func addAdvertisementFields(b *ADBuilder, fields AdvertisementFields) bool {
+	if fields.LocalName != "" {
+		if !b.AddLocalName(fields.LocalName) {
 			return false
 		}
-		// Add the data.
-		buf.data[buf.len+0] = byte(fieldLength - 1)
-		buf.data[buf.len+1] = 0x16
-		buf.data[buf.len+2] = byte(uuid.Get16Bit())
-		buf.data[buf.len+3] = byte(uuid.Get16Bit() >> 8)
-		copy(buf.data[buf.len+4:], data)
-		buf.len += uint8(fieldLength)
-
-	case uuid.Is32Bit():
-		// check if it fits
-		fieldLength := 1 + 1 + 4 + len(data) // 1 byte length, 1 byte ad type, 4 bytes uuid, actual service data
-		if int(buf.len)+fieldLength > len(buf.data) {
+	}
+
+	if !b.AddServiceUUIDs(fields.ServiceUUIDs) {
+		return false
+	}
+
+	for _, element := range fields.ManufacturerData {
+		if !b.AddManufacturerData(element.CompanyID, element.Data) {
 			return false
 		}
-		// Add the data.
-		buf.data[buf.len+0] = byte(fieldLength - 1)
-		buf.data[buf.len+1] = 0x20
-		buf.data[buf.len+2] = byte(uuid.Get32Bit())
-		buf.data[buf.len+3] = byte(uuid.Get32Bit() >> 8)
-		buf.data[buf.len+4] = byte(uuid.Get32Bit() >> 16)
-		buf.data[buf.len+5] = byte(uuid.Get32Bit() >> 24)
-		copy(buf.data[buf.len+6:], data)
-		buf.len += uint8(fieldLength)
-
-	default: // must be 128-bit uuid
-		// check if it fits
-		fieldLength := 1 + 1 + 16 + len(data) // 1 byte length, 1 byte ad type, 16 bytes uuid, actual service data
-		if int(buf.len)+fieldLength > len(buf.data) {
+	}
+
+	for _, element := range fields.ServiceData {
+		if !b.AddServiceData(element.UUID, element.Data) {
 			return false
 		}
-		// Add the data.
-		buf.data[buf.len+0] = byte(fieldLength - 1)
-		buf.data[buf.len+1] = 0x21
-		uuid_bytes := uuid.Bytes()
-		copy(buf.data[buf.len+2:], uuid_bytes[:])
-		copy(buf.data[buf.len+2+16:], data)
-		buf.len += uint8(fieldLength)
-
 	}
+
 	return true
 }
 
-// addFlags adds a flags field to the advertisement buffer. It returns true on
-// success (the flags can be added) and false on failure.
-func (buf *rawAdvertisementPayload) addFlags(flags byte) (ok bool) {
-	if int(buf.len)+3 > len(buf.data) {
-		return false // flags don't fit
+// scanReportCacheSize is the number of advertisers for which the last
+// advertisement packet is remembered, to merge it with their scan response.
+const scanReportCacheSize = 4
+
+// scanReportMerger merges the scan response of a device with the
+// advertisement packet it sent just before, so that a single ScanResult
+// contains the data of both. It implements AdvertisementPayload for the most
+// recent report.
+type scanReportMerger struct {
+	cache [scanReportCacheSize]struct {
+		address MACAddress
+		data    [31]byte
+		len     uint8
 	}
+	next int
 
-	buf.data[buf.len] = 2       // length of field (including type)
-	buf.data[buf.len+1] = 0x01  // type, 0x01 means Flags
-	buf.data[buf.len+2] = flags // the flags
-	buf.len += 3
-	return true
+	data [62]byte
+	len  uint8
 }
 
-// addCompleteLocalName adds the Complete Local Name field to the advertisement
-// buffer. It returns true on success (the name fits) and false on failure.
-func (buf *rawAdvertisementPayload) addCompleteLocalName(name string) (ok bool) {
-	if int(buf.len)+len(name)+2 > len(buf.data) {
-		return false // name doesn't fit
+// add processes a received advertising report and returns the payload to
+// report to the scan callback: the report itself for an advertisement packet,
+// or the preceding advertisement packet followed by the report for a scan
+// response. The returned payload stays valid until the next call to add.
+func (m *scanReportMerger) add(address MACAddress, scanResponse bool, data []byte) *scanReportMerger {
+	if len(data) > 31 {
+		data = data[:31]
 	}
 
-	buf.data[buf.len] = byte(len(name) + 1) // length of field (including type)
-	buf.data[buf.len+1] = 9                 // type, 0x09 means Complete Local name
-	copy(buf.data[buf.len+2:], name)        // copy the name into the buffer
-	buf.len += byte(len(name) + 2)
-	return true
-}
-
-// addServiceUUID adds a Service Class UUID (16-bit or 128-bit). It has
-// currently only been designed for adding single UUIDs: multiple UUIDs are
-// stored in separate fields without joining them together in one field.
-func (buf *rawAdvertisementPayload) addServiceUUID(uuid UUID) (ok bool) {
-	// Don't bother with 32-bit UUID support, it doesn't seem to be used in
-	// practice.
-	if uuid.Is16Bit() {
-		if int(buf.len)+4 > len(buf.data) {
-			return false // UUID doesn't fit.
+	if !scanResponse {
+		i := m.next
+		for j := range m.cache {
+			if m.cache[j].address == address {
+				i = j
+				break
+			}
 		}
-		shortUUID := uuid.Get16Bit()
-		buf.data[buf.len+0] = 3    // length of field, including type
-		buf.data[buf.len+1] = 0x03 // type, 0x03 means "Complete List of 16-bit Service Class UUIDs"
-		buf.data[buf.len+2] = byte(shortUUID)
-		buf.data[buf.len+3] = byte(shortUUID >> 8)
-		buf.len += 4
-		return true
-	} else {
-		if int(buf.len)+18 > len(buf.data) {
-			return false // UUID doesn't fit.
+		if i == m.next {
+			m.next = (m.next + 1) % scanReportCacheSize
 		}
-		buf.data[buf.len+0] = 17   // length of field, including type
-		buf.data[buf.len+1] = 0x07 // type, 0x07 means "Complete List of 128-bit Service Class UUIDs"
-		rawUUID := uuid.Bytes()
-		copy(buf.data[buf.len+2:], rawUUID[:])
-		buf.len += 18
-		return true
+		m.cache[i].address = address
+		m.cache[i].len = uint8(copy(m.cache[i].data[:], data))
+
+		m.len = uint8(copy(m.data[:], data))
+		return m
 	}
+
+	m.len = 0
+	for i := range m.cache {
+		if m.cache[i].address == address {
+			m.len = uint8(copy(m.data[:], m.cache[i].data[:m.cache[i].len]))
+			break
+		}
+	}
+	m.len += uint8(copy(m.data[m.len:], data))
+	return m
+}
+
+// Bytes returns the advertisement packet, followed by the scan response if
+// there is one.
+func (m *scanReportMerger) Bytes() []byte {
+	return m.data[:m.len]
+}
+
+// LocalName returns the local name (complete or shortened) in the
+// advertisement packet or scan response.
+func (m *scanReportMerger) LocalName() string {
+	return AdvertisementData(m.Bytes()).LocalName()
+}
+
+// HasServiceUUID returns true whether the given UUID is present in the
+// advertisement packet or scan response as a Service Class UUID.
+func (m *scanReportMerger) HasServiceUUID(uuid UUID) bool {
+	return AdvertisementData(m.Bytes()).HasServiceUUID(uuid)
+}
+
+// ManufacturerData returns the manufacturer data in the advertisement packet
+// and scan response.
+func (m *scanReportMerger) ManufacturerData() []ManufacturerDataElement {
+	return AdvertisementData(m.Bytes()).ManufacturerData()
+}
+
+// ServiceData returns the service data in the advertisement packet and scan
+// response.
+func (m *scanReportMerger) ServiceData() []ServiceDataElement {
+	return AdvertisementData(m.Bytes()).ServiceData()
 }
 
 // ConnectionParams are used when connecting to a peripherals or when changing
@@ -537,3 +695,48 @@ type ConnectionParams struct {
 	// specified, the timeout will be unchanged.
 	Timeout Duration
 }
+
+// Limits of the payload of link layer data packets, for
+// Device.RequestDataLength.
+const (
+	MinDataLength = 27
+	MaxDataLength = 251
+)
+
+// Limits of the ATT MTU, for Device.ExchangeMTU and Adapter.SetPreferredMTU.
+// Every connection starts with the minimum MTU until the client exchanges a
+// larger one.
+const (
+	MinMTU = 23
+	MaxMTU = 517
+)
+
+// negotiateMTU returns the ATT MTU of a connection after an MTU exchange: the
+// smaller of the MTUs of both sides, but never less than the minimum.
+func negotiateMTU(client, server uint16) uint16 {
+	mtu := client
+	if server < mtu {
+		mtu = server
+	}
+	if mtu < MinMTU {
+		mtu = MinMTU
+	}
+	return mtu
+}
+
+// LinkUpdate is passed to the link update handler when the data length, the
+// PHY or the ATT MTU of a connection changed. Only the fields of the parameter
+// that changed are set, the others are zero.
+type LinkUpdate struct {
+	// Maximum payload of link layer data packets in bytes, in each direction.
+	TxOctets uint16
+	RxOctets uint16
+
+	// PHY used in each direction.
+	TxPHY PHY
+	RxPHY PHY
+
+	// ATT MTU that both sides agreed on in an MTU exchange. Notifications and
+	// read responses are limited to this size.
+	MTU uint16
+}
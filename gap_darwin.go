@@ -37,47 +37,78 @@ func (ad *Address) Set(val string) {
 
 // Scan starts a BLE scan. It is stopped by a call to StopScan. A common pattern
 // is to cancel the scan when a particular device has been found.
+//
+// On macOS, Scan filters duplicate advertisements.
 func (a *Adapter) Scan(callback func(*Adapter, ScanResult)) (err error) {
+	return a.ScanWithOptions(ScanOptions{FilterDuplicates: true}, callback)
+}
+
+// ScanWithOptions starts a BLE scan with the given options. It is stopped by a
+// call to StopScan or when the timeout expires.
+//
+// On macOS, only FilterDuplicates and Timeout are used.
+func (a *Adapter) ScanWithOptions(options ScanOptions, callback func(*Adapter, ScanResult)) (err error) {
 	if callback == nil {
 		return errors.New("must provide callback to Scan function")
 	}
 
+	a.scanMu.Lock()
 	if a.scanChan != nil {
+		a.scanMu.Unlock()
 		return errors.New("already calling Scan function")
 	}
 
 	a.peripheralFoundHandler = callback
 
-	// Channel that will be closed when the scan is stopped.
-	// Detecting whether the scan is stopped can be done by doing a non-blocking
-	// read from it. If it succeeds, the scan is stopped.
-	a.scanChan = make(chan error)
+	// Channel that receives a value when the scan is stopped. It is buffered
+	// so that StopScan doesn't block.
+	stop := make(chan error, 1)
+	a.scanChan = stop
+	a.scanMu.Unlock()
 
 	a.cm.Scan(nil, &cbgo.CentralManagerScanOpts{
-		AllowDuplicates: false,
+		AllowDuplicates: !options.FilterDuplicates,
 	})
 
-	// Check whether the scan is stopped. This is necessary to avoid a race
-	// condition between the signal channel and the cancelScan channel when
-	// the callback calls StopScan() (no new callbacks may be called after
-	// StopScan is called).
+	var timeout <-chan time.Time
+	if options.Timeout != 0 {
+		timer := time.NewTimer(options.Timeout)
+		defer timer.Stop()
+		timeout = timer.C
+	}
+
+	// Wait until the scan is stopped: StopScan already stops CoreBluetooth, so
+	// no new callbacks are called after it returns.
 	select {
-	case <-a.scanChan:
-		close(a.scanChan)
-		a.scanChan = nil
-		return nil
+	case <-stop:
+	case <-timeout:
+		a.cm.StopScan()
+	case <-options.done:
+		a.cm.StopScan()
 	}
+
+	a.scanMu.Lock()
+	a.scanChan = nil
+	a.scanMu.Unlock()
+	return nil
 }
 
 // StopScan stops any in-progress scan. It can be called from within a Scan
 // callback to stop the current scan. If no scan is in progress, an error will
 // be returned.
 func (a *Adapter) StopScan() error {
+	a.scanMu.Lock()
+	defer a.scanMu.Unlock()
+
 	if a.scanChan == nil {
 		return errors.New("not calling Scan function")
 	}
 
-	a.scanChan <- nil
+	select {
+	case a.scanChan <- nil:
+	default:
+		// The scan is already being stopped.
+	}
 	a.cm.StopScan()
 
 	return nil
@@ -188,6 +219,37 @@ func (d Device) RequestConnectionParams(params ConnectionParams) error {
 	return nil
 }
 
+// RequestDataLength requests a larger (or smaller) payload for link layer data
+// packets sent to the device, between MinDataLength and MaxDataLength bytes.
+//
+// CoreBluetooth doesn't offer a way to request this, so this call always
+// returns ErrNotSupported.
+func (d Device) RequestDataLength(txOctets uint16) error {
+	return ErrNotSupported
+}
+
+// SetPHY requests the PHYs to use for sending to and receiving from the
+// device.
+//
+// CoreBluetooth doesn't offer a way to request this, so this call always
+// returns ErrNotSupported.
+func (d Device) SetPHY(tx, rx PHY) error {
+	return ErrNotSupported
+}
+
+// ExchangeMTU requests a larger (or smaller) ATT MTU for the connection,
+// between MinMTU and MaxMTU bytes, and returns the MTU that both devices agreed
+// on.
+//
+// CoreBluetooth exchanges the MTU on its own and doesn't offer a way to request
+// a different one, so this call returns the MTU that it agreed on.
+func (d Device) ExchangeMTU(mtu uint16) (uint16, error) {
+	if mtu < MinMTU || mtu > MaxMTU {
+		return 0, errInvalidMTU
+	}
+	return uint16(d.prph.MaximumWriteValueLength(false)) + 3, nil
+}
+
 // Peripheral delegate functions
 
 type peripheralDelegate struct {
@@ -3,9 +3,8 @@
 package bluetooth
 
 import (
-	"encoding/binary"
+	"context"
 	"errors"
-	"slices"
 	"time"
 )
 
@@ -15,92 +14,133 @@ var (
 	ErrConnect = errors.New("bluetooth: could not connect")
 )
 
-// Scan starts a BLE scan.
+// Scan starts a passive BLE scan, reporting every received advertisement
+// packet.
 func (a *Adapter) Scan(callback func(*Adapter, ScanResult)) error {
+	return a.ScanWithOptions(ScanOptions{}, callback)
+}
+
+// ScanWithOptions starts a BLE scan with the given options. It is stopped by a
+// call to StopScan or when the timeout expires. The default interval is 80ms,
+// with a 30ms window.
+func (a *Adapter) ScanWithOptions(options ScanOptions, callback func(*Adapter, ScanResult)) error {
 	if a.scanning {
 		return errScanning
 	}
 
-	if err := a.hci.leSetScanEnable(false, true); err != nil {
+	// Once the controller has been used with the extended advertising
+	// commands, it rejects the legacy commands.
+	extended := options.Extended || a.hci.extended
+	if err := a.setScanEnable(extended, false, true); err != nil {
 		return err
 	}
 
-	// passive scanning, every 40ms, for 30ms
-	if err := a.hci.leSetScanParameters(0x00, 0x0080, 0x0030, 0x00, 0x00); err != nil {
-		return err
+	typ := uint8(0x00) // passive
+	if options.Active {
+		typ = 0x01
+	}
+	interval := uint16(options.Interval)
+	if interval == 0 {
+		interval = 0x0080
+	}
+	window := uint16(options.Window)
+	if window == 0 {
+		window = 0x0030
+		if window > interval {
+			window = interval
+		}
+	}
+	if extended {
+		phys := uint8(0x01) // 1M
+		if options.CodedPHY {
+			phys |= 0x04
+		}
+		if err := a.hci.leSetExtendedScanParameters(typ, interval, window, uint8(options.OwnAddressType), uint8(options.FilterPolicy), phys); err != nil {
+			return err
+		}
+	} else {
+		if err := a.hci.leSetScanParameters(typ, interval, window, uint8(options.OwnAddressType), uint8(options.FilterPolicy)); err != nil {
+			return err
+		}
 	}
 
 	a.scanning = true
 
-	// scan with duplicates
-	if err := a.hci.leSetScanEnable(true, false); err != nil {
+	a.hci.clearAdvReports()
+	if err := a.setScanEnable(extended, true, options.FilterDuplicates); err != nil {
 		return err
 	}
 
+	var deadline time.Time
+	if options.Timeout != 0 {
+		deadline = time.Now().Add(options.Timeout)
+	}
+
 	lastUpdate := time.Now().UnixNano()
 
 	for {
-		if err := a.hci.poll(); err != nil {
+		if a.scanning {
+			stop := !deadline.IsZero() && time.Now().After(deadline)
+			select {
+			case <-options.done:
+				stop = true
+			default:
+			}
+			if stop {
+				if err := a.StopScan(); err != nil {
+					return err
+				}
+			}
+		}
+
+		if err := a.poll(); err != nil {
 			return err
 		}
 
 		switch {
-		case a.hci.advData.reported:
-			adf := AdvertisementFields{}
-			if a.hci.advData.eirLength > 31 {
-				if debug {
-					println("eirLength too long")
-				}
-
-				a.hci.clearAdvData()
-				continue
-			}
-
-			for i := 0; i < int(a.hci.advData.eirLength); {
-				l, t := int(a.hci.advData.eirData[i]), a.hci.advData.eirData[i+1]
-				if l < 1 {
-					break
+		case len(a.hci.advReports) != 0:
+			// The callback may poll for more events, so the queue can grow
+			// while it is being processed.
+			for i := 0; i < len(a.hci.advReports) && a.scanning; i++ {
+				report := &a.hci.advReports[i]
+				address := MACAddress{
+					MAC:      makeAddress(report.peerBdaddr),
+					isRandom: report.peerBdaddrType&0x01 != 0,
 				}
 
-				switch t {
-				case 0x02, 0x03:
-					// 16-bit Service Class UUID
-					adf.ServiceUUIDs = append(adf.ServiceUUIDs, New16BitUUID(binary.LittleEndian.Uint16(a.hci.advData.eirData[i+2:i+4])))
-				case 0x06, 0x07:
-					// 128-bit Service Class UUID
-					var uuid [16]byte
-					copy(uuid[:], a.hci.advData.eirData[i+2:i+18])
-					adf.ServiceUUIDs = append(adf.ServiceUUIDs, NewUUID(uuid))
-				case 0x08, 0x09:
-					if debug {
-						println("local name", string(a.hci.advData.eirData[i+2:i+1+l]))
-					}
-
-					adf.LocalName = string(a.hci.advData.eirData[i+2 : i+1+l])
-				case 0xFF:
-					// Manufacturer Specific Data
+				if report.extended {
+					// Extended advertisements have no scan response to merge
+					// with.
+					a.extendedScanData = report.extData
+					identity, _ := a.identityAddress(address)
+					callback(a, ScanResult{
+						Address:              Address{address},
+						RSSI:                 int16(report.rssi),
+						PDUType:              AdvertisingPDUExtended,
+						PrimaryPHY:           PHY(report.primaryPHY),
+						SecondaryPHY:         PHY(report.secondaryPHY),
+						SID:                  report.sid,
+						TxPower:              report.txPower,
+						IdentityAddress:      identity,
+						AdvertisementPayload: &a.extendedScanData,
+					})
+					continue
 				}
 
-				i += l + 1
+				scanResponse := report.typ == leAdvTypeScanRsp
+				payload := a.scanReports.add(address, scanResponse, report.eirData[:report.eirLength])
+				identity, _ := a.identityAddress(address)
+
+				callback(a, ScanResult{
+					Address:              Address{address},
+					RSSI:                 int16(report.rssi),
+					PDUType:              AdvertisingPDUType(report.typ) + 1,
+					IdentityAddress:      identity,
+					AdvertisementPayload: payload,
+				})
 			}
 
-			random := a.hci.advData.peerBdaddrType == 0x01
-
-			callback(a, ScanResult{
-				Address: Address{
-					MACAddress{
-						MAC:      makeAddress(a.hci.advData.peerBdaddr),
-						isRandom: random,
-					},
-				},
-				RSSI: int16(a.hci.advData.rssi),
-				AdvertisementPayload: &advertisementFields{
-					AdvertisementFields: adf,
-				},
-			})
-
-			a.hci.clearAdvData()
-			time.Sleep(5 * time.Millisecond)
+			a.hci.clearAdvReports()
 
 		default:
 			if !a.scanning {
@@ -115,8 +155,6 @@ func (a *Adapter) Scan(callback func(*Adapter, ScanResult)) error {
 			time.Sleep(5 * time.Millisecond)
 		}
 	}
-
-	return nil
 }
 
 func (a *Adapter) StopScan() error {
@@ -124,7 +162,7 @@ func (a *Adapter) StopScan() error {
 		return errNotScanning
 	}
 
-	if err := a.hci.leSetScanEnable(false, false); err != nil {
+	if err := a.setScanEnable(a.hci.extended, false, false); err != nil {
 		return err
 	}
 
@@ -133,56 +171,74 @@ func (a *Adapter) StopScan() error {
 	return nil
 }
 
+func (a *Adapter) setScanEnable(extended, enabled, filterDuplicates bool) error {
+	if extended {
+		return a.hci.leSetExtendedScanEnable(enabled, filterDuplicates)
+	}
+
+	return a.hci.leSetScanEnable(enabled, filterDuplicates)
+}
+
 // Address contains a Bluetooth MAC address.
 type Address struct {
 	MACAddress
 }
 
 // Connect starts a connection attempt to the given peripheral device address.
+// Multiple devices may be connected at the same time, but the controller
+// makes one connection attempt at a time, so concurrent calls are handled one
+// after the other.
 func (a *Adapter) Connect(address Address, params ConnectionParams) (Device, error) {
 	if debug {
 		println("Connect")
 	}
 
+	a.connecting.Lock()
+	defer a.connecting.Unlock()
+
 	random := uint8(0)
 	if address.isRandom {
 		random = 1
 	}
-	if err := a.hci.leCreateConn(0x0060, 0x0030, 0x00,
+	createConn := a.hci.leCreateConn
+	if a.hci.extended {
+		createConn = a.hci.leExtendedCreateConn
+	}
+
+	a.att.busy.Lock()
+	a.hci.clearConnectData()
+	err := createConn(0x0060, 0x0030, 0x00,
 		random, makeNINAAddress(address.MAC),
-		0x00, 0x0006, 0x000c, 0x0000, 0x00c8, 0x0004, 0x0006); err != nil {
+		0x00, 0x0006, 0x000c, 0x0000, 0x00c8, 0x0004, 0x0006)
+	a.att.busy.Unlock()
+	if err != nil {
 		return Device{}, err
 	}
 
 	// are we connected?
 	start := time.Now().UnixNano()
 	for {
-		if err := a.hci.poll(); err != nil {
+		if err := a.poll(); err != nil {
 			return Device{}, err
 		}
 
-		if a.hci.connectData.connected {
-			defer a.hci.clearConnectData()
+		a.att.busy.Lock()
+		result := a.hci.connectData
+		a.att.busy.Unlock()
 
-			random := false
-			if address.isRandom {
-				random = true
+		if result.completed {
+			if result.status != 0 {
+				return Device{}, ErrConnect
 			}
 
-			d := Device{
-				Address: Address{
-					MACAddress{
-						MAC:      makeAddress(a.hci.connectData.peerBdaddr),
-						isRandom: random},
-				},
-				deviceInternal: &deviceInternal{
-					adapter:                   a,
-					handle:                    a.hci.connectData.handle,
-					mtu:                       defaultMTU,
-					notificationRegistrations: make([]notificationRegistration, 0),
-				},
+			// The connection table has been updated by the poll that
+			// completed the connection, which may have been done by another
+			// goroutine.
+			a.handleConnectionEvents()
+			d := a.findConnection(result.handle)
+			if d.deviceInternal == nil {
+				return Device{}, ErrConnect
 			}
-			a.addConnection(d)
 
 			return d, nil
 
@@ -197,7 +253,10 @@ func (a *Adapter) Connect(address Address, params ConnectionParams) (Device, err
 	}
 
 	// cancel connection attempt that failed
-	if err := a.hci.leCancelConn(); err != nil {
+	a.att.busy.Lock()
+	err = a.hci.leCancelConn()
+	a.att.busy.Unlock()
+	if err != nil {
 		return Device{}, err
 	}
 
@@ -218,7 +277,6 @@ type Device struct {
 type deviceInternal struct {
 	adapter *Adapter
 	handle  uint16
-	mtu     uint16
 
 	notificationRegistrations []notificationRegistration
 }
@@ -228,12 +286,12 @@ func (d Device) Disconnect() error {
 	if debug {
 		println("Disconnect")
 	}
-	if err := d.adapter.hci.disconnect(d.handle); err != nil {
-		return err
-	}
+	// The device is removed from the connected devices once the controller
+	// reports that the connection is closed.
+	d.adapter.att.busy.Lock()
+	defer d.adapter.att.busy.Unlock()
 
-	d.adapter.removeConnection(d)
-	return nil
+	return d.adapter.hci.disconnect(d.handle)
 }
 
 // RequestConnectionParams requests a different connection latency and timeout
@@ -241,11 +299,142 @@ func (d Device) Disconnect() error {
 // Whether or not the device will actually honor this, depends on the device and
 // on the specific parameters.
 //
-// On NINA, this call hasn't been implemented yet.
+// The HCI LE Connection Update command has no way to leave a parameter
+// unchanged, so unset fields are replaced with the defaults used by Connect.
 func (d Device) RequestConnectionParams(params ConnectionParams) error {
+	// Connection intervals are in units of 1.25ms, supervision timeout in
+	// units of 10ms.
+	minInterval, maxInterval := uint16(0x0006), uint16(0x000c)
+	if params.MinInterval != 0 || params.MaxInterval != 0 {
+		minInterval = uint16(params.MinInterval / 2)
+		maxInterval = uint16(params.MaxInterval / 2)
+		if minInterval == 0 {
+			minInterval = maxInterval
+		}
+		if maxInterval < minInterval {
+			maxInterval = minInterval
+		}
+	}
+	timeout := uint16(0x00c8)
+	if params.Timeout != 0 {
+		timeout = uint16(params.Timeout / 16)
+	}
+
+	d.adapter.att.busy.Lock()
+	defer d.adapter.att.busy.Unlock()
+
+	return d.adapter.hci.leConnUpdate(d.handle, minInterval, maxInterval, 0, timeout)
+}
+
+// RequestDataLength requests a larger (or smaller) payload for link layer data
+// packets sent to the device, between MinDataLength and MaxDataLength bytes.
+// Both controllers negotiate the data length that is actually used, which is
+// reported to the link update handler once it changes.
+func (d Device) RequestDataLength(txOctets uint16) error {
+	if txOctets < MinDataLength || txOctets > MaxDataLength {
+		return errInvalidDataLength
+	}
+
+	if err := d.setDataLength(txOctets); err != nil {
+		return err
+	}
+
+	// The change is reported by the controller later on.
+	d.startNotifications()
+
+	return nil
+}
+
+func (d Device) setDataLength(txOctets uint16) error {
+	d.adapter.att.busy.Lock()
+	defer d.adapter.att.busy.Unlock()
+
+	return d.adapter.hci.leSetDataLength(d.handle, txOctets)
+}
+
+// SetPHY requests the PHYs to use for sending to and receiving from the
+// device. A zero PHY leaves the choice for that direction to the controllers.
+// The PHYs that are actually used are reported to the link update handler once
+// they change.
+func (d Device) SetPHY(tx, rx PHY) error {
+	if err := d.setPHY(tx, rx); err != nil {
+		return err
+	}
+
+	// The change is reported by the controller later on.
+	d.startNotifications()
+
 	return nil
 }
 
+func (d Device) setPHY(tx, rx PHY) error {
+	d.adapter.att.busy.Lock()
+	defer d.adapter.att.busy.Unlock()
+
+	return d.adapter.hci.leSetPHY(d.handle, tx, rx)
+}
+
+// ExchangeMTU requests a larger (or smaller) ATT MTU for the connection,
+// between MinMTU and MaxMTU bytes, and returns the MTU that both devices agreed
+// on. The MTU can only be exchanged once per connection, and only by the
+// central. The new MTU is also reported to the link update handler.
+func (d Device) ExchangeMTU(mtu uint16) (uint16, error) {
+	if mtu < MinMTU || mtu > MaxMTU {
+		return 0, errInvalidMTU
+	}
+
+	mtu, err := d.adapter.att.mtuReq(d.handle, mtu)
+	if err != nil {
+		return 0, err
+	}
+
+	// The link update is reported outside of the event handler.
+	d.startNotifications()
+
+	return mtu, nil
+}
+
+// Pair pairs with the device and encrypts the connection, and waits until that
+// has finished or the context is done. The IO capabilities of both devices
+// decide whether the user must enter or confirm a passkey, see
+// SetIOCapability and SetPairingHandler. The keys are kept in memory, so that
+// the next connection to the device can be encrypted without pairing again.
+//
+// As central, the connection is encrypted with the keys of an earlier pairing
+// if there are any. As peripheral, the central is asked to pair or encrypt the
+// connection.
+func (d Device) Pair(ctx context.Context) error {
+	d.adapter.att.busy.Lock()
+	err := d.adapter.hci.smp.pair(d.handle)
+	d.adapter.att.busy.Unlock()
+	if err != nil {
+		return err
+	}
+
+	for {
+		if err := d.adapter.poll(); err != nil {
+			return err
+		}
+
+		d.adapter.att.busy.Lock()
+		done, err := true, errNotConnected
+		if c := d.adapter.hci.smp.findConnection(d.handle); c != nil {
+			done, err = c.done, c.err
+		}
+		d.adapter.att.busy.Unlock()
+
+		if done {
+			return err
+		}
+
+		select {
+		case <-ctx.Done():
+			return ctx.Err()
+		case <-time.After(5 * time.Millisecond):
+		}
+	}
+}
+
 func (d Device) findNotificationRegistration(handle uint16) *notificationRegistration {
 	for _, n := range d.notificationRegistrations {
 		if n.handle == handle {
@@ -268,39 +457,109 @@ func (d Device) startNotifications() {
 	d.adapter.startNotifications()
 }
 
-var defaultAdvertisement Advertisement
-
 // Advertisement encapsulates a single advertisement instance.
 type Advertisement struct {
 	adapter *Adapter
 
-	localName    []byte
-	serviceUUIDs []UUID
-	interval     uint16
+	// handle is the advertising set used with the extended advertising
+	// commands.
+	handle uint8
+
+	localName        []byte
+	interval         uint16
+	nonConnectable   bool
+	advertisingData  rawAdvertisementPayload
+	scanResponseData rawAdvertisementPayload
+
+	extended     bool
+	extendedData []byte
+	primaryPHY   PHY
+	secondaryPHY PHY
+	txPower      int8
+
+	whileConnected bool
+
+	// started is set while the advertisement is started, startedExtended when
+	// it was started with the extended advertising commands.
+	started         bool
+	startedExtended bool
 }
 
 // DefaultAdvertisement returns the default advertisement instance but does not
 // configure it.
 func (a *Adapter) DefaultAdvertisement() *Advertisement {
-	if defaultAdvertisement.adapter == nil {
-		defaultAdvertisement.adapter = a
+	if a.defaultAdvertisement == nil {
+		a.defaultAdvertisement = &Advertisement{adapter: a}
+		a.advertisements = append(a.advertisements, a.defaultAdvertisement)
 	}
 
-	return &defaultAdvertisement
+	return a.defaultAdvertisement
+}
+
+// NewAdvertisement returns a new advertisement instance, that advertises at the
+// same time as the default advertisement and other new advertisements. Every
+// instance is an advertising set of the extended advertising commands, so the
+// controller must support Bluetooth 5. Once used, the legacy scanning and
+// advertising commands are no longer available, and the default advertisement
+// is also sent with the extended advertising commands.
+func (a *Adapter) NewAdvertisement() *Advertisement {
+	a.lastAdvertisingHandle++
+	adv := &Advertisement{
+		adapter: a,
+		handle:  a.lastAdvertisingHandle,
+	}
+	a.advertisements = append(a.advertisements, adv)
+	return adv
 }
 
 // Configure this advertisement.
+//
+// Without a local name in the options or the scan response, the name "TinyGo"
+// is advertised. Legacy advertisements always move fields that don't fit to
+// the scan response, as if AutoScanResponse was set, so that a long name
+// doesn't crowd out the service UUIDs.
 func (a *Advertisement) Configure(options AdvertisementOptions) error {
 	switch {
 	case options.LocalName != "":
 		a.localName = []byte(options.LocalName)
+	case options.ScanResponse.LocalName != "":
+		a.localName = []byte(options.ScanResponse.LocalName)
 	default:
 		a.localName = []byte("TinyGo")
+		options.LocalName = "TinyGo"
+	}
+	if !options.Extended {
+		options.AutoScanResponse = true
 	}
 
-	a.serviceUUIDs = append([]UUID{}, options.ServiceUUIDs...)
 	a.interval = uint16(options.Interval)
-
+	if a.interval == 0 {
+		// Use a default interval of 152.5ms, as recommended by Apple.
+		a.interval = uint16(NewDuration(152500 * time.Microsecond))
+	}
+	a.nonConnectable = options.NonConnectable
+	a.whileConnected = options.AdvertiseWhileConnected
+
+	a.extended = options.Extended
+	a.primaryPHY = options.PrimaryPHY
+	a.secondaryPHY = options.SecondaryPHY
+	a.txPower = options.TxPower
+	if options.Extended {
+		if !options.ScanResponse.isEmpty() {
+			return errExtendedScanResponse
+		}
+		if a.extendedData == nil {
+			a.extendedData = make([]byte, 0, maxExtendedAdvertisingDataLength)
+		}
+		adv := NewADBuilder(a.extendedData)
+		scanResponse := NewADBuilder(nil)
+		if !buildAdvertisementData(options, &adv, &scanResponse) {
+			return errAdvertisementPacketTooBig
+		}
+		a.extendedData = adv.Bytes()
+	} else if !makeAdvertisementPayloads(options, &a.advertisingData, &a.scanResponseData) {
+		return errAdvertisementPacketTooBig
+	}
 	a.adapter.AddService(
 		&Service{
 			UUID: ServiceUUIDGenericAccess,
@@ -332,91 +591,188 @@ func (a *Advertisement) Configure(options AdvertisementOptions) error {
 
 // Start advertisement. May only be called after it has been configured.
 func (a *Advertisement) Start() error {
-	// uint8_t type = (_connectable) ? 0x00 : (_localName ? 0x02 : 0x03);
-	typ := uint8(0x00)
-
-	if err := a.adapter.hci.leSetAdvertisingParameters(a.interval, a.interval,
-		typ, 0x00, 0x00, [6]byte{0x00, 0x00, 0x00, 0x00, 0x00, 0x00}, 0x07, 0); err != nil {
+	// Another advertisement may already be polling for events.
+	a.adapter.att.busy.Lock()
+	err := a.start()
+	a.adapter.att.busy.Unlock()
+	if err != nil {
 		return err
 	}
 
-	var advertisingData [31]byte
-	advertisingDataLen := uint8(0)
+	if a.adapter.advertisementPolling {
+		return nil
+	}
+	a.adapter.advertisementPolling = true
 
-	advertisingData[0] = 0x02
-	advertisingData[1] = 0x01
-	advertisingData[2] = 0x06
-	advertisingDataLen += 3
+	// go routine to poll for HCI events while advertising
+	go func() {
+		for {
+			if err := a.adapter.poll(); err != nil {
+				// TODO: handle error
+				if debug {
+					println("error polling while advertising:", err.Error())
+				}
+			}
 
-	// TODO: handle multiple service UUIDs
-	if len(a.serviceUUIDs) > 0 {
-		uuid := a.serviceUUIDs[0]
-		var sz uint8
+			time.Sleep(5 * time.Millisecond)
+		}
+	}()
 
-		switch {
-		case uuid.Is16Bit():
-			sz = 2
-			binary.LittleEndian.PutUint16(advertisingData[5:], uuid.Get16Bit())
-		case uuid.Is32Bit():
-			sz = 6
-			data := uuid.Bytes()
-			slices.Reverse(data[:])
-			copy(advertisingData[5:], data[:])
+	return nil
+}
+
+func (a *Advertisement) start() error {
+	if a.extended || a.handle != 0 || a.adapter.hci.extended {
+		if err := a.startExtended(); err != nil {
+			return err
+		}
+	} else {
+		// Connectable, scannable (ADV_IND) or non-connectable, scannable if
+		// there is a scan response (ADV_SCAN_IND or ADV_NONCONN_IND).
+		typ := uint8(leAdvTypeAdvInd)
+		if a.nonConnectable {
+			typ = leAdvTypeAdvNonconnInd
+			if a.scanResponseData.len != 0 {
+				typ = leAdvTypeAdvScanInd
+			}
 		}
 
-		advertisingData[3] = sz + 1
-		advertisingData[4] = sz
-		advertisingDataLen += sz + 2
-	}
+		if err := a.adapter.hci.leSetAdvertisingParameters(a.interval, a.interval,
+			typ, a.adapter.hci.ownAddressType(), 0x00, [6]byte{0x00, 0x00, 0x00, 0x00, 0x00, 0x00}, 0x07, 0); err != nil {
+			return err
+		}
 
-	// TODO: handle manufacturer data
+		if err := a.adapter.hci.leSetAdvertisingData(a.advertisingData.Bytes()); err != nil {
+			return err
+		}
 
-	if err := a.adapter.hci.leSetAdvertisingData(advertisingData[:advertisingDataLen]); err != nil {
-		return err
+		if err := a.adapter.hci.leSetScanResponseData(a.scanResponseData.Bytes()); err != nil {
+			return err
+		}
+
+		if err := a.adapter.hci.leSetAdvertiseEnable(true); err != nil {
+			return err
+		}
 	}
 
-	var scanResponseData [31]byte
-	scanResponseDataLen := uint8(0)
+	a.started = true
+	return nil
+}
 
-	switch {
-	case len(a.localName) > 29:
-		scanResponseData[1] = 0x08
-		scanResponseData[0] = 1 + 29
-		copy(scanResponseData[2:], a.localName[:29])
-		scanResponseDataLen = 31
-	case len(a.localName) > 0:
-		scanResponseData[1] = 0x09
-		scanResponseData[0] = uint8(1 + len(a.localName))
-		copy(scanResponseData[2:], a.localName)
-		scanResponseDataLen = uint8(2 + len(a.localName))
-	}
-
-	if err := a.adapter.hci.leSetScanResponseData(scanResponseData[:scanResponseDataLen]); err != nil {
-		return err
+// startExtended starts the advertisement as an advertising set, with the
+// extended advertising commands.
+func (a *Advertisement) startExtended() error {
+	h := a.adapter.hci
+
+	var properties uint16
+	var data []byte
+	scannable := false
+	if a.extended {
+		// Extended advertisements can't be both connectable and scannable.
+		properties = leExtAdvIncludeTxPower
+		if !a.nonConnectable {
+			properties |= leExtAdvConnectable
+		}
+		data = a.extendedData
+	} else {
+		// Legacy advertising PDUs, as sent with the legacy commands.
+		properties = leExtAdvLegacy | leExtAdvScannable | leExtAdvConnectable
+		if a.nonConnectable {
+			properties = leExtAdvLegacy
+			if a.scanResponseData.len != 0 {
+				properties |= leExtAdvScannable
+			}
+		}
+		scannable = properties&leExtAdvScannable != 0
+		data = a.advertisingData.Bytes()
 	}
 
-	if err := a.adapter.hci.leSetAdvertiseEnable(true); err != nil {
-		return err
+	primaryPHY, secondaryPHY := a.primaryPHY, a.secondaryPHY
+	if !a.extended || primaryPHY == 0 {
+		primaryPHY = PHY1M
+	}
+	if !a.extended || secondaryPHY == 0 {
+		secondaryPHY = PHY1M
+	}
+	txPower := a.txPower
+	if !a.extended || txPower == 0 {
+		txPower = 0x7f // no preference
 	}
 
-	// go routine to poll for HCI events while advertising
-	go func() {
-		for {
-			if err := a.adapter.att.poll(); err != nil {
-				// TODO: handle error
-				if debug {
-					println("error polling while advertising:", err.Error())
-				}
-			}
+	// The parameters can't be changed while the set is enabled.
+	if a.startedExtended {
+		if err := h.leSetExtendedAdvertisingEnable(false, a.handle); err != nil {
+			return err
+		}
+	}
 
-			time.Sleep(5 * time.Millisecond)
+	if _, err := h.leSetExtendedAdvertisingParameters(a.handle, properties,
+		uint32(a.interval), uint32(a.interval), h.ownAddressType(), txPower,
+		uint8(primaryPHY), uint8(secondaryPHY), a.handle&0x0f); err != nil {
+		return err
+	}
+	if h.privacy {
+		// Every advertising set has its own random address.
+		if err := h.leSetAdvertisingSetRandomAddress(a.handle, h.randomAddress); err != nil {
+			return err
 		}
-	}()
+	}
+	if err := h.leSetExtendedAdvertisingData(a.handle, false, data); err != nil {
+		return err
+	}
+	if scannable {
+		if err := h.leSetExtendedAdvertisingData(a.handle, true, a.scanResponseData.Bytes()); err != nil {
+			return err
+		}
+	}
+	if err := h.leSetExtendedAdvertisingEnable(true, a.handle); err != nil {
+		return err
+	}
 
+	a.startedExtended = true
 	return nil
 }
 
 // Stop advertisement. May only be called after it has been started.
 func (a *Advertisement) Stop() error {
-	return a.adapter.hci.leSetAdvertiseEnable(false)
+	a.adapter.att.busy.Lock()
+	defer a.adapter.att.busy.Unlock()
+
+	a.started = false
+	if !a.startedExtended {
+		if a.adapter.hci.extended {
+			// Not started, or started before the legacy commands became
+			// unavailable.
+			return nil
+		}
+		return a.adapter.hci.leSetAdvertiseEnable(false)
+	}
+
+	a.startedExtended = false
+	return a.adapter.hci.leSetExtendedAdvertisingEnable(false, a.handle)
+}
+
+// restartAdvertisements restarts the connectable advertisements after the
+// controller stopped them because a central connected. Directly after a
+// connection, only the advertisements that continue while connected are
+// restarted, after a disconnection all of them.
+func (a *Adapter) restartAdvertisements(connected bool) {
+	for _, adv := range a.advertisements {
+		if !adv.started || adv.nonConnectable || (connected && !adv.whileConnected) {
+			continue
+		}
+
+		a.att.busy.Lock()
+		var err error
+		if adv.startedExtended {
+			err = a.hci.leSetExtendedAdvertisingEnable(true, adv.handle)
+		} else {
+			err = a.hci.leSetAdvertiseEnable(true)
+		}
+		a.att.busy.Unlock()
+
+		if err != nil && debug {
+			println("could not restart advertisement:", err.Error())
+		}
+	}
 }
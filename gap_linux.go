@@ -1,4 +1,4 @@
-//go:build !baremetal
+//go:build !baremetal && !hci
 
 package bluetooth
 
@@ -7,6 +7,7 @@ import (
 	"fmt"
 	"strings"
 	"sync/atomic"
+	"time"
 
 	"github.com/godbus/dbus/v5"
 	"github.com/godbus/dbus/v5/prop"
@@ -14,6 +15,7 @@ import (
 
 var errAdvertisementNotStarted = errors.New("bluetooth: stop advertisement that was not started")
 var errAdvertisementAlreadyStarted = errors.New("bluetooth: start advertisement that was already started")
+var errUnknownMTU = errors.New("bluetooth: the MTU is not known before the services are resolved")
 
 // Unique ID per advertisement (to generate a unique object path).
 var advertisementID uint64
@@ -41,27 +43,38 @@ func (a *Adapter) DefaultAdvertisement() *Advertisement {
 	return a.defaultAdvertisement
 }
 
+// NewAdvertisement returns a new advertisement instance, that advertises at the
+// same time as the default advertisement and other new advertisements. BlueZ
+// limits the number of simultaneous advertisements, depending on the
+// controller.
+func (a *Adapter) NewAdvertisement() *Advertisement {
+	return &Advertisement{
+		adapter: a,
+	}
+}
+
 // Configure this advertisement.
 //
 // On Linux with BlueZ, it is not possible to set the advertisement interval.
+// BlueZ decides itself which fields go in the advertisement packet and which
+// in the scan response, so AutoScanResponse has no effect and the local name
+// may end up in either. BlueZ also decides whether to use extended
+// advertising, based on the controller and the amount of data, so Extended
+// and PrimaryPHY are ignored.
 func (a *Advertisement) Configure(options AdvertisementOptions) error {
 	if a.properties != nil {
 		panic("todo: configure advertisement a second time")
 	}
 
-	var serviceUUIDs []string
-	for _, uuid := range options.ServiceUUIDs {
-		serviceUUIDs = append(serviceUUIDs, uuid.String())
-	}
-	var serviceData = make(map[string]interface{})
-	for _, element := range options.ServiceData {
-		serviceData[element.UUID.String()] = element.Data
-	}
+	serviceUUIDs, manufacturerData, serviceData := makeAdvertisementProperties(AdvertisementFields{
+		ServiceUUIDs:     options.ServiceUUIDs,
+		ManufacturerData: options.ManufacturerData,
+		ServiceData:      options.ServiceData,
+	})
 
-	// Convert map[uint16][]byte to map[uint16]any because that's what BlueZ needs.
-	manufacturerData := map[uint16]any{}
-	for _, element := range options.ManufacturerData {
-		manufacturerData[element.CompanyID] = element.Data
+	localName := options.LocalName
+	if localName == "" {
+		localName = options.ScanResponse.LocalName
 	}
 
 	// Build an org.bluez.LEAdvertisement1 object, to be exported over DBus.
@@ -74,7 +87,7 @@ func (a *Advertisement) Configure(options AdvertisementOptions) error {
 			"Type":             {Value: "broadcast"},
 			"ServiceUUIDs":     {Value: serviceUUIDs},
 			"ManufacturerData": {Value: manufacturerData},
-			"LocalName":        {Value: options.LocalName},
+			"LocalName":        {Value: localName},
 			"ServiceData":      {Value: serviceData},
 			// The documentation states:
 			// > Timeout of the advertisement in seconds. This defines the
@@ -85,6 +98,29 @@ func (a *Advertisement) Configure(options AdvertisementOptions) error {
 			// TODO: MinInterval and MaxInterval (experimental as of BlueZ 5.71)
 		},
 	}
+
+	// The scan response properties are experimental in BlueZ, so only add
+	// them when they are used.
+	scanResponse := options.ScanResponse
+	if len(scanResponse.ServiceUUIDs) != 0 || len(scanResponse.ManufacturerData) != 0 || len(scanResponse.ServiceData) != 0 {
+		serviceUUIDs, manufacturerData, serviceData := makeAdvertisementProperties(scanResponse)
+		props := propsSpec["org.bluez.LEAdvertisement1"]
+		props["ScanResponseServiceUUIDs"] = &prop.Prop{Value: serviceUUIDs}
+		props["ScanResponseManufacturerData"] = &prop.Prop{Value: manufacturerData}
+		props["ScanResponseServiceData"] = &prop.Prop{Value: serviceData}
+	}
+
+	// Same for the extended advertising properties.
+	if options.SecondaryPHY != 0 {
+		channels := map[PHY]string{PHY1M: "1M", PHY2M: "2M", PHYCoded: "Coded"}
+		propsSpec["org.bluez.LEAdvertisement1"]["SecondaryChannel"] = &prop.Prop{Value: channels[options.SecondaryPHY]}
+	}
+	if options.TxPower != 0 {
+		props := propsSpec["org.bluez.LEAdvertisement1"]
+		props["TxPower"] = &prop.Prop{Value: int16(options.TxPower)}
+		props["Includes"] = &prop.Prop{Value: []string{"tx-power"}}
+	}
+
 	props, err := prop.Export(a.adapter.bus, a.path, propsSpec)
 	if err != nil {
 		return err
@@ -94,6 +130,26 @@ func (a *Advertisement) Configure(options AdvertisementOptions) error {
 	return nil
 }
 
+// makeAdvertisementProperties converts the service UUIDs, manufacturer data
+// and service data to the types used in org.bluez.LEAdvertisement1.
+func makeAdvertisementProperties(fields AdvertisementFields) (serviceUUIDs []string, manufacturerData map[uint16]any, serviceData map[string]any) {
+	for _, uuid := range fields.ServiceUUIDs {
+		serviceUUIDs = append(serviceUUIDs, uuid.String())
+	}
+	serviceData = make(map[string]any)
+	for _, element := range fields.ServiceData {
+		serviceData[element.UUID.String()] = element.Data
+	}
+
+	// Convert map[uint16][]byte to map[uint16]any because that's what BlueZ needs.
+	manufacturerData = map[uint16]any{}
+	for _, element := range fields.ManufacturerData {
+		manufacturerData[element.CompanyID] = element.Data
+	}
+
+	return
+}
+
 // Start advertisement. May only be called after it has been configured.
 func (a *Advertisement) Start() error {
 	// Register our advertisement object to start advertising.
@@ -134,6 +190,15 @@ func (a *Advertisement) Stop() error {
 // possible some events are missed and perhaps even possible that some events
 // are duplicated.
 func (a *Adapter) Scan(callback func(*Adapter, ScanResult)) error {
+	return a.ScanWithOptions(ScanOptions{}, callback)
+}
+
+// ScanWithOptions starts a BLE scan with the given options. It is stopped by a
+// call to StopScan or when the timeout expires.
+//
+// BlueZ always does an active scan and picks the scan parameters itself, so
+// only FilterDuplicates and Timeout are used.
+func (a *Adapter) ScanWithOptions(options ScanOptions, callback func(*Adapter, ScanResult)) error {
 	if a.scanCancelChan != nil {
 		return errScanning
 	}
@@ -147,7 +212,8 @@ func (a *Adapter) Scan(callback func(*Adapter, ScanResult)) error {
 	// This appears to be necessary to receive any BLE discovery results at all.
 	defer a.adapter.Call("org.bluez.Adapter1.SetDiscoveryFilter", 0)
 	err := a.adapter.Call("org.bluez.Adapter1.SetDiscoveryFilter", 0, map[string]interface{}{
-		"Transport": "le",
+		"Transport":     "le",
+		"DuplicateData": !options.FilterDuplicates,
 	}).Err
 	if err != nil {
 		return err
@@ -201,6 +267,13 @@ func (a *Adapter) Scan(callback func(*Adapter, ScanResult)) error {
 		return err
 	}
 
+	var timeout <-chan time.Time
+	if options.Timeout != 0 {
+		timer := time.NewTimer(options.Timeout)
+		defer timer.Stop()
+		timeout = timer.C
+	}
+
 	for {
 		// Check whether the scan is stopped. This is necessary to avoid a race
 		// condition between the signal channel and the cancelScan channel when
@@ -243,6 +316,10 @@ func (a *Adapter) Scan(callback func(*Adapter, ScanResult)) error {
 				}
 				callback(a, makeScanResult(device))
 			}
+		case <-timeout:
+			a.StopScan()
+		case <-options.done:
+			a.StopScan()
 		case <-cancelChan:
 			continue
 		}
@@ -333,10 +410,9 @@ type Device struct {
 //
 // On Linux and Windows, the IsRandom part of the address is ignored.
 func (a *Adapter) Connect(address Address, params ConnectionParams) (Device, error) {
-	devicePath := dbus.ObjectPath(string(a.adapter.Path()) + "/dev_" + strings.Replace(address.MAC.String(), ":", "_", -1))
 	device := Device{
 		Address: address,
-		device:  a.bus.Object("org.bluez", devicePath),
+		device:  a.bus.Object("org.bluez", a.devicePath(address)),
 		adapter: a,
 	}
 
@@ -390,6 +466,11 @@ func (a *Adapter) Connect(address Address, params ConnectionParams) (Device, err
 	return device, nil
 }
 
+// devicePath returns the path of the BlueZ object of the device.
+func (a *Adapter) devicePath(address Address) dbus.ObjectPath {
+	return dbus.ObjectPath(string(a.adapter.Path()) + "/dev_" + strings.Replace(address.MAC.String(), ":", "_", -1))
+}
+
 // Disconnect from the BLE device. This method is non-blocking and does not
 // wait until the connection is fully gone.
 func (d Device) Disconnect() error {
@@ -408,3 +489,50 @@ func (d Device) Disconnect() error {
 func (d Device) RequestConnectionParams(params ConnectionParams) error {
 	return nil
 }
+
+// RequestDataLength requests a larger (or smaller) payload for link layer data
+// packets sent to the device, between MinDataLength and MaxDataLength bytes.
+//
+// BlueZ doesn't offer a way to request this, so this call always returns
+// ErrNotSupported. The kernel negotiates the data length on its own.
+func (d Device) RequestDataLength(txOctets uint16) error {
+	return ErrNotSupported
+}
+
+// SetPHY requests the PHYs to use for sending to and receiving from the
+// device.
+//
+// BlueZ doesn't offer a way to request this, so this call always returns
+// ErrNotSupported.
+func (d Device) SetPHY(tx, rx PHY) error {
+	return ErrNotSupported
+}
+
+// ExchangeMTU requests a larger (or smaller) ATT MTU for the connection,
+// between MinMTU and MaxMTU bytes, and returns the MTU that both devices agreed
+// on.
+//
+// BlueZ exchanges the MTU on its own after connecting and doesn't offer a way
+// to request a different one, so this call returns the MTU that BlueZ agreed
+// on. It is known once the services have been resolved, see DiscoverServices.
+func (d Device) ExchangeMTU(mtu uint16) (uint16, error) {
+	if mtu < MinMTU || mtu > MaxMTU {
+		return 0, errInvalidMTU
+	}
+
+	// Each characteristic of the device reports the MTU of the connection.
+	var list map[dbus.ObjectPath]map[string]map[string]dbus.Variant
+	err := d.adapter.bluez.Call("org.freedesktop.DBus.ObjectManager.GetManagedObjects", 0).Store(&list)
+	if err != nil {
+		return 0, err
+	}
+	for objectPath, interfaces := range list {
+		if !strings.HasPrefix(string(objectPath), string(d.device.Path())+"/") {
+			continue
+		}
+		if mtu, ok := interfaces["org.bluez.GattCharacteristic1"]["MTU"].Value().(uint16); ok {
+			return mtu, nil
+		}
+	}
+	return 0, errUnknownMTU
+}
@@ -26,6 +26,7 @@ type Address struct {
 // Advertisement encapsulates a single advertisement instance.
 type Advertisement struct {
 	interval      Duration
+	typ           C.uint8_t
 	isAdvertising volatile.Register8
 }
 
@@ -48,13 +49,24 @@ func (a *Advertisement) Configure(options AdvertisementOptions) error {
 	}
 
 	// Construct payload.
-	var payload rawAdvertisementPayload
-	if !payload.addFromOptions(options) {
+	var payload, scanResponse rawAdvertisementPayload
+	if !makeAdvertisementPayloads(options, &payload, &scanResponse) {
 		return errAdvertisementPacketTooBig
 	}
 
-	errCode := C.sd_ble_gap_adv_data_set((*C.uint8_t)(unsafe.Pointer(&payload.data[0])), C.uint8_t(payload.len), nil, 0)
+	var scanResponseData *C.uint8_t
+	if scanResponse.len != 0 {
+		scanResponseData = (*C.uint8_t)(unsafe.Pointer(&scanResponse.data[0]))
+	}
+	errCode := C.sd_ble_gap_adv_data_set((*C.uint8_t)(unsafe.Pointer(&payload.data[0])), C.uint8_t(payload.len), scanResponseData, C.uint8_t(scanResponse.len))
 	a.interval = options.Interval
+	a.typ = C.BLE_GAP_ADV_TYPE_ADV_IND
+	if options.NonConnectable {
+		a.typ = C.BLE_GAP_ADV_TYPE_ADV_NONCONN_IND
+		if scanResponse.len != 0 {
+			a.typ = C.BLE_GAP_ADV_TYPE_ADV_SCAN_IND
+		}
+	}
 	return makeError(errCode)
 }
 
@@ -76,10 +88,28 @@ func (a *Advertisement) Stop() error {
 // is lost.
 func (a *Advertisement) start() C.uint32_t {
 	params := C.ble_gap_adv_params_t{
-		_type:    C.BLE_GAP_ADV_TYPE_ADV_IND,
+		_type:    a.typ,
 		fp:       C.BLE_GAP_ADV_FP_ANY,
 		interval: C.uint16_t(a.interval),
 		timeout:  0, // no timeout
 	}
 	return C.sd_ble_gap_adv_start_noescape(params)
 }
+
+// RequestDataLength requests a larger (or smaller) payload for link layer data
+// packets sent to the device, between MinDataLength and MaxDataLength bytes.
+//
+// The S110 SoftDevice predates the data length extension, so this call always
+// returns ErrNotSupported.
+func (d Device) RequestDataLength(txOctets uint16) error {
+	return ErrNotSupported
+}
+
+// SetPHY requests the PHYs to use for sending to and receiving from the
+// device.
+//
+// The S110 SoftDevice only supports the 1M PHY, so this call always returns
+// ErrNotSupported.
+func (d Device) SetPHY(tx, rx PHY) error {
+	return ErrNotSupported
+}
@@ -23,6 +23,7 @@ type Advertisement struct {
 	handle        C.uint8_t
 	isAdvertising volatile.Register8
 	payload       rawAdvertisementPayload
+	scanResponse  rawAdvertisementPayload
 }
 
 // The nrf528xx devices only seem to support one advertisement instance. The way
@@ -51,8 +52,7 @@ func (a *Advertisement) Configure(options AdvertisementOptions) error {
 	// Construct payload.
 	// Note that the payload needs to be part of the Advertisement object as the
 	// memory is still used after sd_ble_gap_adv_set_configure returns.
-	a.payload.reset()
-	if !a.payload.addFromOptions(options) {
+	if !makeAdvertisementPayloads(options, &a.payload, &a.scanResponse) {
 		return errAdvertisementPacketTooBig
 	}
 
@@ -61,9 +61,22 @@ func (a *Advertisement) Configure(options AdvertisementOptions) error {
 		p_data: (*C.uint8_t)(unsafe.Pointer(&a.payload.data[0])),
 		len:    C.uint16_t(a.payload.len),
 	}
+	if a.scanResponse.len != 0 {
+		data.scan_rsp_data = C.ble_data_t{
+			p_data: (*C.uint8_t)(unsafe.Pointer(&a.scanResponse.data[0])),
+			len:    C.uint16_t(a.scanResponse.len),
+		}
+	}
+	typ := C.uint8_t(C.BLE_GAP_ADV_TYPE_CONNECTABLE_SCANNABLE_UNDIRECTED)
+	if options.NonConnectable {
+		typ = C.BLE_GAP_ADV_TYPE_NONCONNECTABLE_NONSCANNABLE_UNDIRECTED
+		if a.scanResponse.len != 0 {
+			typ = C.BLE_GAP_ADV_TYPE_NONCONNECTABLE_SCANNABLE_UNDIRECTED
+		}
+	}
 	params := C.ble_gap_adv_params_t{
 		properties: C.ble_gap_adv_properties_t{
-			_type: C.BLE_GAP_ADV_TYPE_CONNECTABLE_SCANNABLE_UNDIRECTED,
+			_type: typ,
 		},
 		interval: C.uint32_t(options.Interval),
 	}
@@ -74,7 +87,7 @@ func (a *Advertisement) Configure(options AdvertisementOptions) error {
 // Start advertisement. May only be called after it has been configured.
 func (a *Advertisement) Start() error {
 	a.isAdvertising.Set(1)
-	errCode := C.sd_ble_gap_adv_start(a.handle, C.BLE_CONN_CFG_TAG_DEFAULT)
+	errCode := C.sd_ble_gap_adv_start(a.handle, connectionConfig)
 	return makeError(errCode)
 }
 
@@ -21,7 +21,9 @@ var errConnectionTimeout = errors.New("bluetooth: timeout while connecting")
 // Memory buffers needed by sd_ble_gap_scan_start.
 var (
 	scanReportBuffer rawAdvertisementPayload
+	scanReports      scanReportMerger
 	gotScanReport    volatile.Register8
+	scanTimedOut     volatile.Register8
 	globalScanResult ScanResult
 )
 
@@ -31,6 +33,17 @@ var (
 // The callback is run on the same goroutine as the Scan function when using a
 // SoftDevice.
 func (a *Adapter) Scan(callback func(*Adapter, ScanResult)) error {
+	return a.ScanWithOptions(ScanOptions{}, callback)
+}
+
+// ScanWithOptions starts a BLE scan with the given options. It is stopped by a
+// call to StopScan or when the timeout expires. The default interval is 40ms,
+// with a 30ms window.
+//
+// The SoftDevice doesn't filter duplicates and uses the address configured
+// for the adapter, so FilterDuplicates and OwnAddressType are ignored. The
+// timeout is rounded down to 10ms units, up to about 11 minutes.
+func (a *Adapter) ScanWithOptions(options ScanOptions, callback func(*Adapter, ScanResult)) error {
 	if a.scanning {
 		// There is a possible race condition here if Scan() is called from a
 		// different goroutine, but that is not allowed (and will likely result
@@ -39,16 +52,44 @@ func (a *Adapter) Scan(callback func(*Adapter, ScanResult)) error {
 	}
 	a.scanning = true
 
+	interval := options.Interval
+	if interval == 0 {
+		interval = NewDuration(40 * time.Millisecond)
+	}
+	window := options.Window
+	if window == 0 {
+		window = NewDuration(30 * time.Millisecond)
+		if window > interval {
+			window = interval
+		}
+	}
+	timeout := C.uint16_t(C.BLE_GAP_SCAN_TIMEOUT_UNLIMITED)
+	if options.Timeout != 0 {
+		timeout = C.uint16_t(0xffff)
+		if units := options.Timeout / (10 * time.Millisecond); units < 0xffff {
+			timeout = C.uint16_t(units)
+		}
+		if timeout == 0 {
+			timeout = 1
+		}
+	}
+
 	scanParams := C.ble_gap_scan_params_t{}
 	scanParams.set_bitfield_extended(0)
-	scanParams.set_bitfield_active(0)
-	scanParams.interval = C.uint16_t(NewDuration(40 * time.Millisecond))
-	scanParams.window = C.uint16_t(NewDuration(30 * time.Millisecond))
-	scanParams.timeout = C.BLE_GAP_SCAN_TIMEOUT_UNLIMITED
+	if options.Active {
+		scanParams.set_bitfield_active(1)
+	} else {
+		scanParams.set_bitfield_active(0)
+	}
+	scanParams.set_bitfield_filter_policy(C.uint8_t(options.FilterPolicy))
+	scanParams.interval = C.uint16_t(interval)
+	scanParams.window = C.uint16_t(window)
+	scanParams.timeout = timeout
 	scanReportBufferInfo := C.ble_data_t{
 		p_data: (*C.uint8_t)(unsafe.Pointer(&scanReportBuffer.data[0])),
 		len:    C.uint16_t(len(scanReportBuffer.data)),
 	}
+	scanTimedOut.Set(0)
 	errCode := C.sd_ble_gap_scan_start(&scanParams, &scanReportBufferInfo)
 	if errCode != 0 {
 		return Error(errCode)
@@ -60,6 +101,17 @@ func (a *Adapter) Scan(callback func(*Adapter, ScanResult)) error {
 		// TODO: use some sort of condition variable once the scheduler supports
 		// them.
 		arm.Asm("wfe")
+		if scanTimedOut.Get() != 0 {
+			// The SoftDevice has stopped the scan.
+			a.scanning = false
+			break
+		}
+		select {
+		case <-options.done:
+			a.scanning = false
+			return makeError(C.sd_ble_gap_scan_stop())
+		default:
+		}
 		if gotScanReport.Get() == 0 {
 			// Spurious event. Continue waiting.
 			continue
@@ -67,6 +119,9 @@ func (a *Adapter) Scan(callback func(*Adapter, ScanResult)) error {
 		gotScanReport.Set(0)
 
 		// Call the callback with the scan result.
+		if globalScanResult.IdentityAddress == (Address{}) {
+			globalScanResult.IdentityAddress, _ = a.identityAddress(globalScanResult.Address.MACAddress)
+		}
 		callback(a, globalScanResult)
 
 		// Restart the advertisement. This is needed, because advertisements are
@@ -162,7 +217,7 @@ func (a *Adapter) Connect(address Address, params ConnectionParams) (Device, err
 	connectionAttempt.state.Set(1)
 
 	// Start the connection attempt. We'll get a signal in the event handler.
-	errCode := C.sd_ble_gap_connect(&addr, &scanParams, &connectionParams, C.BLE_CONN_CFG_TAG_DEFAULT)
+	errCode := C.sd_ble_gap_connect(&addr, &scanParams, &connectionParams, connectionConfig)
 	if errCode != 0 {
 		connectionAttempt.state.Set(0)
 		return Device{}, Error(errCode)
@@ -230,3 +285,26 @@ func (d Device) RequestConnectionParams(params ConnectionParams) error {
 	errCode := C.sd_ble_gap_conn_param_update(d.connectionHandle, &connParams)
 	return makeError(errCode)
 }
+
+// handleSecRequest answers a peripheral that asks for security, by encrypting
+// the connection with the key of an earlier pairing or else by pairing.
+func handleSecRequest(handle C.uint16_t) {
+	c := findSecurityConnection(handle)
+	if c == nil || DefaultAdapter.bondStore == nil {
+		return
+	}
+
+	if bond, ok := DefaultAdapter.bondStore.Bond(c.address); ok {
+		var id C.ble_gap_master_id_t
+		id.ediv = C.uint16_t(bond.EDIV)
+		for i := range id.rand {
+			id.rand[i] = C.uint8_t(bond.Rand >> (8 * i))
+		}
+		info := makeEncInfo(bond)
+		C.sd_ble_gap_encrypt(handle, &id, &info)
+		return
+	}
+
+	params := makeSecParams(true)
+	C.sd_ble_gap_authenticate(handle, &params)
+}
@@ -0,0 +1,88 @@
+//go:build (softdevice && s113v7) || (softdevice && s132v6) || (softdevice && s140v6) || (softdevice && s140v7)
+
+package bluetooth
+
+/*
+#include "ble_gap.h"
+*/
+import "C"
+
+// RequestDataLength requests a larger (or smaller) payload for link layer data
+// packets sent to the device, between MinDataLength and MaxDataLength bytes.
+// Both sides negotiate the data length that is actually used, which is
+// reported to the link update handler once it changes.
+//
+// On the Nordic SoftDevice, the data length is also limited by the connection
+// event length of the SoftDevice configuration.
+func (d Device) RequestDataLength(txOctets uint16) error {
+	if txOctets < MinDataLength || txOctets > MaxDataLength {
+		return errInvalidDataLength
+	}
+
+	params := C.ble_gap_data_length_params_t{
+		max_tx_octets:  C.uint16_t(txOctets),
+		max_rx_octets:  C.BLE_GAP_DATA_LENGTH_AUTO,
+		max_tx_time_us: C.BLE_GAP_DATA_LENGTH_AUTO,
+		max_rx_time_us: C.BLE_GAP_DATA_LENGTH_AUTO,
+	}
+	errCode := C.sd_ble_gap_data_length_update(d.connectionHandle, &params, nil)
+	return makeError(errCode)
+}
+
+// SetPHY requests the PHYs to use for sending to and receiving from the
+// device. A zero PHY leaves the choice for that direction to the SoftDevice.
+// The PHYs that are actually used are reported to the link update handler once
+// they change.
+func (d Device) SetPHY(tx, rx PHY) error {
+	phys := C.ble_gap_phys_t{
+		tx_phys: makeSoftDevicePHY(tx),
+		rx_phys: makeSoftDevicePHY(rx),
+	}
+	errCode := C.sd_ble_gap_phy_update(d.connectionHandle, &phys)
+	return makeError(errCode)
+}
+
+// makeSoftDevicePHY converts a PHY to the SoftDevice PHY bit.
+func makeSoftDevicePHY(phy PHY) C.uint8_t {
+	switch phy {
+	case PHY1M:
+		return C.BLE_GAP_PHY_1MBPS
+	case PHY2M:
+		return C.BLE_GAP_PHY_2MBPS
+	case PHYCoded:
+		return C.BLE_GAP_PHY_CODED
+	default:
+		return C.BLE_GAP_PHY_AUTO
+	}
+}
+
+// makePHY converts a SoftDevice PHY bit to a PHY.
+func makePHY(phy C.uint8_t) PHY {
+	switch phy {
+	case C.BLE_GAP_PHY_1MBPS:
+		return PHY1M
+	case C.BLE_GAP_PHY_2MBPS:
+		return PHY2M
+	case C.BLE_GAP_PHY_CODED:
+		return PHYCoded
+	default:
+		return 0
+	}
+}
+
+// handleLinkUpdate passes a data length or PHY update event to the link update
+// handler, if there is one. The device has the address of the peer that was
+// recorded when it connected.
+func handleLinkUpdate(connectionHandle C.uint16_t, update LinkUpdate) {
+	if DefaultAdapter.linkUpdateHandler == nil {
+		return
+	}
+
+	device := Device{
+		connectionHandle: connectionHandle,
+	}
+	if int(connectionHandle) < len(connectionPeers) {
+		device.Address = Address{connectionPeers[connectionHandle].address}
+	}
+	DefaultAdapter.linkUpdateHandler(device, update)
+}
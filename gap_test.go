@@ -42,12 +42,9 @@ func TestCreateAdvertisementPayload(t *testing.T) {
 			},
 		},
 		{
-			// Note: the two service UUIDs should really be merged into one to
-			// save space.
 			raw: "\x02\x01\x06" + // flags
 				"\x0b\x09Heart rate" + // local name
-				"\x03\x03\x0d\x18" + // heart rate service UUID
-				"\x03\x03\x0f\x18", // battery service UUID
+				"\x05\x03\x0d\x18\x0f\x18", // heart rate and battery service UUIDs
 			parsed: AdvertisementOptions{
 				LocalName: "Heart rate",
 				ServiceUUIDs: []UUID{
@@ -131,3 +128,74 @@ func TestCreateAdvertisementPayload(t *testing.T) {
 		}
 	}
 }
+
+func TestCreateScanResponsePayload(t *testing.T) {
+	uuid128, _ := ParseUUID("a0b40001-926d-4d61-98df-8c5c62ee53b3")
+	raw128 := uuid128.Bytes()
+
+	var adv, scanResponse rawAdvertisementPayload
+
+	// A 128-bit UUID and a long name don't fit together.
+	options := AdvertisementOptions{
+		LocalName:    "A rather long name",
+		ServiceUUIDs: []UUID{uuid128},
+	}
+	if makeAdvertisementPayloads(options, &adv, &scanResponse) {
+		t.Error("expected advertisement to overflow")
+	}
+
+	// With AutoScanResponse, the name is moved to the scan response.
+	options.AutoScanResponse = true
+	if !makeAdvertisementPayloads(options, &adv, &scanResponse) {
+		t.Fatal("expected advertisement to fit")
+	}
+	if expected := "\x02\x01\x06\x11\x07" + string(raw128[:]); string(adv.Bytes()) != expected {
+		t.Errorf("unexpected advertisement:\nexpected: %x\nactual:   %x", expected, adv.Bytes())
+	}
+	if expected := "\x13\x09A rather long name"; string(scanResponse.Bytes()) != expected {
+		t.Errorf("unexpected scan response:\nexpected: %x\nactual:   %x", expected, scanResponse.Bytes())
+	}
+
+	// Explicit scan response fields.
+	options = AdvertisementOptions{
+		ServiceUUIDs: []UUID{ServiceUUIDHeartRate},
+		ScanResponse: AdvertisementFields{
+			LocalName: "foobar",
+			ManufacturerData: []ManufacturerDataElement{
+				{0xffff, []byte{1, 2}},
+			},
+		},
+	}
+	if !makeAdvertisementPayloads(options, &adv, &scanResponse) {
+		t.Fatal("expected advertisement to fit")
+	}
+	if expected := "\x02\x01\x06\x03\x03\x0d\x18"; string(adv.Bytes()) != expected {
+		t.Errorf("unexpected advertisement:\nexpected: %x\nactual:   %x", expected, adv.Bytes())
+	}
+	if expected := "\x07\x09foobar\x05\xff\xff\xff\x01\x02"; string(scanResponse.Bytes()) != expected {
+		t.Errorf("unexpected scan response:\nexpected: %x\nactual:   %x", expected, scanResponse.Bytes())
+	}
+}
+
+func TestScanReportMerger(t *testing.T) {
+	var m scanReportMerger
+	a := MACAddress{MAC: MAC{1, 2, 3, 4, 5, 6}}
+	b := MACAddress{MAC: MAC{6, 5, 4, 3, 2, 1}}
+
+	if p := m.add(a, false, []byte("\x02\x01\x06\x03\x03\x0d\x18")); p.LocalName() != "" || !p.HasServiceUUID(ServiceUUIDHeartRate) {
+		t.Errorf("unexpected advertisement payload: %x", p.Bytes())
+	}
+	m.add(b, false, []byte("\x02\x01\x06"))
+
+	// The scan response is merged with the advertisement of the same device.
+	p := m.add(a, true, []byte("\x04\x09abc"))
+	if p.LocalName() != "abc" || !p.HasServiceUUID(ServiceUUIDHeartRate) {
+		t.Errorf("unexpected merged payload: %x", p.Bytes())
+	}
+
+	// A scan response of an unknown device is reported as-is.
+	c := MACAddress{MAC: MAC{1, 1, 1, 1, 1, 1}}
+	if p := m.add(c, true, []byte("\x04\x09def")); string(p.Bytes()) != "\x04\x09def" {
+		t.Errorf("unexpected scan response payload: %x", p.Bytes())
+	}
+}
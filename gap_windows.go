@@ -2,6 +2,7 @@ package bluetooth
 
 import (
 	"fmt"
+	"time"
 	"unsafe"
 
 	"github.com/go-ole/go-ole"
@@ -20,7 +21,17 @@ type Address struct {
 
 // Scan starts a BLE scan. It is stopped by a call to StopScan. A common pattern
 // is to cancel the scan when a particular device has been found.
+//
+// On Windows, Scan does an active scan so that scan responses are received.
 func (a *Adapter) Scan(callback func(*Adapter, ScanResult)) (err error) {
+	return a.ScanWithOptions(ScanOptions{Active: true}, callback)
+}
+
+// ScanWithOptions starts a BLE scan with the given options. It is stopped by a
+// call to StopScan or when the timeout expires.
+//
+// On Windows, only Active and Timeout are used.
+func (a *Adapter) ScanWithOptions(options ScanOptions, callback func(*Adapter, ScanResult)) (err error) {
 	if a.watcher != nil {
 		// Cannot scan more than once: which one should ScanStop()
 		// stop?
@@ -36,9 +47,13 @@ func (a *Adapter) Scan(callback func(*Adapter, ScanResult)) (err error) {
 		a.watcher = nil
 	}()
 
-	// Set scanning mode to active so we receive scan responses
-	// from devices in advertising mode
-	err = a.watcher.SetScanningMode(advertisement.BluetoothLEScanningModeActive)
+	// Active scanning is needed to receive scan responses from devices in
+	// advertising mode.
+	scanningMode := advertisement.BluetoothLEScanningModePassive
+	if options.Active {
+		scanningMode = advertisement.BluetoothLEScanningModeActive
+	}
+	err = a.watcher.SetScanningMode(scanningMode)
 	if err != nil {
 		return
 	}
@@ -102,6 +117,26 @@ func (a *Adapter) Scan(callback func(*Adapter, ScanResult)) (err error) {
 		return err
 	}
 
+	if options.Timeout != 0 {
+		watcher := a.watcher
+		timer := time.AfterFunc(options.Timeout, func() {
+			watcher.Stop()
+		})
+		defer timer.Stop()
+	}
+	if options.done != nil {
+		watcher := a.watcher
+		finished := make(chan struct{})
+		defer close(finished)
+		go func() {
+			select {
+			case <-options.done:
+				watcher.Stop()
+			case <-finished:
+			}
+		}()
+	}
+
 	// Wait until advertisement has stopped, and finish.
 	return <-stoppingChan
 }
@@ -268,3 +303,32 @@ func (d Device) RequestConnectionParams(params ConnectionParams) error {
 	// BluetoothLEDevice.RequestPreferredConnectionParameters.
 	return nil
 }
+
+// RequestDataLength requests a larger (or smaller) payload for link layer data
+// packets sent to the device, between MinDataLength and MaxDataLength bytes.
+//
+// This call has not yet been implemented on Windows and returns ErrNotSupported.
+func (d Device) RequestDataLength(txOctets uint16) error {
+	return ErrNotSupported
+}
+
+// SetPHY requests the PHYs to use for sending to and receiving from the
+// device.
+//
+// This call has not yet been implemented on Windows and returns ErrNotSupported.
+func (d Device) SetPHY(tx, rx PHY) error {
+	return ErrNotSupported
+}
+
+// ExchangeMTU requests a larger (or smaller) ATT MTU for the connection,
+// between MinMTU and MaxMTU bytes, and returns the MTU that both devices agreed
+// on.
+//
+// Windows exchanges the MTU on its own and doesn't offer a way to request a
+// different one, so this call returns the MTU of the GATT session.
+func (d Device) ExchangeMTU(mtu uint16) (uint16, error) {
+	if mtu < MinMTU || mtu > MaxMTU {
+		return 0, errInvalidMTU
+	}
+	return d.session.GetMaxPduSize()
+}
@@ -222,9 +222,10 @@ func (c DeviceCharacteristic) EnableNotifications(callback func(buf []byte)) err
 	return nil
 }
 
-// GetMTU returns the MTU for the characteristic.
+// GetMTU returns the ATT MTU of the connection.
 func (c DeviceCharacteristic) GetMTU() (uint16, error) {
-	return uint16(c.service.device.prph.MaximumWriteValueLength(false)), nil
+	// The longest write without response fills the MTU after a 3 byte header.
+	return uint16(c.service.device.prph.MaximumWriteValueLength(false)) + 3, nil
 }
 
 // Read reads the current characteristic value.
@@ -247,3 +248,21 @@ func (c *deviceCharacteristic) Read(data []byte) (n int, err error) {
 	copy(data, c.characteristic.Value())
 	return len(c.characteristic.Value()), nil
 }
+
+// ReadLong reads the characteristic value into data, and returns the number of
+// bytes read. CoreBluetooth reads long values by itself, so this is the same as Read
+// except that the returned length is limited to the length of data.
+func (c DeviceCharacteristic) ReadLong(data []byte) (int, error) {
+	n, err := c.Read(data)
+	if n > len(data) {
+		n = len(data)
+	}
+	return n, err
+}
+
+// WriteLong replaces the characteristic value with a new value, which may be
+// longer than fits in a single write. CoreBluetooth sends long values with Prepare
+// Write Requests by itself, so this is the same as Write.
+func (c DeviceCharacteristic) WriteLong(p []byte) (n int, err error) {
+	return c.Write(p)
+}
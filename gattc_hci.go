@@ -68,7 +68,14 @@ func (d Device) DiscoverServices(uuids []UUID) ([]DeviceService, error) {
 	endHandle := uint16(0xffff)
 	for endHandle == uint16(0xffff) {
 		err := d.adapter.att.readByGroupReq(d.handle, startHandle, endHandle, gattServiceUUID)
-		if err != nil {
+		switch {
+		case err == ErrATTOp:
+			opcode, _, errcode := d.adapter.att.lastError(d.handle)
+			if opcode != attOpReadByGroupReq || errcode != attErrorAttrNotFound {
+				return nil, err
+			}
+			// no more services
+		case err != nil:
 			return nil, err
 		}
 
@@ -255,9 +262,13 @@ func (c DeviceCharacteristic) WriteWithoutResponse(p []byte) (n int, err error)
 // notification with a new value every time the value of the characteristic
 // changes.
 //
+// Characteristics that only support indications are subscribed to with
+// indications instead. These are confirmed automatically and passed to the
+// callback like notifications.
+//
 // Users may call EnableNotifications with a nil callback to disable notifications.
 func (c DeviceCharacteristic) EnableNotifications(callback func(buf []byte)) error {
-	if !c.permissions.Notify() {
+	if !c.permissions.Notify() && !c.permissions.Indicate() {
 		return errNoNotify
 	}
 
@@ -278,7 +289,11 @@ func (c DeviceCharacteristic) EnableNotifications(callback func(buf []byte)) err
 			println("enabling notifications")
 		}
 
-		err := c.service.device.adapter.att.writeReq(c.service.device.handle, c.handle+1, []byte{0x01, 0x00})
+		value := []byte{cccdNotify, 0x00}
+		if !c.permissions.Notify() {
+			value[0] = cccdIndicate
+		}
+		err := c.service.device.adapter.att.writeReq(c.service.device.handle, c.handle+1, value)
 		if err != nil {
 			return err
 		}
@@ -292,19 +307,23 @@ func (c DeviceCharacteristic) EnableNotifications(callback func(buf []byte)) err
 	return nil
 }
 
-// GetMTU returns the MTU for the characteristic.
+// GetMTU returns the ATT MTU of the connection, which is the default MTU
+// until it is exchanged with Device.ExchangeMTU.
 func (c DeviceCharacteristic) GetMTU() (uint16, error) {
-	err := c.service.device.adapter.att.mtuReq(c.service.device.handle)
+	a := c.service.device.adapter.att
+	a.busy.Lock()
+	defer a.busy.Unlock()
+
+	cd, err := a.findConnectionData(c.service.device.handle)
 	if err != nil {
 		return 0, err
 	}
 
-	c.service.device.mtu = c.service.device.adapter.att.mtu
-
-	return c.service.device.mtu, nil
+	return uint16(cd.attMTU()), nil
 }
 
-// Read reads the current characteristic value.
+// Read reads the current characteristic value up to MTU length. Use ReadLong
+// to read longer values.
 func (c DeviceCharacteristic) Read(data []byte) (int, error) {
 	if !c.permissions.Read() {
 		return 0, errNoRead
@@ -328,3 +347,84 @@ func (c DeviceCharacteristic) Read(data []byte) (int, error) {
 
 	return len(cd.value), nil
 }
+
+// ReadLong reads the characteristic value into data, also when the value is
+// longer than fits in a single read. It reads the rest of the value with Read
+// Blob Requests, until the whole value has been read or data is full, and
+// returns the number of bytes read.
+func (c DeviceCharacteristic) ReadLong(data []byte) (int, error) {
+	if !c.permissions.Read() {
+		return 0, errNoRead
+	}
+
+	a := c.service.device.adapter.att
+	handle := c.service.device.handle
+	n := 0
+	for n < len(data) {
+		var err error
+		if n == 0 {
+			err = a.readReq(handle, c.handle)
+		} else {
+			err = a.readBlobReq(handle, c.handle, uint16(n))
+		}
+		if err != nil {
+			// Some servers report the end of a value that exactly fills
+			// the earlier responses with an error.
+			if _, _, code := a.lastError(handle); n > 0 && (code == attErrorAttrNotLong || code == attErrorInvalidOffset) {
+				break
+			}
+			return n, err
+		}
+
+		cd, err := a.findConnectionData(handle)
+		if err != nil {
+			return n, err
+		}
+		n += copy(data[n:], cd.value)
+
+		// A response that doesn't fill the MTU is the end of the value.
+		if len(cd.value) < cd.attMTU()-1 {
+			break
+		}
+	}
+
+	return n, nil
+}
+
+// WriteLong replaces the characteristic value with a new value, which may be
+// longer than fits in a single write. The value is sent in parts with Prepare
+// Write Requests, which the peripheral applies at once when they are
+// executed.
+func (c DeviceCharacteristic) WriteLong(p []byte) (n int, err error) {
+	if !c.permissions.Write() {
+		return 0, errNoWrite
+	}
+
+	a := c.service.device.adapter.att
+	handle := c.service.device.handle
+	cd, err := a.findConnectionData(handle)
+	if err != nil {
+		return 0, err
+	}
+
+	// A Prepare Write Request has a 5 byte header.
+	size := cd.attMTU() - 5
+	for n < len(p) {
+		part := p[n:]
+		if len(part) > size {
+			part = part[:size]
+		}
+		if err := a.prepWriteReq(handle, c.handle, uint16(n), part); err != nil {
+			// Cancel the parts that were already sent.
+			a.execWriteReq(handle, 0x00)
+			return 0, err
+		}
+		n += len(part)
+	}
+
+	if err := a.execWriteReq(handle, 0x01); err != nil {
+		return 0, err
+	}
+
+	return n, nil
+}
@@ -1,4 +1,4 @@
-//go:build !baremetal
+//go:build !baremetal && !hci
 
 package bluetooth
 
@@ -234,6 +234,10 @@ func (c DeviceCharacteristic) WriteWithoutResponse(p []byte) (n int, err error)
 // notification with a new value every time the value of the characteristic
 // changes.
 //
+// BlueZ subscribes to indications instead for characteristics that only
+// support indications. These are confirmed automatically and passed to the
+// callback like notifications.
+//
 // Users may call EnableNotifications with a nil callback to disable notifications.
 func (c DeviceCharacteristic) EnableNotifications(callback func(buf []byte)) error {
 	switch callback {
@@ -305,3 +309,30 @@ func (c DeviceCharacteristic) Read(data []byte) (int, error) {
 	copy(data, result)
 	return len(result), nil
 }
+
+// ReadLong reads the characteristic value into data, also when the value is
+// longer than fits in a single read, and returns the number of bytes read.
+// BlueZ reads long values with Read Blob Requests by itself.
+func (c DeviceCharacteristic) ReadLong(data []byte) (int, error) {
+	var result []byte
+	err := c.characteristic.Call("org.bluez.GattCharacteristic1.ReadValue", 0, map[string]dbus.Variant{}).Store(&result)
+	if err != nil {
+		return 0, err
+	}
+	return copy(data, result), nil
+}
+
+// WriteLong replaces the characteristic value with a new value, which may be
+// longer than fits in a single write. BlueZ sends the value in parts with
+// Prepare Write Requests, which the peripheral applies at once when they are
+// executed.
+func (c DeviceCharacteristic) WriteLong(p []byte) (n int, err error) {
+	options := map[string]dbus.Variant{
+		"type": dbus.MakeVariant("reliable"),
+	}
+	err = c.characteristic.Call("org.bluez.GattCharacteristic1.WriteValue", 0, p, options).Err
+	if err != nil {
+		return 0, err
+	}
+	return len(p), nil
+}
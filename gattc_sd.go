@@ -23,6 +23,8 @@ var (
 	errAlreadyDiscovering = errors.New("bluetooth: already discovering a service or characteristic")
 	errNotFound           = errors.New("bluetooth: not found")
 	errNoNotify           = errors.New("bluetooth: no notify permission")
+	errReadFailed         = errors.New("bluetooth: read failed")
+	errWriteFailed        = errors.New("bluetooth: write failed")
 )
 
 // A global used while discovering services, to communicate between the main
@@ -277,9 +279,9 @@ func (s DeviceService) DiscoverCharacteristics(uuids []UUID) ([]DeviceCharacteri
 		dc.permissions = permissions
 		dc.valueHandle = foundCharacteristicHandle
 
-		if permissions&CharacteristicNotifyPermission != 0 {
-			// This characteristic has the notify permission, so most
-			// likely it also supports notifications.
+		if permissions&(CharacteristicNotifyPermission|CharacteristicIndicatePermission) != 0 {
+			// This characteristic has the notify or indicate permission, so
+			// most likely it has a CCCD.
 			errCode := C.sd_ble_gattc_descriptors_discover(s.connectionHandle, &C.ble_gattc_handle_range_t{
 				start_handle: startHandle,
 				end_handle:   startHandle + 1,
@@ -350,11 +352,15 @@ var gattcNotificationCallbacks []gattcNotificationCallback
 // notification with a new value every time the value of the characteristic
 // changes.
 //
+// Characteristics that only support indications are subscribed to with
+// indications instead. These are confirmed automatically and passed to the
+// callback like notifications.
+//
 // Warning: when using the SoftDevice, the callback is called from an interrupt
 // which means there are various limitations (such as not being able to allocate
 // heap memory).
 func (c DeviceCharacteristic) EnableNotifications(callback func(buf []byte)) error {
-	if c.permissions&CharacteristicNotifyPermission == 0 {
+	if c.permissions&(CharacteristicNotifyPermission|CharacteristicIndicatePermission) == 0 {
 		return errNoNotify
 	}
 
@@ -401,7 +407,10 @@ func (c DeviceCharacteristic) EnableNotifications(callback func(buf []byte)) err
 	}
 
 	// Write to the CCCD to enable notifications. Don't wait for a response.
-	value := [2]C.uint8_t{0x01, 0x00} // 0x0001 enables notifications (and disables indications)
+	value := [2]C.uint8_t{cccdNotify, 0x00} // 0x0001 enables notifications (and disables indications)
+	if c.permissions&CharacteristicNotifyPermission == 0 {
+		value[0] = cccdIndicate
+	}
 	errCode := C.sd_ble_gattc_write(c.connectionHandle, &C.ble_gattc_write_params_t{
 		write_op: C.BLE_GATT_OP_WRITE_CMD,
 		handle:   c.cccdHandle,
@@ -418,12 +427,12 @@ var readingCharacteristic struct {
 	handle_value volatileHandle
 	offset       C.uint16_t
 	length       C.uint16_t
+	status       C.uint16_t
 	value        []byte
 }
 
-// Read reads the current characteristic value up to MTU length.
-// A future enhancement would be to be able to retrieve a longer
-// value by making multiple calls.
+// Read reads the current characteristic value up to MTU length. Use ReadLong
+// to read longer values.
 func (c DeviceCharacteristic) Read(data []byte) (n int, err error) {
 	// global will copy bytes from read operation into data slice
 	readingCharacteristic.value = data
@@ -448,7 +457,152 @@ func (c DeviceCharacteristic) Read(data []byte) (n int, err error) {
 	return
 }
 
-// GetMTU returns the MTU for the characteristic.
+// GetMTU returns the ATT MTU of the connection, which is the default MTU
+// until it is exchanged with Device.ExchangeMTU.
 func (c DeviceCharacteristic) GetMTU() (uint16, error) {
-	return uint16(C.BLE_GATT_ATT_MTU_DEFAULT), nil
+	return connectionMTU(c.connectionHandle), nil
+}
+
+// A global that is set while an MTU exchange is in progress. The event handler
+// clears it once the peripheral has responded.
+var exchangingMTU volatile.Register8
+
+// ExchangeMTU requests a larger (or smaller) ATT MTU for the connection,
+// between MinMTU and MaxMTU bytes, and returns the MTU that both devices agreed
+// on. The MTU can only be exchanged once per connection, and only by the
+// central. The new MTU is also reported to the link update handler.
+//
+// The SoftDevice always requests the MTU it was configured with (see
+// Adapter.SetPreferredMTU), so that MTU is also the limit for the MTU that
+// both devices can agree on.
+func (d Device) ExchangeMTU(mtu uint16) (uint16, error) {
+	if mtu < MinMTU || mtu > MaxMTU {
+		return 0, errInvalidMTU
+	}
+
+	exchangingMTU.Set(1)
+	errCode := C.sd_ble_gattc_exchange_mtu_request(d.connectionHandle, C.uint16_t(DefaultAdapter.attMTU()))
+	if errCode != 0 {
+		exchangingMTU.Set(0)
+		return 0, Error(errCode)
+	}
+
+	for exchangingMTU.Get() != 0 {
+		arm.Asm("wfe")
+	}
+
+	return connectionMTU(d.connectionHandle), nil
+}
+
+// ReadLong reads the characteristic value into data, also when the value is
+// longer than fits in a single read. It reads the rest of the value with Read
+// Blob Requests, until the whole value has been read or data is full, and
+// returns the number of bytes read.
+func (c DeviceCharacteristic) ReadLong(data []byte) (n int, err error) {
+	mtu := int(connectionMTU(c.connectionHandle))
+	for n < len(data) {
+		// The SoftDevice sends a Read Blob Request for a non-zero offset.
+		readingCharacteristic.value = data[n:]
+		errCode := C.sd_ble_gattc_read(c.connectionHandle, c.valueHandle, C.uint16_t(n))
+		if errCode != 0 {
+			return n, Error(errCode)
+		}
+
+		for readingCharacteristic.handle_value.Get() == 0 {
+			arm.Asm("wfe")
+		}
+		length := int(readingCharacteristic.length)
+		status := readingCharacteristic.status
+		readingCharacteristic.handle_value.Set(0)
+		readingCharacteristic.length = 0
+
+		if status != C.BLE_GATT_STATUS_SUCCESS {
+			// Some servers report the end of a value that exactly fills the
+			// earlier responses with an error.
+			if n > 0 && (status == C.BLE_GATT_STATUS_ATTERR_INVALID_OFFSET || status == C.BLE_GATT_STATUS_ATTERR_ATTRIBUTE_NOT_LONG) {
+				break
+			}
+			return n, errReadFailed
+		}
+
+		if length > len(data)-n {
+			length = len(data) - n
+		}
+		n += length
+
+		// A response that doesn't fill the MTU is the end of the value.
+		if length < mtu-1 {
+			break
+		}
+	}
+
+	return n, nil
+}
+
+// A global used to pass the result of a write request from the event handler
+// back to writeRequest below.
+var writingCharacteristic struct {
+	done   volatile.Register8
+	status C.uint16_t
+}
+
+// WriteLong replaces the characteristic value with a new value, which may be
+// longer than fits in a single write. The value is sent in parts with Prepare
+// Write Requests, which the peripheral applies at once when they are
+// executed.
+func (c DeviceCharacteristic) WriteLong(p []byte) (n int, err error) {
+	if len(p) == 0 {
+		return 0, nil
+	}
+
+	// A Prepare Write Request has a 5 byte header.
+	size := int(connectionMTU(c.connectionHandle)) - 5
+	for n < len(p) {
+		part := p[n:]
+		if len(part) > size {
+			part = part[:size]
+		}
+		if err := c.writeRequest(C.BLE_GATT_OP_PREP_WRITE_REQ, 0, n, part); err != nil {
+			// Cancel the parts that were already sent.
+			c.writeRequest(C.BLE_GATT_OP_EXEC_WRITE_REQ, C.BLE_GATT_EXEC_WRITE_FLAG_PREPARED_CANCEL, 0, nil)
+			return 0, err
+		}
+		n += len(part)
+	}
+
+	err = c.writeRequest(C.BLE_GATT_OP_EXEC_WRITE_REQ, C.BLE_GATT_EXEC_WRITE_FLAG_PREPARED_WRITE, 0, nil)
+	if err != nil {
+		return 0, err
+	}
+	return n, nil
+}
+
+// writeRequest sends a write that the peripheral responds to, and waits for
+// the response.
+func (c DeviceCharacteristic) writeRequest(op, flags C.uint8_t, offset int, value []byte) error {
+	var p *C.uint8_t
+	if len(value) != 0 {
+		p = (*C.uint8_t)(unsafe.Pointer(&value[0]))
+	}
+
+	writingCharacteristic.done.Set(0)
+	errCode := C.sd_ble_gattc_write(c.connectionHandle, &C.ble_gattc_write_params_t{
+		write_op: op,
+		flags:    flags,
+		handle:   c.valueHandle,
+		offset:   C.uint16_t(offset),
+		len:      C.uint16_t(len(value)),
+		p_value:  p,
+	})
+	if errCode != 0 {
+		return Error(errCode)
+	}
+
+	for writingCharacteristic.done.Get() == 0 {
+		arm.Asm("wfe")
+	}
+	if writingCharacteristic.status != C.BLE_GATT_STATUS_SUCCESS {
+		return errWriteFailed
+	}
+	return nil
 }
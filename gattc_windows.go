@@ -432,3 +432,21 @@ func (c DeviceCharacteristic) EnableNotifications(callback func(buf []byte)) err
 
 	return nil
 }
+
+// ReadLong reads the characteristic value into data, and returns the number of
+// bytes read. Windows reads long values by itself, so this is the same as Read
+// except that the returned length is limited to the length of data.
+func (c DeviceCharacteristic) ReadLong(data []byte) (int, error) {
+	n, err := c.Read(data)
+	if n > len(data) {
+		n = len(data)
+	}
+	return n, err
+}
+
+// WriteLong replaces the characteristic value with a new value, which may be
+// longer than fits in a single write. Windows sends long values with Prepare
+// Write Requests by itself, so this is the same as Write.
+func (c DeviceCharacteristic) WriteLong(p []byte) (n int, err error) {
+	return c.Write(p)
+}
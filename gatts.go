@@ -1,5 +1,21 @@
 package bluetooth
 
+import (
+	"errors"
+	"strconv"
+	"time"
+)
+
+var errNoIndicate = errors.New("bluetooth: indicate not permitted")
+
+// indicationTimeout is how long Characteristic.Write waits for a client to
+// confirm an indication.
+const indicationTimeout = 10 * time.Second
+
+// maxAttributeLength is the longest attribute value allowed by the
+// specification.
+const maxAttributeLength = 512
+
 // Service is a GATT service to be used in AddService.
 type Service struct {
 	handle uint16
@@ -15,9 +31,131 @@ type Service struct {
 type CharacteristicConfig struct {
 	Handle *Characteristic
 	UUID
-	Value      []byte
-	Flags      CharacteristicPermissions
+	Value    []byte
+	Flags    CharacteristicPermissions
+	Security CharacteristicSecurity
+
+	// MaxLength is the longest value that clients can write. Zero allows the
+	// longest value permitted by the specification, 512 bytes.
+	MaxLength int
+
+	// Descriptors are added after the value, and after the Client
+	// Characteristic Configuration descriptor that is added automatically
+	// for notifications and indications.
+	Descriptors []DescriptorConfig
+
+	// ReadEvent is optional. If it is set, it returns the value from the
+	// offset on for each read of a client, instead of Value, so the value can
+	// be computed when it is needed. A long read calls it once for each part
+	// of the value. If it returns an error, the read fails with that error if
+	// it is an ATTError, or with ATTErrorReadNotPermitted otherwise.
+	ReadEvent func(client Connection, offset int) ([]byte, error)
+
+	// WriteEvent is optional. It is called after a client wrote the value at
+	// the offset, but not for Characteristic.Write. The client is the
+	// connection that Adapter.ConnectionInfo describes, as for ReadEvent.
 	WriteEvent func(client Connection, offset int, value []byte)
+
+	// AuthorizeEvent decides whether a client may read or write the value,
+	// when the Security asks for authorization. It is called before each
+	// such access, and the access fails with
+	// ATTErrorInsufficientAuthorization unless it returns true. Without it,
+	// these accesses always fail.
+	AuthorizeEvent func(client Connection, write bool) bool
+}
+
+// DescriptorConfig contains the parameters for the configuration of a single
+// descriptor of a characteristic, for example a Characteristic User
+// Description.
+type DescriptorConfig struct {
+	UUID
+	Value    []byte
+	Flags    DescriptorPermissions
+	Security CharacteristicSecurity
+
+	// ReadEvent is optional. If it is set, it returns the value from the
+	// offset on for each read of a client, instead of Value. If it returns an
+	// error, the read fails as for CharacteristicConfig.ReadEvent.
+	ReadEvent func(client Connection, offset int) ([]byte, error)
+
+	// WriteEvent is optional. It is called after a client wrote the value at
+	// the offset.
+	WriteEvent func(client Connection, offset int, value []byte)
+
+	// AuthorizeEvent decides whether a client may read or write the value, as
+	// for CharacteristicConfig.AuthorizeEvent.
+	AuthorizeEvent func(client Connection, write bool) bool
+}
+
+// ATTError is an error code of the Attribute Protocol. A read handler can
+// return it to make the read of a client fail with that error. The codes from
+// 0x80 to 0x9f are for errors defined by the application.
+type ATTError uint8
+
+// ATT error codes that read handlers may return.
+const (
+	ATTErrorReadNotPermitted            ATTError = 0x02
+	ATTErrorInvalidOffset               ATTError = 0x07
+	ATTErrorInsufficientAuthorization   ATTError = 0x08
+	ATTErrorInvalidAttributeValueLength ATTError = 0x0d
+	ATTErrorUnlikely                    ATTError = 0x0e
+	ATTErrorInsufficientResources       ATTError = 0x11
+	ATTErrorValueNotAllowed             ATTError = 0x13
+	ATTErrorApplication                 ATTError = 0x80
+	ATTErrorOutOfRange                  ATTError = 0xff
+)
+
+func (e ATTError) Error() string {
+	switch e {
+	case ATTErrorReadNotPermitted:
+		return "bluetooth: read not permitted"
+	case ATTErrorInvalidOffset:
+		return "bluetooth: invalid offset"
+	case ATTErrorInsufficientAuthorization:
+		return "bluetooth: insufficient authorization"
+	case ATTErrorInvalidAttributeValueLength:
+		return "bluetooth: invalid attribute value length"
+	case ATTErrorUnlikely:
+		return "bluetooth: unlikely error"
+	case ATTErrorInsufficientResources:
+		return "bluetooth: insufficient resources"
+	case ATTErrorValueNotAllowed:
+		return "bluetooth: value not allowed"
+	case ATTErrorOutOfRange:
+		return "bluetooth: out of range"
+	}
+	if e >= ATTErrorApplication && e <= 0x9f {
+		return "bluetooth: application error 0x" + strconv.FormatUint(uint64(e), 16)
+	}
+	return "bluetooth: ATT error 0x" + strconv.FormatUint(uint64(e), 16)
+}
+
+// attErrorCode returns the ATT error code for an error from a read handler.
+func attErrorCode(err error) uint8 {
+	var code ATTError
+	if errors.As(err, &code) && code != 0 {
+		return uint8(code)
+	}
+	return uint8(ATTErrorReadNotPermitted)
+}
+
+// DescriptorPermissions lists what clients can do with a descriptor.
+type DescriptorPermissions uint8
+
+// Descriptor permission bitfields.
+const (
+	DescriptorReadPermission DescriptorPermissions = 1 << iota
+	DescriptorWritePermission
+)
+
+// Read returns whether reading of the descriptor is permitted.
+func (p DescriptorPermissions) Read() bool {
+	return p&DescriptorReadPermission != 0
+}
+
+// Write returns whether writing of the descriptor is permitted.
+func (p DescriptorPermissions) Write() bool {
+	return p&DescriptorWritePermission != 0
 }
 
 // CharacteristicPermissions lists a number of basic permissions/capabilities
@@ -34,6 +172,18 @@ const (
 	CharacteristicWritePermission
 	CharacteristicNotifyPermission
 	CharacteristicIndicatePermission
+
+	// CharacteristicSignedWritePermission allows bonded clients to write the
+	// value with Signed Write Command, without encrypting the connection. It
+	// is supported by the HCI stack and on Linux.
+	CharacteristicSignedWritePermission
+)
+
+// Bits of the Client Characteristic Configuration descriptor, which a client
+// writes to enable notifications or indications.
+const (
+	cccdNotify   = 0x0001
+	cccdIndicate = 0x0002
 )
 
 // Broadcast returns whether broadcasting of the value is permitted.
@@ -66,3 +216,95 @@ func (p CharacteristicPermissions) Notify() bool {
 func (p CharacteristicPermissions) Indicate() bool {
 	return p&CharacteristicIndicatePermission != 0
 }
+
+// SignedWrite returns whether writing of the value with Signed Write Command is
+// permitted.
+func (p CharacteristicPermissions) SignedWrite() bool {
+	return p&CharacteristicSignedWritePermission != 0
+}
+
+// CharacteristicSecurity lists the security that a connection needs before
+// clients can read or write the value of a characteristic, in addition to the
+// permissions in the Flags. Clients are asked to pair, or to encrypt the
+// connection with the keys of an earlier pairing, until the connection is
+// secure enough.
+type CharacteristicSecurity uint8
+
+// Characteristic security bitfields. Each level includes the levels before
+// it.
+const (
+	// CharacteristicEncryptedRead and CharacteristicEncryptedWrite need an
+	// encrypted connection.
+	CharacteristicEncryptedRead CharacteristicSecurity = 1 << iota
+	CharacteristicEncryptedWrite
+
+	// CharacteristicAuthenticatedRead and CharacteristicAuthenticatedWrite
+	// need a connection encrypted with keys from pairing that was protected
+	// against man-in-the-middle attacks.
+	CharacteristicAuthenticatedRead
+	CharacteristicAuthenticatedWrite
+
+	// CharacteristicSecureRead and CharacteristicSecureWrite need an
+	// authenticated connection with keys from LE Secure Connections pairing.
+	CharacteristicSecureRead
+	CharacteristicSecureWrite
+
+	// CharacteristicAuthorizedRead and CharacteristicAuthorizedWrite need the
+	// program to authorize each access with the AuthorizeEvent. They can be
+	// combined with the levels above.
+	CharacteristicAuthorizedRead
+	CharacteristicAuthorizedWrite
+)
+
+// securityLevel is the security of a connection, from none to LE Secure
+// Connections with protection against man-in-the-middle attacks. It
+// corresponds to the levels of LE security mode 1.
+type securityLevel uint8
+
+const (
+	securityNone securityLevel = iota
+	securityEncrypted
+	securityAuthenticated
+	securitySecure
+)
+
+// read returns the security level needed to read the value.
+func (s CharacteristicSecurity) read() securityLevel {
+	switch {
+	case s&CharacteristicSecureRead != 0:
+		return securitySecure
+	case s&CharacteristicAuthenticatedRead != 0:
+		return securityAuthenticated
+	case s&CharacteristicEncryptedRead != 0:
+		return securityEncrypted
+	}
+	return securityNone
+}
+
+// write returns the security level needed to write the value.
+func (s CharacteristicSecurity) write() securityLevel {
+	// Each write bit follows the read bit of the same level.
+	return (s >> 1).read()
+}
+
+// authorized returns whether an access of the client must be authorized, and
+// if so, whether the program permits it.
+func (s CharacteristicSecurity) authorized(client Connection, write bool, authorize func(Connection, bool) bool) bool {
+	flag := CharacteristicAuthorizedRead
+	if write {
+		flag = CharacteristicAuthorizedWrite
+	}
+	if s&flag == 0 {
+		return true
+	}
+	return authorize != nil && authorize(client, write)
+}
+
+// maxLength returns the longest value clients can write to the
+// characteristic.
+func (c *CharacteristicConfig) maxLength() int {
+	if c.MaxLength <= 0 || c.MaxLength > maxAttributeLength {
+		return maxAttributeLength
+	}
+	return c.MaxLength
+}
@@ -2,12 +2,17 @@
 
 package bluetooth
 
+import "context"
+
 type Characteristic struct {
 	adapter     *Adapter
 	handle      uint16
 	permissions CharacteristicPermissions
+	security    CharacteristicSecurity
+	maxLength   int
+	readEvent   func(client Connection, offset int) ([]byte, error)
+	authorize   func(client Connection, write bool) bool
 	value       []byte
-	cccd        uint16
 }
 
 // AddService creates a new service with the characteristics listed in the
@@ -42,6 +47,11 @@ func (a *Adapter) AddService(service *Service) error {
 			endHandle = a.att.addLocalAttribute(attributeTypeDescriptor, charHandle, shortUUID(gattClientCharacteristicConfigUUID).UUID(), CharacteristicReadPermission|CharacteristicWritePermission, []byte{0, 0})
 		}
 
+		// add the other descriptors
+		for _, descriptor := range service.Characteristics[i].Descriptors {
+			endHandle = a.att.addLocalDescriptor(charHandle, descriptor)
+		}
+
 		if service.Characteristics[i].Handle == nil {
 			service.Characteristics[i].Handle = &Characteristic{}
 		}
@@ -49,12 +59,17 @@ func (a *Adapter) AddService(service *Service) error {
 		service.Characteristics[i].Handle.adapter = a
 		service.Characteristics[i].Handle.handle = valueHandle
 		service.Characteristics[i].Handle.permissions = service.Characteristics[i].Flags
+		service.Characteristics[i].Handle.security = service.Characteristics[i].Security
+		service.Characteristics[i].Handle.maxLength = service.Characteristics[i].maxLength()
+		service.Characteristics[i].Handle.readEvent = service.Characteristics[i].ReadEvent
+		service.Characteristics[i].Handle.authorize = service.Characteristics[i].AuthorizeEvent
 		if len(service.Characteristics[i].Value) > 0 {
 			service.Characteristics[i].Handle.value = service.Characteristics[i].Value
 		}
 
 		if (service.Characteristics[i].Flags.Write() ||
-			service.Characteristics[i].Flags.WriteWithoutResponse()) &&
+			service.Characteristics[i].Flags.WriteWithoutResponse() ||
+			service.Characteristics[i].Flags.SignedWrite()) &&
 			service.Characteristics[i].WriteEvent != nil {
 			handlers := append(a.charWriteHandlers, charWriteHandler{
 				handle:   valueHandle,
@@ -79,42 +94,113 @@ func (a *Adapter) AddService(service *Service) error {
 	return nil
 }
 
-// Write replaces the characteristic value with a new value.
+// ConnectionInfo returns the address, ATT MTU and link type of the client on a
+// connection, such as the one passed to the read and write handlers of a
+// characteristic. It may be called from those handlers.
+func (a *Adapter) ConnectionInfo(connection Connection) (ConnectionInfo, error) {
+	return a.att.clientInfo(uint16(connection))
+}
+
+// Write replaces the characteristic value with a new value, and sends it to
+// the clients that have enabled notifications or indications. For an
+// indication, it blocks until the client has confirmed it, or returns an error
+// after 10 seconds.
 func (c *Characteristic) Write(p []byte) (n int, err error) {
 	if !(c.permissions.Write() || c.permissions.WriteWithoutResponse() ||
 		c.permissions.Notify() || c.permissions.Indicate()) {
 		return 0, errNoWrite
 	}
 
-	hdl := c.adapter.getCharWriteHandler(c.handle)
-	if hdl != nil {
-		hdl.callback(Connection(c.handle), 0, p)
-	}
-
-	copy(c.value, p)
+	c.value = append(c.value[:0], p...)
 
-	if c.cccd&0x01 != 0 {
-		// send notification
+	// Send the value to each client the way it asked for.
+	if c.permissions.Notify() {
 		c.adapter.att.sendNotification(c.handle, c.value)
 	}
+	if c.permissions.Indicate() {
+		ctx, cancel := context.WithTimeout(context.Background(), indicationTimeout)
+		defer cancel()
+		if err := c.adapter.att.sendIndication(ctx, c.handle, c.value); err != nil {
+			return 0, err
+		}
+	}
 
 	return len(c.value), nil
 }
 
-func (c *Characteristic) readCCCD() (uint16, error) {
-	if !c.permissions.Notify() {
+// Indicate replaces the characteristic value with a new value, and sends it
+// as an indication to clients that have enabled indications. It waits until
+// the clients have confirmed the indication or the context is done. It
+// returns right away if no client has enabled indications.
+func (c *Characteristic) Indicate(ctx context.Context, value []byte) error {
+	if !c.permissions.Indicate() {
+		return errNoIndicate
+	}
+
+	c.value = append(c.value[:0], value...)
+
+	return c.adapter.att.sendIndication(ctx, c.handle, c.value)
+}
+
+// readCCCD returns the Client Characteristic Configuration that the client on
+// the connection wrote.
+func (c *Characteristic) readCCCD(connection uint16) (uint16, error) {
+	if !c.permissions.Notify() && !c.permissions.Indicate() {
 		return 0, errNoNotify
 	}
 
-	return c.cccd, nil
+	cd, err := c.adapter.att.findConnectionData(connection)
+	if err != nil {
+		return 0, err
+	}
+
+	return cd.cccds[c.handle], nil
 }
 
-func (c *Characteristic) writeCCCD(val uint16) error {
-	if !c.permissions.Notify() {
+// writeCCCD stores the Client Characteristic Configuration of the client on
+// the connection, which decides whether it receives notifications or
+// indications.
+func (c *Characteristic) writeCCCD(connection uint16, val uint16) error {
+	if !c.permissions.Notify() && !c.permissions.Indicate() {
 		return errNoNotify
 	}
 
-	c.cccd = val
+	cd, err := c.adapter.att.findConnectionData(connection)
+	if err != nil {
+		return err
+	}
+
+	// Only keep the bits for what the characteristic supports.
+	var supported uint16
+	if c.permissions.Notify() {
+		supported |= cccdNotify
+	}
+	if c.permissions.Indicate() {
+		supported |= cccdIndicate
+	}
+	if cd.cccds == nil {
+		cd.cccds = make(map[uint16]uint16)
+	}
+	cd.cccds[c.handle] = val & supported
+
+	return nil
+}
+
+// writeValue stores a value that a client wrote at the given offset, and
+// passes it to the write handler.
+func (c *Characteristic) writeValue(client Connection, offset int, value []byte) error {
+	if !(c.permissions.Write() || c.permissions.WriteWithoutResponse() || c.permissions.SignedWrite()) {
+		return errNoWrite
+	}
+	if offset > len(c.value) {
+		return errWriteFailed
+	}
+
+	c.value = append(c.value[:offset], value...)
+
+	if hdl := c.adapter.getCharWriteHandler(c.handle); hdl != nil {
+		hdl.callback(client, offset, value)
+	}
 
 	return nil
 }
@@ -1,8 +1,9 @@
-//go:build !baremetal
+//go:build !baremetal && !hci
 
 package bluetooth
 
 import (
+	"context"
 	"fmt"
 	"strconv"
 	"sync/atomic"
@@ -48,25 +49,279 @@ func (om *objectManager) GetManagedObjects() (map[dbus.ObjectPath]map[string]map
 // DBus. Here is the documentation:
 // https://git.kernel.org/pub/scm/bluetooth/bluez.git/tree/doc/org.bluez.GattCharacteristic.rst
 type bluezChar struct {
+	adapter    *Adapter
 	props      *prop.Properties
+	maxLength  int
+	security   CharacteristicSecurity
+	readEvent  func(client Connection, offset int) ([]byte, error)
 	writeEvent func(client Connection, offset int, value []byte)
+	authorize  func(client Connection, write bool) bool
+	notifying  int32         // set while clients are subscribed
+	confirm    chan struct{} // confirmations of indications
 }
 
+// ReadValue returns the value from the given offset, from the read handler if
+// there is one. BlueZ reads from an offset for a Read Blob Request, when a
+// client reads a long value.
 func (c *bluezChar) ReadValue(options map[string]dbus.Variant) ([]byte, *dbus.Error) {
-	// TODO: should we use the offset value? The BlueZ documentation doesn't
-	// clearly specify this. The go-bluetooth library doesn't, but I believe it
-	// should be respected.
+	if err := c.adapter.bluezAuthorize(options, c.security, false, c.authorize); err != nil {
+		return nil, err
+	}
+	offset, _ := options["offset"].Value().(uint16)
+	if c.readEvent != nil {
+		value, err := c.readEvent(c.adapter.bluezClient(options), int(offset))
+		if err != nil {
+			return nil, bluezReadError(err)
+		}
+		return value, nil
+	}
+
 	value := c.props.GetMust("org.bluez.GattCharacteristic1", "Value").([]byte)
-	return value, nil
+	if int(offset) > len(value) {
+		return nil, dbus.NewError("org.bluez.Error.InvalidOffset", nil)
+	}
+	return value[offset:], nil
 }
 
 func (c *bluezChar) WriteValue(value []byte, options map[string]dbus.Variant) *dbus.Error {
+	if err := c.adapter.bluezAuthorize(options, c.security, true, c.authorize); err != nil {
+		return err
+	}
+	if bluezPrepareAuthorize(options) {
+		return nil
+	}
+	offset, _ := options["offset"].Value().(uint16)
+	if int(offset)+len(value) > c.maxLength {
+		return dbus.NewError("org.bluez.Error.InvalidValueLength", nil)
+	}
 	if c.writeEvent != nil {
-		// BlueZ doesn't seem to tell who did the write, so pass 0 always as the
-		// connection ID.
-		client := Connection(0)
-		offset, _ := options["offset"].Value().(uint16)
-		c.writeEvent(client, int(offset), value)
+		c.writeEvent(c.adapter.bluezClient(options), int(offset), value)
+	}
+	return nil
+}
+
+// Object that implements org.bluez.GattDescriptor1 to be exported over DBus.
+// Here is the documentation:
+// https://git.kernel.org/pub/scm/bluetooth/bluez.git/tree/doc/org.bluez.GattDescriptor.rst
+type bluezDescriptor struct {
+	adapter    *Adapter
+	props      *prop.Properties
+	security   CharacteristicSecurity
+	readEvent  func(client Connection, offset int) ([]byte, error)
+	writeEvent func(client Connection, offset int, value []byte)
+	authorize  func(client Connection, write bool) bool
+}
+
+// ReadValue returns the value from the given offset, from the read handler if
+// there is one.
+func (d *bluezDescriptor) ReadValue(options map[string]dbus.Variant) ([]byte, *dbus.Error) {
+	if err := d.adapter.bluezAuthorize(options, d.security, false, d.authorize); err != nil {
+		return nil, err
+	}
+	offset, _ := options["offset"].Value().(uint16)
+	if d.readEvent != nil {
+		value, err := d.readEvent(d.adapter.bluezClient(options), int(offset))
+		if err != nil {
+			return nil, bluezReadError(err)
+		}
+		return value, nil
+	}
+
+	value := d.props.GetMust("org.bluez.GattDescriptor1", "Value").([]byte)
+	if int(offset) > len(value) {
+		return nil, dbus.NewError("org.bluez.Error.InvalidOffset", nil)
+	}
+	return value[offset:], nil
+}
+
+// WriteValue stores the value that a client wrote at the given offset, and
+// passes it to the write handler.
+func (d *bluezDescriptor) WriteValue(value []byte, options map[string]dbus.Variant) *dbus.Error {
+	if err := d.adapter.bluezAuthorize(options, d.security, true, d.authorize); err != nil {
+		return err
+	}
+	if bluezPrepareAuthorize(options) {
+		return nil
+	}
+	offset, _ := options["offset"].Value().(uint16)
+	old := d.props.GetMust("org.bluez.GattDescriptor1", "Value").([]byte)
+	if int(offset) > len(old) {
+		return dbus.NewError("org.bluez.Error.InvalidOffset", nil)
+	}
+	if int(offset)+len(value) > maxAttributeLength {
+		return dbus.NewError("org.bluez.Error.InvalidValueLength", nil)
+	}
+
+	d.props.SetMust("org.bluez.GattDescriptor1", "Value", append(old[:offset:offset], value...))
+	if d.writeEvent != nil {
+		d.writeEvent(d.adapter.bluezClient(options), int(offset), value)
+	}
+	return nil
+}
+
+// bluezClient is a client of the GATT server. BlueZ identifies it by the object
+// path of the device, and passes the MTU and the transport of the connection
+// with each read and write.
+type bluezClient struct {
+	device dbus.ObjectPath
+	mtu    uint16
+	link   LinkType
+}
+
+// bluezClient returns the connection of the client that BlueZ reads or writes
+// for, from the options of the call. Each device gets its own connection,
+// which stays the same when it reconnects. It returns 0 for older versions of
+// BlueZ, which don't tell the device.
+func (a *Adapter) bluezClient(options map[string]dbus.Variant) Connection {
+	device, ok := options["device"].Value().(dbus.ObjectPath)
+	if !ok {
+		return 0
+	}
+	mtu, _ := options["mtu"].Value().(uint16)
+	link := LinkTypeUnknown
+	switch options["link"].Value() {
+	case "LE":
+		link = LinkTypeLE
+	case "BR/EDR":
+		link = LinkTypeBREDR
+	}
+
+	a.clientsMu.Lock()
+	defer a.clientsMu.Unlock()
+
+	for i := range a.clients {
+		client := &a.clients[i]
+		if client.device == device {
+			if mtu != 0 {
+				client.mtu = mtu
+			}
+			if link != LinkTypeUnknown {
+				client.link = link
+			}
+			return Connection(i + 1)
+		}
+	}
+	a.clients = append(a.clients, bluezClient{device, mtu, link})
+	return Connection(len(a.clients))
+}
+
+// ConnectionInfo returns the address, ATT MTU and link type of the client on a
+// connection, such as the one passed to the read and write handlers of a
+// characteristic. The MTU and link type are those of the last read or write of
+// the client.
+func (a *Adapter) ConnectionInfo(connection Connection) (ConnectionInfo, error) {
+	a.clientsMu.Lock()
+	if connection == 0 || int(connection) > len(a.clients) {
+		a.clientsMu.Unlock()
+		return ConnectionInfo{}, errUnknownConnection
+	}
+	client := a.clients[connection-1]
+	a.clientsMu.Unlock()
+
+	device := a.bus.Object("org.bluez", client.device)
+	address, err := device.GetProperty("org.bluez.Device1.Address")
+	if err != nil {
+		return ConnectionInfo{}, err
+	}
+	s, _ := address.Value().(string)
+	mac, err := ParseMAC(s)
+	if err != nil {
+		return ConnectionInfo{}, err
+	}
+	info := ConnectionInfo{
+		Address:  Address{MACAddress{MAC: mac}},
+		MTU:      client.mtu,
+		LinkType: client.link,
+	}
+	if typ, err := device.GetProperty("org.bluez.Device1.AddressType"); err == nil {
+		info.Address.SetRandom(typ.Value() == "random")
+	}
+	return info, nil
+}
+
+// bluezAuthorize returns the BlueZ error for a read or write that needs
+// authorization which the program doesn't grant, or nil if the client may
+// access the attribute.
+func (a *Adapter) bluezAuthorize(options map[string]dbus.Variant, security CharacteristicSecurity, write bool, authorize func(Connection, bool) bool) *dbus.Error {
+	if security.authorized(a.bluezClient(options), write, authorize) {
+		return nil
+	}
+	return dbus.NewError("org.bluez.Error.NotAuthorized", nil)
+}
+
+// bluezPrepareAuthorize returns whether BlueZ only asks to authorize a
+// Prepare Write Request, without writing the value yet. It does so for
+// attributes with the authorize flag.
+func bluezPrepareAuthorize(options map[string]dbus.Variant) bool {
+	prepare, _ := options["prepare-authorize"].Value().(bool)
+	return prepare
+}
+
+// bluezReadError returns the BlueZ error for an error from a read handler.
+// BlueZ answers the client with the ATT error that matches the D-Bus error,
+// and takes application error codes from the message of a Failed error.
+func bluezReadError(err error) *dbus.Error {
+	switch code := ATTError(attErrorCode(err)); {
+	case code == ATTErrorReadNotPermitted:
+		return dbus.NewError("org.bluez.Error.NotPermitted", nil)
+	case code == ATTErrorInvalidOffset:
+		return dbus.NewError("org.bluez.Error.InvalidOffset", nil)
+	case code == ATTErrorInsufficientAuthorization:
+		return dbus.NewError("org.bluez.Error.NotAuthorized", nil)
+	case code == ATTErrorInvalidAttributeValueLength:
+		return dbus.NewError("org.bluez.Error.InvalidValueLength", nil)
+	case code >= ATTErrorApplication && code <= 0x9f:
+		return dbus.NewError("org.bluez.Error.Failed", []interface{}{fmt.Sprintf("0x%02x", uint8(code))})
+	default:
+		return dbus.NewError("org.bluez.Error.Failed", nil)
+	}
+}
+
+// bluezSecurityFlags are the prefixes of the BlueZ flags that need each
+// security level to read or write.
+var bluezSecurityFlags = [...]string{
+	securityEncrypted:     "encrypt-",
+	securityAuthenticated: "encrypt-authenticated-",
+	securitySecure:        "secure-",
+}
+
+// appendSecurityFlags adds the BlueZ flags for the security of reads and
+// writes. BlueZ leaves authorization to ReadValue and WriteValue, the authorize
+// flag only makes it ask before queueing a prepared write.
+func appendSecurityFlags(flags []string, security CharacteristicSecurity) []string {
+	if level := security.read(); level != securityNone {
+		flags = append(flags, bluezSecurityFlags[level]+"read")
+	}
+	if level := security.write(); level != securityNone {
+		flags = append(flags, bluezSecurityFlags[level]+"write")
+	}
+	if security&(CharacteristicAuthorizedRead|CharacteristicAuthorizedWrite) != 0 {
+		flags = append(flags, "authorize")
+	}
+	return flags
+}
+
+// StartNotify is called by BlueZ when the first client enables notifications
+// or indications. BlueZ keeps the CCCD of each client itself, and sends a
+// notification or an indication to each subscribed client when the Value
+// property changes.
+func (c *bluezChar) StartNotify() *dbus.Error {
+	atomic.StoreInt32(&c.notifying, 1)
+	return nil
+}
+
+// StopNotify is called by BlueZ when the last client disables notifications or
+// indications.
+func (c *bluezChar) StopNotify() *dbus.Error {
+	atomic.StoreInt32(&c.notifying, 0)
+	return nil
+}
+
+// Confirm is called by BlueZ when a client has confirmed an indication.
+func (c *bluezChar) Confirm() *dbus.Error {
+	select {
+	case c.confirm <- struct{}{}:
+	default:
 	}
 	return nil
 }
@@ -93,12 +348,13 @@ func (a *Adapter) AddService(s *Service) error {
 	for i, char := range s.Characteristics {
 		// Calculate Flags field.
 		bluezCharFlags := []string{
-			"broadcast",              // bit 0
-			"read",                   // bit 1
-			"write-without-response", // bit 2
-			"write",                  // bit 3
-			"notify",                 // bit 4
-			"indicate",               // bit 5
+			"broadcast",                   // bit 0
+			"read",                        // bit 1
+			"write-without-response",      // bit 2
+			"write",                       // bit 3
+			"notify",                      // bit 4
+			"indicate",                    // bit 5
+			"authenticated-signed-writes", // bit 6
 		}
 		var flags []string
 		for i := 0; i < len(bluezCharFlags); i++ {
@@ -106,6 +362,7 @@ func (a *Adapter) AddService(s *Service) error {
 				flags = append(flags, bluezCharFlags[i])
 			}
 		}
+		flags = appendSecurityFlags(flags, char.Security)
 
 		// Export the properties of this characteristic.
 		charPath := path + dbus.ObjectPath("/char"+strconv.Itoa(i))
@@ -125,8 +382,14 @@ func (a *Adapter) AddService(s *Service) error {
 
 		// Export the methods of this characteristic.
 		obj := &bluezChar{
+			adapter:    a,
 			props:      props,
+			maxLength:  char.maxLength(),
+			security:   char.Security,
+			readEvent:  char.ReadEvent,
 			writeEvent: char.WriteEvent,
+			authorize:  char.AuthorizeEvent,
+			confirm:    make(chan struct{}, 1),
 		}
 		err = a.bus.Export(obj, charPath, "org.bluez.GattCharacteristic1")
 		if err != nil {
@@ -138,6 +401,44 @@ func (a *Adapter) AddService(s *Service) error {
 			char.Handle.permissions = char.Flags
 			char.Handle.char = obj
 		}
+
+		for j, desc := range char.Descriptors {
+			var descFlags []string
+			if desc.Flags.Read() {
+				descFlags = append(descFlags, "read")
+			}
+			if desc.Flags.Write() {
+				descFlags = append(descFlags, "write")
+			}
+			descFlags = appendSecurityFlags(descFlags, desc.Security)
+
+			// Export the properties and methods of this descriptor.
+			descPath := charPath + dbus.ObjectPath("/desc"+strconv.Itoa(j))
+			descSpec := map[string]map[string]*prop.Prop{
+				"org.bluez.GattDescriptor1": {
+					"UUID":           {Value: desc.UUID.String()},
+					"Characteristic": {Value: charPath},
+					"Flags":          {Value: descFlags},
+					"Value":          {Value: append([]byte{}, desc.Value...), Emit: prop.EmitTrue},
+				},
+			}
+			objects[descPath] = descSpec
+			descProps, err := prop.Export(a.bus, descPath, descSpec)
+			if err != nil {
+				return err
+			}
+			err = a.bus.Export(&bluezDescriptor{
+				adapter:    a,
+				props:      descProps,
+				security:   desc.Security,
+				readEvent:  desc.ReadEvent,
+				writeEvent: desc.WriteEvent,
+				authorize:  desc.AuthorizeEvent,
+			}, descPath, "org.bluez.GattDescriptor1")
+			if err != nil {
+				return err
+			}
+		}
 	}
 
 	// Export all objects that are part of our service.
@@ -159,12 +460,45 @@ func (c *Characteristic) Write(p []byte) (n int, err error) {
 		return 0, nil // nothing to do
 	}
 
-	if c.char.writeEvent != nil {
-		c.char.writeEvent(0, 0, p)
-	}
 	gattError := c.char.props.Set("org.bluez.GattCharacteristic1", "Value", dbus.MakeVariant(p))
 	if gattError != nil {
 		return 0, gattError
 	}
 	return len(p), nil
 }
+
+// Indicate replaces the characteristic value with a new value, and sends it
+// as an indication to clients that have enabled indications. It waits until a
+// client has confirmed the indication or the context is done. It returns right
+// away if no client has subscribed.
+//
+// On Linux, BlueZ decides for each client whether to send a notification or an
+// indication, depending on what the client enabled. Indicate can't tell them
+// apart, so for a characteristic that also permits notifications it may wait
+// until the context is done when clients only enabled notifications.
+func (c *Characteristic) Indicate(ctx context.Context, value []byte) error {
+	if !c.permissions.Indicate() {
+		return errNoIndicate
+	}
+
+	// Drop the confirmation of an earlier indication that nobody waited for.
+	select {
+	case <-c.char.confirm:
+	default:
+	}
+
+	gattError := c.char.props.Set("org.bluez.GattCharacteristic1", "Value", dbus.MakeVariant(value))
+	if gattError != nil {
+		return gattError
+	}
+	if atomic.LoadInt32(&c.char.notifying) == 0 {
+		return nil
+	}
+
+	select {
+	case <-c.char.confirm:
+		return nil
+	case <-ctx.Done():
+		return ctx.Err()
+	}
+}
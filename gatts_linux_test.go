@@ -0,0 +1,457 @@
+//go:build !baremetal && !hci
+
+package bluetooth
+
+import (
+	"context"
+	"errors"
+	"reflect"
+	"testing"
+	"time"
+
+	"github.com/godbus/dbus/v5"
+)
+
+// addBlueZService enables an adapter with a fake BlueZ, and adds a service
+// with a single characteristic. It returns the characteristic, and the object
+// through which BlueZ accesses it.
+func addBlueZService(t *testing.T, config CharacteristicConfig) (*Characteristic, *fakeBlueZ, dbus.BusObject) {
+	t.Helper()
+
+	address := startDBusDaemon(t)
+	fake := newFakeBlueZ(t, address)
+
+	t.Setenv("DBUS_SYSTEM_BUS_ADDRESS", address)
+	adapter := &Adapter{id: "hci0"}
+	if err := adapter.Enable(); err != nil {
+		t.Fatal("could not enable adapter:", err)
+	}
+	t.Cleanup(func() {
+		adapter.bus.Close()
+	})
+
+	config.Handle = &Characteristic{}
+	config.UUID = CharacteristicUUIDHeartRateMeasurement
+	err := adapter.AddService(&Service{
+		UUID:            ServiceUUIDHeartRate,
+		Characteristics: []CharacteristicConfig{config},
+	})
+	if err != nil {
+		t.Fatal("could not add service:", err)
+	}
+
+	fake.mu.Lock()
+	service := fake.services[0]
+	fake.mu.Unlock()
+	object := fake.conn.Object(service.Destination(), service.Path()+"/char0")
+
+	return config.Handle, fake, object
+}
+
+func TestBlueZReadOffset(t *testing.T) {
+	_, _, object := addBlueZService(t, CharacteristicConfig{
+		Value: []byte("a long value"),
+		Flags: CharacteristicReadPermission,
+	})
+
+	for _, tc := range []struct {
+		offset   uint16
+		expected string
+		err      string
+	}{
+		{0, "a long value", ""},
+		{7, "value", ""},
+		{12, "", ""},
+		{13, "", "org.bluez.Error.InvalidOffset"},
+	} {
+		var value []byte
+		options := map[string]dbus.Variant{"offset": dbus.MakeVariant(tc.offset)}
+		err := object.Call("org.bluez.GattCharacteristic1.ReadValue", 0, options).Store(&value)
+		var dbusErr dbus.Error
+		switch {
+		case tc.err != "":
+			if !errors.As(err, &dbusErr) || dbusErr.Name != tc.err {
+				t.Errorf("offset %d: expected %s, got %v", tc.offset, tc.err, err)
+			}
+		case err != nil:
+			t.Errorf("offset %d: could not read: %v", tc.offset, err)
+		case string(value) != tc.expected:
+			t.Errorf("offset %d: expected %q, got %q", tc.offset, tc.expected, value)
+		}
+	}
+}
+
+func TestBlueZIndications(t *testing.T) {
+	char, fake, object := addBlueZService(t, CharacteristicConfig{
+		Flags: CharacteristicReadPermission | CharacteristicIndicatePermission,
+	})
+
+	// BlueZ sends an indication when the Value property changes.
+	signals := make(chan *dbus.Signal, 8)
+	fake.conn.Signal(signals)
+	err := fake.conn.AddMatchSignal(
+		dbus.WithMatchObjectPath(object.Path()),
+		dbus.WithMatchInterface("org.freedesktop.DBus.Properties"),
+	)
+	if err != nil {
+		t.Fatal(err)
+	}
+	expectValue := func(expected string) {
+		t.Helper()
+		for {
+			select {
+			case sig := <-signals:
+				if sig.Name != "org.freedesktop.DBus.Properties.PropertiesChanged" || len(sig.Body) < 2 {
+					continue
+				}
+				changed, _ := sig.Body[1].(map[string]dbus.Variant)
+				value, ok := changed["Value"]
+				if !ok {
+					continue
+				}
+				if got, _ := value.Value().([]byte); string(got) != expected {
+					t.Errorf("expected value %q, got %q", expected, got)
+				}
+				return
+			case <-time.After(5 * time.Second):
+				t.Fatal("timeout waiting for the value to change")
+			}
+		}
+	}
+
+	// Without subscribed clients, there is nothing to confirm.
+	ctx, cancel := context.WithTimeout(context.Background(), 5*time.Second)
+	defer cancel()
+	if err := char.Indicate(ctx, []byte("unsent")); err != nil {
+		t.Fatal("could not indicate without subscription:", err)
+	}
+	expectValue("unsent")
+
+	// Indicate waits until BlueZ reports the confirmation of the client.
+	if err := object.Call("org.bluez.GattCharacteristic1.StartNotify", 0).Err; err != nil {
+		t.Fatal("could not start notifying:", err)
+	}
+	done := make(chan error, 1)
+	go func() {
+		done <- char.Indicate(ctx, []byte("indicated"))
+	}()
+	expectValue("indicated")
+	select {
+	case err := <-done:
+		t.Fatal("Indicate returned before the confirmation:", err)
+	default:
+	}
+	if err := object.Call("org.bluez.GattCharacteristic1.Confirm", 0).Err; err != nil {
+		t.Fatal("could not confirm:", err)
+	}
+	select {
+	case err := <-done:
+		if err != nil {
+			t.Error("could not indicate:", err)
+		}
+	case <-time.After(5 * time.Second):
+		t.Fatal("timeout waiting for Indicate to return")
+	}
+
+	// Without a confirmation, Indicate returns when the context is done.
+	short, cancelShort := context.WithTimeout(context.Background(), 50*time.Millisecond)
+	defer cancelShort()
+	if err := char.Indicate(short, []byte("unconfirmed")); !errors.Is(err, context.DeadlineExceeded) {
+		t.Errorf("expected %v, got %v", context.DeadlineExceeded, err)
+	}
+	expectValue("unconfirmed")
+
+	var notifyOnly Characteristic
+	notifyOnly.permissions = CharacteristicNotifyPermission
+	if err := notifyOnly.Indicate(ctx, []byte("value")); err != errNoIndicate {
+		t.Errorf("expected %v for a characteristic without indications, got %v", errNoIndicate, err)
+	}
+}
+
+func TestBlueZSecurity(t *testing.T) {
+	var written []byte
+	_, _, object := addBlueZService(t, CharacteristicConfig{
+		Flags:     CharacteristicReadPermission | CharacteristicWritePermission,
+		Security:  CharacteristicEncryptedRead | CharacteristicSecureWrite,
+		MaxLength: 4,
+		WriteEvent: func(client Connection, offset int, value []byte) {
+			written = append(written[:offset], value...)
+		},
+	})
+
+	flags, err := object.GetProperty("org.bluez.GattCharacteristic1.Flags")
+	if err != nil {
+		t.Fatal("could not get flags:", err)
+	}
+	expected := []string{"read", "write", "encrypt-read", "secure-write"}
+	if got, _ := flags.Value().([]string); !reflect.DeepEqual(got, expected) {
+		t.Errorf("expected flags %q, got %q", expected, got)
+	}
+
+	// BlueZ enforces the security flags, the length is checked by WriteValue.
+	for _, tc := range []struct {
+		offset uint16
+		value  string
+		err    string
+	}{
+		{0, "abcd", ""},
+		{2, "xy", ""},
+		{0, "abcde", "org.bluez.Error.InvalidValueLength"},
+		{3, "yz", "org.bluez.Error.InvalidValueLength"},
+	} {
+		options := map[string]dbus.Variant{"offset": dbus.MakeVariant(tc.offset)}
+		err := object.Call("org.bluez.GattCharacteristic1.WriteValue", 0, []byte(tc.value), options).Err
+		var dbusErr dbus.Error
+		switch {
+		case tc.err != "":
+			if !errors.As(err, &dbusErr) || dbusErr.Name != tc.err {
+				t.Errorf("write %q at %d: expected %s, got %v", tc.value, tc.offset, tc.err, err)
+			}
+		case err != nil:
+			t.Errorf("write %q at %d: could not write: %v", tc.value, tc.offset, err)
+		}
+	}
+	if string(written) != "abxy" {
+		t.Errorf("expected value %q, got %q", "abxy", written)
+	}
+}
+
+func TestBlueZAuthorization(t *testing.T) {
+	authorized := false
+	var written []byte
+	_, _, object := addBlueZService(t, CharacteristicConfig{
+		Value:    []byte("on"),
+		Flags:    CharacteristicReadPermission | CharacteristicWritePermission,
+		Security: CharacteristicAuthorizedWrite,
+		AuthorizeEvent: func(client Connection, write bool) bool {
+			if !write {
+				t.Error("unexpected authorization of a read")
+			}
+			return authorized
+		},
+		WriteEvent: func(client Connection, offset int, value []byte) {
+			written = append([]byte{}, value...)
+		},
+	})
+
+	flags, err := object.GetProperty("org.bluez.GattCharacteristic1.Flags")
+	if err != nil {
+		t.Fatal("could not get flags:", err)
+	}
+	expected := []string{"read", "write", "authorize"}
+	if got, _ := flags.Value().([]string); !reflect.DeepEqual(got, expected) {
+		t.Errorf("expected flags %q, got %q", expected, got)
+	}
+
+	var value []byte
+	if err := object.Call("org.bluez.GattCharacteristic1.ReadValue", 0, map[string]dbus.Variant{}).Store(&value); err != nil {
+		t.Error("could not read without authorization:", err)
+	}
+
+	for _, tc := range []struct {
+		authorized bool
+		prepare    bool
+		err        string
+		written    string
+	}{
+		{false, false, "org.bluez.Error.NotAuthorized", ""},
+		{false, true, "org.bluez.Error.NotAuthorized", ""},
+		{true, true, "", ""},
+		{true, false, "", "off"},
+	} {
+		authorized = tc.authorized
+		written = nil
+		options := map[string]dbus.Variant{}
+		if tc.prepare {
+			options["prepare-authorize"] = dbus.MakeVariant(true)
+		}
+		err := object.Call("org.bluez.GattCharacteristic1.WriteValue", 0, []byte("off"), options).Err
+		var dbusErr dbus.Error
+		switch {
+		case tc.err != "":
+			if !errors.As(err, &dbusErr) || dbusErr.Name != tc.err {
+				t.Errorf("authorized %t, prepare %t: expected %s, got %v", tc.authorized, tc.prepare, tc.err, err)
+			}
+		case err != nil:
+			t.Errorf("authorized %t, prepare %t: could not write: %v", tc.authorized, tc.prepare, err)
+		}
+		if string(written) != tc.written {
+			t.Errorf("authorized %t, prepare %t: expected to write %q, wrote %q", tc.authorized, tc.prepare, tc.written, written)
+		}
+	}
+}
+
+func TestBlueZDescriptors(t *testing.T) {
+	var written []byte
+	_, fake, object := addBlueZService(t, CharacteristicConfig{
+		Flags: CharacteristicReadPermission,
+		Descriptors: []DescriptorConfig{
+			{
+				UUID:     New16BitUUID(0x2901),
+				Value:    []byte("name"),
+				Flags:    DescriptorReadPermission | DescriptorWritePermission,
+				Security: CharacteristicEncryptedWrite,
+				WriteEvent: func(client Connection, offset int, value []byte) {
+					written = append(written, value...)
+				},
+			},
+			{
+				UUID:  New16BitUUID(0x2906),
+				Flags: DescriptorReadPermission,
+				ReadEvent: func(client Connection, offset int) ([]byte, error) {
+					if offset != 0 {
+						return nil, errors.New("no offsets")
+					}
+					return []byte{0, 10}, nil
+				},
+			},
+		},
+	})
+	description := fake.conn.Object(object.Destination(), object.Path()+"/desc0")
+	validRange := fake.conn.Object(object.Destination(), object.Path()+"/desc1")
+
+	for _, tc := range []struct {
+		object dbus.BusObject
+		name   string
+		value  interface{}
+	}{
+		{description, "UUID", "00002901-0000-1000-8000-00805f9b34fb"},
+		{description, "Characteristic", object.Path()},
+		{description, "Flags", []string{"read", "write", "encrypt-write"}},
+		{validRange, "Flags", []string{"read"}},
+	} {
+		value, err := tc.object.GetProperty("org.bluez.GattDescriptor1." + tc.name)
+		if err != nil {
+			t.Errorf("could not get %s: %v", tc.name, err)
+		} else if !reflect.DeepEqual(value.Value(), tc.value) {
+			t.Errorf("expected %s %v, got %v", tc.name, tc.value, value.Value())
+		}
+	}
+
+	read := func(object dbus.BusObject, offset uint16) (string, error) {
+		var value []byte
+		options := map[string]dbus.Variant{"offset": dbus.MakeVariant(offset)}
+		err := object.Call("org.bluez.GattDescriptor1.ReadValue", 0, options).Store(&value)
+		return string(value), err
+	}
+	options := map[string]dbus.Variant{"offset": dbus.MakeVariant(uint16(2))}
+	if err := description.Call("org.bluez.GattDescriptor1.WriteValue", 0, []byte("NE"), options).Err; err != nil {
+		t.Fatal("could not write:", err)
+	}
+	if value, err := read(description, 1); err != nil || value != "aNE" {
+		t.Errorf("expected %q, got %q (%v)", "aNE", value, err)
+	}
+	if string(written) != "NE" {
+		t.Errorf("expected write event with %q, got %q", "NE", written)
+	}
+
+	if value, err := read(validRange, 0); err != nil || value != "\x00\x0a" {
+		t.Errorf("expected the value from the read handler, got %q (%v)", value, err)
+	}
+	var dbusErr dbus.Error
+	if _, err := read(validRange, 1); !errors.As(err, &dbusErr) || dbusErr.Name != "org.bluez.Error.NotPermitted" {
+		t.Errorf("expected org.bluez.Error.NotPermitted, got %v", err)
+	}
+}
+
+func TestBlueZReadEvent(t *testing.T) {
+	var readError error
+	_, _, object := addBlueZService(t, CharacteristicConfig{
+		Value: []byte("static"),
+		Flags: CharacteristicReadPermission,
+		ReadEvent: func(client Connection, offset int) ([]byte, error) {
+			if readError != nil {
+				return nil, readError
+			}
+			return []byte("dynamic")[offset:], nil
+		},
+	})
+
+	for _, tc := range []struct {
+		offset   uint16
+		readErr  error
+		expected string
+		err      string
+		body     []interface{}
+	}{
+		{0, nil, "dynamic", "", nil},
+		{3, nil, "amic", "", nil},
+		{0, ATTErrorInsufficientAuthorization, "", "org.bluez.Error.NotAuthorized", nil},
+		{0, ATTErrorApplication + 1, "", "org.bluez.Error.Failed", []interface{}{"0x81"}},
+		{0, ATTErrorUnlikely, "", "org.bluez.Error.Failed", nil},
+		{0, errors.New("failed"), "", "org.bluez.Error.NotPermitted", nil},
+	} {
+		readError = tc.readErr
+		var value []byte
+		options := map[string]dbus.Variant{"offset": dbus.MakeVariant(tc.offset)}
+		err := object.Call("org.bluez.GattCharacteristic1.ReadValue", 0, options).Store(&value)
+		var dbusErr dbus.Error
+		switch {
+		case tc.err != "":
+			if !errors.As(err, &dbusErr) || dbusErr.Name != tc.err {
+				t.Errorf("%v: expected %s, got %v", tc.readErr, tc.err, err)
+			} else if tc.body != nil && !reflect.DeepEqual(dbusErr.Body, tc.body) {
+				t.Errorf("%v: expected message %q, got %q", tc.readErr, tc.body, dbusErr.Body)
+			}
+		case err != nil:
+			t.Errorf("offset %d: could not read: %v", tc.offset, err)
+		case string(value) != tc.expected:
+			t.Errorf("offset %d: expected %q, got %q", tc.offset, tc.expected, value)
+		}
+	}
+}
+
+func TestBlueZClients(t *testing.T) {
+	var clients []Connection
+	char, _, object := addBlueZService(t, CharacteristicConfig{
+		Flags: CharacteristicReadPermission | CharacteristicWritePermission | CharacteristicNotifyPermission,
+		WriteEvent: func(client Connection, offset int, value []byte) {
+			clients = append(clients, client)
+		},
+	})
+	adapter := char.char.adapter
+
+	otherDevice := fakeDevicePath + "0"
+	for _, options := range []map[string]dbus.Variant{
+		{"device": dbus.MakeVariant(fakeDevicePath), "mtu": dbus.MakeVariant(uint16(23)), "link": dbus.MakeVariant("LE")},
+		{"device": dbus.MakeVariant(otherDevice), "mtu": dbus.MakeVariant(uint16(23)), "link": dbus.MakeVariant("BR/EDR")},
+		{"device": dbus.MakeVariant(fakeDevicePath), "mtu": dbus.MakeVariant(uint16(185)), "link": dbus.MakeVariant("LE")},
+		{}, // older versions of BlueZ
+	} {
+		if err := object.Call("org.bluez.GattCharacteristic1.WriteValue", 0, []byte("x"), options).Err; err != nil {
+			t.Fatal("could not write:", err)
+		}
+	}
+
+	// Writes of the program itself don't come from a client.
+	if _, err := char.Write([]byte("local")); err != nil {
+		t.Fatal("could not write characteristic:", err)
+	}
+	if expected := []Connection{1, 2, 1, 0}; !reflect.DeepEqual(clients, expected) {
+		t.Errorf("expected writes from %v, got %v", expected, clients)
+	}
+
+	info, err := adapter.ConnectionInfo(1)
+	if err != nil {
+		t.Fatal("could not get connection info:", err)
+	}
+	mac, _ := ParseMAC("11:22:33:44:55:66")
+	expected := ConnectionInfo{
+		Address:  Address{MACAddress{MAC: mac, isRandom: true}},
+		MTU:      185,
+		LinkType: LinkTypeLE,
+	}
+	if info != expected {
+		t.Errorf("expected %+v, got %+v", expected, info)
+	}
+
+	// The fake BlueZ only knows the first device.
+	if _, err := adapter.ConnectionInfo(2); err == nil {
+		t.Error("expected an error for a device that doesn't exist")
+	}
+	for _, connection := range []Connection{0, 3} {
+		if _, err := adapter.ConnectionInfo(connection); err != errUnknownConnection {
+			t.Errorf("connection %d: expected %v, got %v", connection, errUnknownConnection, err)
+		}
+	}
+}
@@ -2,7 +2,15 @@
 
 package bluetooth
 
+import (
+	"context"
+	"runtime/volatile"
+	"time"
+	"unsafe"
+)
+
 /*
+#include "ble.h"
 #include "ble_gap.h"
 #include "ble_gatts.h"
 
@@ -20,17 +28,73 @@ static inline uint32_t sd_ble_gatts_value_set_noescape(uint16_t conn_handle, uin
 	};
 	return sd_ble_gatts_value_set(conn_handle, handle, &p_value);
 }
+
+// Give the SoftDevice memory to queue Prepare Write Requests in. The block is
+// static, as it must remain valid until the memory is released.
+static inline uint32_t sd_ble_user_mem_reply_noescape(uint16_t conn_handle, uint8_t *p_mem, uint16_t len) {
+	static ble_user_mem_block_t block;
+	block.p_mem = p_mem;
+	block.len = len;
+	return sd_ble_user_mem_reply(conn_handle, &block);
+}
+
+// Answer a read of an attribute with read authorization with the given value,
+// or with an error status. Without update, the client reads the stored value.
+static inline uint32_t sd_ble_gatts_read_authorize_reply_noescape(uint16_t conn_handle, uint16_t gatt_status, uint8_t update, uint16_t offset, uint8_t *p_data, uint16_t len) {
+	ble_gatts_rw_authorize_reply_params_t reply = {0};
+	reply.type = BLE_GATTS_AUTHORIZE_TYPE_READ;
+	reply.params.read.gatt_status = gatt_status;
+	reply.params.read.update = update;
+	reply.params.read.offset = offset;
+	reply.params.read.len = len;
+	reply.params.read.p_data = p_data;
+	return sd_ble_gatts_rw_authorize_reply(conn_handle, &reply);
+}
+
+// Answer a write of an attribute with write authorization. The SoftDevices of
+// the nRF52 only store the value if asked to; the S110 stores it when the
+// write succeeds.
+static inline uint32_t sd_ble_gatts_write_authorize_reply_noescape(uint16_t conn_handle, uint16_t gatt_status, uint16_t offset, const uint8_t *p_data, uint16_t len) {
+	ble_gatts_rw_authorize_reply_params_t reply = {0};
+	reply.type = BLE_GATTS_AUTHORIZE_TYPE_WRITE;
+	reply.params.write.gatt_status = gatt_status;
+#ifdef BLE_GATT_ATT_MTU_DEFAULT
+	reply.params.write.update = 1;
+	reply.params.write.offset = offset;
+	reply.params.write.len = len;
+	reply.params.write.p_data = p_data;
+#endif
+	return sd_ble_gatts_rw_authorize_reply(conn_handle, &reply);
+}
+
+// Read the Client Characteristic Configuration descriptor of a connection.
+// It is zero if it can't be read, for example because the client never wrote
+// it.
+static inline uint16_t sd_ble_gatts_cccd_get_noescape(uint16_t conn_handle, uint16_t handle) {
+	uint8_t buf[2] = {0, 0};
+	ble_gatts_value_t p_value = {
+		.len     = sizeof(buf),
+		.offset  = 0,
+		.p_value = buf,
+	};
+	sd_ble_gatts_value_get(conn_handle, handle, &p_value);
+	return buf[0] | (buf[1] << 8);
+}
 */
 import "C"
-import "unsafe"
 
 // Characteristic is a single characteristic in a service. It has an UUID and a
 // value.
 type Characteristic struct {
 	handle      C.uint16_t
+	cccdHandle  C.uint16_t
 	permissions CharacteristicPermissions
 }
 
+// indicationPending is set while the SoftDevice waits for the confirmation of
+// an indication. Only one indication can be outstanding at a time.
+var indicationPending volatile.Register8
+
 // AddService creates a new service with the characteristics listed in the
 // Service struct.
 func (a *Adapter) AddService(service *Service) error {
@@ -58,24 +122,46 @@ func (a *Adapter) AddService(service *Service) error {
 		value := C.ble_gatts_attr_t{
 			p_uuid: &charUUID,
 			p_attr_md: &C.ble_gatts_attr_md_t{
-				read_perm:  secModeOpen,
-				write_perm: secModeOpen,
+				read_perm:  securityMode(char.Security.read()),
+				write_perm: securityMode(char.Security.write()),
 			},
 			init_len:  C.uint16_t(len(char.Value)),
 			init_offs: 0,
 			max_len:   20, // This is a conservative maximum length.
 		}
+		if len(char.Value) > int(value.max_len) {
+			// Allow long initial values.
+			value.max_len = C.uint16_t(len(char.Value))
+		}
+		if maxNotification := int(a.attMTU()) - 3; maxNotification > int(value.max_len) {
+			// Allow notifications that fill a larger MTU.
+			value.max_len = C.uint16_t(maxNotification)
+		}
+		if char.MaxLength > 0 {
+			// The SoftDevice rejects longer values from clients, and from
+			// Write as well.
+			value.max_len = C.uint16_t(char.maxLength())
+		}
 		if len(char.Value) != 0 {
 			value.p_value = (*C.uint8_t)(unsafe.Pointer(&char.Value[0]))
 		}
 		value.p_attr_md.set_bitfield_vloc(C.BLE_GATTS_VLOC_STACK)
 		value.p_attr_md.set_bitfield_vlen(1)
+		if char.ReadEvent != nil || char.Security&CharacteristicAuthorizedRead != 0 {
+			// The SoftDevice asks to authorize each read, which is answered
+			// with the value from the handler, or refused.
+			value.p_attr_md.set_bitfield_rd_auth(1)
+		}
+		if char.Security&CharacteristicAuthorizedWrite != 0 {
+			value.p_attr_md.set_bitfield_wr_auth(1)
+		}
 		errCode = C.sd_ble_gatts_characteristic_add(C.uint16_t(service.handle), &metadata, &value, &handles)
 		if errCode != 0 {
 			return Error(errCode)
 		}
 		if char.Handle != nil {
 			char.Handle.handle = handles.value_handle
+			char.Handle.cccdHandle = handles.cccd_handle
 			char.Handle.permissions = char.Flags
 		}
 		if char.Flags.Write() && char.WriteEvent != nil {
@@ -87,10 +173,119 @@ func (a *Adapter) AddService(service *Service) error {
 			a.charWriteHandlers = handlers
 			RestoreInterrupts(mask)
 		}
+		if char.ReadEvent != nil {
+			handlers := append(a.readHandlers, readHandler{
+				handle:   handles.value_handle,
+				callback: char.ReadEvent,
+			})
+			mask := DisableInterrupts()
+			a.readHandlers = handlers
+			RestoreInterrupts(mask)
+		}
+		if char.Security&(CharacteristicAuthorizedRead|CharacteristicAuthorizedWrite) != 0 {
+			handlers := append(a.authorizeHandlers, authorizeHandler{
+				handle:   handles.value_handle,
+				security: char.Security,
+				callback: char.AuthorizeEvent,
+			})
+			mask := DisableInterrupts()
+			a.authorizeHandlers = handlers
+			RestoreInterrupts(mask)
+		}
+		for _, desc := range char.Descriptors {
+			if err := a.addDescriptor(desc); err != nil {
+				return err
+			}
+		}
 	}
 	return makeError(errCode)
 }
 
+// ConnectionInfo returns the address, ATT MTU and link type of the client on a
+// connection, such as the one passed to the read and write handlers of a
+// characteristic.
+func (a *Adapter) ConnectionInfo(connection Connection) (ConnectionInfo, error) {
+	if int(connection) >= len(connectionPeers) {
+		return ConnectionInfo{}, errUnknownConnection
+	}
+	mask := DisableInterrupts()
+	peer := connectionPeers[connection]
+	RestoreInterrupts(mask)
+	if !peer.connected {
+		return ConnectionInfo{}, errUnknownConnection
+	}
+
+	return ConnectionInfo{
+		Address:  Address{peer.address},
+		MTU:      connectionMTU(C.uint16_t(connection)),
+		LinkType: LinkTypeLE,
+	}, nil
+}
+
+// addDescriptor adds a descriptor to the characteristic that was added last.
+func (a *Adapter) addDescriptor(desc DescriptorConfig) error {
+	descUUID, errCode := desc.UUID.shortUUID()
+	if errCode != 0 {
+		return Error(errCode)
+	}
+	attr := C.ble_gatts_attr_t{
+		p_uuid:    &descUUID,
+		p_attr_md: &C.ble_gatts_attr_md_t{}, // no access unless permitted
+		init_len:  C.uint16_t(len(desc.Value)),
+		max_len:   20, // This is a conservative maximum length.
+	}
+	if len(desc.Value) > int(attr.max_len) {
+		attr.max_len = C.uint16_t(len(desc.Value))
+	}
+	if len(desc.Value) != 0 {
+		attr.p_value = (*C.uint8_t)(unsafe.Pointer(&desc.Value[0]))
+	}
+	if desc.Flags.Read() {
+		attr.p_attr_md.read_perm = securityMode(desc.Security.read())
+	}
+	if desc.Flags.Write() {
+		attr.p_attr_md.write_perm = securityMode(desc.Security.write())
+	}
+	attr.p_attr_md.set_bitfield_vloc(C.BLE_GATTS_VLOC_STACK)
+	attr.p_attr_md.set_bitfield_vlen(1)
+	if desc.ReadEvent != nil || desc.Security&CharacteristicAuthorizedRead != 0 {
+		// The SoftDevice asks to authorize each read, which is answered with
+		// the value from the handler, or refused.
+		attr.p_attr_md.set_bitfield_rd_auth(1)
+	}
+	if desc.Security&CharacteristicAuthorizedWrite != 0 {
+		attr.p_attr_md.set_bitfield_wr_auth(1)
+	}
+	var handle C.uint16_t
+	errCode = C.sd_ble_gatts_descriptor_add(C.BLE_GATT_HANDLE_INVALID, &attr, &handle)
+	if errCode != 0 {
+		return Error(errCode)
+	}
+
+	mask := DisableInterrupts()
+	if desc.WriteEvent != nil {
+		a.charWriteHandlers = append(a.charWriteHandlers, charWriteHandler{
+			handle:   handle,
+			callback: desc.WriteEvent,
+		})
+	}
+	if desc.ReadEvent != nil {
+		a.readHandlers = append(a.readHandlers, readHandler{
+			handle:   handle,
+			callback: desc.ReadEvent,
+		})
+	}
+	if desc.Security&(CharacteristicAuthorizedRead|CharacteristicAuthorizedWrite) != 0 {
+		a.authorizeHandlers = append(a.authorizeHandlers, authorizeHandler{
+			handle:   handle,
+			security: desc.Security,
+			callback: desc.AuthorizeEvent,
+		})
+	}
+	RestoreInterrupts(mask)
+	return nil
+}
+
 // charWriteHandler contains a handler->callback mapping for characteristic
 // writes.
 type charWriteHandler struct {
@@ -115,7 +310,184 @@ func (a *Adapter) getCharWriteHandler(handle C.uint16_t) *charWriteHandler {
 	return nil // not found
 }
 
-// Write replaces the characteristic value with a new value.
+// readHandler contains a handler->callback mapping for reads of attributes
+// whose value comes from the program.
+type readHandler struct {
+	handle   C.uint16_t
+	callback func(client Connection, offset int) ([]byte, error)
+}
+
+// getReadHandler returns the read handler of the attribute with the handle, or
+// nil if there is none.
+func (a *Adapter) getReadHandler(handle C.uint16_t) *readHandler {
+	for i := range a.readHandlers {
+		if a.readHandlers[i].handle == handle {
+			return &a.readHandlers[i]
+		}
+	}
+	return nil
+}
+
+// authorizeHandler contains the security of an attribute that needs
+// authorization, and the callback that authorizes accesses.
+type authorizeHandler struct {
+	handle   C.uint16_t
+	security CharacteristicSecurity
+	callback func(client Connection, write bool) bool
+}
+
+// authorized returns whether the client may access the attribute with the
+// handle. Attributes without authorization handler need no authorization.
+func (a *Adapter) authorized(connection Connection, handle C.uint16_t, write bool) bool {
+	for i := range a.authorizeHandlers {
+		h := &a.authorizeHandlers[i]
+		if h.handle == handle {
+			return h.security.authorized(connection, write, h.callback)
+		}
+	}
+	return true
+}
+
+// handleAuthorizeRequest answers a read of an attribute with a read handler
+// with the value that the handler returns, or with its ATT error. Accesses of
+// attributes that need authorization are refused unless the program permits
+// them.
+func (a *Adapter) handleAuthorizeRequest(connHandle C.uint16_t, request *C.ble_gatts_evt_rw_authorize_request_t) {
+	switch request._type {
+	case C.BLE_GATTS_AUTHORIZE_TYPE_READ:
+		a.handleReadAuthorizeRequest(connHandle, request.request.unionfield_read())
+	case C.BLE_GATTS_AUTHORIZE_TYPE_WRITE:
+		a.handleWriteAuthorizeRequest(connHandle, request.request.unionfield_write())
+	}
+}
+
+// handleReadAuthorizeRequest answers a read with the value of the read
+// handler, or with the stored value if there is none.
+func (a *Adapter) handleReadAuthorizeRequest(connHandle C.uint16_t, read *C.ble_gatts_evt_read_t) {
+	if !a.authorized(Connection(connHandle), read.handle, false) {
+		C.sd_ble_gatts_read_authorize_reply_noescape(connHandle, C.BLE_GATT_STATUS_ATTERR_INSUF_AUTHORIZATION, 0, 0, nil, 0)
+		return
+	}
+
+	handler := a.getReadHandler(read.handle)
+	if handler == nil {
+		// Only authorization was needed.
+		C.sd_ble_gatts_read_authorize_reply_noescape(connHandle, C.BLE_GATT_STATUS_SUCCESS, 0, 0, nil, 0)
+		return
+	}
+
+	status := C.uint16_t(C.BLE_GATT_STATUS_SUCCESS)
+	value, err := handler.callback(Connection(connHandle), int(read.offset))
+	if err != nil {
+		// The GATT status codes of ATT errors are the ATT error codes
+		// offset by BLE_GATT_STATUS_ATTERR_INVALID.
+		status = C.BLE_GATT_STATUS_ATTERR_INVALID + C.uint16_t(attErrorCode(err))
+	}
+
+	var data *C.uint8_t
+	if status == C.BLE_GATT_STATUS_SUCCESS && len(value) != 0 {
+		data = (*C.uint8_t)(unsafe.Pointer(&value[0]))
+	} else {
+		value = nil
+	}
+	C.sd_ble_gatts_read_authorize_reply_noescape(connHandle, status, 1, read.offset, data, C.uint16_t(len(value)))
+}
+
+// handleWriteAuthorizeRequest answers a write of an attribute that needs
+// authorization. The SoftDevice doesn't send a write event for such writes,
+// so the write handler is called here.
+func (a *Adapter) handleWriteAuthorizeRequest(connHandle C.uint16_t, write *C.ble_gatts_evt_write_t) {
+	connection := Connection(connHandle)
+	switch write.op {
+	case C.BLE_GATTS_OP_EXEC_WRITE_REQ_CANCEL:
+		C.sd_ble_gatts_write_authorize_reply_noescape(connHandle, C.BLE_GATT_STATUS_SUCCESS, 0, nil, 0)
+	case C.BLE_GATTS_OP_EXEC_WRITE_REQ_NOW:
+		// A long write, queued in the memory given below. All the queued
+		// writes must be authorized.
+		status := C.uint16_t(C.BLE_GATT_STATUS_SUCCESS)
+		if !a.queuedWritesAuthorized(connection) {
+			status = C.BLE_GATT_STATUS_ATTERR_INSUF_AUTHORIZATION
+		}
+		C.sd_ble_gatts_write_authorize_reply_noescape(connHandle, status, 0, nil, 0)
+		if status == C.BLE_GATT_STATUS_SUCCESS {
+			a.handleQueuedWrites(connection)
+		}
+	default:
+		if !a.authorized(connection, write.handle, true) {
+			C.sd_ble_gatts_write_authorize_reply_noescape(connHandle, C.BLE_GATT_STATUS_ATTERR_INSUF_AUTHORIZATION, 0, nil, 0)
+			return
+		}
+		C.sd_ble_gatts_write_authorize_reply_noescape(connHandle, C.BLE_GATT_STATUS_SUCCESS, write.offset, &write.data[0], write.len)
+		if write.op == C.BLE_GATTS_OP_PREP_WRITE_REQ {
+			// The value is only complete once the client executes the
+			// writes.
+			return
+		}
+		if handler := a.getCharWriteHandler(write.handle); handler != nil {
+			length := int(write.len)
+			data := (*[255]byte)(unsafe.Pointer(&write.data[0]))[:length:length]
+			handler.callback(connection, int(write.offset), data)
+		}
+	}
+}
+
+// queuedWrites is the memory in which the SoftDevice queues the Prepare Write
+// Requests of a client, for long writes. Each write is stored as its handle,
+// offset and length (16 bits each) followed by the data. An invalid handle
+// ends the list.
+var queuedWrites [512]byte
+
+// replyUserMemRequest gives the SoftDevice the memory for queued writes.
+func replyUserMemRequest(connHandle C.uint16_t) {
+	C.sd_ble_user_mem_reply_noescape(connHandle, &queuedWrites[0], C.uint16_t(len(queuedWrites)))
+}
+
+// queuedWritesAuthorized returns whether the client may execute all the
+// queued writes.
+func (a *Adapter) queuedWritesAuthorized(connection Connection) bool {
+	buf := queuedWrites[:]
+	for len(buf) >= 6 {
+		handle := C.uint16_t(buf[0]) | C.uint16_t(buf[1])<<8
+		if handle == 0 { // BLE_GATT_HANDLE_INVALID
+			break
+		}
+		length := int(buf[4]) | int(buf[5])<<8
+		if !a.authorized(connection, handle, true) {
+			return false
+		}
+		if 6+length > len(buf) {
+			break
+		}
+		buf = buf[6+length:]
+	}
+	return true
+}
+
+// handleQueuedWrites passes the queued writes to the write handlers, once the
+// client has executed them. The SoftDevice has already written the values.
+func (a *Adapter) handleQueuedWrites(connection Connection) {
+	buf := queuedWrites[:]
+	for len(buf) >= 6 {
+		handle := C.uint16_t(buf[0]) | C.uint16_t(buf[1])<<8
+		if handle == 0 { // BLE_GATT_HANDLE_INVALID
+			break
+		}
+		offset := int(buf[2]) | int(buf[3])<<8
+		length := int(buf[4]) | int(buf[5])<<8
+		if 6+length > len(buf) {
+			break
+		}
+		if handler := a.getCharWriteHandler(handle); handler != nil {
+			handler.callback(connection, offset, buf[6:6+length])
+		}
+		buf = buf[6+length:]
+	}
+}
+
+// Write replaces the characteristic value with a new value, and sends it to
+// the clients that have enabled notifications or indications. For an
+// indication, it blocks until the client has confirmed it, or returns an error
+// after 10 seconds.
 func (c *Characteristic) Write(p []byte) (n int, err error) {
 	if len(p) == 0 {
 		// Nothing to write.
@@ -123,30 +495,52 @@ func (c *Characteristic) Write(p []byte) (n int, err error) {
 	}
 
 	connHandle := currentConnection.Get()
-	if connHandle != C.BLE_CONN_HANDLE_INVALID && c.permissions&(CharacteristicNotifyPermission|CharacteristicIndicatePermission) != 0 {
-		// There is a connected central.
-		p_len := uint16(len(p))
-		errCode := C.sd_ble_gatts_hvx_noescape(connHandle,
-			c.handle,
-			C.BLE_GATT_HVX_NOTIFICATION,
-			0,
-			C.uint16_t(p_len),
-			(*C.uint8_t)(unsafe.Pointer(&p[0])),
-		)
-
-		// Check for some expected errors. Don't report them as errors, but
-		// instead fall through and do a normal characteristic value update.
-		// Only return (and possibly report an error) in other cases.
-		//
-		// TODO: improve CGo so that the C constant can be used.
-		if errCode == 0x0008 { // C.NRF_ERROR_INVALID_STATE
-			// May happen when the central has unsubscribed from the
-			// characteristic.
-		} else if errCode == 0x3401 { // C.BLE_ERROR_GATTS_SYS_ATTR_MISSING
-			// May happen when the central is not subscribed to this
-			// characteristic.
-		} else {
-			return int(p_len), makeError(errCode)
+	if connHandle != C.BLE_CONN_HANDLE_INVALID && c.cccdHandle != 0 {
+		// There is a connected central. Send the value the way it asked for.
+		cccd := uint16(C.sd_ble_gatts_cccd_get_noescape(connHandle, c.cccdHandle))
+		switch {
+		case cccd&cccdNotify != 0:
+			// Send as much of the value as fits in the MTU.
+			p_len := uint16(len(p))
+			if maxLen := connectionMTU(connHandle) - 3; p_len > maxLen {
+				p_len = maxLen
+			}
+			errCode := C.sd_ble_gatts_hvx_noescape(connHandle,
+				c.handle,
+				C.BLE_GATT_HVX_NOTIFICATION,
+				0,
+				C.uint16_t(p_len),
+				(*C.uint8_t)(unsafe.Pointer(&p[0])),
+			)
+
+			// Check for some expected errors. Don't report them as errors, but
+			// instead fall through and do a normal characteristic value update.
+			// Only return (and possibly report an error) in other cases.
+			//
+			// TODO: improve CGo so that the C constant can be used.
+			if errCode == 0x0008 { // C.NRF_ERROR_INVALID_STATE
+				// May happen when the central has unsubscribed from the
+				// characteristic.
+			} else if errCode == 0x3401 { // C.BLE_ERROR_GATTS_SYS_ATTR_MISSING
+				// May happen when the central is not subscribed to this
+				// characteristic.
+			} else if errCode != 0 {
+				return 0, Error(errCode)
+			} else if int(p_len) == len(p) {
+				return len(p), nil
+			}
+			// The notification only stored the bytes that were sent, so
+			// store the complete value below.
+		case cccd&cccdIndicate != 0:
+			ctx, cancel := context.WithTimeout(context.Background(), indicationTimeout)
+			defer cancel()
+			if err := c.indicate(ctx, connHandle, p); err != nil {
+				return 0, err
+			}
+			if int(connectionMTU(connHandle))-3 >= len(p) {
+				return len(p), nil
+			}
+			// Store the complete value, as for a notification.
 		}
 	}
 
@@ -157,3 +551,75 @@ func (c *Characteristic) Write(p []byte) (n int, err error) {
 
 	return len(p), nil
 }
+
+// Indicate replaces the characteristic value with a new value, and sends it
+// as an indication if the central has enabled indications. It waits until the
+// central has confirmed the indication or the context is done. It returns
+// right away if the central hasn't enabled indications.
+func (c *Characteristic) Indicate(ctx context.Context, value []byte) error {
+	if !c.permissions.Indicate() {
+		return errNoIndicate
+	}
+
+	connHandle := currentConnection.Get()
+	if connHandle != C.BLE_CONN_HANDLE_INVALID && len(value) != 0 {
+		cccd := uint16(C.sd_ble_gatts_cccd_get_noescape(connHandle, c.cccdHandle))
+		if cccd&cccdIndicate != 0 {
+			return c.indicate(ctx, connHandle, value)
+		}
+	}
+
+	var p *C.uint8_t
+	if len(value) != 0 {
+		p = (*C.uint8_t)(unsafe.Pointer(&value[0]))
+	}
+	errCode := C.sd_ble_gatts_value_set_noescape(C.BLE_CONN_HANDLE_INVALID, c.handle, C.uint16_t(len(value)), p)
+	return makeError(errCode)
+}
+
+// indicate sends the value as an indication, which also updates the
+// characteristic value, and waits for the confirmation.
+func (c *Characteristic) indicate(ctx context.Context, connHandle C.uint16_t, value []byte) error {
+	// Wait for the confirmation of an earlier indication.
+	if err := waitIndication(ctx); err != nil {
+		return err
+	}
+
+	// Send as much of the value as fits in the MTU.
+	length := len(value)
+	if maxLen := int(connectionMTU(connHandle)) - 3; length > maxLen {
+		length = maxLen
+	}
+
+	indicationPending.Set(1)
+	errCode := C.sd_ble_gatts_hvx_noescape(connHandle,
+		c.handle,
+		C.BLE_GATT_HVX_INDICATION,
+		0,
+		C.uint16_t(length),
+		(*C.uint8_t)(unsafe.Pointer(&value[0])),
+	)
+	if errCode != 0 {
+		indicationPending.Set(0)
+		return Error(errCode)
+	}
+
+	return waitIndication(ctx)
+}
+
+// waitIndication waits until there is no outstanding indication. The event
+// handler clears indicationPending when the confirmation arrives, or when the
+// central disconnects.
+func waitIndication(ctx context.Context) error {
+	for indicationPending.Get() != 0 {
+		select {
+		case <-ctx.Done():
+			// The SoftDevice still waits for the confirmation, and refuses
+			// new indications until it arrives.
+			return ctx.Err()
+		case <-time.After(time.Millisecond):
+		}
+	}
+
+	return nil
+}
@@ -8,6 +8,7 @@ require (
 	github.com/saltosystems/winrt-go v0.0.0-20240320113951-a2e4fc03f5f4
 	github.com/tinygo-org/cbgo v0.0.4
 	golang.org/x/crypto v0.12.0
+	golang.org/x/sys v0.11.0
 	tinygo.org/x/drivers v0.26.1-0.20230922160320-ed51435c2ef6
 	tinygo.org/x/tinyfont v0.4.0
 	tinygo.org/x/tinyterm v0.3.0
@@ -16,6 +17,5 @@ require (
 require (
 	github.com/google/shlex v0.0.0-20191202100458-e7afc7fbc510 // indirect
 	github.com/sirupsen/logrus v1.9.3 // indirect
-	golang.org/x/sys v0.11.0 // indirect
 	golang.org/x/term v0.11.0 // indirect
 )
@@ -1,4 +1,4 @@
-//go:build ninafw
+//go:build hci || ninafw
 
 package bluetooth
 
@@ -6,7 +6,6 @@ import (
 	"encoding/binary"
 	"encoding/hex"
 	"errors"
-	"machine"
 	"time"
 )
 
@@ -28,6 +27,7 @@ const (
 
 	// ogfInfoParam
 	ocfReadLocalVersion = 0x0001
+	ocfReadBufferSize   = 0x0005
 	ocfReadBDAddr       = 0x0009
 
 	// ogfStatusParam
@@ -46,9 +46,24 @@ const (
 	ocfLECancelConn               = 0x000e
 	ocfLEConnUpdate               = 0x0013
 	ocfLEParamRequestReply        = 0x0020
+	ocfLESetDataLength            = 0x0022
+	ocfLESetPHY                   = 0x0032
+
+	ocfLESetAdvertisingSetRandomAddress       = 0x0035
+	ocfLESetExtendedAdvertisingParameters     = 0x0036
+	ocfLESetExtendedAdvertisingData           = 0x0037
+	ocfLESetExtendedScanResponseData          = 0x0038
+	ocfLESetExtendedAdvertisingEnable         = 0x0039
+	ocfLEReadMaximumAdvertisingDataLength     = 0x003a
+	ocfLEReadNumberOfSupportedAdvertisingSets = 0x003b
+	ocfLERemoveAdvertisingSet                 = 0x003c
+	ocfLESetExtendedScanParameters            = 0x0041
+	ocfLESetExtendedScanEnable                = 0x0042
+	ocfLEExtendedCreateConn                   = 0x0043
 
 	leCommandEncrypt                  = 0x0017
 	leCommandRandom                   = 0x0018
+	leCommandStartEncryption          = 0x0019
 	leCommandLongTermKeyReply         = 0x001A
 	leCommandLongTermKeyNegativeReply = 0x001B
 	leCommandReadLocalP256            = 0x0025
@@ -66,20 +81,50 @@ const (
 	leMetaEventGenerateDHKeyComplete          = 0x09
 	leMetaEventEnhancedConnectionComplete     = 0x0A
 	leMetaEventDirectAdvertisingReport        = 0x0B
+	leMetaEventPHYUpdateComplete              = 0x0C
+	leMetaEventExtendedAdvertisingReport      = 0x0D
+
+	leAdvTypeAdvInd        = 0x00
+	leAdvTypeAdvDirectInd  = 0x01
+	leAdvTypeAdvScanInd    = 0x02
+	leAdvTypeAdvNonconnInd = 0x03
+	leAdvTypeScanRsp       = 0x04
+
+	// Event type bits of extended advertising reports and advertising event
+	// properties of extended advertising sets.
+	leExtAdvConnectable    = 0x0001
+	leExtAdvScannable      = 0x0002
+	leExtAdvDirected       = 0x0004
+	leExtAdvScanResponse   = 0x0008 // only in reports
+	leExtAdvLegacy         = 0x0010
+	leExtAdvDataStatusMask = 0x0060 // only in reports
+	leExtAdvDataIncomplete = 0x0020 // only in reports
+	leExtAdvIncludeTxPower = 0x0040 // only in properties
+
+	// Operations for fragmented extended advertising data.
+	leExtAdvDataIntermediate = 0x00
+	leExtAdvDataFirst        = 0x01
+	leExtAdvDataLast         = 0x02
+	leExtAdvDataComplete     = 0x03
+
+	// Maximum amount of data in a single LE Set Extended Advertising Data or
+	// LE Set Extended Scan Response Data command.
+	leExtAdvDataFragmentSize = 251
 
 	hciCommandPkt  = 0x01
 	hciACLDataPkt  = 0x02
 	hciEventPkt    = 0x04
 	hciSecurityPkt = 0x06
 
-	evtDisconnComplete  = 0x05
-	evtEncryptionChange = 0x08
-	evtCmdComplete      = 0x0e
-	evtCmdStatus        = 0x0f
-	evtHardwareError    = 0x10
-	evtNumCompPkts      = 0x13
-	evtReturnLinkKeys   = 0x15
-	evtLEMetaEvent      = 0x3e
+	evtDisconnComplete      = 0x05
+	evtEncryptionChange     = 0x08
+	evtCmdComplete          = 0x0e
+	evtCmdStatus            = 0x0f
+	evtHardwareError        = 0x10
+	evtNumCompPkts          = 0x13
+	evtReturnLinkKeys       = 0x15
+	evtEncryptionKeyRefresh = 0x30
+	evtLEMetaEvent          = 0x3e
 
 	hciOEUserEndedConnection = 0x13
 )
@@ -88,6 +133,29 @@ const (
 	hciACLLenPos = 4
 	hciEvtLenPos = 2
 
+	// The largest packet is a command with 255 bytes of parameters.
+	hciMaxPacketSize = 1 + 3 + 255
+
+	// Maximum number of extended advertisements that are combined at the same
+	// time.
+	maxExtendedReassembly = 4
+
+	// Packet boundary flags of ACL data packets.
+	aclStartNonFlushable = 0x00
+	aclContinuing        = 0x01
+	aclStartFlushable    = 0x02
+
+	// Every LE controller supports ACL data packets of at least 27 bytes.
+	aclMinDataLength = 27
+
+	// Maximum number of ACL data packets queued per connection, and how long
+	// to wait for the controller to free a buffer.
+	aclMaxQueuedPkts  = 32
+	aclTimeoutSeconds = 3
+
+	// The largest L2CAP packet that is reassembled, for an ATT MTU of 517.
+	hciMaxL2CAPLength = 4 + 517
+
 	attCID       = 0x0004
 	bleCTL       = 0x0008
 	signalingCID = 0x0005
@@ -100,64 +168,130 @@ var (
 	ErrHCIUnknown       = errors.New("bluetooth: HCI unknown error")
 	ErrHCIInvalidPacket = errors.New("bluetooth: HCI invalid packet")
 	ErrHCIHardware      = errors.New("bluetooth: HCI hardware error")
+	ErrHCIBuffersFull   = errors.New("bluetooth: HCI controller buffers full")
+	ErrHCINoConnection  = errors.New("bluetooth: HCI unknown connection handle")
 )
 
 type leAdvertisingReport struct {
-	reported                        bool
-	numReports, typ, peerBdaddrType uint8
-	peerBdaddr                      [6]uint8
-	eirLength                       uint8
-	eirData                         [31]uint8
-	rssi                            int8
+	typ            uint8
+	peerBdaddrType uint8
+	peerBdaddr     [6]uint8
+	eirLength      uint8
+	eirData        [31]uint8
+	rssi           int8
+
+	// Set for extended advertisements (not for legacy advertisements received
+	// in an extended advertising report).
+	extended     bool
+	primaryPHY   uint8
+	secondaryPHY uint8
+	sid          uint8
+	txPower      int8
+	extData      []byte
 }
 
-type leConnectData struct {
-	connected      bool
-	status         uint8
+// hciStatusError is returned when the controller rejects a command.
+type hciStatusError uint8
+
+func (e hciStatusError) Error() string {
+	return "bluetooth: HCI command failed with status 0x" + hex.EncodeToString([]byte{byte(e)})
+}
+
+const (
+	hciRoleCentral    = 0x00
+	hciRolePeripheral = 0x01
+)
+
+// hciConnection is an entry in the connection table.
+type hciConnection struct {
 	handle         uint16
 	role           uint8
 	peerBdaddrType uint8
 	peerBdaddr     [6]uint8
 	interval       uint16
 	timeout        uint16
+
+	// ACL flow control and reassembly state.
+	pendingPkts uint16   // packets sent but not yet completed by the controller
+	txQueue     [][]byte // packets waiting for a free controller buffer
+	rxBuf       []byte   // L2CAP packet being reassembled
+}
+
+// hciConnectionEvent is a change in the connection table, which is handled by
+// the adapter outside of the event handler.
+type hciConnectionEvent struct {
+	hciConnection
+	connected bool
+}
+
+// hciLinkUpdate is a data length or PHY change of a connection, which is
+// reported by the adapter outside of the event handler.
+type hciLinkUpdate struct {
+	handle uint16
+	LinkUpdate
+}
+
+// leConnectData is the result of the last connection attempt as a central.
+type leConnectData struct {
+	completed bool
+	status    uint8
+	hciConnection
 }
 
 type hci struct {
-	uart              *machine.UART
-	softCTS           machine.Pin
-	softRTS           machine.Pin
+	transport         HCITransport
+	flowControl       HCIFlowControl
 	att               *att
 	l2cap             *l2cap
+	smp               *smp
 	buf               []byte
 	address           [6]byte
+	randomAddress     [6]byte // resolvable private address while privacy is enabled
+	privacy           bool
+	irk               [16]byte // identity resolving key while privacy is enabled
 	cmdCompleteOpcode uint16
 	cmdCompleteStatus uint8
 	cmdResponse       []byte
 	scanning          bool
-	advData           leAdvertisingReport
+	advReports        []leAdvertisingReport
+	extReassembly     []leAdvertisingReport
+	extended          bool
+	connections       []hciConnection
+	connectionEvents  []hciConnectionEvent
+	linkUpdates       []hciLinkUpdate
 	connectData       leConnectData
-	maxPkt            uint16
-	pendingPkt        uint16
+	aclMaxLen         uint16 // size of a controller ACL data buffer
+	aclMaxPkts        uint16 // number of controller ACL data buffers, 0 if unknown
+	aclBuf            []byte
+	handling          bool
+	capture           *hciCapture
 }
 
-func newHCI(uart *machine.UART) *hci {
-	return &hci{
-		uart:    uart,
-		softCTS: machine.NoPin,
-		softRTS: machine.NoPin,
-		buf:     make([]byte, 256),
+func newHCI(transport HCITransport) *hci {
+	h := &hci{
+		transport: transport,
+		buf:       make([]byte, hciMaxPacketSize),
+		aclMaxLen: aclMinDataLength,
+		aclBuf:    make([]byte, 1+hciACLLenPos+aclMinDataLength),
 	}
+
+	// software flow control is optional
+	h.flowControl, _ = transport.(HCIFlowControl)
+
+	return h
 }
 
 func (h *hci) start() error {
-	if h.softRTS != machine.NoPin {
-		h.softRTS.Low()
+	if h.flowControl != nil {
+		h.flowControl.SetReadyToReceive(true)
 
-		defer h.softRTS.High()
+		defer h.flowControl.SetReadyToReceive(false)
 	}
 
-	for h.uart.Buffered() > 0 {
-		h.uart.ReadByte()
+	for h.transport.Buffered() > 0 {
+		if _, err := h.transport.Read(h.buf[:1]); err != nil {
+			return err
+		}
 	}
 
 	return nil
@@ -172,16 +306,17 @@ func (h *hci) reset() error {
 }
 
 func (h *hci) poll() error {
-	if h.softRTS != machine.NoPin {
-		h.softRTS.Low()
+	if h.flowControl != nil {
+		h.flowControl.SetReadyToReceive(true)
 
-		defer h.softRTS.High()
+		defer h.flowControl.SetReadyToReceive(false)
 	}
 
 	i := 0
-	for h.uart.Buffered() > 0 {
-		data, _ := h.uart.ReadByte()
-		h.buf[i] = data
+	for h.transport.Buffered() > 0 {
+		if _, err := h.transport.Read(h.buf[i : i+1]); err != nil {
+			return err
+		}
 
 		done, err := h.processPacket(i)
 		switch {
@@ -203,7 +338,11 @@ func (h *hci) poll() error {
 			time.Sleep(5 * time.Millisecond)
 		default:
 			i++
-			time.Sleep(1 * time.Millisecond)
+
+			// wait for the rest of the packet to arrive
+			if h.transport.Buffered() == 0 {
+				time.Sleep(1 * time.Millisecond)
+			}
 		}
 	}
 
@@ -222,7 +361,11 @@ func (h *hci) processPacket(i int) (bool, error) {
 				if debug {
 					println("hci acl data:", i, hex.EncodeToString(h.buf[:1+hciACLLenPos+pktlen]))
 				}
-				return true, h.handleACLData(h.buf[1 : 1+hciACLLenPos+pktlen])
+				h.capture.record(true, h.buf[:1+hciACLLenPos+pktlen])
+				h.handling = true
+				err := h.handleACLData(h.buf[1 : 1+hciACLLenPos+pktlen])
+				h.handling = false
+				return true, err
 			}
 		}
 
@@ -237,7 +380,11 @@ func (h *hci) processPacket(i int) (bool, error) {
 				if debug {
 					println("hci event data:", i, hex.EncodeToString(h.buf[:1+hciEvtLenPos+pktlen]))
 				}
-				return true, h.handleEventData(h.buf[1 : 1+hciEvtLenPos+pktlen])
+				h.capture.record(true, h.buf[:1+hciEvtLenPos+pktlen])
+				h.handling = true
+				err := h.handleEventData(h.buf[1 : 1+hciEvtLenPos+pktlen])
+				h.handling = false
+				return true, err
 			}
 		}
 
@@ -256,11 +403,41 @@ func (h *hci) readBdAddr() error {
 		return err
 	}
 
-	copy(h.address[:], h.cmdResponse[:7])
+	copy(h.address[:], h.cmdResponse[:6])
 
 	return nil
 }
 
+func (h *hci) leSetRandomAddress(address [6]byte) error {
+	if err := h.sendCommandWithParams(ogfLECtrl<<ogfCommandPos|ocfLESetRandomAddress, address[:]); err != nil {
+		return err
+	}
+
+	return h.statusError()
+}
+
+func (h *hci) leSetAdvertisingSetRandomAddress(handle uint8, address [6]byte) error {
+	var b [7]byte
+	b[0] = handle
+	copy(b[1:], address[:])
+
+	if err := h.sendCommandWithParams(ogfLECtrl<<ogfCommandPos|ocfLESetAdvertisingSetRandomAddress, b[:]); err != nil {
+		return err
+	}
+
+	return h.statusError()
+}
+
+// ownAddressType returns the own address type to advertise with: the random
+// address while privacy is enabled, the public address otherwise.
+func (h *hci) ownAddressType() uint8 {
+	if h.privacy {
+		return 0x01
+	}
+
+	return 0x00
+}
+
 func (h *hci) setEventMask(eventMask uint64) error {
 	var b [8]byte
 	binary.LittleEndian.PutUint64(b[:], eventMask)
@@ -278,18 +455,36 @@ func (h *hci) readLeBufferSize() error {
 		return err
 	}
 
-	pktLen := binary.LittleEndian.Uint16(h.buf[0:])
-	h.maxPkt = uint16(h.buf[2])
+	if len(h.cmdResponse) < 3 {
+		return ErrHCIInvalidPacket
+	}
 
-	// pkt len must be at least 27 bytes
-	if pktLen < 27 {
-		pktLen = 27
+	pktLen := binary.LittleEndian.Uint16(h.cmdResponse[0:])
+	maxPkts := uint16(h.cmdResponse[2])
+
+	// A length of zero means that LE shares the buffers with BR/EDR.
+	if pktLen == 0 {
+		if err := h.sendCommand(ogfInfoParam<<ogfCommandPos | ocfReadBufferSize); err != nil {
+			return err
+		}
+
+		if len(h.cmdResponse) < 7 {
+			return ErrHCIInvalidPacket
+		}
+
+		pktLen = binary.LittleEndian.Uint16(h.cmdResponse[0:])
+		maxPkts = binary.LittleEndian.Uint16(h.cmdResponse[3:])
 	}
 
-	if err := h.att.setMaxMTU(pktLen); err != nil {
-		return err
+	// pkt len must be at least 27 bytes
+	if pktLen < aclMinDataLength {
+		pktLen = aclMinDataLength
 	}
 
+	h.aclMaxLen = pktLen
+	h.aclMaxPkts = maxPkts
+	h.aclBuf = make([]byte, 1+hciACLLenPos+int(pktLen))
+
 	return nil
 }
 
@@ -361,6 +556,204 @@ func (h *hci) leSetScanResponseData(data []byte) error {
 	return h.sendCommandWithParams(ogfLECtrl<<ogfCommandPos|ocfLESetScanResponseData, b[:])
 }
 
+// statusError returns an error if the last command was rejected by the
+// controller.
+func (h *hci) statusError() error {
+	if h.cmdCompleteStatus != 0 {
+		return hciStatusError(h.cmdCompleteStatus)
+	}
+
+	return nil
+}
+
+func (h *hci) leSetExtendedAdvertisingParameters(handle uint8, properties uint16,
+	minInterval, maxInterval uint32, ownBdaddrType uint8, txPower int8,
+	primaryPHY, secondaryPHY, sid uint8) (selectedTxPower int8, err error) {
+
+	var b [25]byte
+	b[0] = handle
+	binary.LittleEndian.PutUint16(b[1:], properties)
+	b[3], b[4], b[5] = byte(minInterval), byte(minInterval>>8), byte(minInterval>>16)
+	b[6], b[7], b[8] = byte(maxInterval), byte(maxInterval>>8), byte(maxInterval>>16)
+	b[9] = 0x07 // all channels
+	b[10] = ownBdaddrType
+	b[18] = 0x00 // no filter
+	b[19] = byte(txPower)
+	b[20] = primaryPHY
+	b[21] = 0x00 // secondary max skip
+	b[22] = secondaryPHY
+	b[23] = sid
+	b[24] = 0x00 // no scan request notifications
+
+	if err := h.sendCommandWithParams(ogfLECtrl<<ogfCommandPos|ocfLESetExtendedAdvertisingParameters, b[:]); err != nil {
+		return 0, err
+	}
+	if err := h.statusError(); err != nil {
+		return 0, err
+	}
+	if len(h.cmdResponse) < 1 {
+		return 0, ErrHCIInvalidPacket
+	}
+
+	h.extended = true
+	return int8(h.cmdResponse[0]), nil
+}
+
+// leSetExtendedAdvertisingData sets the advertising data or scan response
+// data of an advertising set, split over as many commands as needed.
+func (h *hci) leSetExtendedAdvertisingData(handle uint8, scanResponse bool, data []byte) error {
+	ocf := uint16(ocfLESetExtendedAdvertisingData)
+	if scanResponse {
+		ocf = ocfLESetExtendedScanResponseData
+	}
+
+	var b [4 + leExtAdvDataFragmentSize]byte
+	for offset := 0; ; offset += leExtAdvDataFragmentSize {
+		fragment := data[offset:]
+		last := len(fragment) <= leExtAdvDataFragmentSize
+		if !last {
+			fragment = fragment[:leExtAdvDataFragmentSize]
+		}
+
+		switch {
+		case offset == 0 && last:
+			b[1] = leExtAdvDataComplete
+		case offset == 0:
+			b[1] = leExtAdvDataFirst
+		case last:
+			b[1] = leExtAdvDataLast
+		default:
+			b[1] = leExtAdvDataIntermediate
+		}
+		b[0] = handle
+		b[2] = 0x01 // the controller should not fragment the data
+		b[3] = byte(len(fragment))
+		copy(b[4:], fragment)
+
+		if err := h.sendCommandWithParams(ogfLECtrl<<ogfCommandPos|ocf, b[:4+len(fragment)]); err != nil {
+			return err
+		}
+		if err := h.statusError(); err != nil {
+			return err
+		}
+
+		if last {
+			return nil
+		}
+	}
+}
+
+func (h *hci) leSetExtendedAdvertisingEnable(enabled bool, handle uint8) error {
+	var b [6]byte
+	if enabled {
+		b[0] = 1
+	}
+	b[1] = 1 // number of sets
+	b[2] = handle
+	// no duration or maximum number of events
+
+	if err := h.sendCommandWithParams(ogfLECtrl<<ogfCommandPos|ocfLESetExtendedAdvertisingEnable, b[:]); err != nil {
+		return err
+	}
+
+	return h.statusError()
+}
+
+func (h *hci) leRemoveAdvertisingSet(handle uint8) error {
+	if err := h.sendCommandWithParams(ogfLECtrl<<ogfCommandPos|ocfLERemoveAdvertisingSet, []byte{handle}); err != nil {
+		return err
+	}
+
+	return h.statusError()
+}
+
+func (h *hci) leReadMaximumAdvertisingDataLength() (uint16, error) {
+	if err := h.sendCommand(ogfLECtrl<<ogfCommandPos | ocfLEReadMaximumAdvertisingDataLength); err != nil {
+		return 0, err
+	}
+	if err := h.statusError(); err != nil {
+		return 0, err
+	}
+	if len(h.cmdResponse) < 2 {
+		return 0, ErrHCIInvalidPacket
+	}
+
+	return binary.LittleEndian.Uint16(h.cmdResponse), nil
+}
+
+// leSetExtendedScanParameters sets the same scan parameters for every PHY in
+// the phys bitmask (bit 0 for 1M, bit 2 for Coded).
+func (h *hci) leSetExtendedScanParameters(typ uint8, interval, window uint16, ownBdaddrType, filter, phys uint8) error {
+	var b [3 + 2*5]byte
+	b[0] = ownBdaddrType
+	b[1] = filter
+	b[2] = phys
+
+	n := 3
+	for phy := 0; phy < 8; phy++ {
+		if phys&(1<<phy) == 0 {
+			continue
+		}
+		b[n] = typ
+		binary.LittleEndian.PutUint16(b[n+1:], interval)
+		binary.LittleEndian.PutUint16(b[n+3:], window)
+		n += 5
+	}
+
+	if err := h.sendCommandWithParams(ogfLECtrl<<ogfCommandPos|ocfLESetExtendedScanParameters, b[:n]); err != nil {
+		return err
+	}
+	if err := h.statusError(); err != nil {
+		return err
+	}
+
+	h.extended = true
+	return nil
+}
+
+func (h *hci) leSetExtendedScanEnable(enabled, duplicates bool) error {
+	h.scanning = enabled
+	h.extReassembly = h.extReassembly[:0]
+
+	var b [6]byte
+	if enabled {
+		b[0] = 1
+	}
+	if duplicates {
+		b[1] = 1
+	}
+	// no duration or period
+
+	return h.sendCommandWithParams(ogfLECtrl<<ogfCommandPos|ocfLESetExtendedScanEnable, b[:])
+}
+
+// leExtendedCreateConn is like leCreateConn, for controllers that have been
+// switched to the extended advertising commands. It connects on the 1M PHY.
+func (h *hci) leExtendedCreateConn(interval, window uint16,
+	initiatorFilter, peerBdaddrType uint8, peerBdaddr [6]byte, ownBdaddrType uint8,
+	minInterval, maxInterval, latency, supervisionTimeout,
+	minCeLength, maxCeLength uint16) error {
+
+	var b [10 + 16]byte
+	b[0] = initiatorFilter
+	b[1] = ownBdaddrType
+	b[2] = peerBdaddrType
+	copy(b[3:], peerBdaddr[:])
+	b[9] = 0x01 // 1M PHY
+
+	p := b[10:]
+	binary.LittleEndian.PutUint16(p[0:], interval)
+	binary.LittleEndian.PutUint16(p[2:], window)
+	binary.LittleEndian.PutUint16(p[4:], minInterval)
+	binary.LittleEndian.PutUint16(p[6:], maxInterval)
+	binary.LittleEndian.PutUint16(p[8:], latency)
+	binary.LittleEndian.PutUint16(p[10:], supervisionTimeout)
+	binary.LittleEndian.PutUint16(p[12:], minCeLength)
+	binary.LittleEndian.PutUint16(p[14:], maxCeLength)
+
+	return h.sendCommandWithParams(ogfLECtrl<<ogfCommandPos|ocfLEExtendedCreateConn, b[:])
+}
+
 func (h *hci) leCreateConn(interval, window uint16,
 	initiatorFilter, peerBdaddrType uint8, peerBdaddr [6]byte, ownBdaddrType uint8,
 	minInterval, maxInterval, latency, supervisionTimeout,
@@ -390,7 +783,64 @@ func (h *hci) leCancelConn() error {
 func (h *hci) leConnUpdate(handle uint16, minInterval, maxInterval,
 	latency, supervisionTimeout uint16) error {
 
-	var b [14]byte
+	b := leConnUpdateParams(handle, minInterval, maxInterval, latency, supervisionTimeout)
+	return h.sendCommandWithParams(ogfLECtrl<<ogfCommandPos|ocfLEConnUpdate, b[:])
+}
+
+// leConnUpdateWithoutResponse is like leConnUpdate, but doesn't wait for the
+// controller to respond. Event handlers must use it: waiting for a response
+// in an event handler would swallow the response to a command that is
+// already waiting.
+func (h *hci) leConnUpdateWithoutResponse(handle uint16, minInterval, maxInterval,
+	latency, supervisionTimeout uint16) error {
+
+	b := leConnUpdateParams(handle, minInterval, maxInterval, latency, supervisionTimeout)
+	return h.sendWithoutResponse(ogfLECtrl<<ogfCommandPos|ocfLEConnUpdate, b[:])
+}
+
+// leSetDataLength suggests a maximum payload size of link layer data packets
+// sent on the connection. The controllers negotiate the actual size.
+func (h *hci) leSetDataLength(handle, txOctets uint16) error {
+	var b [6]byte
+	binary.LittleEndian.PutUint16(b[0:], handle)
+	binary.LittleEndian.PutUint16(b[2:], txOctets)
+	// transmit time on the 1M PHY: preamble, access address, header and MIC
+	binary.LittleEndian.PutUint16(b[4:], (txOctets+14)*8)
+
+	if err := h.sendCommandWithParams(ogfLECtrl<<ogfCommandPos|ocfLESetDataLength, b[:]); err != nil {
+		return err
+	}
+
+	return h.statusError()
+}
+
+// leSetPHY sets the preferred PHYs of the connection. A zero PHY means no
+// preference for that direction.
+func (h *hci) leSetPHY(handle uint16, tx, rx PHY) error {
+	var b [7]byte
+	binary.LittleEndian.PutUint16(b[0:], handle)
+	if tx == 0 {
+		b[2] |= 0x01 // no TX preference
+	} else {
+		b[3] = 1 << (tx - 1)
+	}
+	if rx == 0 {
+		b[2] |= 0x02 // no RX preference
+	} else {
+		b[4] = 1 << (rx - 1)
+	}
+	// b[5:7]: no preferred coding on the coded PHY
+
+	if err := h.sendCommandWithParams(ogfLECtrl<<ogfCommandPos|ocfLESetPHY, b[:]); err != nil {
+		return err
+	}
+
+	return h.statusError()
+}
+
+func leConnUpdateParams(handle uint16, minInterval, maxInterval,
+	latency, supervisionTimeout uint16) (b [14]byte) {
+
 	binary.LittleEndian.PutUint16(b[0:], handle)
 	binary.LittleEndian.PutUint16(b[2:], minInterval)
 	binary.LittleEndian.PutUint16(b[4:], maxInterval)
@@ -399,7 +849,7 @@ func (h *hci) leConnUpdate(handle uint16, minInterval, maxInterval,
 	binary.LittleEndian.PutUint16(b[10:], 0x0004)
 	binary.LittleEndian.PutUint16(b[12:], 0x0006)
 
-	return h.sendCommandWithParams(ogfLECtrl<<ogfCommandPos|ocfLEConnUpdate, b[:])
+	return b
 }
 
 func (h *hci) disconnect(handle uint16) error {
@@ -465,24 +915,148 @@ func (h *hci) sendWithoutResponse(opcode uint16, params []byte) error {
 	return nil
 }
 
+// findConnection returns the connection table entry for the handle, or nil if
+// there is no such connection. The pointer is only valid until the next packet
+// is processed.
+func (h *hci) findConnection(handle uint16) *hciConnection {
+	for i := range h.connections {
+		if h.connections[i].handle == handle {
+			return &h.connections[i]
+		}
+	}
+
+	return nil
+}
+
+// hasACLBuffer returns whether the controller has a free ACL data buffer.
+func (h *hci) hasACLBuffer() bool {
+	if h.aclMaxPkts == 0 {
+		return true
+	}
+
+	pending := uint16(0)
+	for i := range h.connections {
+		pending += h.connections[i].pendingPkts
+	}
+
+	return pending < h.aclMaxPkts
+}
+
+// sendAclPkt sends an L2CAP packet on the connection, split into fragments
+// that fit in the controller buffers. Fragments that can't be sent right away
+// are queued until the controller completes earlier packets. Outside of the
+// event handlers, it waits until all fragments have been sent.
 func (h *hci) sendAclPkt(handle uint16, cid uint8, data []byte) error {
-	h.buf[0] = hciACLDataPkt
-	binary.LittleEndian.PutUint16(h.buf[1:], handle)
-	binary.LittleEndian.PutUint16(h.buf[3:], uint16(len(data)+4))
-	binary.LittleEndian.PutUint16(h.buf[5:], uint16(len(data)))
-	binary.LittleEndian.PutUint16(h.buf[7:], uint16(cid))
+	conn := h.findConnection(handle)
+	if conn == nil {
+		return ErrHCINoConnection
+	}
+
+	var header [4]byte
+	binary.LittleEndian.PutUint16(header[0:], uint16(len(data)))
+	binary.LittleEndian.PutUint16(header[2:], uint16(cid))
 
-	copy(h.buf[9:], data)
+	total := len(header) + len(data)
+	maxLen := int(h.aclMaxLen)
+	if len(conn.txQueue)+(total+maxLen-1)/maxLen > aclMaxQueuedPkts {
+		return ErrHCIBuffersFull
+	}
 
 	if debug {
-		println("hci send acl data", handle, cid, hex.EncodeToString(h.buf[:9+len(data)]))
+		println("hci send acl data", handle, cid, hex.EncodeToString(data))
 	}
 
-	if _, err := h.write(h.buf[:9+len(data)]); err != nil {
-		return err
+	flags := uint16(aclStartNonFlushable)
+	for offset := 0; offset < total; {
+		n := total - offset
+		if n > maxLen {
+			n = maxLen
+		}
+
+		pkt := h.aclBuf[:1+hciACLLenPos+n]
+		pkt[0] = hciACLDataPkt
+		binary.LittleEndian.PutUint16(pkt[1:], handle|flags<<12)
+		binary.LittleEndian.PutUint16(pkt[3:], uint16(n))
+
+		fragment := pkt[1+hciACLLenPos:]
+		m := 0
+		if offset < len(header) {
+			m = copy(fragment, header[offset:])
+		}
+		copy(fragment[m:], data[offset+m-len(header):])
+
+		if len(conn.txQueue) == 0 && h.hasACLBuffer() {
+			if _, err := h.write(pkt); err != nil {
+				return err
+			}
+			conn.pendingPkts++
+		} else {
+			conn.txQueue = append(conn.txQueue, append([]byte(nil), pkt...))
+		}
+
+		offset += n
+		flags = aclContinuing
 	}
 
-	h.pendingPkt++
+	if h.handling {
+		// The queue is sent when the controller completes packets, which is
+		// handled by the caller.
+		return nil
+	}
+
+	return h.waitForACLQueue(handle)
+}
+
+// waitForACLQueue processes incoming packets until all queued packets of the
+// connection have been sent. The queue is dropped when the controller doesn't
+// free any buffers in time.
+func (h *hci) waitForACLQueue(handle uint16) error {
+	start := time.Now().UnixNano()
+	for {
+		conn := h.findConnection(handle)
+		switch {
+		case conn == nil:
+			return ErrHCINoConnection
+
+		case len(conn.txQueue) == 0:
+			return nil
+
+		case (time.Now().UnixNano()-start)/int64(time.Second) > aclTimeoutSeconds:
+			conn.txQueue = nil
+			return ErrHCIBuffersFull
+		}
+
+		if err := h.poll(); err != nil {
+			return err
+		}
+
+		time.Sleep(1 * time.Millisecond)
+	}
+}
+
+// sendQueuedACL sends queued packets while the controller has free buffers,
+// taking turns between the connections.
+func (h *hci) sendQueuedACL() error {
+	for sent := true; sent; {
+		sent = false
+		for i := range h.connections {
+			conn := &h.connections[i]
+			if len(conn.txQueue) == 0 {
+				continue
+			}
+			if !h.hasACLBuffer() {
+				return nil
+			}
+
+			if _, err := h.write(conn.txQueue[0]); err != nil {
+				return err
+			}
+			conn.txQueue[0] = nil
+			conn.txQueue = conn.txQueue[1:]
+			conn.pendingPkts++
+			sent = true
+		}
+	}
 
 	return nil
 }
@@ -490,9 +1064,9 @@ func (h *hci) sendAclPkt(handle uint16, cid uint8, data []byte) error {
 const writeAttempts = 200
 
 func (h *hci) write(buf []byte) (int, error) {
-	if h.softCTS != machine.NoPin {
+	if h.flowControl != nil {
 		retries := writeAttempts
-		for h.softCTS.Get() {
+		for !h.flowControl.ClearToSend() {
 			retries--
 			if retries == 0 {
 				return 0, ErrHCITimeout
@@ -500,55 +1074,100 @@ func (h *hci) write(buf []byte) (int, error) {
 		}
 	}
 
-	n, err := h.uart.Write(buf)
+	n, err := h.transport.Write(buf)
 	if err != nil {
 		return 0, err
 	}
 
-	return n, nil
-}
+	h.capture.record(false, buf)
 
-type aclDataHeader struct {
-	handle uint16
-	dlen   uint16
-	len    uint16
-	cid    uint16
+	return n, nil
 }
 
+// handleACLData reassembles fragmented L2CAP packets and passes complete ones
+// on to handleL2CAPData.
 func (h *hci) handleACLData(buf []byte) error {
-	aclHdr := aclDataHeader{
-		handle: binary.LittleEndian.Uint16(buf[0:]),
-		dlen:   binary.LittleEndian.Uint16(buf[2:]),
-		len:    binary.LittleEndian.Uint16(buf[4:]),
-		cid:    binary.LittleEndian.Uint16(buf[6:]),
+	if len(buf) < hciACLLenPos {
+		return ErrHCIInvalidPacket
 	}
 
-	aclFlags := (aclHdr.handle & 0xf000) >> 12
-	if aclHdr.dlen-4 != aclHdr.len {
-		return errors.New("fragmented packet")
-	}
+	handle := binary.LittleEndian.Uint16(buf[0:]) & 0x0fff
+	flags := binary.LittleEndian.Uint16(buf[0:]) >> 12 & 0x3
+	data := buf[hciACLLenPos:]
 
-	switch aclHdr.cid {
-	case attCID:
-		if aclFlags == 0x01 {
-			// TODO: use buffered packet
+	conn := h.findConnection(handle)
+
+	switch flags {
+	case aclStartNonFlushable, aclStartFlushable:
+		if conn != nil {
+			conn.rxBuf = conn.rxBuf[:0]
+		}
+
+		// Most packets fit in a single fragment.
+		if len(data) >= 4 && int(binary.LittleEndian.Uint16(data))+4 == len(data) {
+			return h.handleL2CAPData(handle, data)
+		}
+
+		if conn == nil {
+			return nil
+		}
+		conn.rxBuf = append(conn.rxBuf, data...)
+
+	case aclContinuing:
+		if conn == nil || len(conn.rxBuf) == 0 {
 			if debug {
-				println("WARNING: att.handleACLData needs buffered packet")
+				println("dropping acl continuation without start", handle)
 			}
-			return h.att.handleData(aclHdr.handle&0x0fff, buf[8:aclHdr.len+8])
-		} else {
-			return h.att.handleData(aclHdr.handle&0x0fff, buf[8:aclHdr.len+8])
+			return nil
 		}
+		conn.rxBuf = append(conn.rxBuf, data...)
+
+	default:
+		return ErrHCIInvalidPacket
+	}
+
+	if len(conn.rxBuf) < 4 {
+		return nil
+	}
+
+	length := 4 + int(binary.LittleEndian.Uint16(conn.rxBuf))
+	switch {
+	case length > hciMaxL2CAPLength || len(conn.rxBuf) > length:
+		conn.rxBuf = conn.rxBuf[:0]
+		return ErrHCIInvalidPacket
+
+	case len(conn.rxBuf) < length:
+		// wait for the next fragment
+		return nil
+	}
+
+	pkt := conn.rxBuf
+	conn.rxBuf = conn.rxBuf[:0]
+
+	return h.handleL2CAPData(handle, pkt)
+}
+
+// handleL2CAPData dispatches a complete L2CAP packet to its channel.
+func (h *hci) handleL2CAPData(handle uint16, pkt []byte) error {
+	cid := binary.LittleEndian.Uint16(pkt[2:])
+
+	switch cid {
+	case attCID:
+		return h.att.handleData(handle, pkt[4:])
+
 	case signalingCID:
 		if debug {
-			println("signaling cid", aclHdr.cid, hex.EncodeToString(buf))
+			println("signaling cid", cid, hex.EncodeToString(pkt))
 		}
 
-		return h.l2cap.handleData(aclHdr.handle&0x0fff, buf[8:aclHdr.len+8])
+		return h.l2cap.handleData(handle, pkt[4:])
+
+	case securityCID:
+		return h.smp.handleData(handle, pkt[4:])
 
 	default:
 		if debug {
-			println("unknown acl data cid", aclHdr.cid)
+			println("unknown acl data cid", cid)
 		}
 	}
 
@@ -565,22 +1184,56 @@ func (h *hci) handleEventData(buf []byte) error {
 			println("evtDisconnComplete")
 		}
 
+		if buf[2] != 0 {
+			// the disconnect failed
+			return nil
+		}
+
 		handle := binary.LittleEndian.Uint16(buf[3:])
 		h.att.removeConnection(handle)
 		h.l2cap.removeConnection(handle)
+		h.smp.removeConnection(handle)
+
+		for i := range h.connections {
+			if h.connections[i].handle == handle {
+				h.connectionEvents = append(h.connectionEvents, hciConnectionEvent{
+					hciConnection: h.connections[i],
+					connected:     false,
+				})
+				h.connections = append(h.connections[:i], h.connections[i+1:]...)
+				break
+			}
+		}
 
-		return h.leSetAdvertiseEnable(true)
+		return nil
 
 	case evtEncryptionChange:
 		if debug {
 			println("evtEncryptionChange")
 		}
 
+		if len(buf) < 6 {
+			return ErrHCIInvalidPacket
+		}
+		return h.smp.handleEncryptionChange(binary.LittleEndian.Uint16(buf[3:]), buf[2], buf[5] != 0)
+
+	case evtEncryptionKeyRefresh:
+		if debug {
+			println("evtEncryptionKeyRefresh")
+		}
+
+		if len(buf) < 5 {
+			return ErrHCIInvalidPacket
+		}
+		return h.smp.handleEncryptionChange(binary.LittleEndian.Uint16(buf[3:]), buf[2], true)
+
 	case evtCmdComplete:
 		h.cmdCompleteOpcode = binary.LittleEndian.Uint16(buf[3:])
 		h.cmdCompleteStatus = buf[5]
-		if plen > 0 {
-			h.cmdResponse = buf[1 : plen+2]
+
+		// return parameters following the status
+		if plen > 4 {
+			h.cmdResponse = buf[6 : plen+2]
 		} else {
 			h.cmdResponse = buf[:0]
 		}
@@ -606,25 +1259,32 @@ func (h *hci) handleEventData(buf []byte) error {
 		if debug {
 			println("evtNumCompPkts", hex.EncodeToString(buf))
 		}
-		// count of handles
-		c := buf[2]
-		pkts := uint16(0)
-
-		for i := byte(0); i < c; i++ {
-			pkts += binary.LittleEndian.Uint16(buf[5+i*4:])
+		// The controller completed packets, which frees their buffers.
+		c := int(buf[2])
+		if len(buf) < 3+c*4 {
+			return ErrHCIInvalidPacket
 		}
 
-		if pkts > 0 && h.pendingPkt > pkts {
-			h.pendingPkt -= pkts
-		} else {
-			h.pendingPkt = 0
-		}
+		for i := 0; i < c; i++ {
+			handle := binary.LittleEndian.Uint16(buf[3+i*4:]) & 0x0fff
+			pkts := binary.LittleEndian.Uint16(buf[5+i*4:])
 
-		if debug {
-			println("evtNumCompPkts", pkts, h.pendingPkt)
+			conn := h.findConnection(handle)
+			if conn == nil {
+				continue
+			}
+			if pkts < conn.pendingPkts {
+				conn.pendingPkts -= pkts
+			} else {
+				conn.pendingPkts = 0
+			}
+
+			if debug {
+				println("evtNumCompPkts", handle, pkts, conn.pendingPkts)
+			}
 		}
 
-		return nil
+		return h.sendQueuedACL()
 
 	case evtLEMetaEvent:
 		if debug {
@@ -637,54 +1297,128 @@ func (h *hci) handleEventData(buf []byte) error {
 				println("leMetaEventConnComplete")
 			}
 
-			h.connectData.connected = true
-			h.connectData.status = buf[3]
-			h.connectData.handle = binary.LittleEndian.Uint16(buf[4:])
-			h.connectData.role = buf[6]
-			h.connectData.peerBdaddrType = buf[7]
-			copy(h.connectData.peerBdaddr[0:], buf[8:])
+			status := buf[3]
+			conn := hciConnection{
+				handle:         binary.LittleEndian.Uint16(buf[4:]),
+				role:           buf[6],
+				peerBdaddrType: buf[7],
+			}
+			copy(conn.peerBdaddr[0:], buf[8:])
 
 			switch buf[2] {
 			case leMetaEventConnComplete:
-				h.connectData.interval = binary.LittleEndian.Uint16(buf[14:])
-				h.connectData.timeout = binary.LittleEndian.Uint16(buf[16:])
+				conn.interval = binary.LittleEndian.Uint16(buf[14:])
+				conn.timeout = binary.LittleEndian.Uint16(buf[18:])
 			case leMetaEventEnhancedConnectionComplete:
-				h.connectData.interval = binary.LittleEndian.Uint16(buf[26:])
-				h.connectData.timeout = binary.LittleEndian.Uint16(buf[28:])
+				conn.interval = binary.LittleEndian.Uint16(buf[26:])
+				conn.timeout = binary.LittleEndian.Uint16(buf[30:])
 			}
 
-			h.att.addConnection(h.connectData.handle)
-			if err := h.l2cap.addConnection(h.connectData.handle, h.connectData.role,
-				h.connectData.interval, h.connectData.timeout); err != nil {
-				return err
+			// Only a connection as central completes a connection attempt,
+			// a central may connect to us in the meantime.
+			if conn.role == hciRoleCentral {
+				h.connectData = leConnectData{
+					completed:     true,
+					status:        status,
+					hciConnection: conn,
+				}
+			}
+			if status != 0 {
+				return nil
 			}
 
-			return h.leSetAdvertiseEnable(false)
+			// The controller stops advertising when a central connects, the
+			// adapter restarts it if needed.
+			h.connections = append(h.connections, conn)
+			h.connectionEvents = append(h.connectionEvents, hciConnectionEvent{
+				hciConnection: conn,
+				connected:     true,
+			})
+
+			h.att.addConnection(conn)
+			h.smp.addConnection(conn)
+			return h.l2cap.addConnection(conn.handle, conn.role, conn.interval, conn.timeout)
 
 		case leMetaEventAdvertisingReport:
-			h.advData.reported = true
-			h.advData.numReports = buf[3]
-			h.advData.typ = buf[4]
-			h.advData.peerBdaddrType = buf[5]
-			copy(h.advData.peerBdaddr[0:], buf[6:])
-			h.advData.eirLength = buf[12]
-			h.advData.rssi = 0
+			// The reports follow each other, each with its own data length.
+			numReports := int(buf[3])
 			if debug {
-				println("leMetaEventAdvertisingReport", plen, h.advData.numReports,
-					h.advData.typ, h.advData.peerBdaddrType, h.advData.eirLength)
+				println("leMetaEventAdvertisingReport", plen, numReports)
 			}
 
-			if int(13+h.advData.eirLength+1) > len(buf) || h.advData.eirLength > 31 {
-				if debug {
-					println("invalid packet length", h.advData.eirLength, len(buf))
+			pos := 4
+			for i := 0; i < numReports; i++ {
+				if pos+9 > len(buf) {
+					return ErrHCIInvalidPacket
+				}
+
+				var report leAdvertisingReport
+				report.typ = buf[pos]
+				report.peerBdaddrType = buf[pos+1]
+				copy(report.peerBdaddr[:], buf[pos+2:pos+8])
+				report.eirLength = buf[pos+8]
+				pos += 9
+
+				if pos+int(report.eirLength)+1 > len(buf) || report.eirLength > 31 {
+					if debug {
+						println("invalid packet length", report.eirLength, len(buf))
+					}
+					return ErrHCIInvalidPacket
 				}
+				copy(report.eirData[:], buf[pos:pos+int(report.eirLength)])
+				pos += int(report.eirLength)
+				report.rssi = int8(buf[pos])
+				pos++
+
+				if h.scanning {
+					h.advReports = append(h.advReports, report)
+				}
+			}
+
+			return nil
+
+		case leMetaEventDirectAdvertisingReport:
+			// Directed advertisements have no data, but the same address and
+			// RSSI as other reports.
+			numReports := int(buf[3])
+			if debug {
+				println("leMetaEventDirectAdvertisingReport", plen, numReports)
+			}
+
+			if 4+numReports*16 > len(buf) {
 				return ErrHCIInvalidPacket
 			}
-			copy(h.advData.eirData[0:h.advData.eirLength], buf[13:13+h.advData.eirLength])
+			for i := 0; i < numReports; i++ {
+				pos := 4 + i*16
+
+				var report leAdvertisingReport
+				report.typ = buf[pos]
+				report.peerBdaddrType = buf[pos+1]
+				copy(report.peerBdaddr[:], buf[pos+2:pos+8])
+				report.rssi = int8(buf[pos+15])
+
+				if h.scanning {
+					h.advReports = append(h.advReports, report)
+				}
+			}
+
+			return nil
+
+		case leMetaEventExtendedAdvertisingReport:
+			numReports := int(buf[3])
+			if debug {
+				println("leMetaEventExtendedAdvertisingReport", plen, numReports)
+			}
 
-			// TODO: handle multiple reports
-			if h.advData.numReports == 0x01 {
-				h.advData.rssi = int8(buf[int(13+h.advData.eirLength)])
+			pos := 4
+			for i := 0; i < numReports; i++ {
+				if pos+24 > len(buf) || pos+24+int(buf[pos+23]) > len(buf) {
+					return ErrHCIInvalidPacket
+				}
+				if h.scanning {
+					h.handleExtendedAdvertisingReport(buf[pos : pos+24+int(buf[pos+23])])
+				}
+				pos += 24 + int(buf[pos+23])
 			}
 
 			return nil
@@ -694,6 +1428,12 @@ func (h *hci) handleEventData(buf []byte) error {
 				println("leMetaEventLongTermKeyRequest")
 			}
 
+			if len(buf) < 15 {
+				return ErrHCIInvalidPacket
+			}
+			return h.smp.handleLongTermKeyRequest(binary.LittleEndian.Uint16(buf[3:]),
+				binary.LittleEndian.Uint64(buf[5:]), binary.LittleEndian.Uint16(buf[13:]))
+
 		case leMetaEventRemoteConnParamReq:
 			if debug {
 				println("leMetaEventRemoteConnParamReq")
@@ -726,22 +1466,62 @@ func (h *hci) handleEventData(buf []byte) error {
 				println("leMetaEventReadLocalP256Complete")
 			}
 
+			if len(buf) < 4 {
+				return ErrHCIInvalidPacket
+			}
+			return h.smp.handleLocalPublicKey(buf[3], buf[4:])
+
 		case leMetaEventGenerateDHKeyComplete:
 			if debug {
 				println("leMetaEventGenerateDHKeyComplete")
 			}
 
+			if len(buf) < 4 {
+				return ErrHCIInvalidPacket
+			}
+			return h.smp.handleDHKey(buf[3], buf[4:])
+
 		case leMetaEventDataLengthChange:
 			if debug {
 				println("leMetaEventDataLengthChange")
 			}
 
+			if len(buf) < 13 {
+				return ErrHCIInvalidPacket
+			}
+			h.linkUpdates = append(h.linkUpdates, hciLinkUpdate{
+				handle: binary.LittleEndian.Uint16(buf[3:]),
+				LinkUpdate: LinkUpdate{
+					TxOctets: binary.LittleEndian.Uint16(buf[5:]),
+					RxOctets: binary.LittleEndian.Uint16(buf[9:]),
+				},
+			})
+
+		case leMetaEventPHYUpdateComplete:
+			if debug {
+				println("leMetaEventPHYUpdateComplete")
+			}
+
+			if len(buf) < 8 {
+				return ErrHCIInvalidPacket
+			}
+			if buf[3] != 0 {
+				// the PHY update failed
+				return nil
+			}
+			h.linkUpdates = append(h.linkUpdates, hciLinkUpdate{
+				handle: binary.LittleEndian.Uint16(buf[4:]),
+				LinkUpdate: LinkUpdate{
+					TxPHY: PHY(buf[6]),
+					RxPHY: PHY(buf[7]),
+				},
+			})
+
 		default:
 			if debug {
 				println("unknown metaevent", buf[2], buf[3], buf[4], buf[5])
 			}
 
-			h.clearAdvData()
 			return ErrHCIUnknownEvent
 		}
 	case evtHardwareError:
@@ -751,26 +1531,89 @@ func (h *hci) handleEventData(buf []byte) error {
 	return nil
 }
 
-func (h *hci) clearAdvData() error {
-	h.advData.reported = false
-	h.advData.numReports = 0
-	h.advData.typ = 0
-	h.advData.peerBdaddrType = 0
-	h.advData.peerBdaddr = [6]uint8{}
-	h.advData.eirLength = 0
-	h.advData.eirData = [31]uint8{}
-	h.advData.rssi = 0
+// handleExtendedAdvertisingReport queues a single report from an LE Extended
+// Advertising Report event. Legacy advertisements are queued like reports from
+// an LE Advertising Report event. Extended advertisements may be split over
+// multiple reports, which are combined before they are queued.
+func (h *hci) handleExtendedAdvertisingReport(buf []byte) {
+	eventType := binary.LittleEndian.Uint16(buf)
+	data := buf[24:]
 
-	return nil
+	var report leAdvertisingReport
+	report.peerBdaddrType = buf[2]
+	copy(report.peerBdaddr[:], buf[3:9])
+	report.rssi = int8(buf[13])
+
+	if eventType&leExtAdvLegacy != 0 {
+		switch {
+		case eventType&leExtAdvScanResponse != 0:
+			report.typ = leAdvTypeScanRsp
+		case eventType&leExtAdvDirected != 0:
+			report.typ = leAdvTypeAdvDirectInd
+		case eventType&leExtAdvConnectable != 0:
+			report.typ = leAdvTypeAdvInd
+		case eventType&leExtAdvScannable != 0:
+			report.typ = leAdvTypeAdvScanInd
+		default:
+			report.typ = leAdvTypeAdvNonconnInd
+		}
+		if len(data) > len(report.eirData) {
+			return
+		}
+		report.eirLength = uint8(copy(report.eirData[:], data))
+		h.advReports = append(h.advReports, report)
+		return
+	}
+
+	report.extended = true
+	report.typ = uint8(eventType & (leExtAdvConnectable | leExtAdvScannable | leExtAdvDirected | leExtAdvScanResponse))
+	report.primaryPHY = buf[9]
+	report.secondaryPHY = buf[10]
+	report.sid = buf[11]
+	report.txPower = int8(buf[12])
+
+	// Continue a report of the same advertising set, if there is one.
+	partial := -1
+	for i := range h.extReassembly {
+		r := &h.extReassembly[i]
+		if r.peerBdaddr == report.peerBdaddr && r.peerBdaddrType == report.peerBdaddrType && r.sid == report.sid {
+			partial = i
+			break
+		}
+	}
+	if partial >= 0 {
+		report.extData = append(h.extReassembly[partial].extData, data...)
+		h.extReassembly = append(h.extReassembly[:partial], h.extReassembly[partial+1:]...)
+	} else {
+		report.extData = append([]byte{}, data...)
+	}
+
+	switch eventType & leExtAdvDataStatusMask {
+	case 0x00:
+		// complete
+		h.advReports = append(h.advReports, report)
+	case leExtAdvDataIncomplete:
+		// more data will follow
+		if len(h.extReassembly) >= maxExtendedReassembly {
+			// Drop the oldest partial report, it is probably never completed.
+			h.extReassembly = append(h.extReassembly[:0], h.extReassembly[1:]...)
+		}
+		h.extReassembly = append(h.extReassembly, report)
+	default:
+		// truncated, the rest of the data won't arrive
+		if debug {
+			println("extended advertising data truncated")
+		}
+		h.advReports = append(h.advReports, report)
+	}
+}
+
+func (h *hci) clearAdvReports() {
+	h.advReports = h.advReports[:0]
 }
 
 func (h *hci) clearConnectData() error {
-	h.connectData.connected = false
-	h.connectData.status = 0
-	h.connectData.handle = 0
-	h.connectData.role = 0
-	h.connectData.peerBdaddrType = 0
-	h.connectData.peerBdaddr = [6]uint8{}
+	h.connectData = leConnectData{}
 
 	return nil
 }
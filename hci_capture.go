@@ -0,0 +1,147 @@
+//go:build hci || ninafw
+
+package bluetooth
+
+import (
+	"encoding/binary"
+	"io"
+	"sync"
+	"time"
+)
+
+// CaptureFormat is the file format used for HCI packet captures.
+type CaptureFormat uint8
+
+const (
+	// CaptureBTSnoop writes captures in the BTSnoop format, as used by btmon
+	// and Android. The datalink type is HCI UART (H4).
+	CaptureBTSnoop CaptureFormat = iota
+
+	// CapturePcap writes captures in the pcap format, with link type
+	// LINKTYPE_BLUETOOTH_HCI_H4_WITH_PHDR.
+	CapturePcap
+)
+
+const (
+	btsnoopVersion       = 1
+	btsnoopDatalinkH4    = 1002
+	btsnoopFlagReceived  = 0x01
+	btsnoopFlagCmdOrEvt  = 0x02
+	btsnoopEpochDelta    = 0x00dcddb30f2f8000 // microseconds from year 0 to 1970
+	pcapMagic            = 0xa1b2c3d4
+	pcapSnapLen          = 65535
+	pcapLinkTypeH4WithPH = 201
+	pcapDirectionSent    = 0
+	pcapDirectionRecv    = 1
+)
+
+// hciCapture writes every HCI packet that passes between host and controller
+// to a capture file.
+type hciCapture struct {
+	mu     sync.Mutex
+	w      io.Writer
+	format CaptureFormat
+	hdr    [24]byte
+}
+
+func newHCICapture(w io.Writer, format CaptureFormat) (*hciCapture, error) {
+	c := &hciCapture{
+		w:      w,
+		format: format,
+	}
+
+	var err error
+	switch format {
+	case CaptureBTSnoop:
+		copy(c.hdr[0:], "btsnoop\x00")
+		binary.BigEndian.PutUint32(c.hdr[8:], btsnoopVersion)
+		binary.BigEndian.PutUint32(c.hdr[12:], btsnoopDatalinkH4)
+		_, err = w.Write(c.hdr[:16])
+	case CapturePcap:
+		binary.LittleEndian.PutUint32(c.hdr[0:], pcapMagic)
+		binary.LittleEndian.PutUint16(c.hdr[4:], 2) // version 2.4
+		binary.LittleEndian.PutUint16(c.hdr[6:], 4)
+		binary.LittleEndian.PutUint32(c.hdr[8:], 0) // GMT
+		binary.LittleEndian.PutUint32(c.hdr[12:], 0)
+		binary.LittleEndian.PutUint32(c.hdr[16:], pcapSnapLen)
+		binary.LittleEndian.PutUint32(c.hdr[20:], pcapLinkTypeH4WithPH)
+		_, err = w.Write(c.hdr[:24])
+	default:
+		return nil, errNotYetImplemented
+	}
+	if err != nil {
+		return nil, err
+	}
+
+	return c, nil
+}
+
+// record writes a single packet, including its H4 packet indicator, to the
+// capture. Errors are ignored so that a failing capture doesn't break the
+// connection to the controller.
+func (c *hciCapture) record(received bool, pkt []byte) {
+	if c == nil || len(pkt) == 0 {
+		return
+	}
+
+	c.mu.Lock()
+	defer c.mu.Unlock()
+
+	now := time.Now()
+
+	switch c.format {
+	case CaptureBTSnoop:
+		flags := uint32(0)
+		if received {
+			flags |= btsnoopFlagReceived
+		}
+		if pkt[0] == hciCommandPkt || pkt[0] == hciEventPkt {
+			flags |= btsnoopFlagCmdOrEvt
+		}
+
+		binary.BigEndian.PutUint32(c.hdr[0:], uint32(len(pkt)))
+		binary.BigEndian.PutUint32(c.hdr[4:], uint32(len(pkt)))
+		binary.BigEndian.PutUint32(c.hdr[8:], flags)
+		binary.BigEndian.PutUint32(c.hdr[12:], 0) // cumulative drops
+		binary.BigEndian.PutUint64(c.hdr[16:], uint64(now.UnixMicro()+btsnoopEpochDelta))
+		c.w.Write(c.hdr[:24])
+
+	case CapturePcap:
+		direction := uint32(pcapDirectionSent)
+		if received {
+			direction = pcapDirectionRecv
+		}
+
+		micros := now.UnixMicro()
+		binary.LittleEndian.PutUint32(c.hdr[0:], uint32(micros/1e6))
+		binary.LittleEndian.PutUint32(c.hdr[4:], uint32(micros%1e6))
+		binary.LittleEndian.PutUint32(c.hdr[8:], uint32(4+len(pkt)))
+		binary.LittleEndian.PutUint32(c.hdr[12:], uint32(4+len(pkt)))
+		binary.BigEndian.PutUint32(c.hdr[16:], direction)
+		c.w.Write(c.hdr[:20])
+	}
+
+	c.w.Write(pkt)
+}
+
+// SetCapture writes every HCI command, event and ACL data packet exchanged
+// with the controller to w, in the given format. The resulting capture can be
+// opened in Wireshark or btmon. Call it before Enable() to also capture the
+// initialization of the controller. Pass a nil writer to stop capturing.
+func (a *hciAdapter) SetCapture(w io.Writer, format CaptureFormat) error {
+	if w == nil {
+		a.capture = nil
+	} else {
+		capture, err := newHCICapture(w, format)
+		if err != nil {
+			return err
+		}
+		a.capture = capture
+	}
+
+	if a.hci != nil {
+		a.hci.capture = a.capture
+	}
+
+	return nil
+}
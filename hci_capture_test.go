@@ -0,0 +1,91 @@
+//go:build hci && !baremetal
+
+package bluetooth
+
+import (
+	"bytes"
+	"encoding/binary"
+	"net"
+	"testing"
+)
+
+// captureEnable enables an adapter against a fake controller while capturing
+// in the given format, and returns the capture.
+func captureEnable(t *testing.T, format CaptureFormat) []byte {
+	host, controller := net.Pipe()
+	defer host.Close()
+	defer controller.Close()
+
+	commands := make(chan uint16, 16)
+	go fakeController(t, controller, [6]byte{}, commands)
+
+	var capture bytes.Buffer
+	adapter := NewAdapter(NewHCITransport(host))
+	if err := adapter.SetCapture(&capture, format); err != nil {
+		t.Fatal("could not start capture:", err)
+	}
+	if err := adapter.Enable(); err != nil {
+		t.Fatal("could not enable adapter:", err)
+	}
+
+	return capture.Bytes()
+}
+
+func TestHCICaptureBTSnoop(t *testing.T) {
+	data := captureEnable(t, CaptureBTSnoop)
+
+	if len(data) < 16 || string(data[:8]) != "btsnoop\x00" {
+		t.Fatalf("invalid header: %x", data)
+	}
+	if datalink := binary.BigEndian.Uint32(data[12:]); datalink != btsnoopDatalinkH4 {
+		t.Errorf("unexpected datalink: %d", datalink)
+	}
+
+	// The first packets are the Reset command and its Command Complete event.
+	expected := []struct {
+		flags uint32
+		pkt   []byte
+	}{
+		{btsnoopFlagCmdOrEvt, []byte{hciCommandPkt, 0x03, 0x0c, 0x00}},
+		{btsnoopFlagCmdOrEvt | btsnoopFlagReceived, []byte{hciEventPkt, evtCmdComplete, 4, 1, 0x03, 0x0c, 0x00}},
+	}
+	data = data[16:]
+	for _, e := range expected {
+		if len(data) < 24 {
+			t.Fatal("capture too short")
+		}
+		length := binary.BigEndian.Uint32(data[4:])
+		if flags := binary.BigEndian.Uint32(data[8:]); flags != e.flags {
+			t.Errorf("unexpected flags: %d", flags)
+		}
+		if !bytes.Equal(data[24:24+length], e.pkt) {
+			t.Errorf("unexpected packet: %x", data[24:24+length])
+		}
+		data = data[24+length:]
+	}
+}
+
+func TestHCICapturePcap(t *testing.T) {
+	data := captureEnable(t, CapturePcap)
+
+	if len(data) < 24 || binary.LittleEndian.Uint32(data) != pcapMagic {
+		t.Fatalf("invalid header: %x", data)
+	}
+	if linkType := binary.LittleEndian.Uint32(data[20:]); linkType != pcapLinkTypeH4WithPH {
+		t.Errorf("unexpected link type: %d", linkType)
+	}
+
+	// The first packet is the Reset command, sent by the host.
+	data = data[24:]
+	if len(data) < 16 {
+		t.Fatal("capture too short")
+	}
+	length := binary.LittleEndian.Uint32(data[8:])
+	record := data[16 : 16+length]
+	if direction := binary.BigEndian.Uint32(record); direction != pcapDirectionSent {
+		t.Errorf("unexpected direction: %d", direction)
+	}
+	if !bytes.Equal(record[4:], []byte{hciCommandPkt, 0x03, 0x0c, 0x00}) {
+		t.Errorf("unexpected packet: %x", record[4:])
+	}
+}
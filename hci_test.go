@@ -0,0 +1,236 @@
+//go:build hci && !baremetal
+
+package bluetooth
+
+import (
+	"encoding/binary"
+	"io"
+	"net"
+	"reflect"
+	"testing"
+)
+
+// fakeController answers every HCI command with a successful Command Complete
+// event. The Read BD_ADDR command returns the given address, and LE Read Buffer
+// Size returns 8 buffers of 27 bytes. Every read from
+// conn must return exactly one packet, as with net.Pipe or an HCI socket.
+func fakeController(t *testing.T, conn io.ReadWriter, address [6]byte, commands chan<- uint16) {
+	defer close(commands)
+
+	var buf [260]byte
+	for {
+		n, err := conn.Read(buf[:])
+		if err != nil {
+			return
+		}
+		if n < 4 || buf[0] != hciCommandPkt || n != 4+int(buf[3]) {
+			t.Errorf("unexpected packet: %x", buf[:n])
+			return
+		}
+
+		opcode := binary.LittleEndian.Uint16(buf[1:])
+		commands <- opcode
+
+		evt := []byte{hciEventPkt, evtCmdComplete, 4, 1, buf[1], buf[2], 0x00}
+		if opcode == ogfInfoParam<<ogfCommandPos|ocfReadBDAddr {
+			evt = append(evt, address[:]...)
+			evt[2] += 6
+		}
+		if opcode == ogfLECtrl<<ogfCommandPos|ocfLEReadBufferSize {
+			evt = append(evt, 27, 0, 8)
+			evt[2] += 3
+		}
+		if _, err := conn.Write(evt); err != nil {
+			return
+		}
+	}
+}
+
+func TestHCITransportEnable(t *testing.T) {
+	host, controller := net.Pipe()
+	defer host.Close()
+	defer controller.Close()
+
+	testEnable(t, host, controller)
+}
+
+// testEnable enables an adapter on the host side of the connection and checks
+// the initialization sequence seen by a fake controller.
+func testEnable(t *testing.T, host, controller io.ReadWriter) {
+	address := [6]byte{0x66, 0x55, 0x44, 0x33, 0x22, 0x11}
+	commands := make(chan uint16, 16)
+	go fakeController(t, controller, address, commands)
+
+	adapter := NewAdapter(NewHCITransport(host))
+	if err := adapter.Enable(); err != nil {
+		t.Fatal("could not enable adapter:", err)
+	}
+
+	expected := []uint16{
+		ogfHostCtl<<ogfCommandPos | ocfReset,
+		ogfHostCtl<<ogfCommandPos | ocfSetEventMask,
+		ogfLECtrl<<ogfCommandPos | 0x01,
+		ogfLECtrl<<ogfCommandPos | ocfLEReadBufferSize,
+		ogfInfoParam<<ogfCommandPos | ocfReadBDAddr,
+	}
+	for _, opcode := range expected {
+		if got := <-commands; got != opcode {
+			t.Errorf("expected command %#04x, got %#04x", opcode, got)
+		}
+	}
+
+	addr, err := adapter.Address()
+	if err != nil {
+		t.Fatal("could not read address:", err)
+	}
+	if addr.MAC.String() != "11:22:33:44:55:66" {
+		t.Errorf("unexpected address: %s", addr.MAC.String())
+	}
+}
+
+func TestHCIAdvertisingReports(t *testing.T) {
+	h := &hci{scanning: true}
+
+	// Two reports in a single event, followed by a directed advertising
+	// report.
+	err := h.handleEventData([]byte{evtLEMetaEvent, 27, leMetaEventAdvertisingReport, 2,
+		leAdvTypeAdvInd, 0x00, 1, 2, 3, 4, 5, 6, 3, 0x02, 0x01, 0x06, 0xc4,
+		leAdvTypeScanRsp, 0x01, 6, 5, 4, 3, 2, 1, 0, 0xb0})
+	if err != nil {
+		t.Fatal("could not handle advertising report:", err)
+	}
+	err = h.handleEventData([]byte{evtLEMetaEvent, 18, leMetaEventDirectAdvertisingReport, 1,
+		leAdvTypeAdvDirectInd, 0x01, 1, 1, 1, 1, 1, 1, 0x00, 2, 2, 2, 2, 2, 2, 0xd0})
+	if err != nil {
+		t.Fatal("could not handle direct advertising report:", err)
+	}
+
+	expected := []leAdvertisingReport{
+		{typ: leAdvTypeAdvInd, peerBdaddr: [6]byte{1, 2, 3, 4, 5, 6}, eirLength: 3, eirData: [31]byte{0x02, 0x01, 0x06}, rssi: -60},
+		{typ: leAdvTypeScanRsp, peerBdaddrType: 0x01, peerBdaddr: [6]byte{6, 5, 4, 3, 2, 1}, rssi: -80},
+		{typ: leAdvTypeAdvDirectInd, peerBdaddrType: 0x01, peerBdaddr: [6]byte{1, 1, 1, 1, 1, 1}, rssi: -48},
+	}
+	if !reflect.DeepEqual(h.advReports, expected) {
+		t.Errorf("unexpected reports:\nexpected: %+v\nactual:   %+v", expected, h.advReports)
+	}
+
+	// A truncated event is rejected.
+	err = h.handleEventData([]byte{evtLEMetaEvent, 13, leMetaEventAdvertisingReport, 2,
+		leAdvTypeAdvInd, 0x00, 1, 2, 3, 4, 5, 6, 0, 0xc4})
+	if err != ErrHCIInvalidPacket {
+		t.Errorf("expected invalid packet error, got %v", err)
+	}
+}
+
+// packetRecorder is an HCITransport that records every packet written to it
+// and never has anything to read.
+type packetRecorder struct {
+	packets [][]byte
+}
+
+func (r *packetRecorder) Read(buf []byte) (int, error) { return 0, io.EOF }
+func (r *packetRecorder) Buffered() int                { return 0 }
+
+func (r *packetRecorder) Write(buf []byte) (int, error) {
+	r.packets = append(r.packets, append([]byte(nil), buf...))
+	return len(buf), nil
+}
+
+func TestHCIACLFlowControl(t *testing.T) {
+	recorder := &packetRecorder{}
+	h, a := newBLEStack(recorder)
+	h.aclMaxLen = 27
+	h.aclMaxPkts = 3
+	h.aclBuf = make([]byte, 1+hciACLLenPos+27)
+	for _, handle := range []uint16{1, 2} {
+		conn := hciConnection{handle: handle}
+		h.connections = append(h.connections, conn)
+		a.addConnection(conn)
+	}
+
+	// A fragmented Exchange MTU request is reassembled and answered.
+	if err := h.handleACLData([]byte{0x01, 0x20, 5, 0, 3, 0, attCID, 0, attOpMTUReq}); err != nil {
+		t.Fatal("could not handle first fragment:", err)
+	}
+	if len(recorder.packets) != 0 {
+		t.Fatalf("unexpected response to partial request: %x", recorder.packets)
+	}
+	if err := h.handleACLData([]byte{0x01, 0x10, 2, 0, 0x17, 0x00}); err != nil {
+		t.Fatal("could not handle continuation fragment:", err)
+	}
+	if len(recorder.packets) != 1 || recorder.packets[0][9] != attOpMTUResponse {
+		t.Fatalf("expected an MTU response, got %x", recorder.packets)
+	}
+
+	// A continuation without a start is dropped.
+	if err := h.handleACLData([]byte{0x02, 0x10, 2, 0, 0x17, 0x00}); err != nil {
+		t.Fatal("could not handle continuation fragment:", err)
+	}
+
+	// The response is completed, and the other connection uses a buffer.
+	if err := h.handleEventData([]byte{evtNumCompPkts, 5, 1, 1, 0, 1, 0}); err != nil {
+		t.Fatal("could not handle completed packets:", err)
+	}
+	h.connections[1].pendingPkts = 1
+	recorder.packets = nil
+
+	// A 60 byte packet is sent in three fragments, but only two buffers are
+	// free.
+	data := make([]byte, 60)
+	for i := range data {
+		data[i] = byte(i)
+	}
+	h.handling = true
+	if err := h.sendAclPkt(1, attCID, data); err != nil {
+		t.Fatal("could not send packet:", err)
+	}
+	if len(recorder.packets) != 2 {
+		t.Fatalf("expected 2 fragments to be sent, got %d", len(recorder.packets))
+	}
+	if pending := h.connections[0].pendingPkts; pending != 2 {
+		t.Errorf("expected 2 pending packets, got %d", pending)
+	}
+
+	// Completing a packet sends the last fragment.
+	if err := h.handleEventData([]byte{evtNumCompPkts, 5, 1, 1, 0, 1, 0}); err != nil {
+		t.Fatal("could not handle completed packets:", err)
+	}
+	if len(recorder.packets) != 3 {
+		t.Fatalf("expected 3 fragments to be sent, got %d", len(recorder.packets))
+	}
+
+	var reassembled []byte
+	for i, pkt := range recorder.packets {
+		flags := binary.LittleEndian.Uint16(pkt[1:]) >> 12
+		length := int(binary.LittleEndian.Uint16(pkt[3:]))
+		if i == 0 && flags != aclStartNonFlushable || i > 0 && flags != aclContinuing {
+			t.Errorf("fragment %d: unexpected flags %d", i, flags)
+		}
+		if length != len(pkt)-5 || length > 27 {
+			t.Errorf("fragment %d: unexpected length %d", i, length)
+		}
+		reassembled = append(reassembled, pkt[5:]...)
+	}
+	expected := append([]byte{60, 0, attCID, 0}, data...)
+	if !reflect.DeepEqual(reassembled, expected) {
+		t.Errorf("unexpected packet:\nexpected: %x\nactual:   %x", expected, reassembled)
+	}
+
+	// The buffers of a closed connection are freed.
+	h.connections[1].pendingPkts = 3
+	if h.hasACLBuffer() {
+		t.Error("expected all buffers to be in use")
+	}
+	if err := h.handleEventData([]byte{evtDisconnComplete, 4, 0, 2, 0, hciOEUserEndedConnection}); err != nil {
+		t.Fatal("could not handle disconnection:", err)
+	}
+	if pending := h.connections[0].pendingPkts; len(h.connections) != 1 || pending != 2 {
+		t.Errorf("unexpected connections: %+v", h.connections)
+	}
+	if !h.hasACLBuffer() {
+		t.Error("expected a free buffer")
+	}
+	if err := h.sendAclPkt(2, attCID, data); err != ErrHCINoConnection {
+		t.Errorf("expected unknown connection error, got %v", err)
+	}
+}
@@ -0,0 +1,102 @@
+//go:build hci || ninafw
+
+package bluetooth
+
+import (
+	"io"
+	"sync"
+)
+
+// HCITransport is the byte stream between this package (the host) and an HCI
+// controller. Packets are framed as on a UART (H4): every packet starts with a
+// one byte packet indicator followed by the command, ACL data or event.
+//
+// A UART connected to a NINA or HCI-UART module is one implementation. On
+// hosted systems, NewHCITransport can wrap any io.ReadWriter such as a pty, a
+// socketpair or a serial device.
+type HCITransport interface {
+	io.ReadWriter
+
+	// Buffered returns the number of bytes that can be read without blocking.
+	Buffered() int
+}
+
+// HCIFlowControl may optionally be implemented by an HCITransport that needs
+// software flow control, for example a UART without hardware RTS/CTS lines.
+type HCIFlowControl interface {
+	// ClearToSend returns whether the controller is ready to accept data.
+	ClearToSend() bool
+
+	// SetReadyToReceive signals to the controller whether the host is ready
+	// to receive data.
+	SetReadyToReceive(ready bool)
+}
+
+// streamTransport adapts a blocking io.ReadWriter to an HCITransport. Incoming
+// data is read in a separate goroutine and buffered until it is consumed.
+type streamTransport struct {
+	rw  io.ReadWriter
+	mu  sync.Mutex
+	buf []byte
+	err error
+}
+
+// NewHCITransport returns an HCITransport that reads from and writes to the
+// given stream. It starts a goroutine that continuously reads from the stream
+// until it returns an error.
+func NewHCITransport(rw io.ReadWriter) HCITransport {
+	t := &streamTransport{
+		rw: rw,
+	}
+	go t.readLoop()
+
+	return t
+}
+
+func (t *streamTransport) readLoop() {
+	// Large enough for a complete packet, as packet based streams such as HCI
+	// sockets discard the part of a packet that doesn't fit.
+	var b [1024]byte
+	for {
+		n, err := t.rw.Read(b[:])
+
+		t.mu.Lock()
+		t.buf = append(t.buf, b[:n]...)
+		if err != nil {
+			t.err = err
+			t.mu.Unlock()
+			return
+		}
+		t.mu.Unlock()
+	}
+}
+
+// Buffered returns the number of bytes that have been received but not yet
+// read.
+func (t *streamTransport) Buffered() int {
+	t.mu.Lock()
+	defer t.mu.Unlock()
+
+	return len(t.buf)
+}
+
+// Read reads buffered data. It does not block: if there is no data available
+// it returns zero bytes, or the error that stopped the reader goroutine.
+func (t *streamTransport) Read(p []byte) (int, error) {
+	t.mu.Lock()
+	defer t.mu.Unlock()
+
+	if len(t.buf) == 0 {
+		return 0, t.err
+	}
+
+	n := copy(p, t.buf)
+	t.buf = t.buf[n:]
+
+	return n, nil
+}
+
+// Write writes the data directly to the underlying stream.
+func (t *streamTransport) Write(p []byte) (int, error) {
+	return t.rw.Write(p)
+}
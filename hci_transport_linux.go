@@ -0,0 +1,47 @@
+//go:build hci && linux && !baremetal
+
+package bluetooth
+
+import (
+	"fmt"
+	"os"
+
+	"golang.org/x/sys/unix"
+)
+
+// hciDevDown is the HCIDEVDOWN ioctl, _IOW('H', 202, int).
+const hciDevDown = 0x400448ca
+
+// OpenHCIUserChannel opens the Linux HCI device with the given index (0 for
+// hci0) as an HCI user channel (HCI_CHANNEL_USER). This gives exclusive raw
+// access to the controller, bypassing BlueZ entirely: all commands, events and
+// ACL data are handled by the HCI stack in this package.
+//
+// The kernel only allows a user channel on a device that is down and not in
+// use by bluetoothd. The device is brought down automatically, but bluetoothd
+// must be stopped (or told to leave the device alone) first. This requires the
+// CAP_NET_ADMIN capability.
+//
+// It also works with the virtual controllers provided by the hci_vhci kernel
+// module.
+func OpenHCIUserChannel(dev int) (HCITransport, error) {
+	fd, err := unix.Socket(unix.AF_BLUETOOTH, unix.SOCK_RAW|unix.SOCK_CLOEXEC, unix.BTPROTO_HCI)
+	if err != nil {
+		return nil, fmt.Errorf("bluetooth: could not open HCI socket: %w", err)
+	}
+
+	// Ignore the error: if the device can't be brought down, binding below
+	// will fail with a more useful error.
+	unix.IoctlSetInt(fd, hciDevDown, dev)
+
+	err = unix.Bind(fd, &unix.SockaddrHCI{
+		Dev:     uint16(dev),
+		Channel: unix.HCI_CHANNEL_USER,
+	})
+	if err != nil {
+		unix.Close(fd)
+		return nil, fmt.Errorf("bluetooth: could not open user channel on hci%d: %w", dev, err)
+	}
+
+	return NewHCITransport(os.NewFile(uintptr(fd), fmt.Sprintf("hci%d", dev))), nil
+}
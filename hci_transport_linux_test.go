@@ -0,0 +1,25 @@
+//go:build hci && !baremetal
+
+package bluetooth
+
+import (
+	"os"
+	"testing"
+
+	"golang.org/x/sys/unix"
+)
+
+// TestHCITransportSocket runs the stack over a SOCK_SEQPACKET socketpair, which
+// preserves packet boundaries like an HCI user channel socket does.
+func TestHCITransportSocket(t *testing.T) {
+	fds, err := unix.Socketpair(unix.AF_UNIX, unix.SOCK_SEQPACKET|unix.SOCK_CLOEXEC, 0)
+	if err != nil {
+		t.Fatal("could not create socketpair:", err)
+	}
+	host := os.NewFile(uintptr(fds[0]), "host")
+	controller := os.NewFile(uintptr(fds[1]), "controller")
+	defer host.Close()
+	defer controller.Close()
+
+	testEnable(t, host, controller)
+}
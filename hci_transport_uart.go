@@ -0,0 +1,68 @@
+//go:build ninafw || (hci && hci_uart)
+
+package bluetooth
+
+import (
+	"machine"
+)
+
+// uartTransport is the HCITransport for a controller connected over a UART,
+// optionally using software flow control on a pair of GPIO pins.
+type uartTransport struct {
+	uart *machine.UART
+	cts  machine.Pin
+	rts  machine.Pin
+}
+
+// newUARTTransport returns a transport for the given UART. The cts and rts pins
+// are used for software flow control, pass machine.NoPin if the UART is
+// configured with hardware flow control.
+func newUARTTransport(uart *machine.UART, cts, rts machine.Pin) *uartTransport {
+	t := &uartTransport{
+		uart: uart,
+		cts:  cts,
+		rts:  rts,
+	}
+
+	if t.rts != machine.NoPin {
+		t.rts.Configure(machine.PinConfig{Mode: machine.PinOutput})
+		t.rts.High()
+	}
+
+	if t.cts != machine.NoPin {
+		t.cts.Configure(machine.PinConfig{Mode: machine.PinInput})
+	}
+
+	return t
+}
+
+func (t *uartTransport) Read(p []byte) (int, error) {
+	return t.uart.Read(p)
+}
+
+func (t *uartTransport) Write(p []byte) (int, error) {
+	return t.uart.Write(p)
+}
+
+func (t *uartTransport) Buffered() int {
+	return t.uart.Buffered()
+}
+
+// ClearToSend returns whether the controller is ready to accept data. The CTS
+// line is active low.
+func (t *uartTransport) ClearToSend() bool {
+	if t.cts == machine.NoPin {
+		return true
+	}
+
+	return !t.cts.Get()
+}
+
+// SetReadyToReceive sets the (active low) RTS line.
+func (t *uartTransport) SetReadyToReceive(ready bool) {
+	if t.rts == machine.NoPin {
+		return
+	}
+
+	t.rts.Set(!ready)
+}
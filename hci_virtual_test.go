@@ -0,0 +1,1231 @@
+//go:build hci && !baremetal
+
+package bluetooth
+
+import (
+	"bytes"
+	"context"
+	"path/filepath"
+	"reflect"
+	"testing"
+	"time"
+
+	"tinygo.org/x/bluetooth/virtualhci"
+)
+
+// newVirtualAdapter returns an enabled adapter connected to a new virtual
+// controller on the given medium.
+func newVirtualAdapter(t *testing.T, air *virtualhci.Air, address [6]byte) *Adapter {
+	t.Helper()
+
+	controller := air.NewController(address)
+	t.Cleanup(func() {
+		controller.Close()
+	})
+
+	adapter := NewAdapter(NewHCITransport(controller))
+	if err := adapter.Enable(); err != nil {
+		t.Fatal("could not enable adapter:", err)
+	}
+
+	return adapter
+}
+
+func TestVirtualCentralPeripheral(t *testing.T) {
+	air := virtualhci.NewAir()
+	peripheral := newVirtualAdapter(t, air, [6]byte{0x01, 0x00, 0x00, 0x00, 0x00, 0xc0})
+	central := newVirtualAdapter(t, air, [6]byte{0x02, 0x00, 0x00, 0x00, 0x00, 0xc0})
+
+	serviceUUID, _ := ParseUUID("a0b40001-926d-4d61-98df-8c5c62ee53b3")
+	charUUID, _ := ParseUUID("a0b40002-926d-4d61-98df-8c5c62ee53b3")
+
+	// Set up the peripheral.
+	var char Characteristic
+	err := peripheral.AddService(&Service{
+		UUID: serviceUUID,
+		Characteristics: []CharacteristicConfig{
+			{
+				Handle: &char,
+				UUID:   charUUID,
+				Value:  []byte("initial"),
+				Flags:  CharacteristicReadPermission | CharacteristicNotifyPermission,
+			},
+		},
+	})
+	if err != nil {
+		t.Fatal("could not add service:", err)
+	}
+
+	peripheralAddress, err := peripheral.Address()
+	if err != nil {
+		t.Fatal("could not read address:", err)
+	}
+
+	adv := peripheral.DefaultAdvertisement()
+	err = adv.Configure(AdvertisementOptions{
+		LocalName: "virtual",
+		Interval:  NewDuration(20 * time.Millisecond),
+	})
+	if err != nil {
+		t.Fatal("could not configure advertisement:", err)
+	}
+	if err := adv.Start(); err != nil {
+		t.Fatal("could not start advertisement:", err)
+	}
+
+	// Find the peripheral.
+	var found ScanResult
+	err = central.Scan(func(adapter *Adapter, result ScanResult) {
+		if result.Address.MAC == peripheralAddress.MAC {
+			found = result
+			adapter.StopScan()
+		}
+	})
+	if err != nil {
+		t.Fatal("could not scan:", err)
+	}
+	if found.RSSI != virtualhci.RSSI {
+		t.Errorf("unexpected RSSI: %d", found.RSSI)
+	}
+
+	// Connect and discover the characteristic.
+	device, err := central.Connect(found.Address, ConnectionParams{})
+	if err != nil {
+		t.Fatal("could not connect:", err)
+	}
+
+	all, err := device.DiscoverServices(nil)
+	if err != nil {
+		t.Fatal("could not discover all services:", err)
+	}
+	if len(all) != 3 {
+		t.Errorf("expected 3 services (GAP, GATT and custom), got %d", len(all))
+	}
+
+	services, err := device.DiscoverServices([]UUID{serviceUUID})
+	if err != nil {
+		t.Fatal("could not discover services:", err)
+	}
+	chars, err := services[0].DiscoverCharacteristics([]UUID{charUUID})
+	if err != nil {
+		t.Fatal("could not discover characteristics:", err)
+	}
+
+	buf := make([]byte, 32)
+	n, err := chars[0].Read(buf)
+	if err != nil {
+		t.Fatal("could not read characteristic:", err)
+	}
+	if string(buf[:n]) != "initial" {
+		t.Errorf("unexpected value: %q", buf[:n])
+	}
+
+	// Receive a notification.
+	notifications := make(chan []byte, 1)
+	err = chars[0].EnableNotifications(func(buf []byte) {
+		notifications <- append([]byte{}, buf...)
+	})
+	if err != nil {
+		t.Fatal("could not enable notifications:", err)
+	}
+
+	if _, err := char.Write([]byte("notified")); err != nil {
+		t.Fatal("could not write characteristic:", err)
+	}
+
+	select {
+	case value := <-notifications:
+		if !bytes.Equal(value, []byte("notified")) {
+			t.Errorf("unexpected notification: %q", value)
+		}
+	case <-time.After(5 * time.Second):
+		t.Fatal("timeout waiting for notification")
+	}
+}
+
+func TestVirtualIndications(t *testing.T) {
+	var char Characteristic
+	_, _, _, deviceChar := connectVirtualPeripheral(t, CharacteristicConfig{
+		Handle: &char,
+		Flags:  CharacteristicReadPermission | CharacteristicIndicatePermission,
+	})
+
+	// Without a subscription, there is nothing to confirm.
+	ctx, cancel := context.WithTimeout(context.Background(), 5*time.Second)
+	defer cancel()
+	if err := char.Indicate(ctx, []byte("unsent")); err != nil {
+		t.Fatal("could not indicate without subscription:", err)
+	}
+
+	indications := make(chan []byte, 2)
+	err := deviceChar.EnableNotifications(func(buf []byte) {
+		indications <- append([]byte{}, buf...)
+	})
+	if err != nil {
+		t.Fatal("could not enable indications:", err)
+	}
+
+	// Indicate returns once the central has confirmed the indication, and
+	// Write sends an indication as that is what the central subscribed to.
+	if err := char.Indicate(ctx, []byte("indicated")); err != nil {
+		t.Fatal("could not indicate:", err)
+	}
+	if _, err := char.Write([]byte("written")); err != nil {
+		t.Fatal("could not write characteristic:", err)
+	}
+	for _, expected := range []string{"indicated", "written"} {
+		select {
+		case value := <-indications:
+			if string(value) != expected {
+				t.Errorf("expected indication %q, got %q", expected, value)
+			}
+		case <-time.After(5 * time.Second):
+			t.Fatal("timeout waiting for indication")
+		}
+	}
+
+	var notifyOnly Characteristic
+	notifyOnly.permissions = CharacteristicNotifyPermission
+	if err := notifyOnly.Indicate(ctx, []byte("value")); err != errNoIndicate {
+		t.Errorf("expected %v for a characteristic without indications, got %v", errNoIndicate, err)
+	}
+}
+
+func TestVirtualLongAttributes(t *testing.T) {
+	long := make([]byte, 100)
+	for i := range long {
+		long[i] = byte(i)
+	}
+	type write struct {
+		offset int
+		value  []byte
+	}
+	writes := make(chan write, 16)
+	central, _, device, char := connectVirtualPeripheral(t, CharacteristicConfig{
+		Value: append([]byte{}, long...),
+		Flags: CharacteristicReadPermission | CharacteristicWritePermission,
+		WriteEvent: func(client Connection, offset int, value []byte) {
+			writes <- write{offset, append([]byte{}, value...)}
+		},
+	})
+
+	// A single read is limited by the MTU.
+	buf := make([]byte, 200)
+	n, err := char.Read(buf)
+	if err != nil {
+		t.Fatal("could not read characteristic:", err)
+	}
+	if n != defaultMTU-1 || !bytes.Equal(buf[:n], long[:n]) {
+		t.Errorf("unexpected value from a single read: %x", buf[:n])
+	}
+
+	n, err = char.ReadLong(buf)
+	if err != nil {
+		t.Fatal("could not read long characteristic:", err)
+	}
+	if !bytes.Equal(buf[:n], long) {
+		t.Errorf("unexpected long value: %x", buf[:n])
+	}
+
+	// Reading stops when the buffer is full.
+	n, err = char.ReadLong(buf[:30])
+	if err != nil {
+		t.Fatal("could not read long characteristic:", err)
+	}
+	if !bytes.Equal(buf[:n], long[:30]) {
+		t.Errorf("unexpected partial long value: %x", buf[:n])
+	}
+
+	// The write handler sees each part of a long write with its offset.
+	value := bytes.Repeat([]byte("0123456789"), 5)
+	n, err = char.WriteLong(value)
+	if err != nil {
+		t.Fatal("could not write long characteristic:", err)
+	}
+	if n != len(value) {
+		t.Errorf("expected to write %d bytes, wrote %d", len(value), n)
+	}
+	var written []byte
+	for len(written) < len(value) {
+		select {
+		case w := <-writes:
+			if w.offset != len(written) {
+				t.Fatalf("expected a write at offset %d, got %d", len(written), w.offset)
+			}
+			written = append(written, w.value...)
+		case <-time.After(5 * time.Second):
+			t.Fatal("timeout waiting for write")
+		}
+	}
+	if !bytes.Equal(written, value) {
+		t.Errorf("unexpected written value: %q", written)
+	}
+
+	n, err = char.ReadLong(buf)
+	if err != nil {
+		t.Fatal("could not read long characteristic:", err)
+	}
+	if !bytes.Equal(buf[:n], value) {
+		t.Errorf("unexpected value after long write: %q", buf[:n])
+	}
+
+	// Values longer than the specification allows are rejected as a whole.
+	if _, err := char.WriteLong(make([]byte, maxAttributeLength+1)); err == nil {
+		t.Error("expected an error for a value that is too long")
+	}
+	if _, _, code := central.att.lastError(device.handle); code != attErrorInvalidAttrValueLength {
+		t.Errorf("expected error code %#x, got %#x", attErrorInvalidAttrValueLength, code)
+	}
+	select {
+	case w := <-writes:
+		t.Errorf("unexpected write at offset %d", w.offset)
+	default:
+	}
+}
+
+func TestVirtualMTUExchange(t *testing.T) {
+	var char Characteristic
+	central, peripheral, device, deviceChar := connectVirtualPeripheral(t, CharacteristicConfig{
+		Handle: &char,
+		Flags:  CharacteristicReadPermission | CharacteristicNotifyPermission,
+	})
+
+	if err := peripheral.SetPreferredMTU(MinMTU - 1); err != errInvalidMTU {
+		t.Errorf("expected invalid MTU error, got %v", err)
+	}
+	if err := peripheral.SetPreferredMTU(100); err != nil {
+		t.Fatal("could not set preferred MTU:", err)
+	}
+
+	centralUpdates := make(chan LinkUpdate, 4)
+	central.SetLinkUpdateHandler(func(device Device, update LinkUpdate) {
+		centralUpdates <- update
+	})
+	peripheralUpdates := make(chan LinkUpdate, 4)
+	peripheral.SetLinkUpdateHandler(func(device Device, update LinkUpdate) {
+		peripheralUpdates <- update
+	})
+
+	notifications := make(chan []byte, 2)
+	err := deviceChar.EnableNotifications(func(buf []byte) {
+		notifications <- append([]byte{}, buf...)
+	})
+	if err != nil {
+		t.Fatal("could not enable notifications:", err)
+	}
+
+	long := make([]byte, 200)
+	for i := range long {
+		long[i] = byte(i)
+	}
+	expectNotification := func(length int) {
+		t.Helper()
+		if _, err := char.Write(long); err != nil {
+			t.Fatal("could not write characteristic:", err)
+		}
+		select {
+		case value := <-notifications:
+			if !bytes.Equal(value, long[:length]) {
+				t.Errorf("expected a notification of %d bytes, got %d bytes", length, len(value))
+			}
+		case <-time.After(5 * time.Second):
+			t.Fatal("timeout waiting for notification")
+		}
+	}
+
+	// Until the MTU is exchanged, the default MTU is used.
+	if mtu, err := deviceChar.GetMTU(); err != nil || mtu != MinMTU {
+		t.Errorf("expected MTU %d, got %d (%v)", MinMTU, mtu, err)
+	}
+	expectNotification(MinMTU - 3)
+
+	// Both sides use the smaller of the two MTUs.
+	if _, err := device.ExchangeMTU(MaxMTU + 1); err != errInvalidMTU {
+		t.Errorf("expected invalid MTU error, got %v", err)
+	}
+	mtu, err := device.ExchangeMTU(185)
+	if err != nil {
+		t.Fatal("could not exchange MTU:", err)
+	}
+	if mtu != 100 {
+		t.Errorf("expected MTU 100, got %d", mtu)
+	}
+	expectLinkUpdate(t, centralUpdates, LinkUpdate{MTU: 100})
+	expectLinkUpdate(t, peripheralUpdates, LinkUpdate{MTU: 100})
+
+	if mtu, err := deviceChar.GetMTU(); err != nil || mtu != 100 {
+		t.Errorf("expected MTU 100, got %d (%v)", mtu, err)
+	}
+	expectNotification(100 - 3)
+
+	buf := make([]byte, len(long))
+	n, err := deviceChar.Read(buf)
+	if err != nil {
+		t.Fatal("could not read characteristic:", err)
+	}
+	if n != 100-1 {
+		t.Errorf("expected to read %d bytes, read %d", 100-1, n)
+	}
+}
+
+func TestVirtualConnectionInfo(t *testing.T) {
+	// The read handler runs while the stack is busy, and can still look up
+	// the client.
+	var peripheral *Adapter
+	infos := make(chan ConnectionInfo, 2)
+	central, peripheral, device, char := connectVirtualPeripheral(t, CharacteristicConfig{
+		Flags: CharacteristicReadPermission,
+		ReadEvent: func(client Connection, offset int) ([]byte, error) {
+			info, err := peripheral.ConnectionInfo(client)
+			if err != nil {
+				t.Error("could not get connection info:", err)
+			}
+			infos <- info
+			return []byte("value"), nil
+		},
+	})
+	centralAddress, err := central.Address()
+	if err != nil {
+		t.Fatal("could not read address:", err)
+	}
+
+	expectInfo := func(mtu uint16) {
+		t.Helper()
+		buf := make([]byte, 16)
+		if _, err := char.Read(buf); err != nil {
+			t.Fatal("could not read characteristic:", err)
+		}
+		select {
+		case info := <-infos:
+			if info.Address.MAC != centralAddress.MAC || info.MTU != mtu || info.LinkType != LinkTypeLE {
+				t.Errorf("unexpected connection info: %+v", info)
+			}
+		case <-time.After(5 * time.Second):
+			t.Fatal("timeout waiting for read")
+		}
+	}
+	expectInfo(MinMTU)
+	if _, err := device.ExchangeMTU(100); err != nil {
+		t.Fatal("could not exchange MTU:", err)
+	}
+	expectInfo(100)
+
+	if _, err := peripheral.ConnectionInfo(0x0eff); err != errUnknownConnection {
+		t.Errorf("expected %v for an unknown connection, got %v", errUnknownConnection, err)
+	}
+}
+
+func TestVirtualActiveScan(t *testing.T) {
+	air := virtualhci.NewAir()
+	peripheral := newVirtualAdapter(t, air, [6]byte{0x01, 0x00, 0x00, 0x00, 0x00, 0xc0})
+	central := newVirtualAdapter(t, air, [6]byte{0x02, 0x00, 0x00, 0x00, 0x00, 0xc0})
+
+	adv := peripheral.DefaultAdvertisement()
+	err := adv.Configure(AdvertisementOptions{
+		ServiceUUIDs: []UUID{ServiceUUIDHeartRate},
+		ScanResponse: AdvertisementFields{
+			LocalName: "virtual",
+		},
+		Interval: NewDuration(20 * time.Millisecond),
+	})
+	if err != nil {
+		t.Fatal("could not configure advertisement:", err)
+	}
+	if err := adv.Start(); err != nil {
+		t.Fatal("could not start advertisement:", err)
+	}
+
+	// A passive scan only sees the advertisement packet, and stops after the
+	// timeout.
+	start := time.Now()
+	err = central.ScanWithOptions(ScanOptions{Timeout: 200 * time.Millisecond}, func(adapter *Adapter, result ScanResult) {
+		if result.LocalName() != "" {
+			t.Errorf("unexpected local name in passive scan: %q", result.LocalName())
+		}
+	})
+	if err != nil {
+		t.Fatal("could not scan:", err)
+	}
+	if time.Since(start) < 200*time.Millisecond {
+		t.Errorf("scan stopped before the timeout")
+	}
+
+	// An active scan also gets the scan response, merged with the
+	// advertisement packet.
+	found := false
+	err = central.ScanWithOptions(ScanOptions{Active: true, FilterDuplicates: true, Timeout: 5 * time.Second}, func(adapter *Adapter, result ScanResult) {
+		if result.LocalName() == "virtual" && result.HasServiceUUID(ServiceUUIDHeartRate) {
+			if result.PDUType != AdvertisingPDUScanRsp {
+				t.Errorf("unexpected PDU type: %d", result.PDUType)
+			}
+			found = true
+			adapter.StopScan()
+		}
+	})
+	if err != nil {
+		t.Fatal("could not scan:", err)
+	}
+	if !found {
+		t.Error("scan response not received")
+	}
+}
+
+func TestVirtualAdvertisementName(t *testing.T) {
+	air := virtualhci.NewAir()
+	peripheral := newVirtualAdapter(t, air, [6]byte{0x01, 0x00, 0x00, 0x00, 0x00, 0xc0})
+	central := newVirtualAdapter(t, air, [6]byte{0x02, 0x00, 0x00, 0x00, 0x00, 0xc0})
+
+	// A long name doesn't fit next to a 128-bit UUID, so it is moved to the
+	// scan response.
+	uuid := NewUUID([16]byte{0xa0, 0xb4, 0x00, 0x01, 0x92, 0x6d, 0x4d, 0x61, 0x98, 0xdf, 0x8c, 0x5c, 0x62, 0xee, 0x53, 0xb3})
+	adv := peripheral.DefaultAdvertisement()
+	err := adv.Configure(AdvertisementOptions{
+		LocalName:    "a long peripheral name",
+		ServiceUUIDs: []UUID{uuid},
+		Interval:     NewDuration(20 * time.Millisecond),
+	})
+	if err != nil {
+		t.Fatal("could not configure advertisement:", err)
+	}
+	if err := adv.Start(); err != nil {
+		t.Fatal("could not start advertisement:", err)
+	}
+	found := false
+	err = central.ScanWithOptions(ScanOptions{Active: true, FilterDuplicates: true, Timeout: 5 * time.Second}, func(adapter *Adapter, result ScanResult) {
+		if result.LocalName() == "a long peripheral name" && result.HasServiceUUID(uuid) {
+			found = true
+			adapter.StopScan()
+		}
+	})
+	if err != nil {
+		t.Fatal("could not scan:", err)
+	}
+	if !found {
+		t.Error("name and service UUID not received")
+	}
+	if err := adv.Stop(); err != nil {
+		t.Fatal("could not stop advertisement:", err)
+	}
+
+	// Without a name, the default name is advertised.
+	err = adv.Configure(AdvertisementOptions{
+		ServiceUUIDs: []UUID{uuid},
+		Interval:     NewDuration(20 * time.Millisecond),
+	})
+	if err != nil {
+		t.Fatal("could not configure advertisement:", err)
+	}
+	if err := adv.Start(); err != nil {
+		t.Fatal("could not start advertisement:", err)
+	}
+	found = false
+	err = central.ScanWithOptions(ScanOptions{Active: true, FilterDuplicates: true, Timeout: 5 * time.Second}, func(adapter *Adapter, result ScanResult) {
+		if result.LocalName() == "TinyGo" && result.HasServiceUUID(uuid) {
+			found = true
+			adapter.StopScan()
+		}
+	})
+	if err != nil {
+		t.Fatal("could not scan:", err)
+	}
+	if !found {
+		t.Error("default name not received")
+	}
+}
+
+func TestVirtualScanContext(t *testing.T) {
+	air := virtualhci.NewAir()
+	peripheral := newVirtualAdapter(t, air, [6]byte{0x01, 0x00, 0x00, 0x00, 0x00, 0xc0})
+	central := newVirtualAdapter(t, air, [6]byte{0x02, 0x00, 0x00, 0x00, 0x00, 0xc0})
+
+	adv := peripheral.DefaultAdvertisement()
+	err := adv.Configure(AdvertisementOptions{
+		LocalName: "virtual",
+		Interval:  NewDuration(20 * time.Millisecond),
+	})
+	if err != nil {
+		t.Fatal("could not configure advertisement:", err)
+	}
+	if err := adv.Start(); err != nil {
+		t.Fatal("could not start advertisement:", err)
+	}
+
+	ctx, cancel := context.WithTimeout(context.Background(), 5*time.Second)
+	defer cancel()
+	results, wait := central.ScanContext(ctx, ScanOptions{})
+
+	// Every result has its own payload.
+	first := <-results
+	second := <-results
+	if first.LocalName() != "virtual" || second.LocalName() != "virtual" {
+		t.Errorf("unexpected local names: %q %q", first.LocalName(), second.LocalName())
+	}
+	if &first.Bytes()[0] == &second.Bytes()[0] {
+		t.Error("scan results share the same payload")
+	}
+
+	// Cancelling the context ends the scan and closes the channel.
+	cancel()
+	for range results {
+	}
+	if err := wait(); err != context.Canceled {
+		t.Errorf("unexpected scan error: %v", err)
+	}
+
+	// The adapter can scan again.
+	err = central.ScanWithOptions(ScanOptions{Timeout: 50 * time.Millisecond}, func(*Adapter, ScanResult) {})
+	if err != nil {
+		t.Error("could not scan again:", err)
+	}
+}
+
+func TestVirtualExtendedAdvertising(t *testing.T) {
+	air := virtualhci.NewAir()
+	peripheral := newVirtualAdapter(t, air, [6]byte{0x01, 0x00, 0x00, 0x00, 0x00, 0xc0})
+	central := newVirtualAdapter(t, air, [6]byte{0x02, 0x00, 0x00, 0x00, 0x00, 0xc0})
+
+	// A large, non-connectable extended advertisement, which is split over
+	// multiple packets.
+	large := bytes.Repeat([]byte("0123456789"), 20)
+	manufacturerData := []ManufacturerDataElement{
+		{CompanyID: 0xfffe, Data: large},
+		{CompanyID: 0xffff, Data: large},
+	}
+	ext := peripheral.NewAdvertisement()
+	err := ext.Configure(AdvertisementOptions{
+		ManufacturerData: manufacturerData,
+		Interval:         NewDuration(20 * time.Millisecond),
+		NonConnectable:   true,
+		Extended:         true,
+		SecondaryPHY:     PHY2M,
+		TxPower:          -4,
+	})
+	if err != nil {
+		t.Fatal("could not configure extended advertisement:", err)
+	}
+	if err := ext.Start(); err != nil {
+		t.Fatal("could not start extended advertisement:", err)
+	}
+
+	// The default advertisement is sent at the same time, as a legacy
+	// advertisement through the extended advertising commands.
+	adv := peripheral.DefaultAdvertisement()
+	err = adv.Configure(AdvertisementOptions{
+		LocalName: "legacy",
+		Interval:  NewDuration(20 * time.Millisecond),
+	})
+	if err != nil {
+		t.Fatal("could not configure advertisement:", err)
+	}
+	if err := adv.Start(); err != nil {
+		t.Fatal("could not start advertisement:", err)
+	}
+
+	var extended, legacy ScanResult
+	err = central.ScanWithOptions(ScanOptions{Extended: true, Timeout: 5 * time.Second}, func(adapter *Adapter, result ScanResult) {
+		switch result.PDUType {
+		case AdvertisingPDUExtended:
+			extended = result
+			extended.AdvertisementPayload = AdvertisementData(append([]byte{}, result.Bytes()...))
+		case AdvertisingPDUAdvInd:
+			legacy = result
+		}
+		if extended.PDUType != 0 && legacy.PDUType != 0 {
+			adapter.StopScan()
+		}
+	})
+	if err != nil {
+		t.Fatal("could not scan:", err)
+	}
+
+	if extended.PDUType == 0 {
+		t.Fatal("extended advertisement not received")
+	}
+	if mfr := extended.ManufacturerData(); !reflect.DeepEqual(mfr, manufacturerData) {
+		t.Errorf("unexpected manufacturer data: %v", mfr)
+	}
+	if extended.PrimaryPHY != PHY1M || extended.SecondaryPHY != PHY2M || extended.SID != 1 || extended.TxPower != -4 {
+		t.Errorf("unexpected extended advertisement: %+v", extended)
+	}
+	if legacy.LocalName() != "legacy" {
+		t.Errorf("unexpected legacy advertisement: %q", legacy.LocalName())
+	}
+
+	// Connecting uses the extended commands as well.
+	if _, err := central.Connect(legacy.Address, ConnectionParams{}); err != nil {
+		t.Fatal("could not connect:", err)
+	}
+}
+
+// startVirtualPeripheral starts a peripheral with a single readable
+// characteristic, advertising with the given options.
+func startVirtualPeripheral(t *testing.T, air *virtualhci.Air, address [6]byte, value string, options AdvertisementOptions) (*Adapter, Address) {
+	t.Helper()
+
+	adapter := newVirtualAdapter(t, air, address)
+	err := adapter.AddService(&Service{
+		UUID: ServiceUUIDDeviceInformation,
+		Characteristics: []CharacteristicConfig{
+			{
+				UUID:  CharacteristicUUIDModelNumberString,
+				Value: []byte(value),
+				Flags: CharacteristicReadPermission,
+			},
+		},
+	})
+	if err != nil {
+		t.Fatal("could not add service:", err)
+	}
+
+	options.Interval = NewDuration(20 * time.Millisecond)
+	adv := adapter.DefaultAdvertisement()
+	if err := adv.Configure(options); err != nil {
+		t.Fatal("could not configure advertisement:", err)
+	}
+	if err := adv.Start(); err != nil {
+		t.Fatal("could not start advertisement:", err)
+	}
+
+	mac, err := adapter.Address()
+	if err != nil {
+		t.Fatal("could not read address:", err)
+	}
+
+	return adapter, Address{mac}
+}
+
+// connectVirtualPeripheral connects a central to a peripheral with a service
+// that has a single characteristic with the given configuration. It returns
+// both adapters, the connection of the central and the characteristic as
+// discovered by the central.
+func connectVirtualPeripheral(t *testing.T, config CharacteristicConfig) (central, peripheral *Adapter, device Device, char DeviceCharacteristic) {
+	t.Helper()
+
+	air := virtualhci.NewAir()
+	central = newVirtualAdapter(t, air, [6]byte{0x02, 0x00, 0x00, 0x00, 0x00, 0xc0})
+	peripheral = newVirtualAdapter(t, air, [6]byte{0x01, 0x00, 0x00, 0x00, 0x00, 0xc0})
+
+	serviceUUID, _ := ParseUUID("a0b40001-926d-4d61-98df-8c5c62ee53b3")
+	config.UUID, _ = ParseUUID("a0b40002-926d-4d61-98df-8c5c62ee53b3")
+	err := peripheral.AddService(&Service{
+		UUID:            serviceUUID,
+		Characteristics: []CharacteristicConfig{config},
+	})
+	if err != nil {
+		t.Fatal("could not add service:", err)
+	}
+
+	adv := peripheral.DefaultAdvertisement()
+	if err := adv.Configure(AdvertisementOptions{Interval: NewDuration(20 * time.Millisecond)}); err != nil {
+		t.Fatal("could not configure advertisement:", err)
+	}
+	if err := adv.Start(); err != nil {
+		t.Fatal("could not start advertisement:", err)
+	}
+	peripheralAddress, err := peripheral.Address()
+	if err != nil {
+		t.Fatal("could not read address:", err)
+	}
+
+	device, err = central.Connect(Address{peripheralAddress}, ConnectionParams{})
+	if err != nil {
+		t.Fatal("could not connect:", err)
+	}
+	services, err := device.DiscoverServices([]UUID{serviceUUID})
+	if err != nil {
+		t.Fatal("could not discover services:", err)
+	}
+	chars, err := services[0].DiscoverCharacteristics([]UUID{config.UUID})
+	if err != nil {
+		t.Fatal("could not discover characteristics:", err)
+	}
+
+	return central, peripheral, device, chars[0]
+}
+
+// readModelNumber reads the characteristic of a peripheral started with
+// startVirtualPeripheral.
+func readModelNumber(t *testing.T, device Device) string {
+	t.Helper()
+
+	services, err := device.DiscoverServices([]UUID{ServiceUUIDDeviceInformation})
+	if err != nil {
+		t.Fatal("could not discover services:", err)
+	}
+	chars, err := services[0].DiscoverCharacteristics([]UUID{CharacteristicUUIDModelNumberString})
+	if err != nil {
+		t.Fatal("could not discover characteristics:", err)
+	}
+
+	buf := make([]byte, 32)
+	n, err := chars[0].Read(buf)
+	if err != nil {
+		t.Fatal("could not read characteristic:", err)
+	}
+
+	return string(buf[:n])
+}
+
+func TestVirtualMultipleConnections(t *testing.T) {
+	air := virtualhci.NewAir()
+	first, firstAddress := startVirtualPeripheral(t, air, [6]byte{0x01, 0x00, 0x00, 0x00, 0x00, 0xc0}, "first", AdvertisementOptions{
+		AdvertiseWhileConnected: true,
+	})
+	_, secondAddress := startVirtualPeripheral(t, air, [6]byte{0x02, 0x00, 0x00, 0x00, 0x00, 0xc0}, "second", AdvertisementOptions{})
+	central := newVirtualAdapter(t, air, [6]byte{0x03, 0x00, 0x00, 0x00, 0x00, 0xc0})
+	other := newVirtualAdapter(t, air, [6]byte{0x04, 0x00, 0x00, 0x00, 0x00, 0xc0})
+
+	connections := make(chan bool, 4)
+	first.SetConnectHandler(func(device Device, connected bool) {
+		connections <- connected
+	})
+
+	// Connect to both peripherals at the same time.
+	var devices [2]Device
+	errs := make(chan error, 2)
+	for i, address := range []Address{firstAddress, secondAddress} {
+		go func(i int, address Address) {
+			var err error
+			devices[i], err = central.Connect(address, ConnectionParams{})
+			errs <- err
+		}(i, address)
+	}
+	for range devices {
+		if err := <-errs; err != nil {
+			t.Fatal("could not connect:", err)
+		}
+	}
+	if devices[0].handle == devices[1].handle {
+		t.Fatal("connections share the same handle")
+	}
+
+	// Data is routed to the right connection.
+	if value := readModelNumber(t, devices[0]); value != "first" {
+		t.Errorf("unexpected value from first peripheral: %q", value)
+	}
+	if value := readModelNumber(t, devices[1]); value != "second" {
+		t.Errorf("unexpected value from second peripheral: %q", value)
+	}
+
+	// The first peripheral keeps advertising, so another central can connect.
+	device, err := other.Connect(firstAddress, ConnectionParams{})
+	if err != nil {
+		t.Fatal("could not connect second central:", err)
+	}
+	if value := readModelNumber(t, device); value != "first" {
+		t.Errorf("unexpected value for second central: %q", value)
+	}
+	if err := device.Disconnect(); err != nil {
+		t.Fatal("could not disconnect:", err)
+	}
+
+	// The peripheral saw both connections, and the disconnection.
+	for _, expected := range []bool{true, true, false} {
+		select {
+		case connected := <-connections:
+			if connected != expected {
+				t.Errorf("unexpected connection event: %v", connected)
+			}
+		case <-time.After(5 * time.Second):
+			t.Fatal("timeout waiting for connection event")
+		}
+	}
+}
+
+func TestVirtualLinkUpdate(t *testing.T) {
+	air := virtualhci.NewAir()
+	peripheral, address := startVirtualPeripheral(t, air, [6]byte{0x01, 0x00, 0x00, 0x00, 0x00, 0xc0}, "peripheral", AdvertisementOptions{})
+	central := newVirtualAdapter(t, air, [6]byte{0x02, 0x00, 0x00, 0x00, 0x00, 0xc0})
+
+	centralUpdates := make(chan LinkUpdate, 4)
+	central.SetLinkUpdateHandler(func(device Device, update LinkUpdate) {
+		centralUpdates <- update
+	})
+	peripheralUpdates := make(chan LinkUpdate, 4)
+	peripheral.SetLinkUpdateHandler(func(device Device, update LinkUpdate) {
+		peripheralUpdates <- update
+	})
+
+	device, err := central.Connect(address, ConnectionParams{})
+	if err != nil {
+		t.Fatal("could not connect:", err)
+	}
+
+	if err := device.RequestDataLength(10); err != errInvalidDataLength {
+		t.Errorf("expected invalid data length error, got %v", err)
+	}
+	if err := device.RequestDataLength(MaxDataLength); err != nil {
+		t.Fatal("could not request data length:", err)
+	}
+	expectLinkUpdate(t, centralUpdates, LinkUpdate{TxOctets: MaxDataLength, RxOctets: MinDataLength})
+	expectLinkUpdate(t, peripheralUpdates, LinkUpdate{TxOctets: MinDataLength, RxOctets: MaxDataLength})
+
+	if err := device.SetPHY(PHY2M, PHYCoded); err != nil {
+		t.Fatal("could not set PHY:", err)
+	}
+	expectLinkUpdate(t, centralUpdates, LinkUpdate{TxPHY: PHY2M, RxPHY: PHYCoded})
+	expectLinkUpdate(t, peripheralUpdates, LinkUpdate{TxPHY: PHYCoded, RxPHY: PHY2M})
+
+	// The connection still works after the updates.
+	if value := readModelNumber(t, device); value != "peripheral" {
+		t.Errorf("unexpected value: %q", value)
+	}
+}
+
+// expectLinkUpdate waits for the next update passed to a link update handler.
+func expectLinkUpdate(t *testing.T, updates <-chan LinkUpdate, expected LinkUpdate) {
+	t.Helper()
+
+	select {
+	case update := <-updates:
+		if update != expected {
+			t.Errorf("unexpected link update:\nexpected: %+v\nactual:   %+v", expected, update)
+		}
+	case <-time.After(5 * time.Second):
+		t.Errorf("timeout waiting for link update %+v", expected)
+	}
+}
+
+func TestVirtualPairing(t *testing.T) {
+	tests := []struct {
+		name         string
+		legacy       bool
+		central      IOCapability
+		peripheral   IOCapability
+		wrongPasskey bool
+		compare      bool
+		security     securityLevel
+		err          error
+	}{
+		{name: "legacy just works", legacy: true, central: IOCapabilityNoInputNoOutput, peripheral: IOCapabilityNoInputNoOutput,
+			security: securityEncrypted},
+		{name: "legacy passkey", legacy: true, central: IOCapabilityKeyboardOnly, peripheral: IOCapabilityDisplayOnly,
+			security: securityAuthenticated},
+		{name: "legacy wrong passkey", legacy: true, central: IOCapabilityKeyboardOnly, peripheral: IOCapabilityDisplayOnly,
+			wrongPasskey: true, err: smpError(smpReasonConfirmValueFailed)},
+		{name: "just works", central: IOCapabilityNoInputNoOutput, peripheral: IOCapabilityDisplayYesNo,
+			security: securityEncrypted},
+		{name: "numeric comparison", central: IOCapabilityKeyboardDisplay, peripheral: IOCapabilityDisplayYesNo, compare: true,
+			security: securitySecure},
+		{name: "passkey", central: IOCapabilityDisplayOnly, peripheral: IOCapabilityKeyboardDisplay,
+			security: securitySecure},
+		{name: "wrong passkey", central: IOCapabilityKeyboardOnly, peripheral: IOCapabilityDisplayOnly,
+			wrongPasskey: true, err: smpError(smpReasonConfirmValueFailed)},
+	}
+	for _, tc := range tests {
+		t.Run(tc.name, func(t *testing.T) {
+			air := virtualhci.NewAir()
+			peripheral, address := startVirtualPeripheral(t, air, [6]byte{0x01, 0x00, 0x00, 0x00, 0x00, 0xc0}, "peripheral", AdvertisementOptions{})
+			central := newVirtualAdapter(t, air, [6]byte{0x02, 0x00, 0x00, 0x00, 0x00, 0xc0})
+			central.hci.smp.secureConnections = !tc.legacy
+			central.SetIOCapability(tc.central)
+			peripheral.SetIOCapability(tc.peripheral)
+
+			// The passkey shown by one side is entered on the other, and both
+			// numbers of a numeric comparison must be the same.
+			passkeys := make(chan uint32, 1)
+			numbers := make(chan uint32, 2)
+			peripheralDone := make(chan error, 1)
+			handler := PairingHandler{
+				DisplayPasskey: func(device Device, passkey uint32) {
+					passkeys <- passkey
+				},
+				RequestPasskey: func(device Device) (uint32, bool) {
+					select {
+					case passkey := <-passkeys:
+						if tc.wrongPasskey {
+							passkey = (passkey + 1) % 1000000
+						}
+						return passkey, true
+					case <-time.After(5 * time.Second):
+						return 0, false
+					}
+				},
+				ConfirmPasskey: func(device Device, passkey uint32) bool {
+					numbers <- passkey
+					return true
+				},
+			}
+			central.SetPairingHandler(handler)
+			handler.PairingComplete = func(device Device, err error) {
+				peripheralDone <- err
+			}
+			peripheral.SetPairingHandler(handler)
+
+			device, err := central.Connect(address, ConnectionParams{})
+			if err != nil {
+				t.Fatal("could not connect:", err)
+			}
+
+			ctx, cancel := context.WithTimeout(context.Background(), 5*time.Second)
+			defer cancel()
+			if err := device.Pair(ctx); err != tc.err {
+				t.Fatalf("expected pairing result %v, got %v", tc.err, err)
+			}
+			expectPairingComplete(t, peripheralDone, tc.err)
+			if tc.err != nil {
+				return
+			}
+
+			switch {
+			case !tc.compare && len(numbers) != 0:
+				t.Error("unexpected numeric comparison")
+			case tc.compare && len(numbers) != 2:
+				t.Errorf("expected numeric comparison on both sides, got %d", len(numbers))
+			case tc.compare && <-numbers != <-numbers:
+				t.Error("numeric comparison shows different numbers")
+			}
+			centralBonds, _ := central.Bonds()
+			peripheralBonds, _ := peripheral.Bonds()
+			if len(centralBonds) != 1 || len(peripheralBonds) != 1 {
+				t.Fatalf("expected a bond on both sides, got %d and %d", len(centralBonds), len(peripheralBonds))
+			}
+			if centralBonds[0].Address.MAC != address.MAC || centralBonds[0].LTK != peripheralBonds[0].LTK {
+				t.Errorf("bonds don't match:\ncentral:    %+v\nperipheral: %+v", centralBonds[0], peripheralBonds[0])
+			}
+			if value := readModelNumber(t, device); value != "peripheral" {
+				t.Errorf("unexpected value: %q", value)
+			}
+			expectLinkSecurity(t, central, tc.security)
+			expectLinkSecurity(t, peripheral, tc.security)
+
+			// The next connection is encrypted with the stored keys, without
+			// asking the user again.
+			if err := device.Disconnect(); err != nil {
+				t.Fatal("could not disconnect:", err)
+			}
+			device, err = central.Connect(address, ConnectionParams{})
+			if err != nil {
+				t.Fatal("could not reconnect:", err)
+			}
+			central.SetPairingHandler(PairingHandler{})
+			if err := device.Pair(ctx); err != nil {
+				t.Fatal("could not encrypt with stored keys:", err)
+			}
+			expectPairingComplete(t, peripheralDone, nil)
+			if value := readModelNumber(t, device); value != "peripheral" {
+				t.Errorf("unexpected value: %q", value)
+			}
+			expectLinkSecurity(t, central, tc.security)
+			expectLinkSecurity(t, peripheral, tc.security)
+		})
+	}
+}
+
+// expectLinkSecurity checks the security of the only connection of an
+// adapter.
+func expectLinkSecurity(t *testing.T, adapter *Adapter, expected securityLevel) {
+	t.Helper()
+
+	adapter.att.busy.Lock()
+	defer adapter.att.busy.Unlock()
+
+	if len(adapter.hci.smp.connections) != 1 {
+		t.Fatalf("expected a single connection, got %d", len(adapter.hci.smp.connections))
+	}
+	if security := adapter.hci.smp.connections[0].security; security != expected {
+		t.Errorf("expected security level %d, got %d", expected, security)
+	}
+}
+
+func TestVirtualBondStore(t *testing.T) {
+	air := virtualhci.NewAir()
+	peripheral, address := startVirtualPeripheral(t, air, [6]byte{0x01, 0x00, 0x00, 0x00, 0x00, 0xc0}, "peripheral", AdvertisementOptions{})
+	peripheralDone := make(chan error, 1)
+	peripheral.SetPairingHandler(PairingHandler{
+		PairingComplete: func(device Device, err error) {
+			peripheralDone <- err
+		},
+	})
+
+	// The central is restarted with the same bond file, until the peripheral
+	// forgets the bond.
+	path := filepath.Join(t.TempDir(), "bonds.json")
+	centralAddress := [6]byte{0x02, 0x00, 0x00, 0x00, 0x00, 0xc0}
+	var ltk [16]byte
+	for run := 0; run < 3; run++ {
+		controller := air.NewController(centralAddress)
+		central := NewAdapter(NewHCITransport(controller))
+		if err := central.Enable(); err != nil {
+			t.Fatal("could not enable adapter:", err)
+		}
+		store, err := NewFileBondStore(path)
+		if err != nil {
+			t.Fatal("could not open bond store:", err)
+		}
+		central.SetBondStore(store)
+
+		device, err := central.Connect(address, ConnectionParams{})
+		if err != nil {
+			t.Fatal("could not connect:", err)
+		}
+		ctx, cancel := context.WithTimeout(context.Background(), 5*time.Second)
+		err = device.Pair(ctx)
+		cancel()
+
+		switch run {
+		case 0:
+			if err != nil {
+				t.Fatal("could not pair:", err)
+			}
+			expectPairingComplete(t, peripheralDone, nil)
+			bonds, _ := store.Bonds()
+			if len(bonds) != 1 {
+				t.Fatalf("expected a bond, got %d", len(bonds))
+			}
+			ltk = bonds[0].LTK
+
+		case 1:
+			// Encrypted with the stored key, without pairing again.
+			if err != nil {
+				t.Fatal("could not encrypt with stored keys:", err)
+			}
+			expectPairingComplete(t, peripheralDone, nil)
+			bonds, _ := peripheral.Bonds()
+			if len(bonds) != 1 || bonds[0].LTK != ltk {
+				t.Fatalf("expected the bond of the first connection, got %+v", bonds)
+			}
+			if err := peripheral.DeleteBond(bonds[0].Address); err != nil {
+				t.Fatal("could not delete bond:", err)
+			}
+
+		case 2:
+			if err != hciStatusError(0x06) {
+				t.Fatalf("expected missing key error, got %v", err)
+			}
+		}
+
+		controller.Close()
+	}
+}
+
+// expectPairingComplete waits for the result passed to a pairing handler.
+func expectPairingComplete(t *testing.T, done <-chan error, expected error) {
+	t.Helper()
+
+	select {
+	case err := <-done:
+		if err != expected {
+			t.Errorf("expected pairing result %v, got %v", expected, err)
+		}
+	case <-time.After(5 * time.Second):
+		t.Error("timeout waiting for pairing to complete")
+	}
+}
+
+func TestVirtualPrivacy(t *testing.T) {
+	for _, extended := range []bool{false, true} {
+		name := "legacy"
+		if extended {
+			name = "extended"
+		}
+		t.Run(name, func(t *testing.T) {
+			testVirtualPrivacy(t, extended)
+		})
+	}
+}
+
+func testVirtualPrivacy(t *testing.T, extended bool) {
+	air := virtualhci.NewAir()
+	peripheral, identity := startVirtualPeripheral(t, air, [6]byte{0x01, 0x00, 0x00, 0x00, 0x00, 0xc0}, "private", AdvertisementOptions{
+		LocalName: "private",
+		Extended:  extended,
+	})
+	central := newVirtualAdapter(t, air, [6]byte{0x02, 0x00, 0x00, 0x00, 0x00, 0xc0})
+
+	connections := make(chan bool, 4)
+	peripheral.SetConnectHandler(func(device Device, connected bool) {
+		connections <- connected
+	})
+	peripheralDone := make(chan error, 1)
+	peripheral.SetPairingHandler(PairingHandler{
+		PairingComplete: func(device Device, err error) {
+			peripheralDone <- err
+		},
+	})
+
+	// The advertisement that was already started changes to the private
+	// address.
+	irk := [16]byte{0x0f, 0x1e, 0x2d, 0x3c, 0x4b, 0x5a, 0x69, 0x78}
+	if err := peripheral.EnablePrivacy(irk, time.Hour); err != nil {
+		t.Fatal("could not enable privacy:", err)
+	}
+
+	// scan returns the address the peripheral advertises with, and the
+	// identity address the central resolved it to.
+	scan := func() (address, resolved Address) {
+		t.Helper()
+		err := central.ScanWithOptions(ScanOptions{Extended: extended, Timeout: 5 * time.Second}, func(adapter *Adapter, result ScanResult) {
+			if result.LocalName() == "private" {
+				address, resolved = result.Address, result.IdentityAddress
+				adapter.StopScan()
+			}
+		})
+		if err != nil {
+			t.Fatal("could not scan:", err)
+		}
+		if address.Type() != AddressResolvablePrivate {
+			t.Fatalf("expected a resolvable private address, got %s of type %d", address.MAC, address.Type())
+		}
+		if _, ok := address.Resolve([][16]byte{irk}); !ok {
+			t.Fatalf("address %s doesn't resolve with the IRK", address.MAC)
+		}
+		return
+	}
+	connect := func(address Address) {
+		t.Helper()
+		device, err := central.Connect(address, ConnectionParams{})
+		if err != nil {
+			t.Fatal("could not connect:", err)
+		}
+		ctx, cancel := context.WithTimeout(context.Background(), 5*time.Second)
+		defer cancel()
+		if err := device.Pair(ctx); err != nil {
+			t.Fatal("could not pair:", err)
+		}
+		expectPairingComplete(t, peripheralDone, nil)
+		if err := device.Disconnect(); err != nil {
+			t.Fatal("could not disconnect:", err)
+		}
+		for _, expected := range []bool{true, false} {
+			select {
+			case connected := <-connections:
+				if connected != expected {
+					t.Fatalf("unexpected connection event: %v", connected)
+				}
+			case <-time.After(5 * time.Second):
+				t.Fatal("timeout waiting for connection event")
+			}
+		}
+	}
+
+	// Before pairing, the central can't tell who the peripheral is.
+	first, resolved := scan()
+	if resolved != (Address{}) {
+		t.Errorf("address resolved before pairing: %s", resolved.MAC)
+	}
+	connect(first)
+	bonds, _ := central.Bonds()
+	if len(bonds) != 1 || bonds[0].Address != identity.MACAddress || bonds[0].IRK != irk {
+		t.Fatalf("expected a bond with the identity of the peripheral, got %+v", bonds)
+	}
+	ltk := bonds[0].LTK
+
+	// After the address changes, the central recognizes the peripheral, and
+	// encrypts with the key of the bond.
+	if err := peripheral.EnablePrivacy(irk, time.Hour); err != nil {
+		t.Fatal("could not change address:", err)
+	}
+	second, resolved := scan()
+	if second == first {
+		t.Errorf("address didn't change: %s", second.MAC)
+	}
+	if resolved != identity {
+		t.Errorf("expected identity address %s, got %s", identity.MAC, resolved.MAC)
+	}
+	connect(second)
+	bonds, _ = central.Bonds()
+	if len(bonds) != 1 || bonds[0].LTK != ltk {
+		t.Errorf("expected the bond of the first connection, got %+v", bonds)
+	}
+}
@@ -1,4 +1,4 @@
-//go:build ninafw
+//go:build hci || ninafw
 
 package bluetooth
 
@@ -64,7 +64,7 @@ func newL2CAP(hci *hci) *l2cap {
 }
 
 func (l *l2cap) addConnection(handle uint16, role uint8, interval, timeout uint16) error {
-	if role != 0x01 {
+	if role != hciRolePeripheral {
 		return nil
 	}
 
@@ -132,7 +132,7 @@ func (l *l2cap) handleParameterUpdateRequest(connectionHandle uint16, identifier
 
 	// valid so update connection parameters
 	if resp.value == 0 {
-		return l.hci.leConnUpdate(connectionHandle, req.minInterval, req.maxInterval, req.latency, req.timeout)
+		return l.hci.leConnUpdateWithoutResponse(connectionHandle, req.minInterval, req.maxInterval, req.latency, req.timeout)
 	}
 
 	return nil
@@ -0,0 +1,152 @@
+package bluetooth
+
+import (
+	"crypto/aes"
+	"crypto/rand"
+)
+
+// AddressType is the kind of a Bluetooth device address. Random addresses are
+// told apart by the two most significant bits of the address.
+type AddressType uint8
+
+const (
+	// AddressPublic is an address assigned by the manufacturer.
+	AddressPublic AddressType = iota
+
+	// AddressRandomStatic is a random address that stays the same at least
+	// until the device restarts.
+	AddressRandomStatic
+
+	// AddressResolvablePrivate is a random address that changes every now and
+	// then, and that can be linked to its device with the IRK of the device.
+	AddressResolvablePrivate
+
+	// AddressNonResolvablePrivate is a random address that can't be linked to
+	// a device at all.
+	AddressNonResolvablePrivate
+
+	// AddressRandomReserved is a random address with the most significant bits
+	// set to a value that is reserved for future use.
+	AddressRandomReserved
+)
+
+// Type returns the kind of the address.
+func (mac MACAddress) Type() AddressType {
+	if !mac.isRandom {
+		return AddressPublic
+	}
+
+	switch mac.MAC[5] >> 6 {
+	case 0b11:
+		return AddressRandomStatic
+	case 0b01:
+		return AddressResolvablePrivate
+	case 0b00:
+		return AddressNonResolvablePrivate
+	default:
+		return AddressRandomReserved
+	}
+}
+
+// NewStaticAddress returns a new random static address.
+func NewStaticAddress() (MACAddress, error) {
+	return newRandomAddress(0b11)
+}
+
+// NewNonResolvableAddress returns a new non-resolvable private address.
+func NewNonResolvableAddress() (MACAddress, error) {
+	return newRandomAddress(0b00)
+}
+
+// NewResolvableAddress returns a new resolvable private address, generated
+// from the IRK of the device. Like the keys in a Bond, the IRK is in the order
+// in which it is sent over the air.
+func NewResolvableAddress(irk [16]byte) (MACAddress, error) {
+	// The random part is in the upper half of the address, the hash of it in
+	// the lower half.
+	address, err := newRandomAddress(0b01)
+	if err != nil {
+		return MACAddress{}, err
+	}
+
+	prand := uint32(address.MAC[3]) | uint32(address.MAC[4])<<8 | uint32(address.MAC[5])<<16
+	hash := ah(reverseIRK(irk), prand)
+	address.MAC[0] = byte(hash)
+	address.MAC[1] = byte(hash >> 8)
+	address.MAC[2] = byte(hash >> 16)
+
+	return address, nil
+}
+
+// Resolve checks whether the address is a resolvable private address that was
+// generated with one of the IRKs, and returns the index of that IRK.
+func (mac MACAddress) Resolve(irks [][16]byte) (index int, ok bool) {
+	if mac.Type() != AddressResolvablePrivate {
+		return 0, false
+	}
+
+	prand := uint32(mac.MAC[3]) | uint32(mac.MAC[4])<<8 | uint32(mac.MAC[5])<<16
+	hash := uint32(mac.MAC[0]) | uint32(mac.MAC[1])<<8 | uint32(mac.MAC[2])<<16
+	for i, irk := range irks {
+		if ah(reverseIRK(irk), prand) == hash {
+			return i, true
+		}
+	}
+
+	return 0, false
+}
+
+// newRandomAddress returns a random address with the given two most
+// significant bits. The random part of a static or non-resolvable address
+// must not be all zeros or all ones.
+func newRandomAddress(typ byte) (MACAddress, error) {
+	address := MACAddress{isRandom: true}
+	for {
+		if _, err := rand.Read(address.MAC[:]); err != nil {
+			return MACAddress{}, err
+		}
+		address.MAC[5] = address.MAC[5]&0x3f | typ<<6
+
+		var zeros, ones int
+		bits := 46
+		if typ == 0b01 {
+			// Only the 22 random bits of the prand of a resolvable address.
+			bits = 22
+		}
+		for i := 0; i < bits; i++ {
+			bit := 47 - 2 - i
+			if address.MAC[bit/8]>>(bit%8)&1 != 0 {
+				ones++
+			} else {
+				zeros++
+			}
+		}
+		if zeros != 0 && ones != 0 {
+			return address, nil
+		}
+	}
+}
+
+// ah is the random address hash function, which hashes the 24 bit prand of a
+// resolvable private address with the IRK. The IRK is most significant octet
+// first, as in the specification.
+func ah(irk [16]byte, prand uint32) uint32 {
+	var r [16]byte
+	r[13] = byte(prand >> 16)
+	r[14] = byte(prand >> 8)
+	r[15] = byte(prand)
+
+	block, _ := aes.NewCipher(irk[:])
+	block.Encrypt(r[:], r[:])
+
+	return uint32(r[13])<<16 | uint32(r[14])<<8 | uint32(r[15])
+}
+
+// reverseIRK converts an IRK from the order in which it is sent over the air
+// to the order of the specification.
+func reverseIRK(irk [16]byte) (reversed [16]byte) {
+	for i := range irk {
+		reversed[15-i] = irk[i]
+	}
+	return
+}
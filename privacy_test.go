@@ -0,0 +1,128 @@
+package bluetooth
+
+import "testing"
+
+func TestAh(t *testing.T) {
+	// Sample data from the Bluetooth Core Specification, Vol 3, Part H,
+	// Appendix D.7.
+	irk := [16]byte{
+		0xec, 0x02, 0x34, 0xa3, 0x57, 0xc8, 0xad, 0x05,
+		0x34, 0x10, 0x10, 0xa6, 0x0a, 0x39, 0x7d, 0x9b,
+	}
+	if hash := ah(irk, 0x708194); hash != 0x0dfbaa {
+		t.Errorf("ah: expected 0x0dfbaa, got %#06x", hash)
+	}
+}
+
+func TestAddressType(t *testing.T) {
+	for _, tc := range []struct {
+		address string
+		random  bool
+		typ     AddressType
+	}{
+		{"C0:12:34:56:78:9A", false, AddressPublic},
+		{"C0:12:34:56:78:9A", true, AddressRandomStatic},
+		{"4F:12:34:56:78:9A", true, AddressResolvablePrivate},
+		{"3F:12:34:56:78:9A", true, AddressNonResolvablePrivate},
+		{"80:12:34:56:78:9A", true, AddressRandomReserved},
+	} {
+		mac, err := ParseMAC(tc.address)
+		if err != nil {
+			t.Fatal(err)
+		}
+		address := MACAddress{MAC: mac, isRandom: tc.random}
+		if typ := address.Type(); typ != tc.typ {
+			t.Errorf("%s (random: %t): expected type %d, got %d", tc.address, tc.random, tc.typ, typ)
+		}
+	}
+}
+
+func TestNewAddress(t *testing.T) {
+	for _, tc := range []struct {
+		name string
+		new  func() (MACAddress, error)
+		typ  AddressType
+	}{
+		{"static", NewStaticAddress, AddressRandomStatic},
+		{"non-resolvable", NewNonResolvableAddress, AddressNonResolvablePrivate},
+	} {
+		a, err := tc.new()
+		if err != nil {
+			t.Fatal(err)
+		}
+		b, err := tc.new()
+		if err != nil {
+			t.Fatal(err)
+		}
+		if a.Type() != tc.typ || b.Type() != tc.typ {
+			t.Errorf("%s: unexpected types %d and %d", tc.name, a.Type(), b.Type())
+		}
+		if a == b {
+			t.Errorf("%s: the same address was generated twice: %s", tc.name, a.MAC)
+		}
+	}
+}
+
+func TestResolvableAddress(t *testing.T) {
+	irks := [][16]byte{
+		{0x01, 0x02, 0x03},
+		{0x9b, 0x7d, 0x39, 0x0a, 0xa6, 0x10, 0x10, 0x34, 0x05, 0xad, 0xc8, 0x57, 0xa3, 0x34, 0x02, 0xec},
+	}
+
+	address, err := NewResolvableAddress(irks[1])
+	if err != nil {
+		t.Fatal(err)
+	}
+	if address.Type() != AddressResolvablePrivate {
+		t.Fatalf("expected a resolvable private address, got type %d", address.Type())
+	}
+	if i, ok := address.Resolve(irks); !ok || i != 1 {
+		t.Errorf("expected the address to resolve with IRK 1, got %d, %t", i, ok)
+	}
+	if _, ok := address.Resolve(irks[:1]); ok {
+		t.Error("the address resolved with the wrong IRK")
+	}
+
+	// The address from the sample data of the specification, with the IRK in
+	// the order in which it is sent over the air.
+	mac, err := ParseMAC("70:81:94:0D:FB:AA")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if i, ok := (MACAddress{MAC: mac, isRandom: true}).Resolve(irks); !ok || i != 1 {
+		t.Errorf("expected the sample address to resolve with IRK 1, got %d, %t", i, ok)
+	}
+	if _, ok := (MACAddress{MAC: mac}).Resolve(irks); ok {
+		t.Error("a public address was resolved")
+	}
+}
+
+func TestResolveBond(t *testing.T) {
+	irk := [16]byte{0x42}
+	identity := MACAddress{MAC: MAC{1, 2, 3, 4, 5, 6}}
+	store := NewMemoryBondStore()
+	store.SaveBond(Bond{Address: MACAddress{MAC: MAC{6, 5, 4, 3, 2, 0x41}, isRandom: true}})
+	store.SaveBond(Bond{Address: identity, IRK: irk})
+
+	private, err := NewResolvableAddress(irk)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if bond, ok := resolveBond(store, private); !ok || bond.Address != identity {
+		t.Errorf("expected the bond with %s, got %s, %t", identity.MAC, bond.Address.MAC, ok)
+	}
+	if bond, ok := resolveBond(store, identity); !ok || bond.Address != identity {
+		t.Errorf("expected the bond with %s, got %s, %t", identity.MAC, bond.Address.MAC, ok)
+	}
+
+	other, err := NewResolvableAddress([16]byte{0x43})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if _, ok := resolveBond(store, other); ok {
+		t.Error("an address of another device was resolved")
+	}
+	if _, ok := resolveBond(nil, private); ok {
+		t.Error("an address was resolved without a store")
+	}
+}
@@ -0,0 +1,57 @@
+//go:build !softdevice || s132v6 || s140v6 || s140v7
+
+package bluetooth
+
+import (
+	"context"
+)
+
+// ScanContext starts a BLE scan in the background and returns a channel with
+// the scan results. The scan ends when ctx is cancelled, when the timeout in
+// the options expires or when it fails, after which the channel is closed.
+// Unlike the Scan callback, every result has its own copy of the
+// advertisement payload, so it stays valid after the next result arrives.
+//
+// The returned wait function blocks until the scan has ended and returns the
+// error that ended it: ctx.Err() if the context was cancelled, nil if the
+// timeout expired or StopScan was called. It may be called more than once.
+// Results that are not received before the context is cancelled are dropped.
+func (a *Adapter) ScanContext(ctx context.Context, options ScanOptions) (results <-chan ScanResult, wait func() error) {
+	ch := make(chan ScanResult)
+	errChan := make(chan error, 1)
+	options.done = ctx.Done()
+
+	go func() {
+		defer close(ch)
+		err := a.ScanWithOptions(options, func(adapter *Adapter, result ScanResult) {
+			select {
+			case ch <- copyScanResult(result):
+			case <-ctx.Done():
+				// The scan will stop soon, drop the result.
+			}
+		})
+		if err == nil {
+			err = ctx.Err()
+		}
+		errChan <- err
+	}()
+
+	wait = func() error {
+		err := <-errChan
+		errChan <- err
+		return err
+	}
+	return ch, wait
+}
+
+// copyScanResult returns a copy of the scan result with a raw advertisement
+// payload that is not reused for the next result. Structured payloads are
+// created for every result and are not copied.
+func copyScanResult(result ScanResult) ScanResult {
+	if result.AdvertisementPayload != nil {
+		if raw := result.AdvertisementPayload.Bytes(); raw != nil {
+			result.AdvertisementPayload = AdvertisementData(append([]byte{}, raw...))
+		}
+	}
+	return result
+}
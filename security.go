@@ -0,0 +1,49 @@
+package bluetooth
+
+// IOCapability describes the means a device has to show a passkey to the user
+// or let the user enter or confirm one. The capabilities of both devices decide
+// how pairing is authenticated: with a passkey, by comparing numbers, or not at
+// all ("Just Works").
+type IOCapability uint8
+
+const (
+	// IOCapabilityDisplayOnly can show a passkey, but has no input.
+	IOCapabilityDisplayOnly IOCapability = iota
+
+	// IOCapabilityDisplayYesNo can show a number and ask the user to confirm
+	// it.
+	IOCapabilityDisplayYesNo
+
+	// IOCapabilityKeyboardOnly can let the user enter a passkey, but has no
+	// display.
+	IOCapabilityKeyboardOnly
+
+	// IOCapabilityNoInputNoOutput has no way to interact with the user. Pairing
+	// is not protected against man-in-the-middle attacks. This is the default.
+	IOCapabilityNoInputNoOutput
+
+	// IOCapabilityKeyboardDisplay can both show a passkey and let the user
+	// enter one.
+	IOCapabilityKeyboardDisplay
+)
+
+// PairingHandler contains the functions that involve the user during pairing.
+// Functions that are nil are not called: without RequestPasskey or
+// ConfirmPasskey, pairing that needs them fails.
+type PairingHandler struct {
+	// DisplayPasskey is called with the six digit passkey that the user must
+	// enter on the other device.
+	DisplayPasskey func(device Device, passkey uint32)
+
+	// RequestPasskey asks the user for the six digit passkey that is shown by
+	// the other device. Returning false rejects the pairing.
+	RequestPasskey func(device Device) (passkey uint32, ok bool)
+
+	// ConfirmPasskey asks the user whether the six digit number is the same as
+	// the one shown by the other device. Returning false rejects the pairing.
+	ConfirmPasskey func(device Device, passkey uint32) bool
+
+	// PairingComplete is called when pairing has finished, with a nil error on
+	// success.
+	PairingComplete func(device Device, err error)
+}
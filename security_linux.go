@@ -0,0 +1,295 @@
+//go:build !baremetal && !hci
+
+package bluetooth
+
+import (
+	"context"
+	"errors"
+	"sync"
+
+	"github.com/godbus/dbus/v5"
+)
+
+// This file implements pairing with BlueZ. BlueZ asks an agent, an
+// org.bluez.Agent1 object registered with the AgentManager1 interface, to show
+// or request passkeys. The agent passes these requests to the PairingHandler
+// of the adapter. See:
+// https://git.kernel.org/pub/scm/bluetooth/bluez.git/tree/doc/org.bluez.Agent.rst
+
+const agentPath = dbus.ObjectPath("/org/tinygo/bluetooth/agent")
+
+// BlueZ names of the IO capabilities.
+var agentCapabilities = [...]string{
+	IOCapabilityDisplayOnly:     "DisplayOnly",
+	IOCapabilityDisplayYesNo:    "DisplayYesNo",
+	IOCapabilityKeyboardOnly:    "KeyboardOnly",
+	IOCapabilityNoInputNoOutput: "NoInputNoOutput",
+	IOCapabilityKeyboardDisplay: "KeyboardDisplay",
+}
+
+var errAgentRejected = dbus.NewError("org.bluez.Error.Rejected", nil)
+
+// agent is the org.bluez.Agent1 object exported by the adapter.
+type agent struct {
+	adapter *Adapter
+
+	mu             sync.Mutex
+	configured     bool // SetIOCapability or SetPairingHandler was called
+	registered     bool // registered with BlueZ, with the capability below
+	ioCapability   IOCapability
+	pairingHandler PairingHandler
+}
+
+// SetIOCapability sets the means this device has to interact with the user
+// during pairing. The default is IOCapabilityNoInputNoOutput, which only
+// allows pairing without protection against man-in-the-middle attacks.
+//
+// On Linux, the adapter registers its agent with BlueZ once it has been
+// enabled, which replaces the default agent of the system (for example the
+// one of bluetoothctl).
+func (a *Adapter) SetIOCapability(ioCapability IOCapability) {
+	a.agent.mu.Lock()
+	a.agent.ioCapability = ioCapability
+	a.agent.configured = true
+	a.agent.registered = false
+	a.agent.mu.Unlock()
+
+	a.updateAgent()
+}
+
+// SetPairingHandler sets the functions that show or ask the user for a
+// passkey during pairing, and that report the result of pairing.
+//
+// On Linux, PairingComplete is only called for pairing that was started with
+// Device.Pair.
+func (a *Adapter) SetPairingHandler(handler PairingHandler) {
+	a.agent.mu.Lock()
+	a.agent.pairingHandler = handler
+	a.agent.configured = true
+	a.agent.mu.Unlock()
+
+	a.updateAgent()
+}
+
+// updateAgent registers the agent once the adapter has been enabled and the
+// agent has been configured, so that it also answers pairing that a central
+// starts. Errors are reported by the next call to Device.Pair, which tries
+// again.
+func (a *Adapter) updateAgent() {
+	a.agent.mu.Lock()
+	configured := a.agent.configured
+	a.agent.mu.Unlock()
+	if a.bus == nil || !configured {
+		return
+	}
+
+	err := a.registerAgent()
+	if err != nil && debug {
+		println("could not register agent:", err.Error())
+	}
+}
+
+// registerAgent exports the agent and registers it as the default agent of
+// BlueZ, unless that has already been done with the current IO capability.
+func (a *Adapter) registerAgent() error {
+	a.agent.mu.Lock()
+	defer a.agent.mu.Unlock()
+
+	if a.agent.registered {
+		return nil
+	}
+
+	a.agent.adapter = a
+	if err := a.bus.Export(&a.agent, agentPath, "org.bluez.Agent1"); err != nil {
+		return err
+	}
+
+	// An agent can't change its capability, it must be registered again.
+	agentManager := a.bus.Object("org.bluez", dbus.ObjectPath("/org/bluez"))
+	agentManager.Call("org.bluez.AgentManager1.UnregisterAgent", 0, agentPath)
+
+	capability := agentCapabilities[IOCapabilityNoInputNoOutput]
+	if int(a.agent.ioCapability) < len(agentCapabilities) {
+		capability = agentCapabilities[a.agent.ioCapability]
+	}
+	if err := agentManager.Call("org.bluez.AgentManager1.RegisterAgent", 0, agentPath, capability).Err; err != nil {
+		return err
+	}
+	if err := agentManager.Call("org.bluez.AgentManager1.RequestDefaultAgent", 0, agentPath).Err; err != nil {
+		return err
+	}
+
+	a.agent.registered = true
+	return nil
+}
+
+// RemoveDevice removes the device from BlueZ, along with the keys of an
+// earlier pairing. The connection to the device is closed.
+func (a *Adapter) RemoveDevice(address Address) error {
+	return a.adapter.Call("org.bluez.Adapter1.RemoveDevice", 0, a.devicePath(address)).Err
+}
+
+// Pair pairs with the device and encrypts the connection, and waits until that
+// has finished or the context is done. The IO capabilities of both devices
+// decide whether the user must enter or confirm a passkey, see
+// SetIOCapability and SetPairingHandler. BlueZ keeps the keys, so that the
+// next connection to the device can be encrypted without pairing again.
+//
+// Pairing with a device that is already paired succeeds right away.
+func (d Device) Pair(ctx context.Context) error {
+	if err := d.adapter.registerAgent(); err != nil {
+		return err
+	}
+
+	call := d.device.Go("org.bluez.Device1.Pair", 0, nil)
+	var err error
+	select {
+	case <-call.Done:
+		err = call.Err
+	case <-ctx.Done():
+		d.device.Call("org.bluez.Device1.CancelPairing", 0)
+		err = ctx.Err()
+	}
+
+	var dbusErr dbus.Error
+	if errors.As(err, &dbusErr) && dbusErr.Name == "org.bluez.Error.AlreadyExists" {
+		err = nil
+	}
+
+	d.adapter.agent.mu.Lock()
+	handler := d.adapter.agent.pairingHandler
+	d.adapter.agent.mu.Unlock()
+	if handler.PairingComplete != nil {
+		handler.PairingComplete(d, err)
+	}
+
+	return err
+}
+
+// IsPaired returns whether BlueZ has paired with the device.
+func (d Device) IsPaired() (bool, error) {
+	paired, err := d.device.GetProperty("org.bluez.Device1.Paired")
+	if err != nil {
+		return false, err
+	}
+
+	value, _ := paired.Value().(bool)
+	return value, nil
+}
+
+// device returns the device that BlueZ asks the agent about.
+func (ag *agent) device(path dbus.ObjectPath) (Device, PairingHandler, *dbus.Error) {
+	ag.mu.Lock()
+	handler := ag.pairingHandler
+	ag.mu.Unlock()
+
+	device := Device{
+		device:  ag.adapter.bus.Object("org.bluez", path),
+		adapter: ag.adapter,
+	}
+	address, err := device.device.GetProperty("org.bluez.Device1.Address")
+	if err != nil {
+		return Device{}, handler, errAgentRejected
+	}
+	s, _ := address.Value().(string)
+	mac, err := ParseMAC(s)
+	if err != nil {
+		return Device{}, handler, errAgentRejected
+	}
+	device.Address = Address{MACAddress{MAC: mac}}
+	if typ, err := device.device.GetProperty("org.bluez.Device1.AddressType"); err == nil {
+		device.Address.SetRandom(typ.Value() == "random")
+	}
+
+	return device, handler, nil
+}
+
+// Release is called when BlueZ unregisters the agent.
+func (ag *agent) Release() *dbus.Error {
+	ag.mu.Lock()
+	ag.registered = false
+	ag.mu.Unlock()
+
+	return nil
+}
+
+// RequestPinCode is only used for pairing with Bluetooth Classic devices,
+// which is not supported.
+func (ag *agent) RequestPinCode(path dbus.ObjectPath) (string, *dbus.Error) {
+	return "", errAgentRejected
+}
+
+// DisplayPinCode is only used for pairing with Bluetooth Classic devices,
+// which is not supported.
+func (ag *agent) DisplayPinCode(path dbus.ObjectPath, pincode string) *dbus.Error {
+	return errAgentRejected
+}
+
+// RequestPasskey asks the user for the passkey shown by the other device.
+func (ag *agent) RequestPasskey(path dbus.ObjectPath) (uint32, *dbus.Error) {
+	device, handler, err := ag.device(path)
+	if err != nil {
+		return 0, err
+	}
+	if handler.RequestPasskey == nil {
+		return 0, errAgentRejected
+	}
+
+	passkey, ok := handler.RequestPasskey(device)
+	if !ok {
+		return 0, errAgentRejected
+	}
+
+	return passkey, nil
+}
+
+// DisplayPasskey shows the passkey the user must enter on the other device.
+// BlueZ calls it again for every digit the user types, which is ignored.
+func (ag *agent) DisplayPasskey(path dbus.ObjectPath, passkey uint32, entered uint16) *dbus.Error {
+	if entered != 0 {
+		return nil
+	}
+
+	device, handler, err := ag.device(path)
+	if err != nil {
+		return err
+	}
+	if handler.DisplayPasskey != nil {
+		handler.DisplayPasskey(device, passkey)
+	}
+
+	return nil
+}
+
+// RequestConfirmation asks the user whether the passkey matches the one shown
+// by the other device.
+func (ag *agent) RequestConfirmation(path dbus.ObjectPath, passkey uint32) *dbus.Error {
+	device, handler, err := ag.device(path)
+	if err != nil {
+		return err
+	}
+	if handler.ConfirmPasskey == nil || !handler.ConfirmPasskey(device, passkey) {
+		return errAgentRejected
+	}
+
+	return nil
+}
+
+// RequestAuthorization is called when a central starts pairing without a
+// passkey ("Just Works"), which is accepted.
+func (ag *agent) RequestAuthorization(path dbus.ObjectPath) *dbus.Error {
+	return nil
+}
+
+// AuthorizeService is called when a device connects to a Bluetooth Classic
+// profile, which is not supported. It is rejected so that the default agent
+// doesn't let other profiles on the system accept connections unasked.
+func (ag *agent) AuthorizeService(path dbus.ObjectPath, uuid string) *dbus.Error {
+	return errAgentRejected
+}
+
+// Cancel is called when BlueZ cancels a request, for example because the
+// device disconnected.
+func (ag *agent) Cancel() *dbus.Error {
+	return nil
+}
@@ -0,0 +1,439 @@
+//go:build !baremetal && !hci
+
+package bluetooth
+
+import (
+	"bufio"
+	"context"
+	"errors"
+	"fmt"
+	"os"
+	"os/exec"
+	"path/filepath"
+	"strconv"
+	"strings"
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/godbus/dbus/v5"
+	"github.com/godbus/dbus/v5/prop"
+)
+
+// startDBusDaemon starts a private message bus and returns its address.
+func startDBusDaemon(t *testing.T) string {
+	t.Helper()
+
+	path, err := exec.LookPath("dbus-daemon")
+	if err != nil {
+		t.Skip("dbus-daemon not found")
+	}
+
+	config := filepath.Join(t.TempDir(), "bus.conf")
+	err = os.WriteFile(config, []byte(`<!DOCTYPE busconfig PUBLIC "-//freedesktop//DTD D-Bus Bus Configuration 1.0//EN"
+ "http://www.freedesktop.org/standards/dbus/1.0/busconfig.dtd">
+<busconfig>
+  <listen>unix:dir=`+filepath.Dir(config)+`</listen>
+  <auth>EXTERNAL</auth>
+  <policy context="default">
+    <allow send_destination="*" eavesdrop="true"/>
+    <allow eavesdrop="true"/>
+    <allow own="*"/>
+  </policy>
+</busconfig>
+`), 0o644)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	cmd := exec.Command(path, "--config-file="+config, "--nofork", "--print-address")
+	stdout, err := cmd.StdoutPipe()
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err := cmd.Start(); err != nil {
+		t.Fatal("could not start dbus-daemon:", err)
+	}
+	t.Cleanup(func() {
+		cmd.Process.Kill()
+		cmd.Wait()
+	})
+
+	address, err := bufio.NewReader(stdout).ReadString('\n')
+	if err != nil {
+		t.Fatal("could not read bus address:", err)
+	}
+
+	return strings.TrimSpace(address)
+}
+
+// fakeBlueZ implements the parts of the BlueZ D-Bus API that are used for
+// pairing and GATT services, with a single adapter and device.
+type fakeBlueZ struct {
+	conn   *dbus.Conn
+	device *prop.Properties
+
+	mu         sync.Mutex
+	agent      dbus.BusObject
+	capability string
+	isDefault  bool
+	canceled   chan struct{}
+	removed    []dbus.ObjectPath
+	services   []dbus.BusObject // registered with GattManager1
+
+	// pair is called by Device1.Pair with the registered agent.
+	pair func(agent dbus.BusObject) *dbus.Error
+}
+
+const (
+	fakeAdapterPath = dbus.ObjectPath("/org/bluez/hci0")
+	fakeDevicePath  = dbus.ObjectPath("/org/bluez/hci0/dev_11_22_33_44_55_66")
+)
+
+func newFakeBlueZ(t *testing.T, address string) *fakeBlueZ {
+	t.Helper()
+
+	conn, err := dbus.Connect(address)
+	if err != nil {
+		t.Fatal("could not connect to bus:", err)
+	}
+	t.Cleanup(func() {
+		conn.Close()
+	})
+
+	b := &fakeBlueZ{conn: conn}
+	if _, err := prop.Export(conn, fakeAdapterPath, prop.Map{
+		"org.bluez.Adapter1": {
+			"Address": {Value: "00:11:22:33:44:55"},
+		},
+	}); err != nil {
+		t.Fatal(err)
+	}
+	b.device, err = prop.Export(conn, fakeDevicePath, prop.Map{
+		"org.bluez.Device1": {
+			"Address":     {Value: "11:22:33:44:55:66"},
+			"AddressType": {Value: "random"},
+			"Connected":   {Value: true},
+			"Paired":      {Value: false, Writable: true},
+		},
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+	for _, export := range []struct {
+		v     interface{}
+		path  dbus.ObjectPath
+		iface string
+	}{
+		{fakeAgentManager{b}, "/org/bluez", "org.bluez.AgentManager1"},
+		{fakeAdapter{b}, fakeAdapterPath, "org.bluez.Adapter1"},
+		{fakeGattManager{b}, fakeAdapterPath, "org.bluez.GattManager1"},
+		{fakeDevice{b}, fakeDevicePath, "org.bluez.Device1"},
+	} {
+		if err := conn.Export(export.v, export.path, export.iface); err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	reply, err := conn.RequestName("org.bluez", dbus.NameFlagDoNotQueue)
+	if err != nil || reply != dbus.RequestNameReplyPrimaryOwner {
+		t.Fatal("could not own bus name:", err)
+	}
+
+	return b
+}
+
+type fakeAgentManager struct{ *fakeBlueZ }
+
+func (m fakeAgentManager) RegisterAgent(sender dbus.Sender, path dbus.ObjectPath, capability string) *dbus.Error {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+
+	if m.agent != nil {
+		return dbus.NewError("org.bluez.Error.AlreadyExists", nil)
+	}
+	m.agent = m.conn.Object(string(sender), path)
+	m.capability = capability
+	m.isDefault = false
+	return nil
+}
+
+func (m fakeAgentManager) UnregisterAgent(path dbus.ObjectPath) *dbus.Error {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+
+	if m.agent == nil || m.agent.Path() != path {
+		return dbus.NewError("org.bluez.Error.DoesNotExist", nil)
+	}
+	m.agent = nil
+	return nil
+}
+
+func (m fakeAgentManager) RequestDefaultAgent(path dbus.ObjectPath) *dbus.Error {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+
+	if m.agent == nil || m.agent.Path() != path {
+		return dbus.NewError("org.bluez.Error.DoesNotExist", nil)
+	}
+	m.isDefault = true
+	return nil
+}
+
+type fakeAdapter struct{ *fakeBlueZ }
+
+func (a fakeAdapter) RemoveDevice(path dbus.ObjectPath) *dbus.Error {
+	a.mu.Lock()
+	defer a.mu.Unlock()
+
+	a.removed = append(a.removed, path)
+	return nil
+}
+
+type fakeGattManager struct{ *fakeBlueZ }
+
+func (m fakeGattManager) RegisterApplication(sender dbus.Sender, path dbus.ObjectPath, options map[string]dbus.Variant) *dbus.Error {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+
+	m.services = append(m.services, m.conn.Object(string(sender), path))
+	return nil
+}
+
+type fakeDevice struct{ *fakeBlueZ }
+
+func (d fakeDevice) Pair() *dbus.Error {
+	d.mu.Lock()
+	agent, pair := d.agent, d.pair
+	if agent == nil || !d.isDefault {
+		agent = nil
+	}
+	d.mu.Unlock()
+
+	if agent == nil {
+		return dbus.NewError("org.bluez.Error.AuthenticationFailed", nil)
+	}
+	if err := pair(agent); err != nil {
+		return err
+	}
+
+	d.device.SetMust("org.bluez.Device1", "Paired", true)
+	return nil
+}
+
+func (d fakeDevice) CancelPairing() *dbus.Error {
+	d.mu.Lock()
+	defer d.mu.Unlock()
+
+	if d.canceled != nil {
+		close(d.canceled)
+		d.canceled = nil
+	}
+	return nil
+}
+
+func TestBlueZPairing(t *testing.T) {
+	address := startDBusDaemon(t)
+	fake := newFakeBlueZ(t, address)
+
+	t.Setenv("DBUS_SYSTEM_BUS_ADDRESS", address)
+	adapter := &Adapter{id: "hci0"}
+	if err := adapter.Enable(); err != nil {
+		t.Fatal("could not enable adapter:", err)
+	}
+	t.Cleanup(func() {
+		adapter.bus.Close()
+	})
+
+	device, err := adapter.Connect(Address{MACAddress{MAC: MAC{0x66, 0x55, 0x44, 0x33, 0x22, 0x11}}}, ConnectionParams{})
+	if err != nil {
+		t.Fatal("could not connect:", err)
+	}
+
+	// The handler records what the agent was asked.
+	var (
+		mu       sync.Mutex
+		events   []string
+		complete error
+	)
+	record := func(device Device, event string) {
+		mu.Lock()
+		defer mu.Unlock()
+		if device.Address.MAC.String() != "11:22:33:44:55:66" || !device.Address.IsRandom() {
+			t.Errorf("unexpected device %s", device.Address.MAC)
+		}
+		events = append(events, event)
+	}
+	confirm := true
+	adapter.SetPairingHandler(PairingHandler{
+		DisplayPasskey: func(device Device, passkey uint32) {
+			record(device, "display "+formatPasskey(passkey))
+		},
+		RequestPasskey: func(device Device) (uint32, bool) {
+			record(device, "request")
+			return 999999, confirm
+		},
+		ConfirmPasskey: func(device Device, passkey uint32) bool {
+			record(device, "confirm "+formatPasskey(passkey))
+			return confirm
+		},
+		PairingComplete: func(device Device, err error) {
+			mu.Lock()
+			complete = err
+			mu.Unlock()
+		},
+	})
+
+	for _, tc := range []struct {
+		name       string
+		capability IOCapability
+		confirm    bool
+		pair       func(agent dbus.BusObject) *dbus.Error
+		events     []string
+		err        string
+	}{
+		{
+			name:       "confirmation",
+			capability: IOCapabilityDisplayYesNo,
+			confirm:    true,
+			pair: func(agent dbus.BusObject) *dbus.Error {
+				if err := agent.Call("org.bluez.Agent1.RequestConfirmation", 0, fakeDevicePath, uint32(123456)).Err; err != nil {
+					return dbus.NewError("org.bluez.Error.AuthenticationRejected", nil)
+				}
+				return nil
+			},
+			events: []string{"confirm 123456"},
+		},
+		{
+			name:       "rejected",
+			capability: IOCapabilityDisplayYesNo,
+			confirm:    false,
+			pair: func(agent dbus.BusObject) *dbus.Error {
+				if err := agent.Call("org.bluez.Agent1.RequestConfirmation", 0, fakeDevicePath, uint32(42)).Err; err != nil {
+					return dbus.NewError("org.bluez.Error.AuthenticationRejected", nil)
+				}
+				return nil
+			},
+			events: []string{"confirm 000042"},
+			err:    "org.bluez.Error.AuthenticationRejected",
+		},
+		{
+			name:       "passkey",
+			capability: IOCapabilityKeyboardDisplay,
+			confirm:    true,
+			pair: func(agent dbus.BusObject) *dbus.Error {
+				var passkey uint32
+				if err := agent.Call("org.bluez.Agent1.RequestPasskey", 0, fakeDevicePath).Store(&passkey); err != nil || passkey != 999999 {
+					return dbus.NewError("org.bluez.Error.AuthenticationFailed", nil)
+				}
+				return nil
+			},
+			events: []string{"request"},
+		},
+		{
+			name:       "display",
+			capability: IOCapabilityDisplayOnly,
+			pair: func(agent dbus.BusObject) *dbus.Error {
+				// Called again for every digit that is entered.
+				for entered := uint16(0); entered < 3; entered++ {
+					if err := agent.Call("org.bluez.Agent1.DisplayPasskey", 0, fakeDevicePath, uint32(654321), entered).Err; err != nil {
+						return dbus.NewError("org.bluez.Error.AuthenticationFailed", nil)
+					}
+				}
+				return nil
+			},
+			events: []string{"display 654321"},
+		},
+		{
+			name:       "already paired",
+			capability: IOCapabilityNoInputNoOutput,
+			pair: func(agent dbus.BusObject) *dbus.Error {
+				return dbus.NewError("org.bluez.Error.AlreadyExists", nil)
+			},
+		},
+	} {
+		t.Run(tc.name, func(t *testing.T) {
+			mu.Lock()
+			events, complete, confirm = nil, errors.New("not called"), tc.confirm
+			mu.Unlock()
+			fake.mu.Lock()
+			fake.pair = tc.pair
+			fake.mu.Unlock()
+			fake.device.SetMust("org.bluez.Device1", "Paired", false)
+
+			adapter.SetIOCapability(tc.capability)
+			fake.mu.Lock()
+			capability := fake.capability
+			fake.mu.Unlock()
+			if capability != agentCapabilities[tc.capability] {
+				t.Errorf("expected agent capability %s, got %s", agentCapabilities[tc.capability], capability)
+			}
+
+			ctx, cancel := context.WithTimeout(context.Background(), 5*time.Second)
+			err := device.Pair(ctx)
+			cancel()
+			var dbusErr dbus.Error
+			switch {
+			case tc.err == "" && err != nil:
+				t.Fatal("could not pair:", err)
+			case tc.err != "" && (!errors.As(err, &dbusErr) || dbusErr.Name != tc.err):
+				t.Fatalf("expected error %s, got %v", tc.err, err)
+			}
+
+			mu.Lock()
+			if strings.Join(events, ", ") != strings.Join(tc.events, ", ") {
+				t.Errorf("expected agent requests %q, got %q", tc.events, events)
+			}
+			if fmt.Sprint(complete) != fmt.Sprint(err) {
+				t.Errorf("expected PairingComplete with %v, got %v", err, complete)
+			}
+			mu.Unlock()
+
+			paired, err := device.IsPaired()
+			if err != nil {
+				t.Fatal("could not read paired state:", err)
+			}
+			if paired != (tc.err == "" && tc.name != "already paired") {
+				t.Errorf("unexpected paired state %t", paired)
+			}
+		})
+	}
+
+	t.Run("cancel", func(t *testing.T) {
+		canceled := make(chan struct{})
+		fake.mu.Lock()
+		fake.canceled = canceled
+		fake.pair = func(agent dbus.BusObject) *dbus.Error {
+			<-canceled
+			return dbus.NewError("org.bluez.Error.AuthenticationCanceled", nil)
+		}
+		fake.mu.Unlock()
+
+		ctx, cancel := context.WithTimeout(context.Background(), 100*time.Millisecond)
+		defer cancel()
+		if err := device.Pair(ctx); err != context.DeadlineExceeded {
+			t.Errorf("expected deadline exceeded, got %v", err)
+		}
+		select {
+		case <-canceled:
+		case <-time.After(5 * time.Second):
+			t.Error("pairing was not canceled")
+		}
+	})
+
+	t.Run("remove", func(t *testing.T) {
+		if err := adapter.RemoveDevice(device.Address); err != nil {
+			t.Fatal("could not remove device:", err)
+		}
+		fake.mu.Lock()
+		defer fake.mu.Unlock()
+		if len(fake.removed) != 1 || fake.removed[0] != fakeDevicePath {
+			t.Errorf("unexpected removed devices: %v", fake.removed)
+		}
+	})
+}
+
+func formatPasskey(passkey uint32) string {
+	s := "000000" + strconv.Itoa(int(passkey))
+	return s[len(s)-6:]
+}
@@ -0,0 +1,409 @@
+//go:build (softdevice && s113v7) || (softdevice && s132v6) || (softdevice && s140v6) || (softdevice && s140v7)
+
+package bluetooth
+
+// This file implements bonding with the SoftDevice. Pairing uses LE legacy
+// pairing without user interaction ("Just Works"), the keys are kept in the
+// bond store of the adapter. With privacy enabled, the SoftDevice generates
+// and rotates the resolvable private address itself.
+
+import "time"
+
+/*
+#include "ble_gap.h"
+*/
+import "C"
+
+// securityConnection is the peer of a connection, which is needed to store
+// the keys once pairing has finished.
+type securityConnection struct {
+	handle  C.uint16_t
+	address MACAddress
+	central bool // the local device is the central
+}
+
+// Connections that may be paired, at most one per link.
+var securityConnections [4]securityConnection
+
+// Keys exchanged during pairing, which the SoftDevice fills in until pairing
+// has finished.
+var securityKeys struct {
+	own     C.ble_gap_enc_key_t
+	peerEnc C.ble_gap_enc_key_t
+	peerID  C.ble_gap_id_key_t
+	peerSig C.ble_gap_sign_info_t
+	keyset  C.ble_gap_sec_keyset_t
+}
+
+// Identities of the bonded devices that sent their IRK. The SoftDevice resolves
+// the private addresses of these devices itself, and reports their identity
+// address instead.
+var bondIdentities struct {
+	keys  [8]C.ble_gap_id_key_t // BLE_GAP_DEVICE_IDENTITIES_MAX_COUNT
+	ptrs  [8]*C.ble_gap_id_key_t
+	count int
+}
+
+func init() {
+	for i := range securityConnections {
+		securityConnections[i].handle = C.BLE_CONN_HANDLE_INVALID
+	}
+}
+
+// SetBondStore sets the store that keeps the keys of paired devices. The
+// default is a MemoryBondStore. The store is used from the SoftDevice event
+// handler, see BondStore.
+func (a *Adapter) SetBondStore(store BondStore) {
+	mask := DisableInterrupts()
+	defer RestoreInterrupts(mask)
+
+	a.bondStore = store
+
+	var enabled C.uint8_t
+	C.sd_softdevice_is_enabled(&enabled)
+	if enabled != 0 {
+		err := loadBondIdentities(store)
+		if err != nil && debug {
+			println("could not set device identities:", err.Error())
+		}
+	}
+}
+
+// Bonds returns the bonds with the devices this adapter has paired with.
+func (a *Adapter) Bonds() ([]Bond, error) {
+	mask := DisableInterrupts()
+	defer RestoreInterrupts(mask)
+
+	return a.bondStore.Bonds()
+}
+
+// DeleteBond forgets the keys of the device with the given identity address,
+// so that it must pair again.
+func (a *Adapter) DeleteBond(address MACAddress) error {
+	mask := DisableInterrupts()
+	defer RestoreInterrupts(mask)
+
+	if err := a.bondStore.DeleteBond(address); err != nil {
+		return err
+	}
+
+	// A stale identity is harmless: the address is resolved, but there is no
+	// bond with it.
+	if i := findBondIdentity(address); i >= 0 {
+		bondIdentities.count--
+		bondIdentities.keys[i] = bondIdentities.keys[bondIdentities.count]
+		setBondIdentities()
+	}
+	return nil
+}
+
+// loadBondIdentities fills the device identity list of the SoftDevice with the
+// bonds in the store. It is called once the SoftDevice is enabled.
+func loadBondIdentities(store BondStore) error {
+	mask := DisableInterrupts()
+	defer RestoreInterrupts(mask)
+
+	bondIdentities.count = 0
+	if store != nil {
+		bonds, err := store.Bonds()
+		if err != nil {
+			return err
+		}
+		for _, bond := range bonds {
+			addBondIdentity(bond)
+		}
+	}
+	return setBondIdentities()
+}
+
+// addBondIdentity adds the identity of a bond to the list, or replaces the
+// identity with the same address. It doesn't allocate memory, so it can be
+// used from the event handler. Bonds without an IRK are skipped, as are bonds
+// that don't fit anymore.
+func addBondIdentity(bond Bond) {
+	if bond.IRK == ([16]byte{}) {
+		return
+	}
+	i := findBondIdentity(bond.Address)
+	if i < 0 {
+		if bondIdentities.count == len(bondIdentities.keys) {
+			return
+		}
+		i = bondIdentities.count
+		bondIdentities.count++
+	}
+
+	key := &bondIdentities.keys[i]
+	for j := range key.id_info.irk {
+		key.id_info.irk[j] = C.uint8_t(bond.IRK[j])
+	}
+	key.id_addr_info = C.ble_gap_addr_t{}
+	key.id_addr_info.addr = makeSDAddress(bond.Address.MAC)
+	if bond.Address.IsRandom() {
+		key.id_addr_info.set_bitfield_addr_type(C.BLE_GAP_ADDR_TYPE_RANDOM_STATIC)
+	} else {
+		key.id_addr_info.set_bitfield_addr_type(C.BLE_GAP_ADDR_TYPE_PUBLIC)
+	}
+}
+
+func findBondIdentity(address MACAddress) int {
+	for i := 0; i < bondIdentities.count; i++ {
+		key := &bondIdentities.keys[i]
+		if makeMACAddress(key.id_addr_info) == address {
+			return i
+		}
+	}
+
+	return -1
+}
+
+// setBondIdentities passes the identity list to the SoftDevice. The local IRK
+// is the one set with EnablePrivacy, or the default IRK of the SoftDevice.
+func setBondIdentities() error {
+	if bondIdentities.count == 0 {
+		return makeError(C.sd_ble_gap_device_identities_set(nil, nil, 0))
+	}
+	for i := 0; i < bondIdentities.count; i++ {
+		bondIdentities.ptrs[i] = &bondIdentities.keys[i]
+	}
+	return makeError(C.sd_ble_gap_device_identities_set(&bondIdentities.ptrs[0], nil, C.uint8_t(bondIdentities.count)))
+}
+
+// Privacy settings, passed to the SoftDevice.
+var (
+	privacyEnabled bool
+	privacyIRK     C.ble_gap_irk_t
+)
+
+// EnablePrivacy makes the adapter use a resolvable private address instead of
+// its public address. The address is generated from the IRK and changes every
+// interval, or every 15 minutes if the interval is zero, so that only devices
+// that have bonded with the adapter can recognize it. The IRK and the public
+// address are distributed to devices during pairing.
+//
+// The SoftDevice doesn't allow changing privacy while advertising, scanning or
+// connecting.
+func (a *Adapter) EnablePrivacy(irk [16]byte, interval time.Duration) error {
+	if interval == 0 {
+		interval = 15 * time.Minute
+	}
+	seconds := interval / time.Second
+	if seconds > 0xffff {
+		seconds = 0xffff
+	}
+	if seconds == 0 {
+		seconds = 1
+	}
+
+	for i := range privacyIRK.irk {
+		privacyIRK.irk[i] = C.uint8_t(irk[i])
+	}
+	params := C.ble_gap_privacy_params_t{
+		privacy_mode:         C.BLE_GAP_PRIVACY_MODE_DEVICE_PRIVACY,
+		private_addr_type:    C.BLE_GAP_ADDR_TYPE_RANDOM_PRIVATE_RESOLVABLE,
+		private_addr_cycle_s: C.uint16_t(seconds),
+		p_device_irk:         &privacyIRK,
+	}
+	if err := makeError(C.sd_ble_gap_privacy_set(&params)); err != nil {
+		return err
+	}
+
+	privacyEnabled = true
+	return nil
+}
+
+// identityAddress returns the identity address of a device that uses a
+// resolvable private address, if it is bonded and has sent its IRK.
+func (a *Adapter) identityAddress(address MACAddress) (Address, bool) {
+	if address.Type() != AddressResolvablePrivate {
+		return Address{}, false
+	}
+
+	mask := DisableInterrupts()
+	defer RestoreInterrupts(mask)
+
+	bond, ok := resolveBond(a.bondStore, address)
+	if !ok || bond.Address == address {
+		return Address{}, false
+	}
+
+	return Address{bond.Address}, true
+}
+
+// securityConnected remembers the peer of a new connection.
+func securityConnected(handle C.uint16_t, address MACAddress, central bool) {
+	for i := range securityConnections {
+		if securityConnections[i].handle == C.BLE_CONN_HANDLE_INVALID {
+			securityConnections[i] = securityConnection{handle, address, central}
+			return
+		}
+	}
+}
+
+// securityDisconnected forgets the peer of a closed connection.
+func securityDisconnected(handle C.uint16_t) {
+	if c := findSecurityConnection(handle); c != nil {
+		c.handle = C.BLE_CONN_HANDLE_INVALID
+	}
+}
+
+func findSecurityConnection(handle C.uint16_t) *securityConnection {
+	for i := range securityConnections {
+		if securityConnections[i].handle == handle {
+			return &securityConnections[i]
+		}
+	}
+
+	return nil
+}
+
+// makeSecParams returns the pairing parameters: bonding without user
+// interaction. The peripheral distributes an LTK, the central only its
+// identity.
+func makeSecParams(central bool) C.ble_gap_sec_params_t {
+	var params C.ble_gap_sec_params_t
+	params.set_bitfield_bond(1)
+	params.set_bitfield_io_caps(C.BLE_GAP_IO_CAPS_NONE)
+	params.min_key_size = 7
+	params.max_key_size = 16
+	if central {
+		params.kdist_peer.set_bitfield_enc(1)
+	} else {
+		params.kdist_own.set_bitfield_enc(1)
+	}
+	if privacyEnabled {
+		// The SoftDevice distributes the IRK set with EnablePrivacy.
+		params.kdist_own.set_bitfield_id(1)
+	}
+	params.kdist_peer.set_bitfield_id(1)
+	params.kdist_peer.set_bitfield_sign(1)
+	return params
+}
+
+// handleSecParamsRequest answers the request of the SoftDevice to pair.
+func handleSecParamsRequest(handle C.uint16_t) {
+	c := findSecurityConnection(handle)
+	if c == nil || DefaultAdapter.bondStore == nil {
+		C.sd_ble_gap_sec_params_reply(handle, C.BLE_GAP_SEC_STATUS_PAIRING_NOT_SUPP, nil, nil)
+		return
+	}
+
+	securityKeys.own = C.ble_gap_enc_key_t{}
+	securityKeys.peerEnc = C.ble_gap_enc_key_t{}
+	securityKeys.peerID = C.ble_gap_id_key_t{}
+	securityKeys.peerSig = C.ble_gap_sign_info_t{}
+	securityKeys.keyset.keys_own.p_enc_key = &securityKeys.own
+	securityKeys.keyset.keys_peer.p_enc_key = &securityKeys.peerEnc
+	securityKeys.keyset.keys_peer.p_id_key = &securityKeys.peerID
+	securityKeys.keyset.keys_peer.p_sign_key = &securityKeys.peerSig
+
+	if c.central {
+		// The parameters were passed when the central started pairing.
+		C.sd_ble_gap_sec_params_reply(handle, C.BLE_GAP_SEC_STATUS_SUCCESS, nil, &securityKeys.keyset)
+		return
+	}
+	params := makeSecParams(false)
+	C.sd_ble_gap_sec_params_reply(handle, C.BLE_GAP_SEC_STATUS_SUCCESS, &params, &securityKeys.keyset)
+}
+
+// handleSecInfoRequest looks up the key a central encrypts the connection
+// with. A central that uses a private address was resolved to its identity
+// address when it connected, if it is in the device identity list.
+func handleSecInfoRequest(handle C.uint16_t, request *C.ble_gap_evt_sec_info_request_t) {
+	var bond Bond
+	ok := false
+	if DefaultAdapter.bondStore != nil {
+		address := makeMACAddress(request.peer_addr)
+		if c := findSecurityConnection(handle); c != nil {
+			address = c.address
+		}
+		bond, ok = DefaultAdapter.bondStore.Bond(address)
+	}
+	if !ok || request.bitfield_enc_info() == 0 ||
+		uint16(request.master_id.ediv) != bond.EDIV || makeRand(request.master_id) != bond.Rand {
+		C.sd_ble_gap_sec_info_reply(handle, nil, nil, nil)
+		return
+	}
+
+	info := makeEncInfo(bond)
+	C.sd_ble_gap_sec_info_reply(handle, &info, nil, nil)
+}
+
+// handleAuthStatus saves the keys of a new bond.
+func handleAuthStatus(handle C.uint16_t, status *C.ble_gap_evt_auth_status_t) {
+	c := findSecurityConnection(handle)
+	if c == nil || DefaultAdapter.bondStore == nil ||
+		status.auth_status != C.BLE_GAP_SEC_STATUS_SUCCESS || status.bitfield_bonded() == 0 {
+		return
+	}
+
+	bond := Bond{
+		Address:           c.address,
+		Authenticated:     status.sm1_levels.bitfield_lv3() != 0 || status.sm1_levels.bitfield_lv4() != 0,
+		SecureConnections: status.bitfield_lesc() != 0,
+	}
+
+	// The key distributed by the peripheral is used, or the key both devices
+	// generated with LE Secure Connections.
+	enc := &securityKeys.own
+	if c.central && !bond.SecureConnections {
+		enc = &securityKeys.peerEnc
+	}
+	for i := range bond.LTK {
+		bond.LTK[i] = byte(enc.enc_info.ltk[i])
+	}
+	bond.EDIV = uint16(enc.master_id.ediv)
+	bond.Rand = makeRand(enc.master_id)
+
+	if status.kdist_peer.bitfield_id() != 0 {
+		for i := range bond.IRK {
+			bond.IRK[i] = byte(securityKeys.peerID.id_info.irk[i])
+		}
+		bond.Address = makeMACAddress(securityKeys.peerID.id_addr_info)
+	}
+	if status.kdist_peer.bitfield_sign() != 0 {
+		for i := range bond.CSRK {
+			bond.CSRK[i] = byte(securityKeys.peerSig.csrk[i])
+		}
+	}
+
+	err := DefaultAdapter.bondStore.SaveBond(bond)
+	if err != nil {
+		if debug {
+			println("could not save bond:", err.Error())
+		}
+		return
+	}
+
+	// Resolve the private addresses of the device from now on.
+	addBondIdentity(bond)
+	err = setBondIdentities()
+	if err != nil && debug {
+		println("could not set device identities:", err.Error())
+	}
+}
+
+// makeEncInfo returns the encryption information of a bond.
+func makeEncInfo(bond Bond) C.ble_gap_enc_info_t {
+	var info C.ble_gap_enc_info_t
+	for i := range info.ltk {
+		info.ltk[i] = C.uint8_t(bond.LTK[i])
+	}
+	info.set_bitfield_ltk_len(16)
+	if bond.Authenticated {
+		info.set_bitfield_auth(1)
+	}
+	if bond.SecureConnections {
+		info.set_bitfield_lesc(1)
+	}
+	return info
+}
+
+// makeRand returns the Rand value of a master identification.
+func makeRand(id C.ble_gap_master_id_t) uint64 {
+	var rand uint64
+	for i := len(id.rand) - 1; i >= 0; i-- {
+		rand = rand<<8 | uint64(id.rand[i])
+	}
+	return rand
+}
@@ -0,0 +1,177 @@
+//go:build hci || ninafw
+
+package bluetooth
+
+import (
+	"crypto/aes"
+	"encoding/binary"
+)
+
+// This file implements the cryptographic toolbox of the Security Manager, see
+// Bluetooth Core Specification Vol 3, Part H, section 2.2. All values are in
+// the most significant octet first order used by the specification, which is
+// the reverse of the order in which they are sent over the air.
+
+// smpE is the security function e: AES-128 encryption of a single block.
+func smpE(key, plaintext [16]byte) (result [16]byte) {
+	block, _ := aes.NewCipher(key[:])
+	block.Encrypt(result[:], plaintext[:])
+	return
+}
+
+// aesCMAC computes the AES-CMAC message authentication code of RFC 4493.
+func aesCMAC(key [16]byte, msg []byte) (mac [16]byte) {
+	block, _ := aes.NewCipher(key[:])
+
+	// Derive the subkeys.
+	var k1, k2 [16]byte
+	block.Encrypt(k1[:], k1[:])
+	k1 = cmacSubkey(k1)
+	k2 = cmacSubkey(k1)
+
+	// The last block is either complete and xored with k1, or padded and
+	// xored with k2.
+	n := (len(msg) + 15) / 16
+	var last [16]byte
+	if n > 0 && len(msg)%16 == 0 {
+		copy(last[:], msg[(n-1)*16:])
+		xorBlock(&last, &k1)
+	} else {
+		if n == 0 {
+			n = 1
+		}
+		rest := copy(last[:], msg[(n-1)*16:])
+		last[rest] = 0x80
+		xorBlock(&last, &k2)
+	}
+
+	for i := 0; i < n-1; i++ {
+		for j := 0; j < 16; j++ {
+			mac[j] ^= msg[i*16+j]
+		}
+		block.Encrypt(mac[:], mac[:])
+	}
+	xorBlock(&mac, &last)
+	block.Encrypt(mac[:], mac[:])
+
+	return
+}
+
+// cmacSubkey shifts the block one bit to the left, and applies the constant
+// Rb when the most significant bit was shifted out.
+func cmacSubkey(in [16]byte) (out [16]byte) {
+	for i := 0; i < 15; i++ {
+		out[i] = in[i]<<1 | in[i+1]>>7
+	}
+	out[15] = in[15] << 1
+	if in[0]&0x80 != 0 {
+		out[15] ^= 0x87
+	}
+	return
+}
+
+func xorBlock(dst, src *[16]byte) {
+	for i := range dst {
+		dst[i] ^= src[i]
+	}
+}
+
+// smpC1 is the confirm value generation function c1 of LE legacy pairing. The
+// pairing request and response are the 7 octet PDUs, with the opcode as the
+// least significant octet.
+func smpC1(k, r [16]byte, preq, pres [7]byte, iat, rat uint8, ia, ra [6]byte) [16]byte {
+	var p1, p2 [16]byte
+	copy(p1[0:], pres[:])
+	copy(p1[7:], preq[:])
+	p1[14] = rat
+	p1[15] = iat
+	copy(p2[4:], ia[:])
+	copy(p2[10:], ra[:])
+
+	xorBlock(&r, &p1)
+	result := smpE(k, r)
+	xorBlock(&result, &p2)
+	return smpE(k, result)
+}
+
+// smpS1 is the key generation function s1 of LE legacy pairing, which
+// generates the STK.
+func smpS1(k, r1, r2 [16]byte) [16]byte {
+	var r [16]byte
+	copy(r[0:], r1[8:])
+	copy(r[8:], r2[8:])
+	return smpE(k, r)
+}
+
+// smpF4 is the confirm value generation function f4 of LE Secure Connections.
+func smpF4(u, v [32]byte, x [16]byte, z uint8) [16]byte {
+	var m [65]byte
+	copy(m[0:], u[:])
+	copy(m[32:], v[:])
+	m[64] = z
+	return aesCMAC(x, m[:])
+}
+
+// smpF5Salt is the key of the first step of f5.
+var smpF5Salt = [16]byte{0x6c, 0x88, 0x83, 0x91, 0xaa, 0xf5, 0xa5, 0x38, 0x60, 0x37, 0x0b, 0xdb, 0x5a, 0x60, 0x83, 0xbe}
+
+// smpF5 is the key generation function f5 of LE Secure Connections, which
+// generates the MacKey and the LTK from the DHKey. Addresses are 7 octets: the
+// address type followed by the address.
+func smpF5(w [32]byte, n1, n2 [16]byte, a1, a2 [7]byte) (macKey, ltk [16]byte) {
+	t := aesCMAC(smpF5Salt, w[:])
+
+	var m [53]byte
+	copy(m[1:], "btle")
+	copy(m[5:], n1[:])
+	copy(m[21:], n2[:])
+	copy(m[37:], a1[:])
+	copy(m[44:], a2[:])
+	binary.BigEndian.PutUint16(m[51:], 256)
+
+	m[0] = 0
+	macKey = aesCMAC(t, m[:])
+	m[0] = 1
+	ltk = aesCMAC(t, m[:])
+	return
+}
+
+// smpF6 is the check value generation function f6 of LE Secure Connections.
+// ioCap is AuthReq, OOB data flag and IO capability, in that order.
+func smpF6(w, n1, n2, r [16]byte, ioCap [3]byte, a1, a2 [7]byte) [16]byte {
+	var m [65]byte
+	copy(m[0:], n1[:])
+	copy(m[16:], n2[:])
+	copy(m[32:], r[:])
+	copy(m[48:], ioCap[:])
+	copy(m[51:], a1[:])
+	copy(m[58:], a2[:])
+	return aesCMAC(w, m[:])
+}
+
+// smpG2 is the numeric comparison value generation function g2 of LE Secure
+// Connections. The six digit number to show is the result modulo 1000000.
+func smpG2(u, v [32]byte, x, y [16]byte) uint32 {
+	var m [80]byte
+	copy(m[0:], u[:])
+	copy(m[32:], v[:])
+	copy(m[64:], y[:])
+	mac := aesCMAC(x, m[:])
+	return binary.BigEndian.Uint32(mac[12:])
+}
+
+// smpSign computes the signature of a signed write, see Vol 3, Part H, section
+// 2.4.5. The message and the CSRK are in the order of PDUs, and so is the
+// result: the sign counter followed by the 64 most significant bits of the
+// MAC.
+func smpSign(csrk [16]byte, m []byte, counter uint32) (signature [12]byte) {
+	msg := make([]byte, len(m)+4)
+	copy(msg, m)
+	binary.LittleEndian.PutUint32(msg[len(m):], counter)
+	swapBytes(msg, append([]byte{}, msg...))
+
+	mac := aesCMAC(reverseKey(csrk), msg)
+	binary.LittleEndian.PutUint32(signature[:], counter)
+	swapBytes(signature[4:], mac[:8])
+	return
+}
@@ -0,0 +1,124 @@
+//go:build hci && !baremetal
+
+package bluetooth
+
+import (
+	"encoding/hex"
+	"strings"
+	"testing"
+)
+
+// fromHex decodes sample data from the specification, which may contain
+// spaces between groups of digits.
+func fromHex(t *testing.T, dst []byte, s string) {
+	t.Helper()
+
+	b, err := hex.DecodeString(strings.ReplaceAll(s, " ", ""))
+	if err != nil || len(b) != len(dst) {
+		t.Fatalf("invalid test data %q", s)
+	}
+	copy(dst, b)
+}
+
+func TestAESCMAC(t *testing.T) {
+	// Test vectors from RFC 4493.
+	var key [16]byte
+	fromHex(t, key[:], "2b7e1516 28aed2a6 abf71588 09cf4f3c")
+	msg := make([]byte, 64)
+	fromHex(t, msg, "6bc1bee2 2e409f96 e93d7e11 7393172a ae2d8a57 1e03ac9c 9eb76fac 45af8e51"+
+		"30c81c46 a35ce411 e5fbc119 1a0a52ef f69f2445 df4f9b17 ad2b417b e66c3710")
+
+	for _, tc := range []struct {
+		length int
+		mac    string
+	}{
+		{0, "bb1d6929 e9593728 7fa37d12 9b756746"},
+		{16, "070a16b4 6b4d4144 f79bdd9d d04a287c"},
+		{40, "dfa66747 de9ae630 30ca3261 1497c827"},
+		{64, "51f0bebf 7e3b9d92 fc497417 79363cfe"},
+	} {
+		var expected [16]byte
+		fromHex(t, expected[:], tc.mac)
+		if mac := aesCMAC(key, msg[:tc.length]); mac != expected {
+			t.Errorf("length %d: expected %x, got %x", tc.length, expected, mac)
+		}
+	}
+}
+
+func TestSMPLegacyFunctions(t *testing.T) {
+	// Sample data from Vol 3, Part H, section 2.2.3 and 2.2.4.
+	var k, r, expected [16]byte
+	var preq, pres [7]byte
+	var ia, ra [6]byte
+	fromHex(t, r[:], "5783D521 56AD6F0E 6388274E C6702EE0")
+	fromHex(t, preq[:], "07071000 000101")
+	fromHex(t, pres[:], "05000800 000302")
+	fromHex(t, ia[:], "A1A2A3A4 A5A6")
+	fromHex(t, ra[:], "B1B2B3B4 B5B6")
+	fromHex(t, expected[:], "1e1e3fef 878988ea d2a74dc5 bef13b86")
+	if c1 := smpC1(k, r, preq, pres, 1, 0, ia, ra); c1 != expected {
+		t.Errorf("c1: expected %x, got %x", expected, c1)
+	}
+
+	var r1, r2 [16]byte
+	fromHex(t, r1[:], "000F0E0D 0C0B0A09 11223344 55667788")
+	fromHex(t, r2[:], "01020304 05060708 99AABBCC DDEEFF00")
+	fromHex(t, expected[:], "9a1fe1f0 e8b0f49b 5b4216ae 796da062")
+	if s1 := smpS1(k, r1, r2); s1 != expected {
+		t.Errorf("s1: expected %x, got %x", expected, s1)
+	}
+}
+
+func TestSMPSecureConnectionsFunctions(t *testing.T) {
+	// Sample data from Vol 3, Part H, appendix D.
+	var u, v, w [32]byte
+	var x, y, r, expected [16]byte
+	var a1, a2 [7]byte
+	fromHex(t, u[:], "20b003d2 f297be2c 5e2c83a7 e9f9a5b9 eff49111 acf4fddb cc030148 0e359de6")
+	fromHex(t, v[:], "55188b3d 32f6bb9a 900afcfb eed4e72a 59cb9ac2 f19d7cfb 6b4fdd49 f47fc5fd")
+	fromHex(t, x[:], "d5cb8454 d177733e ffffb2ec 712baeab")
+	fromHex(t, y[:], "a6e8e7cc 25a75f6e 216583f7 ff3dc4cf")
+
+	fromHex(t, expected[:], "f2c916f1 07a9bd1c f1eda1be a974872d")
+	if f4 := smpF4(u, v, x, 0); f4 != expected {
+		t.Errorf("f4: expected %x, got %x", expected, f4)
+	}
+
+	fromHex(t, w[:], "ec0234a3 57c8ad05 341010a6 0a397d9b 99796b13 b4f866f1 868d34f3 73bfa698")
+	fromHex(t, a1[:], "00561237 37bfce")
+	fromHex(t, a2[:], "00a71370 2dcfc1")
+	var expectedMacKey [16]byte
+	fromHex(t, expectedMacKey[:], "2965f176 a1084a02 fd3f6a20 ce636e20")
+	fromHex(t, expected[:], "69867911 69d7cd23 980522b5 94750a38")
+	macKey, ltk := smpF5(w, x, y, a1, a2)
+	if macKey != expectedMacKey {
+		t.Errorf("f5: expected MacKey %x, got %x", expectedMacKey, macKey)
+	}
+	if ltk != expected {
+		t.Errorf("f5: expected LTK %x, got %x", expected, ltk)
+	}
+
+	fromHex(t, r[:], "12a3343b b453bb54 08da42d2 0c2d0fc8")
+	fromHex(t, expected[:], "e3c47398 9cd0e8c5 d26c0b09 da958f61")
+	if f6 := smpF6(macKey, x, y, r, [3]byte{0x01, 0x01, 0x02}, a1, a2); f6 != expected {
+		t.Errorf("f6: expected %x, got %x", expected, f6)
+	}
+
+	if g2 := smpG2(u, v, x, y); g2 != 0x2f9ed5ba {
+		t.Errorf("g2: expected 2f9ed5ba, got %08x", g2)
+	}
+}
+
+func TestSMPSign(t *testing.T) {
+	// The second example of RFC 4493, with the message and key in the order of
+	// PDUs: the last four octets of the message are the sign counter.
+	var csrk [16]byte
+	var m [12]byte
+	var expected [12]byte
+	fromHex(t, csrk[:], "3c4fcf09 8815f7ab a6d2ae28 16157e2b")
+	fromHex(t, m[:], "2a179373 117e3de9 969f402e")
+	fromHex(t, expected[:], "e2bec16b 44414d6b b4160a07")
+	if signature := smpSign(csrk, m[:], 0x6bc1bee2); signature != expected {
+		t.Errorf("expected %x, got %x", expected, signature)
+	}
+}
@@ -0,0 +1,1295 @@
+//go:build hci || ninafw
+
+package bluetooth
+
+import (
+	"crypto/rand"
+	"crypto/subtle"
+	"encoding/binary"
+	"encoding/hex"
+	"errors"
+)
+
+const (
+	smpPairingRequest              = 0x01
+	smpPairingResponse             = 0x02
+	smpPairingConfirm              = 0x03
+	smpPairingRandom               = 0x04
+	smpPairingFailed               = 0x05
+	smpEncryptionInformation       = 0x06
+	smpCentralIdentification       = 0x07
+	smpIdentityInformation         = 0x08
+	smpIdentityAddressInformation  = 0x09
+	smpSigningInformation          = 0x0a
+	smpSecurityRequest             = 0x0b
+	smpPairingPublicKey            = 0x0c
+	smpPairingDHKeyCheck           = 0x0d
+	smpPairingKeypressNotification = 0x0e
+
+	smpAuthReqBonding = 0x01
+	smpAuthReqMITM    = 0x04
+	smpAuthReqSC      = 0x08
+
+	smpKeyDistEncKey  = 0x01
+	smpKeyDistIdKey   = 0x02
+	smpKeyDistSignKey = 0x04
+
+	smpMinEncryptionKeySize = 7
+	smpMaxEncryptionKeySize = 16
+
+	// Number of rounds of passkey entry with LE Secure Connections, one for
+	// every bit of the passkey.
+	smpPasskeyRounds = 20
+)
+
+// Reasons in the Pairing Failed command.
+const (
+	smpReasonPasskeyEntryFailed         = 0x01
+	smpReasonOOBNotAvailable            = 0x02
+	smpReasonAuthenticationRequirements = 0x03
+	smpReasonConfirmValueFailed         = 0x04
+	smpReasonPairingNotSupported        = 0x05
+	smpReasonEncryptionKeySize          = 0x06
+	smpReasonCommandNotSupported        = 0x07
+	smpReasonUnspecified                = 0x08
+	smpReasonRepeatedAttempts           = 0x09
+	smpReasonInvalidParameters          = 0x0a
+	smpReasonDHKeyCheckFailed           = 0x0b
+	smpReasonNumericComparisonFailed    = 0x0c
+)
+
+var errNotConnected = errors.New("bluetooth: not connected")
+
+// smpError is the reason pairing failed, sent by either side in a Pairing
+// Failed command.
+type smpError uint8
+
+func (e smpError) Error() string {
+	switch e {
+	case smpReasonPasskeyEntryFailed:
+		return "bluetooth: pairing failed: passkey entry failed"
+	case smpReasonAuthenticationRequirements:
+		return "bluetooth: pairing failed: authentication requirements not met"
+	case smpReasonConfirmValueFailed:
+		return "bluetooth: pairing failed: confirm value failed"
+	case smpReasonPairingNotSupported:
+		return "bluetooth: pairing failed: pairing not supported"
+	case smpReasonEncryptionKeySize:
+		return "bluetooth: pairing failed: encryption key size too short"
+	case smpReasonDHKeyCheckFailed:
+		return "bluetooth: pairing failed: DHKey check failed"
+	case smpReasonNumericComparisonFailed:
+		return "bluetooth: pairing failed: numeric comparison failed"
+	default:
+		return "bluetooth: pairing failed with reason 0x" + hex.EncodeToString([]byte{byte(e)})
+	}
+}
+
+// smpMethod is the way pairing is authenticated.
+type smpMethod uint8
+
+const (
+	smpJustWorks smpMethod = iota
+	smpPasskeyInitiatorInputs
+	smpPasskeyResponderInputs
+	smpPasskeyBothInput
+	smpNumericComparison
+)
+
+// smpMethods maps the IO capabilities of the responder and the initiator to
+// the pairing method, see Vol 3, Part H, table 2.8.
+var smpMethods = [5][5]smpMethod{
+	IOCapabilityDisplayOnly:     {smpJustWorks, smpJustWorks, smpPasskeyInitiatorInputs, smpJustWorks, smpPasskeyInitiatorInputs},
+	IOCapabilityDisplayYesNo:    {smpJustWorks, smpNumericComparison, smpPasskeyInitiatorInputs, smpJustWorks, smpNumericComparison},
+	IOCapabilityKeyboardOnly:    {smpPasskeyResponderInputs, smpPasskeyResponderInputs, smpPasskeyBothInput, smpJustWorks, smpPasskeyResponderInputs},
+	IOCapabilityNoInputNoOutput: {smpJustWorks, smpJustWorks, smpJustWorks, smpJustWorks, smpJustWorks},
+	IOCapabilityKeyboardDisplay: {smpPasskeyResponderInputs, smpNumericComparison, smpPasskeyInitiatorInputs, smpJustWorks, smpNumericComparison},
+}
+
+// smpPairingMethod returns the pairing method for the IO capabilities of both
+// devices. Numeric comparison is only available with LE Secure Connections.
+func smpPairingMethod(initiator, responder IOCapability, sc bool) smpMethod {
+	if initiator > IOCapabilityKeyboardDisplay || responder > IOCapabilityKeyboardDisplay {
+		return smpJustWorks
+	}
+
+	method := smpMethods[responder][initiator]
+	if method == smpNumericComparison && !sc {
+		switch {
+		case initiator == IOCapabilityDisplayYesNo && responder == IOCapabilityDisplayYesNo:
+			return smpJustWorks
+		case initiator == IOCapabilityDisplayYesNo:
+			return smpPasskeyResponderInputs
+		default:
+			return smpPasskeyInitiatorInputs
+		}
+	}
+
+	return method
+}
+
+type smpState uint8
+
+const (
+	smpStateIdle smpState = iota
+	smpStateWaitPairingResponse
+	smpStateWaitPublicKey
+	smpStateWaitConfirm
+	smpStateWaitRandom
+	smpStateWaitDHKeyCheck
+	smpStateWaitEncryption
+	smpStateKeyDistribution
+	smpStateEncrypting // encrypting with the key of an earlier pairing
+)
+
+// smpEventKind is the kind of an smpEvent.
+type smpEventKind uint8
+
+const (
+	smpEventDisplayPasskey smpEventKind = iota
+	smpEventRequestPasskey
+	smpEventConfirmPasskey
+	smpEventComplete
+)
+
+// smpEvent is a request for the user or the result of pairing, which is
+// handled by the adapter outside of the event handler.
+type smpEvent struct {
+	handle  uint16
+	kind    smpEventKind
+	passkey uint32
+	err     error
+}
+
+// smpConnection is the pairing state of a connection.
+type smpConnection struct {
+	handle    uint16
+	initiator bool
+	peer      MACAddress
+
+	// Addresses of the local and remote device as used by f5, f6 and c1.
+	localAddress  [7]byte
+	remoteAddress [7]byte
+
+	state      smpState
+	preq, pres [7]byte
+	sc         bool
+	bonding    bool
+	method     smpMethod
+	keySize    uint8
+
+	// Keys that still need to be received from and sent to the other side.
+	remoteKeys uint8
+	localKeys  uint8
+
+	passkey      uint32
+	passkeyReady bool
+	confirmed    bool
+	round        int
+
+	localRandom, remoteRandom  [16]byte
+	remoteConfirm              [16]byte
+	confirmSent, confirmPosted bool
+
+	// LE Secure Connections public keys in PDU order, DHKey and keys derived
+	// from it.
+	remotePublicKey     [64]byte
+	remotePublicKeySeen bool
+	publicKeySent       bool
+	dhKeyRequested      bool
+	dhKeyReady          bool
+	dhKey               [32]byte
+	macKey              [16]byte
+	checkSent           bool
+	remoteCheck         [16]byte
+	remoteCheckSeen     bool
+
+	// The STK or LTK used for encryption, and the keys stored after pairing.
+	key  [16]byte
+	bond Bond
+
+	// The security of the encrypted link, which the ATT server checks the
+	// permissions of attributes against.
+	security securityLevel
+
+	// Pair waits for done.
+	done bool
+	err  error
+}
+
+// smp implements the Security Manager Protocol, on the L2CAP security channel.
+type smp struct {
+	hci          *hci
+	ioCapability IOCapability
+
+	// secureConnections offers LE Secure Connections pairing, which needs a
+	// controller that supports the P-256 commands.
+	secureConnections bool
+
+	connections []*smpConnection
+	store       BondStore
+	events      []smpEvent
+
+	// The P-256 key pair is generated by the controller on first use.
+	publicKey          [64]byte
+	publicKeyRequested bool
+	publicKeyReady     bool
+
+	// The controller computes one DHKey at a time.
+	dhKeyHandle  uint16
+	dhKeyPending bool
+
+	// The last sign counter of signed writes from each bonded device. It
+	// must increase, so that writes can't be replayed.
+	signCounters map[MACAddress]uint32
+}
+
+func newSMP(hci *hci) *smp {
+	return &smp{
+		hci:               hci,
+		ioCapability:      IOCapabilityNoInputNoOutput,
+		secureConnections: true,
+		store:             NewMemoryBondStore(),
+	}
+}
+
+func (s *smp) addConnection(conn hciConnection) {
+	c := &smpConnection{
+		handle:    conn.handle,
+		initiator: conn.role == hciRoleCentral,
+		peer: MACAddress{
+			MAC:      makeAddress(conn.peerBdaddr),
+			isRandom: conn.peerBdaddrType&0x01 != 0,
+		},
+	}
+	if s.hci.privacy && !c.initiator {
+		// The central connected to the private address of an advertisement.
+		c.localAddress[0] = 0x01
+		swapBytes(c.localAddress[1:], s.hci.randomAddress[:])
+	} else {
+		c.localAddress[0] = 0x00
+		swapBytes(c.localAddress[1:], s.hci.address[:])
+	}
+	c.remoteAddress[0] = conn.peerBdaddrType & 0x01
+	swapBytes(c.remoteAddress[1:], conn.peerBdaddr[:])
+
+	s.connections = append(s.connections, c)
+}
+
+func (s *smp) removeConnection(handle uint16) {
+	for i, c := range s.connections {
+		if c.handle == handle {
+			s.connections = append(s.connections[:i], s.connections[i+1:]...)
+			break
+		}
+	}
+
+	if s.dhKeyPending && s.dhKeyHandle == handle {
+		// The result is ignored when it arrives.
+		s.dhKeyHandle = 0xffff
+	}
+}
+
+func (s *smp) findConnection(handle uint16) *smpConnection {
+	for _, c := range s.connections {
+		if c.handle == handle {
+			return c
+		}
+	}
+
+	return nil
+}
+
+// localKeyDist returns the keys this device distributes: an LTK, and its
+// IRK and identity address if it uses private addresses.
+func (s *smp) localKeyDist() byte {
+	if s.hci.privacy {
+		return smpKeyDistEncKey | smpKeyDistIdKey
+	}
+
+	return smpKeyDistEncKey
+}
+
+func (s *smp) findBond(address MACAddress) (Bond, bool) {
+	return resolveBond(s.store, address)
+}
+
+// securityLevel returns the security of the link of the connection.
+func (s *smp) securityLevel(handle uint16) securityLevel {
+	if c := s.findConnection(handle); c != nil {
+		return c.security
+	}
+
+	return securityNone
+}
+
+// verifySignature checks the signature of a signed write on the connection,
+// with the CSRK that the device distributed when bonding.
+func (s *smp) verifySignature(handle uint16, m, signature []byte) bool {
+	c := s.findConnection(handle)
+	if c == nil {
+		return false
+	}
+	bond, ok := s.findBond(c.peer)
+	if !ok || bond.CSRK == [16]byte{} {
+		return false
+	}
+
+	counter := binary.LittleEndian.Uint32(signature)
+	if last, ok := s.signCounters[bond.Address]; ok && counter <= last {
+		return false
+	}
+	expected := smpSign(bond.CSRK, m, counter)
+	if subtle.ConstantTimeCompare(expected[:], signature) != 1 {
+		return false
+	}
+
+	if s.signCounters == nil {
+		s.signCounters = make(map[MACAddress]uint32)
+	}
+	s.signCounters[bond.Address] = counter
+	return true
+}
+
+// pair starts pairing on the connection: as central by sending a Pairing
+// Request, or by encrypting with the key of an earlier pairing, and as
+// peripheral by asking the central to do so.
+func (s *smp) pair(handle uint16) error {
+	c := s.findConnection(handle)
+	if c == nil {
+		return errNotConnected
+	}
+
+	c.done = false
+	c.err = nil
+	if c.state != smpStateIdle {
+		// already in progress
+		return nil
+	}
+
+	if !c.initiator {
+		return s.send(c, []byte{smpSecurityRequest, s.authReq()})
+	}
+
+	if bond, ok := s.findBond(c.peer); ok {
+		c.state = smpStateEncrypting
+		return s.startEncryption(c, reverseKey(bond.LTK), bond.EDIV, bond.Rand)
+	}
+
+	s.reset(c)
+	c.preq = [7]byte{smpPairingRequest, byte(s.ioCapability), 0x00, s.authReq(), smpMaxEncryptionKeySize,
+		s.localKeyDist() &^ smpKeyDistEncKey, smpKeyDistEncKey | smpKeyDistIdKey}
+	c.state = smpStateWaitPairingResponse
+
+	return s.send(c, c.preq[:])
+}
+
+func (s *smp) authReq() uint8 {
+	authReq := uint8(smpAuthReqBonding)
+	if s.secureConnections {
+		authReq |= smpAuthReqSC
+	}
+	if s.ioCapability != IOCapabilityNoInputNoOutput {
+		authReq |= smpAuthReqMITM
+	}
+
+	return authReq
+}
+
+// reset clears the state of an earlier pairing attempt.
+func (s *smp) reset(c *smpConnection) {
+	*c = smpConnection{
+		handle:        c.handle,
+		initiator:     c.initiator,
+		peer:          c.peer,
+		localAddress:  c.localAddress,
+		remoteAddress: c.remoteAddress,
+		security:      c.security,
+		done:          c.done,
+		err:           c.err,
+	}
+}
+
+func (s *smp) send(c *smpConnection, data []byte) error {
+	if debug {
+		println("smp.send:", c.handle, "data:", hex.EncodeToString(data))
+	}
+
+	return s.hci.sendAclPkt(c.handle, securityCID, data)
+}
+
+// fail aborts pairing and tells the other side why.
+func (s *smp) fail(c *smpConnection, reason uint8) error {
+	s.finish(c, smpError(reason))
+	return s.send(c, []byte{smpPairingFailed, reason})
+}
+
+// finish ends pairing with the result.
+func (s *smp) finish(c *smpConnection, err error) {
+	if c.state != smpStateEncrypting && c.bonding && err == nil && s.store != nil {
+		err = s.store.SaveBond(c.bond)
+	}
+
+	c.done = true
+	c.err = err
+	s.reset(c)
+	s.events = append(s.events, smpEvent{handle: c.handle, kind: smpEventComplete, err: err})
+}
+
+func (s *smp) handleData(handle uint16, buf []byte) error {
+	if debug {
+		println("smp.handleData:", handle, "data:", hex.EncodeToString(buf))
+	}
+
+	c := s.findConnection(handle)
+	if c == nil || len(buf) == 0 {
+		return nil
+	}
+
+	switch buf[0] {
+	case smpPairingRequest:
+		return s.handlePairingRequest(c, buf)
+	case smpPairingResponse:
+		return s.handlePairingResponse(c, buf)
+	case smpPairingConfirm:
+		return s.handlePairingConfirm(c, buf)
+	case smpPairingRandom:
+		return s.handlePairingRandom(c, buf)
+	case smpPairingPublicKey:
+		return s.handlePairingPublicKey(c, buf)
+	case smpPairingDHKeyCheck:
+		return s.handlePairingDHKeyCheck(c, buf)
+	case smpEncryptionInformation, smpCentralIdentification, smpIdentityInformation,
+		smpIdentityAddressInformation, smpSigningInformation:
+		return s.handleKey(c, buf)
+
+	case smpPairingFailed:
+		if c.state != smpStateIdle && len(buf) >= 2 {
+			s.finish(c, smpError(buf[1]))
+		}
+		return nil
+
+	case smpSecurityRequest:
+		if !c.initiator {
+			return s.send(c, []byte{smpPairingFailed, smpReasonCommandNotSupported})
+		}
+		if c.state != smpStateIdle {
+			return nil
+		}
+		return s.pair(handle)
+
+	case smpPairingKeypressNotification:
+		return nil
+
+	default:
+		return s.send(c, []byte{smpPairingFailed, smpReasonCommandNotSupported})
+	}
+}
+
+func (s *smp) handlePairingRequest(c *smpConnection, buf []byte) error {
+	if c.initiator {
+		return s.send(c, []byte{smpPairingFailed, smpReasonCommandNotSupported})
+	}
+	if len(buf) != 7 {
+		return s.send(c, []byte{smpPairingFailed, smpReasonInvalidParameters})
+	}
+
+	s.reset(c)
+	copy(c.preq[:], buf)
+	if c.preq[4] < smpMinEncryptionKeySize || c.preq[4] > smpMaxEncryptionKeySize {
+		return s.fail(c, smpReasonEncryptionKeySize)
+	}
+
+	// Receive the keys the central offers, and distribute an LTK and the
+	// identity if privacy is enabled. The CSRK of the central checks its
+	// signed writes.
+	initKeys, respKeys := c.preq[5]&(smpKeyDistEncKey|smpKeyDistIdKey|smpKeyDistSignKey), c.preq[6]&s.localKeyDist()
+	if c.preq[3]&smpAuthReqBonding == 0 {
+		initKeys, respKeys = 0, 0
+	}
+	c.pres = [7]byte{smpPairingResponse, byte(s.ioCapability), 0x00, s.authReq(), smpMaxEncryptionKeySize,
+		initKeys, respKeys}
+	if err := s.send(c, c.pres[:]); err != nil {
+		return err
+	}
+
+	return s.startPairing(c)
+}
+
+func (s *smp) handlePairingResponse(c *smpConnection, buf []byte) error {
+	if c.state != smpStateWaitPairingResponse {
+		return s.unexpected(c)
+	}
+	if len(buf) != 7 {
+		return s.fail(c, smpReasonInvalidParameters)
+	}
+
+	copy(c.pres[:], buf)
+	if c.pres[4] < smpMinEncryptionKeySize || c.pres[4] > smpMaxEncryptionKeySize {
+		return s.fail(c, smpReasonEncryptionKeySize)
+	}
+
+	return s.startPairing(c)
+}
+
+// startPairing continues after the pairing features have been exchanged.
+func (s *smp) startPairing(c *smpConnection) error {
+	c.sc = c.preq[3]&c.pres[3]&smpAuthReqSC != 0
+	c.bonding = c.preq[3]&c.pres[3]&smpAuthReqBonding != 0
+	c.keySize = c.preq[4]
+	if c.pres[4] < c.keySize {
+		c.keySize = c.pres[4]
+	}
+
+	if (c.preq[3]|c.pres[3])&smpAuthReqMITM != 0 {
+		c.method = smpPairingMethod(IOCapability(c.preq[1]), IOCapability(c.pres[1]), c.sc)
+	}
+
+	// With LE Secure Connections the LTK is not distributed.
+	initKeys, respKeys := c.pres[5], c.pres[6]
+	if c.sc {
+		initKeys &^= smpKeyDistEncKey
+		respKeys &^= smpKeyDistEncKey
+	}
+	c.localKeys, c.remoteKeys = respKeys, initKeys
+	if c.initiator {
+		c.localKeys, c.remoteKeys = initKeys, respKeys
+	}
+	c.bond = Bond{
+		Address:           c.peer,
+		Authenticated:     c.method != smpJustWorks,
+		SecureConnections: c.sc,
+	}
+
+	if c.sc {
+		c.state = smpStateWaitPublicKey
+		return s.sendPublicKey(c)
+	}
+
+	if err := s.setupPasskey(c); err != nil {
+		return err
+	}
+	return s.startRound(c)
+}
+
+// setupPasskey shows or asks for the passkey, if the pairing method needs one.
+func (s *smp) setupPasskey(c *smpConnection) error {
+	localDisplays := c.method == smpPasskeyInitiatorInputs && !c.initiator ||
+		c.method == smpPasskeyResponderInputs && c.initiator
+
+	switch {
+	case c.method == smpJustWorks || c.method == smpNumericComparison:
+		c.passkeyReady = true
+
+	case localDisplays:
+		var b [4]byte
+		if _, err := rand.Read(b[:]); err != nil {
+			return s.fail(c, smpReasonUnspecified)
+		}
+		c.passkey = binary.LittleEndian.Uint32(b[:]) % 1000000
+		c.passkeyReady = true
+		s.events = append(s.events, smpEvent{handle: c.handle, kind: smpEventDisplayPasskey, passkey: c.passkey})
+
+	default:
+		s.events = append(s.events, smpEvent{handle: c.handle, kind: smpEventRequestPasskey})
+	}
+
+	return nil
+}
+
+// passkeyEntered continues pairing with the passkey entered by the user.
+func (s *smp) passkeyEntered(handle uint16, passkey uint32, ok bool) error {
+	c := s.findConnection(handle)
+	if c == nil || c.state == smpStateIdle || c.passkeyReady {
+		return nil
+	}
+	if !ok || passkey > 999999 {
+		return s.fail(c, smpReasonPasskeyEntryFailed)
+	}
+
+	c.passkey = passkey
+	c.passkeyReady = true
+
+	return s.sendConfirm(c)
+}
+
+// passkeyConfirmed continues pairing after the user compared the numbers.
+func (s *smp) passkeyConfirmed(handle uint16, ok bool) error {
+	c := s.findConnection(handle)
+	if c == nil || c.state != smpStateWaitDHKeyCheck || c.confirmed {
+		return nil
+	}
+	if !ok {
+		return s.fail(c, smpReasonNumericComparisonFailed)
+	}
+
+	c.confirmed = true
+
+	return s.checkDHKey(c)
+}
+
+// startRound starts the exchange of confirm and random values. Passkey entry
+// with LE Secure Connections has a round for every bit of the passkey.
+func (s *smp) startRound(c *smpConnection) error {
+	if _, err := rand.Read(c.localRandom[:]); err != nil {
+		return s.fail(c, smpReasonUnspecified)
+	}
+	c.confirmSent = false
+	c.confirmPosted = false
+	c.state = smpStateWaitConfirm
+
+	return s.sendConfirm(c)
+}
+
+// passkeyMode returns whether the confirm values are generated from the
+// passkey: always with legacy pairing, and for passkey entry with LE Secure
+// Connections. Otherwise only the responder sends a confirm value.
+func (c *smpConnection) passkeyMode() bool {
+	return !c.sc || (c.method != smpJustWorks && c.method != smpNumericComparison)
+}
+
+// sendConfirm sends the local confirm value once it can be computed and it is
+// the turn of this device.
+func (s *smp) sendConfirm(c *smpConnection) error {
+	if c.state != smpStateWaitConfirm || c.confirmSent || !c.passkeyReady {
+		return nil
+	}
+
+	switch {
+	case !c.passkeyMode():
+		// Only the responder commits to its nonce.
+		if c.initiator {
+			return nil
+		}
+	case !c.initiator && !c.confirmPosted:
+		// The responder waits for the confirm value of the initiator.
+		return nil
+	}
+
+	confirm := s.confirmValue(c, c.localRandom, true)
+	var b [17]byte
+	b[0] = smpPairingConfirm
+	swapBytes(b[1:], confirm[:])
+	c.confirmSent = true
+	if !c.initiator {
+		c.state = smpStateWaitRandom
+	}
+
+	return s.send(c, b[:])
+}
+
+// confirmValue computes the confirm value of the local (or remote) device
+// with the given nonce.
+func (s *smp) confirmValue(c *smpConnection, nonce [16]byte, local bool) [16]byte {
+	if !c.sc {
+		var tk [16]byte
+		binary.BigEndian.PutUint32(tk[12:], c.passkey)
+		var preq, pres [7]byte
+		swapBytes(preq[:], c.preq[:])
+		swapBytes(pres[:], c.pres[:])
+		ia, ra := c.localAddress, c.remoteAddress
+		if !c.initiator {
+			ia, ra = ra, ia
+		}
+		var iaddr, raddr [6]byte
+		copy(iaddr[:], ia[1:])
+		copy(raddr[:], ra[1:])
+		return smpC1(tk, nonce, preq, pres, ia[0], ra[0], iaddr, raddr)
+	}
+
+	z := uint8(0)
+	if c.passkeyMode() {
+		z = 0x80 | uint8(c.passkey>>c.round)&0x01
+	}
+	u, v := s.publicKeyX(), c.remotePublicKeyX()
+	if !local {
+		u, v = v, u
+	}
+	return smpF4(u, v, nonce, z)
+}
+
+func (s *smp) handlePairingConfirm(c *smpConnection, buf []byte) error {
+	if c.state != smpStateWaitConfirm || c.confirmPosted {
+		return s.unexpected(c)
+	}
+	if len(buf) != 17 {
+		return s.fail(c, smpReasonInvalidParameters)
+	}
+
+	swapBytes(c.remoteConfirm[:], buf[1:])
+	c.confirmPosted = true
+
+	if !c.initiator {
+		if !c.passkeyMode() {
+			// The initiator doesn't send a confirm value.
+			return s.unexpected(c)
+		}
+		return s.sendConfirm(c)
+	}
+
+	if c.passkeyMode() && !c.confirmSent {
+		// The responder must wait for the confirm value of the initiator.
+		return s.unexpected(c)
+	}
+
+	c.state = smpStateWaitRandom
+	return s.sendRandom(c)
+}
+
+func (s *smp) sendRandom(c *smpConnection) error {
+	var b [17]byte
+	b[0] = smpPairingRandom
+	swapBytes(b[1:], c.localRandom[:])
+
+	return s.send(c, b[:])
+}
+
+func (s *smp) handlePairingRandom(c *smpConnection, buf []byte) error {
+	if c.state != smpStateWaitRandom || (!c.initiator && !c.confirmSent) {
+		return s.unexpected(c)
+	}
+	if len(buf) != 17 {
+		return s.fail(c, smpReasonInvalidParameters)
+	}
+
+	swapBytes(c.remoteRandom[:], buf[1:])
+
+	// Every confirm value that was sent must match.
+	if c.initiator || c.passkeyMode() {
+		if s.confirmValue(c, c.remoteRandom, false) != c.remoteConfirm {
+			return s.fail(c, smpReasonConfirmValueFailed)
+		}
+	}
+
+	if !c.initiator {
+		if err := s.sendRandom(c); err != nil {
+			return err
+		}
+	}
+
+	return s.endRound(c)
+}
+
+// endRound continues after the random values have been exchanged.
+func (s *smp) endRound(c *smpConnection) error {
+	if !c.sc {
+		// The STK encrypts the link for the key distribution.
+		var tk [16]byte
+		binary.BigEndian.PutUint32(tk[12:], c.passkey)
+		srand, mrand := c.localRandom, c.remoteRandom
+		if c.initiator {
+			srand, mrand = mrand, srand
+		}
+		c.key = smpS1(tk, srand, mrand)
+		s.maskKey(c, &c.key)
+		c.state = smpStateWaitEncryption
+		if c.initiator {
+			return s.startEncryption(c, c.key, 0, 0)
+		}
+		return nil
+	}
+
+	if c.passkeyMode() {
+		c.round++
+		if c.round < smpPasskeyRounds {
+			return s.startRound(c)
+		}
+	}
+
+	c.state = smpStateWaitDHKeyCheck
+	switch c.method {
+	case smpNumericComparison:
+		pka, pkb := s.publicKeyX(), c.remotePublicKeyX()
+		na, nb := c.localRandom, c.remoteRandom
+		if !c.initiator {
+			pka, pkb = pkb, pka
+			na, nb = nb, na
+		}
+		c.passkey = smpG2(pka, pkb, na, nb) % 1000000
+		s.events = append(s.events, smpEvent{handle: c.handle, kind: smpEventConfirmPasskey, passkey: c.passkey})
+	default:
+		c.confirmed = true
+	}
+
+	return s.checkDHKey(c)
+}
+
+// sendPublicKey sends the local public key, once the controller generated it.
+// The initiator sends its key first.
+func (s *smp) sendPublicKey(c *smpConnection) error {
+	if c.publicKeySent || (!c.initiator && !c.remotePublicKeySeen) {
+		return nil
+	}
+
+	if !s.publicKeyReady {
+		if s.publicKeyRequested {
+			return nil
+		}
+		s.publicKeyRequested = true
+		return s.hci.sendWithoutResponse(ogfLECtrl<<ogfCommandPos|leCommandReadLocalP256, nil)
+	}
+
+	var b [65]byte
+	b[0] = smpPairingPublicKey
+	copy(b[1:], s.publicKey[:])
+	c.publicKeySent = true
+	if err := s.send(c, b[:]); err != nil {
+		return err
+	}
+
+	if !c.initiator {
+		return s.startPhase2(c)
+	}
+
+	return nil
+}
+
+func (s *smp) handlePairingPublicKey(c *smpConnection, buf []byte) error {
+	if c.state != smpStateWaitPublicKey || c.remotePublicKeySeen || (c.initiator && !c.publicKeySent) {
+		return s.unexpected(c)
+	}
+	if len(buf) != 65 {
+		return s.fail(c, smpReasonInvalidParameters)
+	}
+
+	copy(c.remotePublicKey[:], buf[1:])
+	c.remotePublicKeySeen = true
+	if s.publicKeyReady && c.remotePublicKey == s.publicKey {
+		// A reflected public key is an attack.
+		return s.fail(c, smpReasonInvalidParameters)
+	}
+
+	if c.initiator {
+		return s.startPhase2(c)
+	}
+
+	return s.sendPublicKey(c)
+}
+
+// startPhase2 starts authentication, after the public keys have been
+// exchanged.
+func (s *smp) startPhase2(c *smpConnection) error {
+	c.dhKeyRequested = true
+	if err := s.generateDHKey(); err != nil {
+		return err
+	}
+
+	if err := s.setupPasskey(c); err != nil {
+		return err
+	}
+	return s.startRound(c)
+}
+
+// generateDHKey asks the controller for the DHKey of the next connection that
+// needs one.
+func (s *smp) generateDHKey() error {
+	if s.dhKeyPending {
+		return nil
+	}
+
+	for _, c := range s.connections {
+		if c.dhKeyRequested && !c.dhKeyReady {
+			s.dhKeyPending = true
+			s.dhKeyHandle = c.handle
+			return s.hci.sendWithoutResponse(ogfLECtrl<<ogfCommandPos|leCommandGenerateDHKeyV1, c.remotePublicKey[:])
+		}
+	}
+
+	return nil
+}
+
+func (s *smp) handleLocalPublicKey(status uint8, key []byte) error {
+	s.publicKeyRequested = false
+	if status != 0 || len(key) != 64 {
+		for _, c := range s.connections {
+			if c.state == smpStateWaitPublicKey {
+				if err := s.fail(c, smpReasonUnspecified); err != nil {
+					return err
+				}
+			}
+		}
+		return nil
+	}
+
+	copy(s.publicKey[:], key)
+	s.publicKeyReady = true
+
+	for _, c := range s.connections {
+		if c.state == smpStateWaitPublicKey {
+			if err := s.sendPublicKey(c); err != nil {
+				return err
+			}
+		}
+	}
+
+	return nil
+}
+
+func (s *smp) handleDHKey(status uint8, key []byte) error {
+	handle := s.dhKeyHandle
+	s.dhKeyPending = false
+	defer s.generateDHKey()
+
+	c := s.findConnection(handle)
+	if c == nil || !c.dhKeyRequested {
+		return nil
+	}
+	if status != 0 || len(key) != 32 {
+		// The public key of the remote device is not on the curve.
+		c.dhKeyRequested = false
+		return s.fail(c, smpReasonDHKeyCheckFailed)
+	}
+
+	swapBytes(c.dhKey[:], key)
+	c.dhKeyReady = true
+
+	return s.checkDHKey(c)
+}
+
+// publicKeyX returns the X coordinate of the local public key.
+func (s *smp) publicKeyX() (x [32]byte) {
+	swapBytes(x[:], s.publicKey[:32])
+	return
+}
+
+// remotePublicKeyX returns the X coordinate of the remote public key.
+func (c *smpConnection) remotePublicKeyX() (x [32]byte) {
+	swapBytes(x[:], c.remotePublicKey[:32])
+	return
+}
+
+// checkValues computes the LTK and the DHKey check values of both devices.
+func (s *smp) checkValues(c *smpConnection) (local, remote [16]byte) {
+	na, nb := c.localRandom, c.remoteRandom
+	a, b := c.localAddress, c.remoteAddress
+	ioCapA := [3]byte{c.preq[3], c.preq[2], c.preq[1]}
+	ioCapB := [3]byte{c.pres[3], c.pres[2], c.pres[1]}
+	if !c.initiator {
+		na, nb = nb, na
+		a, b = b, a
+	}
+
+	var r [16]byte
+	if c.passkeyMode() {
+		binary.BigEndian.PutUint32(r[12:], c.passkey)
+	}
+
+	c.macKey, c.key = smpF5(c.dhKey, na, nb, a, b)
+	s.maskKey(c, &c.key)
+	ea := smpF6(c.macKey, na, nb, r, ioCapA, a, b)
+	eb := smpF6(c.macKey, nb, na, r, ioCapB, b, a)
+	if !c.initiator {
+		return eb, ea
+	}
+	return ea, eb
+}
+
+// checkDHKey sends or verifies the DHKey check value, once the DHKey is known
+// and the user confirmed the pairing.
+func (s *smp) checkDHKey(c *smpConnection) error {
+	if c.state != smpStateWaitDHKeyCheck || !c.dhKeyReady || !c.confirmed {
+		return nil
+	}
+
+	local, remote := s.checkValues(c)
+	if c.initiator {
+		if c.checkSent {
+			return nil
+		}
+		c.checkSent = true
+		return s.sendDHKeyCheck(c, local)
+	}
+
+	if !c.remoteCheckSeen {
+		return nil
+	}
+	if remote != c.remoteCheck {
+		return s.fail(c, smpReasonDHKeyCheckFailed)
+	}
+	c.state = smpStateWaitEncryption
+	return s.sendDHKeyCheck(c, local)
+}
+
+func (s *smp) sendDHKeyCheck(c *smpConnection, check [16]byte) error {
+	var b [17]byte
+	b[0] = smpPairingDHKeyCheck
+	swapBytes(b[1:], check[:])
+
+	return s.send(c, b[:])
+}
+
+func (s *smp) handlePairingDHKeyCheck(c *smpConnection, buf []byte) error {
+	if c.state != smpStateWaitDHKeyCheck || c.remoteCheckSeen || (c.initiator && !c.checkSent) {
+		return s.unexpected(c)
+	}
+	if len(buf) != 17 {
+		return s.fail(c, smpReasonInvalidParameters)
+	}
+
+	swapBytes(c.remoteCheck[:], buf[1:])
+	c.remoteCheckSeen = true
+
+	if !c.initiator {
+		return s.checkDHKey(c)
+	}
+
+	if _, remote := s.checkValues(c); remote != c.remoteCheck {
+		return s.fail(c, smpReasonDHKeyCheckFailed)
+	}
+	c.state = smpStateWaitEncryption
+	return s.startEncryption(c, c.key, 0, 0)
+}
+
+// maskKey shortens the key to the negotiated encryption key size.
+func (s *smp) maskKey(c *smpConnection, key *[16]byte) {
+	for i := 0; i < int(smpMaxEncryptionKeySize-c.keySize); i++ {
+		key[i] = 0
+	}
+}
+
+// unexpected aborts pairing after a command that is not expected in the
+// current state.
+func (s *smp) unexpected(c *smpConnection) error {
+	if c.state == smpStateIdle {
+		return nil
+	}
+
+	return s.fail(c, smpReasonUnspecified)
+}
+
+// startEncryption encrypts the link as central.
+func (s *smp) startEncryption(c *smpConnection, key [16]byte, ediv uint16, random uint64) error {
+	var b [28]byte
+	binary.LittleEndian.PutUint16(b[0:], c.handle)
+	binary.LittleEndian.PutUint64(b[2:], random)
+	binary.LittleEndian.PutUint16(b[10:], ediv)
+	swapBytes(b[12:], key[:])
+
+	return s.hci.sendWithoutResponse(ogfLECtrl<<ogfCommandPos|leCommandStartEncryption, b[:])
+}
+
+// handleLongTermKeyRequest answers the request of the controller for the key
+// to encrypt the link with, as peripheral.
+func (s *smp) handleLongTermKeyRequest(handle uint16, random uint64, ediv uint16) error {
+	var key [16]byte
+	found := false
+
+	c := s.findConnection(handle)
+	switch {
+	case c == nil:
+	case c.state == smpStateWaitEncryption:
+		if random == 0 && ediv == 0 {
+			key, found = c.key, true
+		}
+	default:
+		bond, ok := s.findBond(c.peer)
+		if ok && bond.Rand == random && bond.EDIV == ediv {
+			key, found = reverseKey(bond.LTK), true
+		}
+	}
+
+	var b [18]byte
+	binary.LittleEndian.PutUint16(b[0:], handle)
+	if !found {
+		return s.hci.sendWithoutResponse(ogfLECtrl<<ogfCommandPos|leCommandLongTermKeyNegativeReply, b[:2])
+	}
+
+	swapBytes(b[2:], key[:])
+	return s.hci.sendWithoutResponse(ogfLECtrl<<ogfCommandPos|leCommandLongTermKeyReply, b[:])
+}
+
+// handleEncryptionChange continues pairing once the link is encrypted.
+func (s *smp) handleEncryptionChange(handle uint16, status uint8, enabled bool) error {
+	c := s.findConnection(handle)
+	if c == nil {
+		return nil
+	}
+
+	switch {
+	case status != 0:
+		if c.state != smpStateIdle {
+			s.finish(c, hciStatusError(status))
+		}
+		return nil
+
+	case !enabled:
+		c.security = securityNone
+		return nil
+	}
+
+	// The link is as secure as the pairing that created the key. A key
+	// refresh without a bond keeps using the key of pairing on this link.
+	switch bond, ok := s.findBond(c.peer); {
+	case c.state == smpStateWaitEncryption:
+		c.security = pairingSecurity(c.method != smpJustWorks, c.sc)
+	case ok:
+		c.security = pairingSecurity(bond.Authenticated, bond.SecureConnections)
+	case c.security == securityNone:
+		c.security = securityEncrypted
+	}
+
+	switch {
+	case c.state == smpStateEncrypting:
+		s.finish(c, nil)
+		return nil
+
+	case c.state == smpStateWaitEncryption:
+		if c.sc {
+			c.bond.LTK = reverseKey(c.key)
+		}
+		c.state = smpStateKeyDistribution
+		return s.distributeKeys(c)
+
+	case c.state == smpStateIdle && !c.done:
+		// The central encrypted the link after a security request.
+		s.finish(c, nil)
+	}
+
+	return nil
+}
+
+// pairingSecurity returns the security of a link encrypted with a key from
+// pairing.
+func pairingSecurity(authenticated, sc bool) securityLevel {
+	switch {
+	case authenticated && sc:
+		return securitySecure
+	case authenticated:
+		return securityAuthenticated
+	default:
+		return securityEncrypted
+	}
+}
+
+// distributeKeys sends the local keys once it is the turn of this device: the
+// responder distributes its keys first.
+func (s *smp) distributeKeys(c *smpConnection) error {
+	if c.initiator && c.remoteKeys != 0 {
+		return nil
+	}
+
+	if c.localKeys&smpKeyDistEncKey != 0 {
+		// A new LTK, identified by EDIV and Rand.
+		var ltk [16]byte
+		var ids [10]byte
+		if _, err := rand.Read(ltk[:]); err != nil {
+			return s.fail(c, smpReasonUnspecified)
+		}
+		if _, err := rand.Read(ids[:]); err != nil {
+			return s.fail(c, smpReasonUnspecified)
+		}
+		s.maskKey(c, &ltk)
+		c.bond.LTK = reverseKey(ltk)
+		c.bond.EDIV = binary.LittleEndian.Uint16(ids[0:])
+		c.bond.Rand = binary.LittleEndian.Uint64(ids[2:])
+		if err := s.send(c, append([]byte{smpEncryptionInformation}, c.bond.LTK[:]...)); err != nil {
+			return err
+		}
+
+		var id [11]byte
+		id[0] = smpCentralIdentification
+		copy(id[1:], ids[:])
+		if err := s.send(c, id[:]); err != nil {
+			return err
+		}
+	}
+
+	if c.localKeys&smpKeyDistIdKey != 0 {
+		// The IRK resolves the private addresses of this device, the public
+		// address is its identity.
+		if err := s.send(c, append([]byte{smpIdentityInformation}, s.hci.irk[:]...)); err != nil {
+			return err
+		}
+
+		var id [8]byte
+		id[0] = smpIdentityAddressInformation
+		id[1] = 0x00 // public
+		copy(id[2:], s.hci.address[:])
+		if err := s.send(c, id[:]); err != nil {
+			return err
+		}
+	}
+	c.localKeys = 0
+
+	if c.remoteKeys == 0 {
+		s.finish(c, nil)
+	}
+
+	return nil
+}
+
+func (s *smp) handleKey(c *smpConnection, buf []byte) error {
+	if c.state != smpStateKeyDistribution || (!c.initiator && c.localKeys != 0) {
+		return s.unexpected(c)
+	}
+
+	switch buf[0] {
+	case smpEncryptionInformation:
+		if len(buf) != 17 || c.remoteKeys&smpKeyDistEncKey == 0 {
+			return s.fail(c, smpReasonInvalidParameters)
+		}
+		if c.initiator {
+			copy(c.bond.LTK[:], buf[1:])
+		}
+		return nil
+
+	case smpCentralIdentification:
+		if len(buf) != 11 || c.remoteKeys&smpKeyDistEncKey == 0 {
+			return s.fail(c, smpReasonInvalidParameters)
+		}
+		if c.initiator {
+			c.bond.EDIV = binary.LittleEndian.Uint16(buf[1:])
+			c.bond.Rand = binary.LittleEndian.Uint64(buf[3:])
+		}
+		c.remoteKeys &^= smpKeyDistEncKey
+
+	case smpIdentityInformation:
+		if len(buf) != 17 || c.remoteKeys&smpKeyDistIdKey == 0 {
+			return s.fail(c, smpReasonInvalidParameters)
+		}
+		copy(c.bond.IRK[:], buf[1:])
+		return nil
+
+	case smpIdentityAddressInformation:
+		if len(buf) != 8 || c.remoteKeys&smpKeyDistIdKey == 0 {
+			return s.fail(c, smpReasonInvalidParameters)
+		}
+		// The bond is stored under the identity address of the device.
+		var mac [6]byte
+		copy(mac[:], buf[2:])
+		c.bond.Address = MACAddress{MAC: makeAddress(mac), isRandom: buf[1]&0x01 != 0}
+		c.remoteKeys &^= smpKeyDistIdKey
+
+	case smpSigningInformation:
+		if len(buf) != 17 || c.remoteKeys&smpKeyDistSignKey == 0 {
+			return s.fail(c, smpReasonInvalidParameters)
+		}
+		copy(c.bond.CSRK[:], buf[1:])
+		c.remoteKeys &^= smpKeyDistSignKey
+	}
+
+	if c.remoteKeys != 0 {
+		return nil
+	}
+	if c.initiator {
+		return s.distributeKeys(c)
+	}
+
+	s.finish(c, nil)
+	return nil
+}
+
+// reverseKey converts a key between the order of PDUs and the order of the
+// cryptographic functions.
+func reverseKey(key [16]byte) (reversed [16]byte) {
+	swapBytes(reversed[:], key[:])
+	return
+}
+
+// swapBytes copies src to dst in reverse order, to convert between the order
+// of PDUs and the order of the cryptographic functions.
+func swapBytes(dst, src []byte) {
+	for i := range src {
+		dst[len(src)-1-i] = src[i]
+	}
+}
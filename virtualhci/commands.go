@@ -0,0 +1,970 @@
+package virtualhci
+
+import (
+	"bytes"
+	"crypto/aes"
+	"crypto/ecdh"
+	"crypto/rand"
+	"encoding/binary"
+	"math/bits"
+	"slices"
+)
+
+const (
+	packetCommand = 0x01
+	packetACLData = 0x02
+	packetEvent   = 0x04
+
+	aclStartNonFlushable = 0x00
+	aclStartFlushable    = 0x02
+
+	maxHandle = 0x0eff
+
+	evtDisconnectionComplete    = 0x05
+	evtEncryptionChange         = 0x08
+	evtCommandComplete          = 0x0e
+	evtCommandStatus            = 0x0f
+	evtNumberOfCompletedPackets = 0x13
+	evtEncryptionKeyRefresh     = 0x30
+	evtLEMeta                   = 0x3e
+
+	subevtConnectionComplete        = 0x01
+	subevtAdvertisingReport         = 0x02
+	subevtConnectionUpdateComplete  = 0x03
+	subevtLongTermKeyRequest        = 0x05
+	subevtDataLengthChange          = 0x07
+	subevtReadLocalP256Complete     = 0x08
+	subevtGenerateDHKeyComplete     = 0x09
+	subevtPHYUpdateComplete         = 0x0c
+	subevtExtendedAdvertisingReport = 0x0d
+
+	statusSuccess               = 0x00
+	errUnknownCommand           = 0x01
+	errUnknownConnection        = 0x02
+	errPinOrKeyMissing          = 0x06
+	errMemoryCapacityExceeded   = 0x07
+	errConnectionTimeout        = 0x08
+	errCommandDisallowed        = 0x0c
+	errInvalidParameters        = 0x12
+	errLocalHostTerminated      = 0x16
+	errUnacceptableConnInterval = 0x3b
+	errMICFailure               = 0x3d
+	errUnknownAdvertisingSet    = 0x42
+
+	roleCentral    = 0x00
+	rolePeripheral = 0x01
+
+	addrTypePublic = 0x00
+	addrTypeRandom = 0x01
+
+	advInd           = 0x00
+	advDirectIndHigh = 0x01
+	advScanInd       = 0x02
+	advNonconnInd    = 0x03
+	advDirectIndLow  = 0x04
+	reportScanRsp    = 0x04
+
+	// Advertising event properties of advertising sets, which are also the
+	// event type bits of extended advertising reports.
+	propConnectable       = 0x0001
+	propScannable         = 0x0002
+	propDirected          = 0x0004
+	propHighDutyCycle     = 0x0008
+	propLegacy            = 0x0010
+	propIncludeTxPower    = 0x0040
+	reportScanResponse    = 0x0008
+	reportDataIncomplete  = 0x0020
+	phy1M                 = 0x01
+	phyCoded              = 0x03
+	sidNone               = 0xff
+	txPowerNotAvailable   = 0x7f
+	maxAdvertisingSets    = 4
+	maxAdvertisingSetData = 1650
+
+	// Maximum amount of data in a single LE Extended Advertising Report, so
+	// that the event fits in 255 bytes.
+	maxReportDataLength = 229
+
+	maxDataLength = 31
+
+	// Range of the payload of link layer data packets, for LE Set Data Length.
+	minLinkDataLength = 27
+	maxLinkDataLength = 251
+	phy2M             = 0x02
+
+	// Buffer size reported by LE Read Buffer Size.
+	aclDataLength   = 27
+	aclDataPackets  = 8
+	hciVersion      = 0x09 // Bluetooth 5.0
+	manufacturerID  = 0xffff
+	leFeatureCrypto = 0x01 // LE Encryption
+)
+
+// opcode builds an HCI command opcode from its group and command fields.
+func opcode(ogf, ocf uint16) uint16 {
+	return ogf<<10 | ocf
+}
+
+var (
+	opDisconnect               = opcode(0x01, 0x0006)
+	opSetEventMask             = opcode(0x03, 0x0001)
+	opReset                    = opcode(0x03, 0x0003)
+	opReadLocalVersion         = opcode(0x04, 0x0001)
+	opReadBDAddr               = opcode(0x04, 0x0009)
+	opReadRSSI                 = opcode(0x05, 0x0005)
+	opLESetEventMask           = opcode(0x08, 0x0001)
+	opLEReadBufferSize         = opcode(0x08, 0x0002)
+	opLEReadLocalFeatures      = opcode(0x08, 0x0003)
+	opLESetRandomAddress       = opcode(0x08, 0x0005)
+	opLESetAdvertisingParams   = opcode(0x08, 0x0006)
+	opLESetAdvertisingData     = opcode(0x08, 0x0008)
+	opLESetScanResponseData    = opcode(0x08, 0x0009)
+	opLESetAdvertiseEnable     = opcode(0x08, 0x000a)
+	opLESetScanParameters      = opcode(0x08, 0x000b)
+	opLESetScanEnable          = opcode(0x08, 0x000c)
+	opLECreateConnection       = opcode(0x08, 0x000d)
+	opLECreateConnectionCancel = opcode(0x08, 0x000e)
+	opLEConnectionUpdate       = opcode(0x08, 0x0013)
+	opLEEncrypt                = opcode(0x08, 0x0017)
+	opLERand                   = opcode(0x08, 0x0018)
+	opLEStartEncryption        = opcode(0x08, 0x0019)
+	opLELongTermKeyReply       = opcode(0x08, 0x001a)
+	opLELongTermKeyNegReply    = opcode(0x08, 0x001b)
+	opLEReadLocalP256          = opcode(0x08, 0x0025)
+	opLEGenerateDHKey          = opcode(0x08, 0x0026)
+	opLESetDataLength          = opcode(0x08, 0x0022)
+	opLESetPHY                 = opcode(0x08, 0x0032)
+
+	opLESetAdvertisingSetRandomAddr  = opcode(0x08, 0x0035)
+	opLESetExtendedAdvertisingParams = opcode(0x08, 0x0036)
+	opLESetExtendedAdvertisingData   = opcode(0x08, 0x0037)
+	opLESetExtendedScanResponseData  = opcode(0x08, 0x0038)
+	opLESetExtendedAdvertisingEnable = opcode(0x08, 0x0039)
+	opLEReadMaxAdvertisingDataLength = opcode(0x08, 0x003a)
+	opLEReadNumberOfAdvertisingSets  = opcode(0x08, 0x003b)
+	opLERemoveAdvertisingSet         = opcode(0x08, 0x003c)
+	opLESetExtendedScanParameters    = opcode(0x08, 0x0041)
+	opLESetExtendedScanEnable        = opcode(0x08, 0x0042)
+	opLEExtendedCreateConnection     = opcode(0x08, 0x0043)
+)
+
+// commandSetOf returns the set of advertising, scanning and initiating
+// commands the command belongs to, or commandsUnknown for other commands.
+func commandSetOf(op uint16) commandSet {
+	switch op {
+	case opLESetAdvertisingParams, opLESetAdvertisingData, opLESetScanResponseData,
+		opLESetAdvertiseEnable, opLESetScanParameters, opLESetScanEnable, opLECreateConnection:
+		return commandsLegacy
+	case opLESetExtendedAdvertisingParams, opLESetExtendedAdvertisingData, opLESetExtendedScanResponseData,
+		opLESetExtendedAdvertisingEnable, opLEReadMaxAdvertisingDataLength, opLEReadNumberOfAdvertisingSets,
+		opLERemoveAdvertisingSet, opLESetExtendedScanParameters, opLESetExtendedScanEnable, opLEExtendedCreateConnection:
+		return commandsExtended
+	}
+
+	return commandsUnknown
+}
+
+// legacyProperties returns the advertising event properties of a legacy
+// advertising type.
+func legacyProperties(typ uint8) uint16 {
+	switch typ {
+	case advInd:
+		return propLegacy | propScannable | propConnectable
+	case advDirectIndHigh:
+		return propLegacy | propHighDutyCycle | propDirected | propConnectable
+	case advDirectIndLow:
+		return propLegacy | propDirected | propConnectable
+	case advScanInd:
+		return propLegacy | propScannable
+	default:
+		return propLegacy
+	}
+}
+
+// handleCommand executes a single HCI command and sends the resulting events
+// to the host.
+func (c *Controller) handleCommand(op uint16, params []byte) {
+	if commands := commandSetOf(op); commands != commandsUnknown && !c.useCommands(commands) {
+		if op == opLECreateConnection || op == opLEExtendedCreateConnection {
+			c.commandStatus(op, errCommandDisallowed)
+		} else {
+			c.commandComplete(op, errCommandDisallowed)
+		}
+		return
+	}
+
+	switch op {
+	case opReset:
+		c.resetState()
+		for _, l := range c.links {
+			delete(c.links, l.handle)
+			delete(l.peer.links, l.remote.handle)
+			l.peer.send(disconnectionComplete(l.remote.handle, errConnectionTimeout))
+		}
+		c.commandComplete(op, statusSuccess)
+
+	case opSetEventMask, opLESetEventMask:
+		// All events are always sent.
+		c.commandComplete(op, statusSuccess)
+
+	case opReadLocalVersion:
+		var b [8]byte
+		b[0] = hciVersion
+		b[3] = hciVersion
+		binary.LittleEndian.PutUint16(b[4:], manufacturerID)
+		c.commandComplete(op, statusSuccess, b[:]...)
+
+	case opReadBDAddr:
+		c.commandComplete(op, statusSuccess, c.address[:]...)
+
+	case opReadRSSI:
+		if len(params) < 2 {
+			c.commandComplete(op, errInvalidParameters)
+			return
+		}
+		handle := binary.LittleEndian.Uint16(params)
+		if _, ok := c.links[handle]; !ok {
+			c.commandComplete(op, errUnknownConnection, params[0], params[1], 0)
+			return
+		}
+		c.commandComplete(op, statusSuccess, params[0], params[1], byte(RSSI&0xff))
+
+	case opLEReadBufferSize:
+		var b [3]byte
+		binary.LittleEndian.PutUint16(b[:], aclDataLength)
+		b[2] = aclDataPackets
+		c.commandComplete(op, statusSuccess, b[:]...)
+
+	case opLEReadLocalFeatures:
+		c.commandComplete(op, statusSuccess, leFeatureCrypto, 0, 0, 0, 0, 0, 0, 0)
+
+	case opLESetRandomAddress:
+		if len(params) != 6 {
+			c.commandComplete(op, errInvalidParameters)
+			return
+		}
+		if c.adv.advertising != nil {
+			// The address of a legacy advertisement can't change while it
+			// is sent.
+			c.commandComplete(op, errCommandDisallowed)
+			return
+		}
+		copy(c.randomAddress[:], params)
+		c.commandComplete(op, statusSuccess)
+
+	case opLESetAdvertisingParams:
+		if len(params) != 15 || c.adv.advertising != nil {
+			c.commandComplete(op, errCommandDisallowed)
+			return
+		}
+		minInterval := binary.LittleEndian.Uint16(params[0:])
+		maxInterval := binary.LittleEndian.Uint16(params[2:])
+		typ := params[4]
+		directed := typ == advDirectIndHigh || typ == advDirectIndLow
+		if typ > advDirectIndLow || (!directed && (minInterval < 0x0020 || minInterval > maxInterval)) {
+			c.commandComplete(op, errInvalidParameters)
+			return
+		}
+		if typ == advDirectIndHigh {
+			// high duty cycle directed advertising is sent every 3.75ms
+			minInterval = 6
+		}
+		c.adv.params = advertisingParams{
+			minInterval: minInterval,
+			ownAddrType: params[5],
+			direct:      peerAddress{typ: params[6]},
+		}
+		c.adv.properties = legacyProperties(typ)
+		copy(c.adv.params.direct.address[:], params[7:13])
+		c.commandComplete(op, statusSuccess)
+
+	case opLESetAdvertisingData, opLESetScanResponseData:
+		if len(params) < 1 || params[0] > maxDataLength || len(params) < 1+int(params[0]) {
+			c.commandComplete(op, errInvalidParameters)
+			return
+		}
+		data := slices.Clone(params[1 : 1+params[0]])
+		if op == opLESetAdvertisingData {
+			c.adv.data = data
+		} else {
+			c.adv.scanRspData = data
+		}
+		c.commandComplete(op, statusSuccess)
+
+	case opLESetAdvertiseEnable:
+		if len(params) != 1 || params[0] > 1 {
+			c.commandComplete(op, errInvalidParameters)
+			return
+		}
+		switch {
+		case params[0] == 1 && c.adv.advertising == nil:
+			c.startAdvertising(&c.adv)
+		case params[0] == 0:
+			c.adv.stop()
+		}
+		c.commandComplete(op, statusSuccess)
+
+	case opLESetScanParameters:
+		if len(params) != 7 || c.scanning {
+			c.commandComplete(op, errCommandDisallowed)
+			return
+		}
+		c.scan = scanParams{
+			active:      params[0] == 1,
+			ownAddrType: params[5],
+			phys:        1 << (phy1M - 1),
+		}
+		c.commandComplete(op, statusSuccess)
+
+	case opLESetScanEnable:
+		if len(params) != 2 || params[0] > 1 || params[1] > 1 {
+			c.commandComplete(op, errInvalidParameters)
+			return
+		}
+		c.scanning = params[0] == 1
+		c.scan.filter = params[1] == 1
+		c.scanSeen = make(map[seenKey]bool)
+		c.commandComplete(op, statusSuccess)
+
+	case opLESetAdvertisingSetRandomAddr:
+		if len(params) != 7 {
+			c.commandComplete(op, errInvalidParameters)
+			return
+		}
+		set := c.sets[params[0]]
+		if set == nil {
+			c.commandComplete(op, errUnknownAdvertisingSet)
+			return
+		}
+		copy(set.randomAddress[:], params[1:])
+		c.commandComplete(op, statusSuccess)
+
+	case opLESetExtendedAdvertisingParams:
+		c.setExtendedAdvertisingParams(op, params)
+
+	case opLESetExtendedAdvertisingData, opLESetExtendedScanResponseData:
+		c.setExtendedAdvertisingData(op, params)
+
+	case opLESetExtendedAdvertisingEnable:
+		if len(params) < 2 || params[0] > 1 || len(params) != 2+4*int(params[1]) || (params[0] == 1 && params[1] == 0) {
+			c.commandComplete(op, errInvalidParameters)
+			return
+		}
+		if params[1] == 0 {
+			// disable all sets
+			for _, set := range c.sets {
+				set.stop()
+			}
+			c.commandComplete(op, statusSuccess)
+			return
+		}
+		for i := 0; i < int(params[1]); i++ {
+			if c.sets[params[2+4*i]] == nil {
+				c.commandComplete(op, errUnknownAdvertisingSet)
+				return
+			}
+		}
+		for i := 0; i < int(params[1]); i++ {
+			set := c.sets[params[2+4*i]]
+			switch {
+			case params[0] == 1 && set.advertising == nil:
+				c.startAdvertising(set)
+			case params[0] == 0:
+				set.stop()
+			}
+		}
+		c.commandComplete(op, statusSuccess)
+
+	case opLEReadMaxAdvertisingDataLength:
+		c.commandComplete(op, statusSuccess, byte(maxAdvertisingSetData&0xff), byte(maxAdvertisingSetData>>8))
+
+	case opLEReadNumberOfAdvertisingSets:
+		c.commandComplete(op, statusSuccess, maxAdvertisingSets)
+
+	case opLERemoveAdvertisingSet:
+		if len(params) != 1 {
+			c.commandComplete(op, errInvalidParameters)
+			return
+		}
+		set := c.sets[params[0]]
+		switch {
+		case set == nil:
+			c.commandComplete(op, errUnknownAdvertisingSet)
+		case set.advertising != nil:
+			c.commandComplete(op, errCommandDisallowed)
+		default:
+			delete(c.sets, params[0])
+			c.commandComplete(op, statusSuccess)
+		}
+
+	case opLESetExtendedScanParameters:
+		if len(params) < 3 || params[2] == 0 || params[2]&^0x05 != 0 || len(params) != 3+5*bits.OnesCount8(params[2]) {
+			c.commandComplete(op, errInvalidParameters)
+			return
+		}
+		if c.scanning {
+			c.commandComplete(op, errCommandDisallowed)
+			return
+		}
+		// The scan type of the first PHY is used for all PHYs.
+		c.scan = scanParams{
+			active:      params[3] == 1,
+			ownAddrType: params[0],
+			extended:    true,
+			phys:        params[2],
+		}
+		c.commandComplete(op, statusSuccess)
+
+	case opLESetExtendedScanEnable:
+		if len(params) != 6 || params[0] > 1 || params[1] > 2 {
+			c.commandComplete(op, errInvalidParameters)
+			return
+		}
+		c.scanning = params[0] == 1
+		c.scan.filter = params[1] != 0
+		c.scanSeen = make(map[seenKey]bool)
+		c.commandComplete(op, statusSuccess)
+
+	case opLECreateConnection:
+		if len(params) != 25 {
+			c.commandStatus(op, errInvalidParameters)
+			return
+		}
+		peer := peerAddress{typ: params[5]}
+		copy(peer.address[:], params[6:12])
+		c.createConnection(op, peer, params[12], params[13:])
+
+	case opLEExtendedCreateConnection:
+		// The connection parameters of the first PHY are used for all PHYs.
+		if len(params) < 10 || params[9] == 0 || params[9]&^0x07 != 0 || len(params) != 10+16*bits.OnesCount8(params[9]) {
+			c.commandStatus(op, errInvalidParameters)
+			return
+		}
+		peer := peerAddress{typ: params[2]}
+		copy(peer.address[:], params[3:9])
+		c.createConnection(op, peer, params[1], params[14:])
+
+	case opLECreateConnectionCancel:
+		if c.initiating == nil {
+			c.commandComplete(op, errCommandDisallowed)
+			return
+		}
+		c.initiating = nil
+		c.commandComplete(op, statusSuccess)
+		c.send(leConnectionComplete(errUnknownConnection, &link{}, roleCentral, peerAddress{}))
+
+	case opLEConnectionUpdate:
+		if len(params) != 14 {
+			c.commandStatus(op, errInvalidParameters)
+			return
+		}
+		l, ok := c.links[binary.LittleEndian.Uint16(params)]
+		if !ok {
+			c.commandStatus(op, errUnknownConnection)
+			return
+		}
+		minInterval := binary.LittleEndian.Uint16(params[2:])
+		maxInterval := binary.LittleEndian.Uint16(params[4:])
+		latency := binary.LittleEndian.Uint16(params[6:])
+		timeout := binary.LittleEndian.Uint16(params[8:])
+		if !validConnectionParams(minInterval, maxInterval, latency, timeout) {
+			c.commandStatus(op, errInvalidParameters)
+			return
+		}
+		c.commandStatus(op, statusSuccess)
+		for _, end := range []*link{l, l.remote} {
+			end.interval, end.latency, end.timeout = minInterval, latency, timeout
+		}
+		c.send(leConnectionUpdateComplete(l))
+		l.peer.send(leConnectionUpdateComplete(l.remote))
+
+	case opLESetDataLength:
+		if len(params) != 6 {
+			c.commandComplete(op, errInvalidParameters)
+			return
+		}
+		l, ok := c.links[binary.LittleEndian.Uint16(params)]
+		if !ok {
+			c.commandComplete(op, errUnknownConnection, params[0], params[1])
+			return
+		}
+		txOctets := binary.LittleEndian.Uint16(params[2:])
+		if txOctets < minLinkDataLength || txOctets > maxLinkDataLength {
+			c.commandComplete(op, errInvalidParameters, params[0], params[1])
+			return
+		}
+		c.commandComplete(op, statusSuccess, params[0], params[1])
+		// The peer always accepts the largest data length.
+		if l.txOctets != txOctets {
+			l.txOctets, l.remote.rxOctets = txOctets, txOctets
+			c.send(leDataLengthChange(l))
+			l.peer.send(leDataLengthChange(l.remote))
+		}
+
+	case opLESetPHY:
+		if len(params) != 7 {
+			c.commandStatus(op, errInvalidParameters)
+			return
+		}
+		l, ok := c.links[binary.LittleEndian.Uint16(params)]
+		if !ok {
+			c.commandStatus(op, errUnknownConnection)
+			return
+		}
+		txPHY, txOK := preferredPHY(params[2]&0x01 != 0, params[3], l.txPHY)
+		rxPHY, rxOK := preferredPHY(params[2]&0x02 != 0, params[4], l.rxPHY)
+		if !txOK || !rxOK {
+			c.commandStatus(op, errInvalidParameters)
+			return
+		}
+		c.commandStatus(op, statusSuccess)
+		// The peer accepts every PHY, and is only told about changes.
+		changed := txPHY != l.txPHY || rxPHY != l.rxPHY
+		l.txPHY, l.remote.rxPHY = txPHY, txPHY
+		l.rxPHY, l.remote.txPHY = rxPHY, rxPHY
+		c.send(lePHYUpdateComplete(l))
+		if changed {
+			l.peer.send(lePHYUpdateComplete(l.remote))
+		}
+
+	case opDisconnect:
+		if len(params) != 3 {
+			c.commandStatus(op, errInvalidParameters)
+			return
+		}
+		l, ok := c.links[binary.LittleEndian.Uint16(params)]
+		if !ok {
+			c.commandStatus(op, errUnknownConnection)
+			return
+		}
+		c.commandStatus(op, statusSuccess)
+		c.terminate(l, errLocalHostTerminated, params[2])
+
+	case opLEEncrypt:
+		if len(params) != 32 {
+			c.commandComplete(op, errInvalidParameters)
+			return
+		}
+		// Key, plaintext and result are all least significant octet first.
+		key := slices.Clone(params[:16])
+		data := slices.Clone(params[16:])
+		slices.Reverse(key)
+		slices.Reverse(data)
+		block, _ := aes.NewCipher(key)
+		block.Encrypt(data, data)
+		slices.Reverse(data)
+		c.commandComplete(op, statusSuccess, data...)
+
+	case opLERand:
+		var b [8]byte
+		rand.Read(b[:])
+		c.commandComplete(op, statusSuccess, b[:]...)
+
+	case opLEStartEncryption:
+		if len(params) != 28 {
+			c.commandStatus(op, errInvalidParameters)
+			return
+		}
+		l, ok := c.links[binary.LittleEndian.Uint16(params)]
+		if !ok {
+			c.commandStatus(op, errUnknownConnection)
+			return
+		}
+		if l.pendingKey != nil {
+			c.commandStatus(op, errCommandDisallowed)
+			return
+		}
+		c.commandStatus(op, statusSuccess)
+		// The peripheral host looks up the key by EDIV and Rand.
+		l.pendingKey = slices.Clone(params[12:28])
+		l.peer.send(event(evtLEMeta, append([]byte{subevtLongTermKeyRequest,
+			byte(l.remote.handle), byte(l.remote.handle >> 8)}, params[2:12]...)...))
+
+	case opLELongTermKeyReply, opLELongTermKeyNegReply:
+		if op == opLELongTermKeyReply && len(params) != 18 || op == opLELongTermKeyNegReply && len(params) != 2 {
+			c.commandComplete(op, errInvalidParameters)
+			return
+		}
+		l, ok := c.links[binary.LittleEndian.Uint16(params)]
+		if !ok {
+			c.commandComplete(op, errUnknownConnection, params[0], params[1])
+			return
+		}
+		central := l.remote
+		if central.pendingKey == nil {
+			c.commandComplete(op, errCommandDisallowed, params[0], params[1])
+			return
+		}
+		c.commandComplete(op, statusSuccess, params[0], params[1])
+		key := central.pendingKey
+		central.pendingKey = nil
+		switch {
+		case op == opLELongTermKeyNegReply:
+			l.peer.send(encryptionChange(central, errPinOrKeyMissing))
+		case !bytes.Equal(key, params[2:]):
+			// Both ends fail to decrypt each other's packets.
+			c.terminate(l, errMICFailure, errMICFailure)
+		case l.encrypted:
+			c.send(encryptionKeyRefresh(l))
+			l.peer.send(encryptionKeyRefresh(central))
+		default:
+			l.encrypted, central.encrypted = true, true
+			c.send(encryptionChange(l, statusSuccess))
+			l.peer.send(encryptionChange(central, statusSuccess))
+		}
+
+	case opLEReadLocalP256:
+		c.commandStatus(op, statusSuccess)
+		key, err := ecdh.P256().GenerateKey(rand.Reader)
+		if err != nil {
+			c.send(event(evtLEMeta, subevtReadLocalP256Complete, errMemoryCapacityExceeded))
+			return
+		}
+		c.privateKey = key
+		// Both coordinates, least significant octet first.
+		public := key.PublicKey().Bytes()[1:]
+		slices.Reverse(public[:32])
+		slices.Reverse(public[32:])
+		c.send(event(evtLEMeta, append([]byte{subevtReadLocalP256Complete, statusSuccess}, public...)...))
+
+	case opLEGenerateDHKey:
+		if len(params) != 64 {
+			c.commandStatus(op, errInvalidParameters)
+			return
+		}
+		if c.privateKey == nil {
+			c.commandStatus(op, errCommandDisallowed)
+			return
+		}
+		c.commandStatus(op, statusSuccess)
+		remote := append([]byte{0x04}, params...)
+		slices.Reverse(remote[1:33])
+		slices.Reverse(remote[33:])
+		var dhKey []byte
+		public, err := ecdh.P256().NewPublicKey(remote)
+		if err == nil {
+			dhKey, err = c.privateKey.ECDH(public)
+		}
+		if err != nil {
+			// The remote public key is not a point on the curve.
+			c.send(event(evtLEMeta, append([]byte{subevtGenerateDHKeyComplete, errInvalidParameters},
+				make([]byte, 32)...)...))
+			return
+		}
+		slices.Reverse(dhKey)
+		c.send(event(evtLEMeta, append([]byte{subevtGenerateDHKeyComplete, statusSuccess}, dhKey...)...))
+
+	default:
+		c.commandComplete(op, errUnknownCommand)
+	}
+}
+
+// createConnection starts initiating a connection. The connection parameters
+// start with the minimum connection interval, as in LE Create Connection.
+func (c *Controller) createConnection(op uint16, peer peerAddress, ownAddrType uint8, params []byte) {
+	if c.initiating != nil {
+		c.commandStatus(op, errCommandDisallowed)
+		return
+	}
+	req := &initiator{
+		peer:        peer,
+		ownAddrType: ownAddrType,
+		interval:    binary.LittleEndian.Uint16(params[0:]),
+		latency:     binary.LittleEndian.Uint16(params[4:]),
+		timeout:     binary.LittleEndian.Uint16(params[6:]),
+	}
+	maxInterval := binary.LittleEndian.Uint16(params[2:])
+	if !validConnectionParams(req.interval, maxInterval, req.latency, req.timeout) {
+		c.commandStatus(op, errUnacceptableConnInterval)
+		return
+	}
+	c.initiating = req
+	c.commandStatus(op, statusSuccess)
+}
+
+// setExtendedAdvertisingParams handles LE Set Extended Advertising
+// Parameters, which creates the advertising set if it doesn't exist yet.
+func (c *Controller) setExtendedAdvertisingParams(op uint16, params []byte) {
+	if len(params) != 25 || params[0] > 0xef {
+		c.commandComplete(op, errInvalidParameters)
+		return
+	}
+	set := c.sets[params[0]]
+	if set == nil && len(c.sets) >= maxAdvertisingSets {
+		c.commandComplete(op, errMemoryCapacityExceeded)
+		return
+	}
+	if set != nil && set.advertising != nil {
+		c.commandComplete(op, errCommandDisallowed)
+		return
+	}
+
+	properties := binary.LittleEndian.Uint16(params[1:])
+	minInterval := uint32(params[3]) | uint32(params[4])<<8 | uint32(params[5])<<16
+	maxInterval := uint32(params[6]) | uint32(params[7])<<8 | uint32(params[8])<<16
+	primaryPHY, secondaryPHY := params[20], params[22]
+	if minInterval > 0xffff {
+		minInterval = 0xffff
+	}
+
+	valid := primaryPHY == phy1M || primaryPHY == phyCoded
+	if properties&propLegacy != 0 {
+		switch properties &^ propIncludeTxPower {
+		case legacyProperties(advInd), legacyProperties(advDirectIndHigh), legacyProperties(advDirectIndLow),
+			legacyProperties(advScanInd), legacyProperties(advNonconnInd):
+		default:
+			valid = false
+		}
+		valid = valid && primaryPHY == phy1M
+	} else {
+		// Extended advertisements are either connectable or scannable.
+		valid = valid && properties&(propConnectable|propScannable) != propConnectable|propScannable &&
+			properties&propHighDutyCycle == 0 && secondaryPHY >= phy1M && secondaryPHY <= phyCoded
+	}
+	if properties&propHighDutyCycle == 0 && (minInterval < 0x0020 || minInterval > maxInterval) {
+		valid = false
+	}
+	if !valid {
+		c.commandComplete(op, errInvalidParameters)
+		return
+	}
+	if properties&propHighDutyCycle != 0 {
+		// high duty cycle directed advertising is sent every 3.75ms
+		minInterval = 6
+	}
+
+	// Every requested transmit power is supported, within a sensible range.
+	txPower := int8(params[19])
+	switch {
+	case txPower == txPowerNotAvailable:
+		txPower = 0
+	case txPower < -20:
+		txPower = -20
+	case txPower > 10:
+		txPower = 10
+	}
+
+	if set == nil {
+		set = &advertisingSet{}
+		c.sets[params[0]] = set
+	}
+	set.params = advertisingParams{
+		minInterval: uint16(minInterval),
+		ownAddrType: params[10],
+		direct:      peerAddress{typ: params[11]},
+	}
+	copy(set.params.direct.address[:], params[12:18])
+	set.properties = properties
+	set.sid = params[23] & 0x0f
+	set.primaryPHY = primaryPHY
+	set.secondaryPHY = secondaryPHY
+	set.txPower = txPower
+	c.commandComplete(op, statusSuccess, byte(txPower))
+}
+
+// setExtendedAdvertisingData handles LE Set Extended Advertising Data and LE
+// Set Extended Scan Response Data, which may set the data in fragments.
+func (c *Controller) setExtendedAdvertisingData(op uint16, params []byte) {
+	if len(params) < 4 || len(params) != 4+int(params[3]) || params[1] > 3 {
+		c.commandComplete(op, errInvalidParameters)
+		return
+	}
+	set := c.sets[params[0]]
+	if set == nil {
+		c.commandComplete(op, errUnknownAdvertisingSet)
+		return
+	}
+	scanResponse := op == opLESetExtendedScanResponseData
+	if (scanResponse && !set.scannable()) || (set.legacy() && (params[1] != 3 || params[3] > maxDataLength)) {
+		c.commandComplete(op, errInvalidParameters)
+		return
+	}
+
+	operation, fragment := params[1], params[4:]
+	if operation == 1 || operation == 3 {
+		// first fragment or complete data
+		set.pending = nil
+	}
+	if len(set.pending)+len(fragment) > maxAdvertisingSetData {
+		set.pending = nil
+		c.commandComplete(op, errMemoryCapacityExceeded)
+		return
+	}
+	set.pending = append(set.pending, fragment...)
+	if operation == 2 || operation == 3 {
+		// last fragment or complete data
+		if scanResponse {
+			set.scanRspData = set.pending
+		} else {
+			set.data = set.pending
+		}
+		set.pending = nil
+	}
+	c.commandComplete(op, statusSuccess)
+}
+
+// validConnectionParams checks connection parameters against the ranges
+// allowed by the specification.
+func validConnectionParams(minInterval, maxInterval, latency, timeout uint16) bool {
+	switch {
+	case minInterval < 0x0006 || maxInterval > 0x0c80 || minInterval > maxInterval:
+		return false
+	case latency > 0x01f3:
+		return false
+	case timeout < 0x000a || timeout > 0x0c80:
+		return false
+	}
+
+	// The supervision timeout (in 10ms units) must be larger than
+	// (1 + latency) * interval * 2 (interval in 1.25ms units).
+	return uint32(timeout)*8 > (1+uint32(latency))*uint32(maxInterval)*2
+}
+
+// preferredPHY picks the PHY for one direction of a connection from the PHYs
+// preferred by the host, favoring the fastest. Without a preference, the
+// current PHY is kept.
+func preferredPHY(noPreference bool, phys uint8, current uint8) (uint8, bool) {
+	switch {
+	case noPreference:
+		return current, true
+	case phys&0x02 != 0:
+		return phy2M, true
+	case phys&0x01 != 0:
+		return phy1M, true
+	case phys&0x04 != 0:
+		return phyCoded, true
+	}
+
+	return 0, false
+}
+
+func (c *Controller) commandComplete(op uint16, status uint8, params ...byte) {
+	evt := []byte{packetEvent, evtCommandComplete, byte(4 + len(params)), 1, byte(op), byte(op >> 8), status}
+	c.send(append(evt, params...))
+}
+
+func (c *Controller) commandStatus(op uint16, status uint8) {
+	c.send([]byte{packetEvent, evtCommandStatus, 4, status, 1, byte(op), byte(op >> 8)})
+}
+
+func event(code uint8, params ...byte) []byte {
+	return append([]byte{packetEvent, code, byte(len(params))}, params...)
+}
+
+func disconnectionComplete(handle uint16, reason uint8) []byte {
+	return event(evtDisconnectionComplete, statusSuccess, byte(handle), byte(handle>>8), reason)
+}
+
+func encryptionChange(l *link, status uint8) []byte {
+	enabled := uint8(0)
+	if l.encrypted {
+		enabled = 1
+	}
+	return event(evtEncryptionChange, status, byte(l.handle), byte(l.handle>>8), enabled)
+}
+
+func encryptionKeyRefresh(l *link) []byte {
+	return event(evtEncryptionKeyRefresh, statusSuccess, byte(l.handle), byte(l.handle>>8))
+}
+
+func numberOfCompletedPackets(handle uint16, count uint16) []byte {
+	return event(evtNumberOfCompletedPackets, 1, byte(handle), byte(handle>>8), byte(count), byte(count>>8))
+}
+
+func leAdvertisingReport(typ uint8, addr peerAddress, data []byte) []byte {
+	params := []byte{subevtAdvertisingReport, 1, typ, addr.typ}
+	params = append(params, addr.address[:]...)
+	params = append(params, byte(len(data)))
+	params = append(params, data...)
+	params = append(params, byte(RSSI&0xff))
+
+	return event(evtLEMeta, params...)
+}
+
+// leExtendedAdvertisingReports returns the LE Extended Advertising Report
+// events of an advertisement, with the data split over as many events as
+// needed.
+func leExtendedAdvertisingReports(eventType uint16, set *advertisingSet, addr peerAddress, data []byte) [][]byte {
+	primaryPHY, secondaryPHY, sid, txPower := uint8(phy1M), uint8(0), uint8(sidNone), int8(txPowerNotAvailable)
+	if !set.legacy() {
+		primaryPHY, secondaryPHY, sid = set.primaryPHY, set.secondaryPHY, set.sid
+		if set.properties&propIncludeTxPower != 0 {
+			txPower = set.txPower
+		}
+	}
+
+	var events [][]byte
+	for {
+		fragment := data
+		status := uint16(0)
+		if len(fragment) > maxReportDataLength {
+			fragment = fragment[:maxReportDataLength]
+			status = reportDataIncomplete
+		}
+		data = data[len(fragment):]
+
+		var b [26]byte
+		b[0] = subevtExtendedAdvertisingReport
+		b[1] = 1 // number of reports
+		binary.LittleEndian.PutUint16(b[2:], eventType|status)
+		b[4] = addr.typ
+		copy(b[5:], addr.address[:])
+		b[11] = primaryPHY
+		b[12] = secondaryPHY
+		b[13] = sid
+		b[14] = byte(txPower)
+		b[15] = byte(RSSI & 0xff)
+		// no periodic advertising or direct address
+		b[25] = byte(len(fragment))
+		events = append(events, event(evtLEMeta, append(b[:], fragment...)...))
+
+		if status == 0 {
+			return events
+		}
+	}
+}
+
+func leConnectionComplete(status uint8, l *link, role uint8, peer peerAddress) []byte {
+	var b [19]byte
+	b[0] = subevtConnectionComplete
+	b[1] = status
+	binary.LittleEndian.PutUint16(b[2:], l.handle)
+	b[4] = role
+	b[5] = peer.typ
+	copy(b[6:], peer.address[:])
+	binary.LittleEndian.PutUint16(b[12:], l.interval)
+	binary.LittleEndian.PutUint16(b[14:], l.latency)
+	binary.LittleEndian.PutUint16(b[16:], l.timeout)
+	b[18] = 0 // central clock accuracy
+
+	return event(evtLEMeta, b[:]...)
+}
+
+func leDataLengthChange(l *link) []byte {
+	var b [11]byte
+	b[0] = subevtDataLengthChange
+	binary.LittleEndian.PutUint16(b[1:], l.handle)
+	binary.LittleEndian.PutUint16(b[3:], l.txOctets)
+	binary.LittleEndian.PutUint16(b[5:], (l.txOctets+14)*8)
+	binary.LittleEndian.PutUint16(b[7:], l.rxOctets)
+	binary.LittleEndian.PutUint16(b[9:], (l.rxOctets+14)*8)
+
+	return event(evtLEMeta, b[:]...)
+}
+
+func lePHYUpdateComplete(l *link) []byte {
+	return event(evtLEMeta, subevtPHYUpdateComplete, statusSuccess,
+		byte(l.handle), byte(l.handle>>8), l.txPHY, l.rxPHY)
+}
+
+func leConnectionUpdateComplete(l *link) []byte {
+	var b [10]byte
+	b[0] = subevtConnectionUpdateComplete
+	b[1] = statusSuccess
+	binary.LittleEndian.PutUint16(b[2:], l.handle)
+	binary.LittleEndian.PutUint16(b[4:], l.interval)
+	binary.LittleEndian.PutUint16(b[6:], l.latency)
+	binary.LittleEndian.PutUint16(b[8:], l.timeout)
+
+	return event(evtLEMeta, b[:]...)
+}
@@ -0,0 +1,598 @@
+// Package virtualhci implements virtual Bluetooth Low Energy controllers that
+// speak the HCI protocol and are linked over a simulated radio, so that a
+// central and a peripheral can be tested against each other in a single
+// process without any hardware.
+//
+// A Controller is the host end of an H4 transport: every Write carries one
+// command or ACL data packet and every Read returns one event or ACL data
+// packet, just like a Linux HCI user channel socket. It can be wrapped with
+// bluetooth.NewHCITransport when building with the hci tag:
+//
+//	air := virtualhci.NewAir()
+//	peripheral := bluetooth.NewAdapter(bluetooth.NewHCITransport(air.NewController(addr1)))
+//	central := bluetooth.NewAdapter(bluetooth.NewHCITransport(air.NewController(addr2)))
+//
+// The simulation is idealized: every advertising event is received by every
+// scanner, connections are established as soon as the initiator sees a
+// connectable advertisement, and no packets are lost.
+package virtualhci
+
+import (
+	"crypto/ecdh"
+	"encoding/binary"
+	"errors"
+	"io"
+	"sync"
+	"time"
+)
+
+// ErrClosed is returned when writing to a controller that has been closed.
+var ErrClosed = errors.New("virtualhci: controller closed")
+
+// RSSI is the signal strength reported for every received advertisement.
+const RSSI = -50
+
+// Air is the simulated radio medium that links virtual controllers together.
+// All controllers created from the same Air can see each other.
+type Air struct {
+	mu          sync.Mutex
+	controllers []*Controller
+}
+
+// NewAir returns a new, empty radio medium.
+func NewAir() *Air {
+	return &Air{}
+}
+
+// NewController creates a new controller on this medium with the given public
+// device address. The address is in HCI byte order, which means the least
+// significant byte comes first.
+func (air *Air) NewController(address [6]byte) *Controller {
+	c := &Controller{
+		air:        air,
+		address:    address,
+		nextHandle: 0x0001,
+		links:      make(map[uint16]*link),
+		sets:       make(map[uint8]*advertisingSet),
+	}
+	c.resetState()
+	c.queueCond = sync.NewCond(&c.queueMu)
+
+	air.mu.Lock()
+	air.controllers = append(air.controllers, c)
+	air.mu.Unlock()
+
+	return c
+}
+
+// Controller is a virtual HCI controller. It is safe for concurrent use.
+type Controller struct {
+	air     *Air
+	address [6]byte
+
+	// Packets from the controller to the host.
+	queueMu   sync.Mutex
+	queueCond *sync.Cond
+	queue     [][]byte
+	closed    bool
+
+	// The following fields are protected by air.mu.
+	pending       []byte // partial packet written by the host
+	randomAddress [6]byte
+	commands      commandSet
+	adv           advertisingSet            // configured with the legacy commands
+	sets          map[uint8]*advertisingSet // configured with the extended commands
+	scan          scanParams
+	scanning      bool
+	scanSeen      map[seenKey]bool
+	initiating    *initiator
+	nextHandle    uint16
+	links         map[uint16]*link
+	privateKey    *ecdh.PrivateKey // generated by LE Read Local P-256 Public Key
+}
+
+// commandSet is the set of advertising, scanning and initiating commands that
+// is in use. Once the host has used a command of one set, the commands of the
+// other set are rejected until the next reset.
+type commandSet uint8
+
+const (
+	commandsUnknown commandSet = iota
+	commandsLegacy
+	commandsExtended
+)
+
+type peerAddress struct {
+	typ     uint8
+	address [6]byte
+}
+
+type advertisingParams struct {
+	minInterval uint16
+	ownAddrType uint8
+	direct      peerAddress
+}
+
+// advertisingSet is an advertisement, configured either with the legacy
+// advertising commands or as an extended advertising set. Legacy
+// advertisements use legacy advertising event properties.
+type advertisingSet struct {
+	params        advertisingParams
+	properties    uint16
+	sid           uint8
+	primaryPHY    uint8
+	secondaryPHY  uint8
+	txPower       int8
+	data          []byte
+	scanRspData   []byte
+	randomAddress [6]byte       // set with LE Set Advertising Set Random Address
+	pending       []byte        // fragments of data that is being set
+	advertising   chan struct{} // closed to stop advertising, nil if not advertising
+}
+
+func (set *advertisingSet) legacy() bool      { return set.properties&propLegacy != 0 }
+func (set *advertisingSet) connectable() bool { return set.properties&propConnectable != 0 }
+func (set *advertisingSet) scannable() bool   { return set.properties&propScannable != 0 }
+func (set *advertisingSet) directed() bool    { return set.properties&propDirected != 0 }
+
+// legacyReportType returns the event type of the LE Advertising Report of a
+// legacy advertisement.
+func (set *advertisingSet) legacyReportType() uint8 {
+	switch {
+	case set.directed():
+		return advDirectIndHigh
+	case set.connectable():
+		return advInd
+	case set.scannable():
+		return advScanInd
+	default:
+		return advNonconnInd
+	}
+}
+
+type scanParams struct {
+	active      bool
+	ownAddrType uint8
+	filter      bool
+	extended    bool
+	phys        uint8
+}
+
+// seenKey identifies an advertiser for duplicate filtering. Legacy
+// advertisements have no advertising set ID, they use sidNone.
+type seenKey struct {
+	addr peerAddress
+	sid  uint8
+}
+
+type initiator struct {
+	peer        peerAddress
+	ownAddrType uint8
+	interval    uint16
+	latency     uint16
+	timeout     uint16
+}
+
+// link is one end of a connection between two controllers.
+type link struct {
+	handle   uint16
+	peer     *Controller
+	remote   *link
+	interval uint16
+	latency  uint16
+	timeout  uint16
+
+	// Data length and PHYs of the link layer, as seen from this end.
+	txOctets uint16
+	rxOctets uint16
+	txPHY    uint8
+	rxPHY    uint8
+
+	// Encryption state. The key of an encryption started by the central is
+	// kept on its end until the peripheral host replies with its key.
+	encrypted  bool
+	pendingKey []byte
+}
+
+// Address returns the public device address of this controller, in HCI byte
+// order.
+func (c *Controller) Address() [6]byte {
+	return c.address
+}
+
+// Read returns the next packet sent by the controller to the host, prefixed
+// with its H4 packet indicator. It blocks until a packet is available. If p is
+// too small, the rest of the packet is discarded.
+func (c *Controller) Read(p []byte) (int, error) {
+	c.queueMu.Lock()
+	defer c.queueMu.Unlock()
+
+	for len(c.queue) == 0 {
+		if c.closed {
+			return 0, io.EOF
+		}
+		c.queueCond.Wait()
+	}
+
+	pkt := c.queue[0]
+	c.queue[0] = nil
+	c.queue = c.queue[1:]
+
+	return copy(p, pkt), nil
+}
+
+// Write processes packets sent by the host to the controller. Packets must be
+// prefixed with their H4 packet indicator, and may be split over multiple
+// writes.
+func (c *Controller) Write(p []byte) (int, error) {
+	c.air.mu.Lock()
+	defer c.air.mu.Unlock()
+
+	if c.isClosed() {
+		return 0, ErrClosed
+	}
+
+	c.pending = append(c.pending, p...)
+	for len(c.pending) > 0 {
+		n := packetLength(c.pending)
+		if n == 0 || n > len(c.pending) {
+			// wait for the rest of the packet
+			break
+		}
+
+		pkt := c.pending[:n]
+		switch pkt[0] {
+		case packetCommand:
+			c.handleCommand(binary.LittleEndian.Uint16(pkt[1:]), pkt[4:])
+		case packetACLData:
+			c.handleACLData(pkt[1:])
+		}
+		c.pending = c.pending[n:]
+	}
+	if len(c.pending) == 0 {
+		c.pending = nil
+	}
+
+	return len(p), nil
+}
+
+// Close removes the controller from the radio medium. Existing connections
+// are terminated with a connection timeout, and pending reads return io.EOF.
+func (c *Controller) Close() error {
+	c.air.mu.Lock()
+	defer c.air.mu.Unlock()
+
+	if c.isClosed() {
+		return nil
+	}
+
+	c.stopAdvertising()
+	for _, l := range c.links {
+		c.terminate(l, errConnectionTimeout, errConnectionTimeout)
+	}
+	for i, other := range c.air.controllers {
+		if other == c {
+			c.air.controllers = append(c.air.controllers[:i], c.air.controllers[i+1:]...)
+			break
+		}
+	}
+
+	c.queueMu.Lock()
+	c.closed = true
+	c.queueCond.Broadcast()
+	c.queueMu.Unlock()
+
+	return nil
+}
+
+func (c *Controller) isClosed() bool {
+	c.queueMu.Lock()
+	defer c.queueMu.Unlock()
+
+	return c.closed
+}
+
+// send queues a packet for the host.
+func (c *Controller) send(pkt []byte) {
+	c.queueMu.Lock()
+	defer c.queueMu.Unlock()
+
+	if c.closed {
+		return
+	}
+
+	c.queue = append(c.queue, pkt)
+	c.queueCond.Signal()
+}
+
+// resetState puts the controller back in its power-on state. Existing
+// connections are not touched.
+func (c *Controller) resetState() {
+	c.stopAdvertising()
+	c.commands = commandsUnknown
+	c.adv = advertisingSet{
+		params:     advertisingParams{minInterval: 0x0800},
+		properties: legacyProperties(advInd),
+		primaryPHY: phy1M,
+	}
+	for handle := range c.sets {
+		delete(c.sets, handle)
+	}
+	c.scan = scanParams{}
+	c.scanning = false
+	c.scanSeen = nil
+	c.initiating = nil
+	c.privateKey = nil
+}
+
+// useCommands checks that a command of the given set may be used, and
+// returns false if the other set is already in use.
+func (c *Controller) useCommands(commands commandSet) bool {
+	if c.commands == commandsUnknown {
+		c.commands = commands
+	}
+
+	return c.commands == commands
+}
+
+// ownAddress returns the device address that is used for the given own
+// address type.
+func (c *Controller) ownAddress(typ uint8) peerAddress {
+	if typ == addrTypeRandom {
+		return peerAddress{typ: addrTypeRandom, address: c.randomAddress}
+	}
+
+	return peerAddress{typ: addrTypePublic, address: c.address}
+}
+
+// advertisingAddress returns the device address the set advertises with.
+// Advertising sets have their own random address, the legacy advertisement
+// uses the random address of the controller.
+func (c *Controller) advertisingAddress(set *advertisingSet) peerAddress {
+	if set != &c.adv && set.params.ownAddrType == addrTypeRandom {
+		return peerAddress{typ: addrTypeRandom, address: set.randomAddress}
+	}
+
+	return c.ownAddress(set.params.ownAddrType)
+}
+
+// startAdvertising starts sending advertising events of the set every
+// advertising interval, starting right away.
+func (c *Controller) startAdvertising(set *advertisingSet) {
+	stop := make(chan struct{})
+	set.advertising = stop
+
+	interval := time.Duration(set.params.minInterval) * 625 * time.Microsecond
+	go func() {
+		ticker := time.NewTicker(interval)
+		defer ticker.Stop()
+
+		for {
+			c.air.mu.Lock()
+			select {
+			case <-stop:
+				c.air.mu.Unlock()
+				return
+			default:
+			}
+			c.advertisingEvent(set)
+			c.air.mu.Unlock()
+
+			select {
+			case <-stop:
+				return
+			case <-ticker.C:
+			}
+		}
+	}()
+}
+
+func (set *advertisingSet) stop() {
+	if set.advertising != nil {
+		close(set.advertising)
+		set.advertising = nil
+	}
+}
+
+// stopAdvertising stops the legacy advertisement and all advertising sets.
+func (c *Controller) stopAdvertising() {
+	c.adv.stop()
+	for _, set := range c.sets {
+		set.stop()
+	}
+}
+
+// advertisingEvent delivers the advertisement of the set to all scanners and
+// initiators on the medium.
+func (c *Controller) advertisingEvent(set *advertisingSet) {
+	own := c.advertisingAddress(set)
+
+	for _, other := range c.air.controllers {
+		if other == c {
+			continue
+		}
+
+		if set.directed() && other.ownAddress(other.direct()) != set.params.direct {
+			continue
+		}
+
+		if req := other.initiating; req != nil && req.peer == own && set.connectable() {
+			other.connect(c, set)
+
+			// the advertiser stops advertising once connected
+			return
+		}
+
+		if other.scanning {
+			other.advertisingReport(set, own)
+		}
+	}
+}
+
+// direct returns the address type used by this controller to match directed
+// advertisements: the own address type of the initiator or the scanner.
+func (c *Controller) direct() uint8 {
+	if c.initiating != nil {
+		return c.initiating.ownAddrType
+	}
+
+	return c.scan.ownAddrType
+}
+
+// advertisingReport reports an advertisement to the host of this (scanning)
+// controller.
+func (c *Controller) advertisingReport(set *advertisingSet, addr peerAddress) {
+	if !set.legacy() && (!c.scan.extended || c.scan.phys&(1<<(set.primaryPHY-1)) == 0) {
+		// Extended advertisements are only received by extended scanners on
+		// the same PHY.
+		return
+	}
+
+	if c.scan.filter {
+		key := seenKey{addr: addr, sid: sidNone}
+		if !set.legacy() {
+			key.sid = set.sid
+		}
+		if c.scanSeen[key] {
+			return
+		}
+		c.scanSeen[key] = true
+	}
+
+	data := set.data
+	if set.directed() {
+		data = nil
+	}
+	// active scanners also get the scan response of scannable advertisements
+	scanResponse := c.scan.active && set.scannable()
+
+	switch {
+	case !c.scan.extended:
+		c.send(leAdvertisingReport(set.legacyReportType(), addr, data))
+		if scanResponse {
+			c.send(leAdvertisingReport(reportScanRsp, addr, set.scanRspData))
+		}
+	default:
+		eventType := set.properties & (propConnectable | propScannable | propDirected | propLegacy)
+		for _, pkt := range leExtendedAdvertisingReports(eventType, set, addr, data) {
+			c.send(pkt)
+		}
+		if scanResponse {
+			for _, pkt := range leExtendedAdvertisingReports(eventType|reportScanResponse, set, addr, set.scanRspData) {
+				c.send(pkt)
+			}
+		}
+	}
+}
+
+// connect establishes a connection between this initiating controller (the
+// central) and the advertiser (the peripheral) of the given set.
+func (c *Controller) connect(advertiser *Controller, set *advertisingSet) {
+	req := c.initiating
+	c.initiating = nil
+	set.stop()
+
+	central := &link{
+		handle:   c.allocHandle(),
+		peer:     advertiser,
+		interval: req.interval,
+		latency:  req.latency,
+		timeout:  req.timeout,
+		txOctets: minLinkDataLength,
+		rxOctets: minLinkDataLength,
+		txPHY:    phy1M,
+		rxPHY:    phy1M,
+	}
+	peripheral := &link{
+		handle:   advertiser.allocHandle(),
+		peer:     c,
+		remote:   central,
+		interval: req.interval,
+		latency:  req.latency,
+		timeout:  req.timeout,
+		txOctets: minLinkDataLength,
+		rxOctets: minLinkDataLength,
+		txPHY:    phy1M,
+		rxPHY:    phy1M,
+	}
+	central.remote = peripheral
+	c.links[central.handle] = central
+	advertiser.links[peripheral.handle] = peripheral
+
+	c.send(leConnectionComplete(statusSuccess, central, roleCentral,
+		advertiser.advertisingAddress(set)))
+	advertiser.send(leConnectionComplete(statusSuccess, peripheral, rolePeripheral,
+		c.ownAddress(req.ownAddrType)))
+}
+
+func (c *Controller) allocHandle() uint16 {
+	for {
+		handle := c.nextHandle
+		c.nextHandle++
+		if c.nextHandle > maxHandle {
+			c.nextHandle = 0x0001
+		}
+		if _, ok := c.links[handle]; !ok {
+			return handle
+		}
+	}
+}
+
+// terminate closes the connection and reports it to both hosts with the
+// given reasons.
+func (c *Controller) terminate(l *link, localReason, remoteReason uint8) {
+	delete(c.links, l.handle)
+	delete(l.peer.links, l.remote.handle)
+
+	c.send(disconnectionComplete(l.handle, localReason))
+	l.peer.send(disconnectionComplete(l.remote.handle, remoteReason))
+}
+
+// handleACLData forwards ACL data from the host to the peer of the connection.
+func (c *Controller) handleACLData(pkt []byte) {
+	handle := binary.LittleEndian.Uint16(pkt) & 0x0fff
+	flags := binary.LittleEndian.Uint16(pkt) >> 12
+
+	l, ok := c.links[handle]
+	if !ok {
+		return
+	}
+
+	// The host must not send more than fits in a buffer.
+	if len(pkt)-4 > aclDataLength {
+		return
+	}
+
+	// Packets from the controller to the host are always flushable.
+	if flags&0x3 == aclStartNonFlushable {
+		flags = flags&^0x3 | aclStartFlushable
+	}
+
+	out := make([]byte, 1+len(pkt))
+	out[0] = packetACLData
+	copy(out[1:], pkt)
+	binary.LittleEndian.PutUint16(out[1:], l.remote.handle|flags<<12)
+	l.peer.send(out)
+
+	c.send(numberOfCompletedPackets(handle, 1))
+}
+
+// packetLength returns the total length of the H4 packet at the start of buf,
+// or 0 if the header is not complete yet.
+func packetLength(buf []byte) int {
+	switch buf[0] {
+	case packetCommand:
+		if len(buf) < 4 {
+			return 0
+		}
+		return 4 + int(buf[3])
+	case packetACLData:
+		if len(buf) < 5 {
+			return 0
+		}
+		return 5 + int(binary.LittleEndian.Uint16(buf[3:]))
+	default:
+		// unknown packet type, drop everything
+		return len(buf)
+	}
+}